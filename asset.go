@@ -0,0 +1,94 @@
+// Apache License Version 2.0
+// http://www.apache.org/licenses/
+// Copyright (c) 2016 Joel Scoble
+// See LICENSE file for license text.
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Asset is a downloadable file that is published for an episode.
+type Asset struct {
+	Name   string  // the name used to refer to the asset in flags and config
+	format string  // the file name format; the only arg is the episode number
+	url    *string // the base url of the asset; this points to the url var so that mirrors are used
+	source string  // the base url of the asset on GRC's server
+	audio  bool    // whether the asset is an episode's audio
+}
+
+// FileName returns the name of the asset's file for episode i.
+func (a Asset) FileName(i int) string {
+	return fmt.Sprintf(a.format, i)
+}
+
+// URL returns the url of the asset for episode i.
+func (a Asset) URL(i int) string {
+	return *a.url + a.FileName(i)
+}
+
+// SourceURL returns the url of the asset for episode i on GRC's server; unlike
+// URL, a mirror is never used.
+func (a Asset) SourceURL(i int) string {
+	return a.source + a.FileName(i)
+}
+
+// assets are the supported assets, keyed by name.
+var assets = map[string]Asset{
+	"hq":    {Name: "hq", format: "sn-%03d.mp3", url: &SNURL, source: grcSNURL, audio: true},
+	"lq":    {Name: "lq", format: "sn-%03d-lq.mp3", url: &SNURL, source: grcSNURL, audio: true},
+	"txt":   {Name: "txt", format: "sn-%03d.txt", url: &TXTURL, source: grcTXTURL},
+	"pdf":   {Name: "pdf", format: "sn-%03d.pdf", url: &TXTURL, source: grcTXTURL},
+	"notes": {Name: "notes", format: "sn-%03d-notes.pdf", url: &TXTURL, source: grcTXTURL},
+}
+
+// assetNames returns the names of the supported assets, sorted.
+func assetNames() []string {
+	var names []string
+	for k := range assets {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseAssets returns the Assets for the passed names. The names may be
+// either a slice of names, a comma separated list of names, or a mix.
+func parseAssets(names ...string) ([]Asset, error) {
+	var as []Asset
+	seen := make(map[string]bool)
+	for _, v := range names {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" || seen[name] {
+				continue
+			}
+			a, ok := assets[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown asset %q: supported assets are %s", name, strings.Join(assetNames(), ", "))
+			}
+			seen[name] = true
+			as = append(as, a)
+		}
+	}
+	if len(as) == 0 {
+		return nil, fmt.Errorf("no assets specified: supported assets are %s", strings.Join(assetNames(), ", "))
+	}
+	return as, nil
+}
+
+// parseAssetFile returns the asset and episode number of a file name that
+// uses snow's naming, e.g. sn-500-lq.mp3. If the name isn't an asset's file
+// name, false is returned.
+func parseAssetFile(name string) (Asset, int, bool) {
+	for _, a := range assets {
+		var i int
+		_, err := fmt.Sscanf(name, a.format, &i)
+		if err == nil && i > 0 && a.FileName(i) == name {
+			return a, i, true
+		}
+	}
+	return Asset{}, 0, false
+}
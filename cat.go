@@ -0,0 +1,148 @@
+// Apache License Version 2.0
+// http://www.apache.org/licenses/
+// Copyright (c) 2016 Joel Scoble
+// See LICENSE file for license text.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	humanize "github.com/dustin/go-humanize"
+)
+
+// catSave saves the episodes that are streamed from GRC to the save dir.
+var catSave bool
+
+func catCommand() *Command {
+	c := newCommand("cat", "episodes", "write episodes' audio to stdout", `
+Cat writes the audio of the episodes, an episode selection, e.g. 500 or
+500-502, to stdout, in order, so that it can be piped to a player:
+
+    $ snow cat 500 | mpv -
+
+An episode's audio is the first of the audio assets in -assets. If the save
+directory has its file, that is used; otherwise it's streamed from GRC, or the
+mirror. With -save, the episodes that are streamed are also saved to the save
+directory, so the next time they are there; a file is only saved if it was
+streamed completely. Messages are written to stderr.`, runCat)
+	libraryFlags(c.Flags)
+	configFlags(c.Flags, true)
+	mirrorFlag(c.Flags)
+	c.Flags.BoolVar(&catSave, "save", false, "save the episodes that are streamed to the save directory")
+	return c
+}
+
+// runCat writes the selected episodes' audio to stdout.
+func runCat(cmd *Command, args []string) error {
+	if len(args) == 0 {
+		return errors.New("cat: no episodes specified")
+	}
+	messages = os.Stderr
+	defer func() { messages = os.Stdout }()
+	sel, err := ParseSelection(strings.Join(args, ","))
+	if err != nil {
+		return err
+	}
+	cs, err := confs(cmd.Flags)
+	if err != nil {
+		return err
+	}
+	c := cs[0]
+	a, ok := audioAsset(c.assets)
+	if !ok {
+		return errors.New("cat: none of the assets are audio: use -assets hq or -assets lq")
+	}
+	// the most recent episode is only needed for open ranges
+	last, ok := sel.Max()
+	if !ok {
+		last, err = lastEpisode()
+		if err != nil {
+			return err
+		}
+	}
+	episodes := sel.Episodes(last, nil)
+	c.episodes = episodes
+	var h *History
+	if catSave {
+		lock, err := lockSaveDir(&c)
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+		h, err = loadHistory(c.Storage())
+		if err != nil {
+			return fmt.Errorf("error loading the download history: %s", err)
+		}
+		err = h.checkLayout(c.layout)
+		if err != nil {
+			return err
+		}
+	}
+	err = c.layout.Prepare(episodes)
+	if err != nil {
+		return err
+	}
+
+	// when the player exits, the writes to stdout fail instead of snow being
+	// killed, so that a partial file isn't left behind
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGPIPE)
+	defer signal.Stop(sigs)
+
+	s := c.Storage()
+	m := &MP3{storage: s, layout: c.layout}
+	for _, i := range episodes {
+		name, err := audioName(c, s, i)
+		if err != nil {
+			return err
+		}
+		if name != "" {
+			err = catStorage(s, name, os.Stdout)
+			if err != nil {
+				return fmt.Errorf("%s: %s", s.Path(name), err)
+			}
+			continue
+		}
+		d := m.Stream(m.newDownload(a, i), os.Stdout, catSave)
+		if d.err != nil {
+			return fmt.Errorf("%s: %s", d.Name, d.err)
+		}
+		if !catSave {
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "%s: %s saved as %s\n", d.Name, humanize.Bytes(d.n), d.Path)
+		h.recordDownloads([]Download{d})
+		err = h.Save()
+		if err != nil {
+			return fmt.Errorf("error saving the download history: %s", err)
+		}
+	}
+	return nil
+}
+
+// audioAsset returns the first of the assets that is audio.
+func audioAsset(as []Asset) (Asset, bool) {
+	for _, a := range as {
+		if a.audio {
+			return a, true
+		}
+	}
+	return Asset{}, false
+}
+
+// catStorage writes the named file to w.
+func catStorage(s Storage, name string, w io.Writer) error {
+	r, err := s.Open(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(w, r)
+	return err
+}
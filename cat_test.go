@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMP3Stream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/sn-500.mp3" && r.URL.Path != "/sn-501.mp3" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("audio of " + r.URL.Path))
+	}))
+	defer srv.Close()
+	defer func() { SNURL = grcSNURL }()
+	SNURL = srv.URL + "/"
+	layout, _ := ParseLayout(defaultLayout)
+	m := &MP3{storage: localStorage{dir: dir}, layout: layout}
+
+	tests := []struct {
+		episode  int
+		save     bool
+		expected string
+		err      bool
+	}{
+		{500, false, "audio of /sn-500.mp3", false},
+		{501, true, "audio of /sn-501.mp3", false},
+		{502, true, "", true},
+	}
+	for i, test := range tests {
+		var buf bytes.Buffer
+		d := m.Stream(m.newDownload(assets["hq"], test.episode), &buf, test.save)
+		if d.err != nil {
+			if !test.err {
+				t.Errorf("%d: unexpected error: %s", i, d.err)
+			}
+			continue
+		}
+		if test.err {
+			t.Errorf("%d: got no error; want one", i)
+			continue
+		}
+		if buf.String() != test.expected {
+			t.Errorf("%d: got %q; want %q", i, buf.String(), test.expected)
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, d.Name))
+		if !test.save {
+			if err == nil {
+				t.Errorf("%d: the file was saved", i)
+			}
+			continue
+		}
+		if string(b) != test.expected {
+			t.Errorf("%d: saved %q; want %q", i, b, test.expected)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sn-502.mp3")); err == nil {
+		t.Error("502: a file was saved for a missing episode")
+	}
+
+	// what's in the save dir is written as is
+	var buf bytes.Buffer
+	err = catStorage(localStorage{dir: dir}, "sn-501.mp3", &buf)
+	if err != nil {
+		t.Fatalf("cat: unexpected error: %s", err)
+	}
+	if buf.String() != "audio of /sn-501.mp3" {
+		t.Errorf("cat: got %q; want %q", buf.String(), "audio of /sn-501.mp3")
+	}
+}
@@ -0,0 +1,286 @@
+// Apache License Version 2.0
+// http://www.apache.org/licenses/
+// Copyright (c) 2016 Joel Scoble
+// See LICENSE file for license text.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"golang.org/x/net/html"
+)
+
+// FirstYear is the year of the first episode.
+const FirstYear = 2005
+
+// Episode is an episode's information, as parsed from the archive pages.
+type Episode struct {
+	Number      int               `json:"number"`
+	Title       string            `json:"title"`
+	Date        time.Time         `json:"date"`
+	Minutes     int               `json:"minutes"`     // the length of the episode
+	Description string            `json:"description"` // the episode's description
+	Sizes       map[string]uint64 `json:"sizes"`       // the advertised size of each asset, keyed by asset name
+}
+
+// Catalog holds episode information, keyed by episode number.
+type Catalog map[int]Episode
+
+// Numbers returns the catalog's episode numbers, sorted.
+func (c Catalog) Numbers() []int {
+	numbers := make([]int, 0, len(c))
+	for k := range c {
+		numbers = append(numbers, k)
+	}
+	sort.Ints(numbers)
+	return numbers
+}
+
+// Merge adds the episodes in o to the catalog, replacing any episodes that
+// are already in it.
+func (c Catalog) Merge(o Catalog) {
+	for k, v := range o {
+		c[k] = v
+	}
+}
+
+// FetchCatalog retrieves the catalog from the main archive page and the
+// archive pages of the passed years. A year whose archive page doesn't exist
+// yet, e.g. the current year, is skipped.
+func FetchCatalog(years ...int) (Catalog, error) {
+	c, err := fetchCatalogPage(URL)
+	if err != nil {
+		return nil, err
+	}
+	for _, y := range years {
+		cc, err := fetchCatalogPage(fmt.Sprintf(PastURL, y))
+		if err != nil {
+			if err == errNotFound {
+				Verbose(fmt.Sprintf("no archive page for %d", y))
+				continue
+			}
+			return nil, err
+		}
+		c.Merge(cc)
+	}
+	return c, nil
+}
+
+// catalogCache caches the archive pages retrieved during a run so that each
+// page is only retrieved once.
+type catalogCache struct {
+	mu      sync.Mutex
+	catalog Catalog
+	years   map[int]bool // the years whose archive pages have been retrieved
+}
+
+// runCatalog is the catalog for this run.
+var runCatalog catalogCache
+
+// Get returns the catalog with the episodes from the main archive page and
+// the archive pages of the passed years. Only the pages that haven't already
+// been retrieved are retrieved.
+func (c *catalogCache) Get(years ...int) (Catalog, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.get(years...)
+}
+
+// Episode returns episode i from the catalog with the episodes from the main
+// archive page and the archive pages of the passed years. This is safe for
+// concurrent use.
+func (c *catalogCache) Episode(i int, years ...int) (Episode, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cat, err := c.get(years...)
+	if err != nil {
+		return Episode{}, false, err
+	}
+	e, ok := cat[i]
+	return e, ok, nil
+}
+
+// get is Get without locking.
+func (c *catalogCache) get(years ...int) (Catalog, error) {
+	var need []int
+	for _, y := range years {
+		if !c.years[y] {
+			need = append(need, y)
+		}
+	}
+	if c.catalog != nil && len(need) == 0 {
+		return c.catalog, nil
+	}
+	cc, err := FetchCatalog(need...)
+	if err != nil {
+		return nil, err
+	}
+	if c.catalog == nil {
+		c.catalog = make(Catalog)
+		c.years = make(map[int]bool)
+	}
+	c.catalog.Merge(cc)
+	for _, y := range need {
+		c.years[y] = true
+	}
+	return c.catalog, nil
+}
+
+// errNotFound is returned when a page doesn't exist.
+var errNotFound = errors.New("not found")
+
+// fetchCatalogPage retrieves the episodes in the archive page at url.
+func fetchCatalogPage(url string) (Catalog, error) {
+	Verbose("get catalog: " + url)
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errNotFound
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("GET of %q resulted in an unexpected status: %q", url, resp.Status)
+	}
+	return catalogFromTokens(getTokens(resp.Body)), nil
+}
+
+// the states of the archive page parser
+const (
+	stateNone   = iota
+	stateHeader // looking for the episode header: number, date, and length
+	stateTitle  // looking for the title
+	stateDesc   // collecting the description
+	stateAssets // collecting the asset sizes
+)
+
+// episodeHeader matches the header of each episode on an archive page, e.g.
+// "Episode #500 | 24 Mar 2015 | 94 min."
+var episodeHeader = regexp.MustCompile(`Episode\s*#(\d+)\s*\|\s*(\d{1,2} [A-Za-z]{3} \d{4})(?:\s*\|\s*(\d+)\s*min)?`)
+
+// catalogFromTokens builds a catalog from the tokens of an archive page. Each
+// episode starts with an anchor whose name is the episode number. It's
+// followed by the header, the title, which is bold, the description, which is
+// the rest of the text in that cell, and the links to the episode's assets,
+// each of which is followed by the asset's size.
+func catalogFromTokens(tokens []html.Token) Catalog {
+	c := make(Catalog)
+	var ep Episode
+	var title, desc []string
+	var state int
+	var bold bool
+	var asset string // the asset whose size is expected next
+
+	// done adds the current episode to the catalog
+	done := func() {
+		if ep.Number == 0 {
+			return
+		}
+		ep.Title = cleanText(strings.Join(title, " "))
+		ep.Description = cleanText(strings.Join(desc, " "))
+		c[ep.Number] = ep
+	}
+
+	for _, token := range tokens {
+		switch token.Type {
+		case html.StartTagToken:
+			switch token.DataAtom.String() {
+			case "a":
+				for _, attr := range token.Attr {
+					switch attr.Key {
+					case "name":
+						i, err := strconv.Atoi(attr.Val)
+						if err != nil {
+							continue
+						}
+						done()
+						ep = Episode{Number: i, Sizes: make(map[string]uint64)}
+						title, desc = nil, nil
+						state = stateHeader
+					case "href":
+						if state == stateNone || state == stateHeader {
+							continue
+						}
+						asset = assetName(attr.Val, ep.Number)
+					}
+				}
+			case "b":
+				bold = true
+			}
+		case html.EndTagToken:
+			switch token.DataAtom.String() {
+			case "b":
+				bold = false
+				if state == stateTitle && len(title) > 0 {
+					state = stateDesc
+				}
+			case "td":
+				if state == stateDesc {
+					state = stateAssets
+				}
+			}
+		case html.TextToken:
+			s := cleanText(token.Data)
+			if s == "" {
+				continue
+			}
+			switch state {
+			case stateHeader:
+				m := episodeHeader.FindStringSubmatch(s)
+				if m == nil {
+					continue
+				}
+				ep.Date, _ = time.Parse("2 Jan 2006", m[2])
+				ep.Minutes, _ = strconv.Atoi(m[3])
+				state = stateTitle
+			case stateTitle:
+				if bold {
+					title = append(title, s)
+				}
+			case stateDesc:
+				desc = append(desc, s)
+			case stateAssets:
+				if asset == "" {
+					continue
+				}
+				n, err := humanize.ParseBytes(s)
+				if err == nil {
+					ep.Sizes[asset] = n
+				}
+				asset = ""
+			}
+		}
+	}
+	done()
+	return c
+}
+
+// assetName returns the name of the asset that href links to for episode i.
+// If href isn't a link to one of the episode's assets, an empty string is
+// returned.
+func assetName(href string, i int) string {
+	base := path.Base(href)
+	for _, a := range assets {
+		if a.FileName(i) == base {
+			return a.Name
+		}
+	}
+	return ""
+}
+
+// cleanText replaces non-breaking spaces and collapses all whitespace.
+func cleanText(s string) string {
+	s = strings.Replace(s, "\u00a0", " ", -1)
+	return strings.Join(strings.Fields(s), " ")
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCatalogFromTokens(t *testing.T) {
+	c := catalogFromTokens(getTokens(bytes.NewReader(body)))
+	if len(c) != 1 {
+		t.Fatalf("got %d episodes; want 1", len(c))
+	}
+	e, ok := c[500]
+	if !ok {
+		t.Fatalf("episode 500 not found in catalog: %v", c.Numbers())
+	}
+	if e.Title != "Windows Secure Boot" {
+		t.Errorf("title: got %q; want %q", e.Title, "Windows Secure Boot")
+	}
+	date := time.Date(2015, time.March, 24, 0, 0, 0, 0, time.UTC)
+	if !e.Date.Equal(date) {
+		t.Errorf("date: got %s; want %s", e.Date, date)
+	}
+	if e.Minutes != 94 {
+		t.Errorf("minutes: got %d; want 94", e.Minutes)
+	}
+	desc := "Leo and I discuss the recent Pwn2Own hacking competition. We examine"
+	if !strings.HasPrefix(e.Description, desc) {
+		t.Errorf("description: got %q; want it to start with %q", e.Description, desc)
+	}
+	if !strings.HasSuffix(e.Description, "the future of non-Windows operating systems.") {
+		t.Errorf("description: got %q; want the full description", e.Description)
+	}
+	sizes := map[string]uint64{"hq": 45000000, "lq": 11000000, "notes": 348000, "txt": 73000, "pdf": 138000}
+	if !reflect.DeepEqual(e.Sizes, sizes) {
+		t.Errorf("sizes: got %v; want %v", e.Sizes, sizes)
+	}
+}
+
+func TestDateFilter(t *testing.T) {
+	now := time.Date(2016, time.June, 15, 10, 0, 0, 0, time.UTC)
+	catalog := Catalog{
+		490: {Number: 490, Date: time.Date(2015, time.January, 13, 0, 0, 0, 0, time.UTC)},
+		500: {Number: 500, Date: time.Date(2015, time.March, 24, 0, 0, 0, 0, time.UTC)},
+		501: {Number: 501, Date: time.Date(2015, time.March, 31, 0, 0, 0, 0, time.UTC)},
+		540: {Number: 540, Date: time.Date(2016, time.January, 5, 0, 0, 0, 0, time.UTC)},
+		562: {Number: 562, Date: time.Date(2016, time.June, 7, 0, 0, 0, 0, time.UTC)},
+		563: {Number: 563},
+	}
+	episodes := []int{490, 500, 501, 540, 562, 563, 600}
+	tests := []struct {
+		since       string
+		until       string
+		year        int
+		expected    []int
+		expectedErr string
+	}{
+		{year: 2015, expected: []int{490, 500, 501}},
+		{since: "2015-03", until: "2015-03", expected: []int{500, 501}},
+		{since: "2015-03-25", expected: []int{501, 540, 562}},
+		{until: "2015-03-24", expected: []int{490, 500}},
+		{since: "90d", expected: []int{562}},
+		// relative dates are inclusive too: 8d ago is the day 562 aired
+		{until: "8d", expected: []int{490, 500, 501, 540, 562}},
+		{since: "8d", until: "8d", expected: []int{562}},
+		{until: "99999999999999999999d", expectedErr: `until: "99999999999999999999d" is not a valid relative date: strconv.Atoi: parsing "99999999999999999999": value out of range`},
+		{since: "1y", until: "2015", expected: []int{}},
+		{since: "6m", year: 2016, expected: []int{540, 562}},
+		{since: "yesterday", expectedErr: `since: "yesterday" is not a valid date: use YYYY-MM-DD, YYYY-MM, YYYY, or a relative date, e.g. 90d, 12w, 6m, 1y`},
+		{since: "2016", until: "2015", expectedErr: "since, 2016, must be before until, 2015"},
+		{year: 2001, expectedErr: "year: 2001 is not between 2005 and 2016"},
+	}
+
+	for i, test := range tests {
+		f, err := NewDateFilter(test.since, test.until, test.year, now)
+		if err != nil {
+			if err.Error() != test.expectedErr {
+				t.Errorf("%d: got %q; want %q", i, err.Error(), test.expectedErr)
+			}
+			continue
+		}
+		if test.expectedErr != "" {
+			t.Errorf("%d: got no error; want %q", i, test.expectedErr)
+			continue
+		}
+		matched := f.Filter(catalog, episodes)
+		if len(matched) == 0 && len(test.expected) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(matched, test.expected) {
+			t.Errorf("%d: got %v; want %v", i, matched, test.expected)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+// Apache License Version 2.0
+// http://www.apache.org/licenses/
+// Copyright (c) 2016 Joel Scoble
+// See LICENSE file for license text.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// updateChanged re-downloads the files that changed upstream.
+var updateChanged bool
+
+func changesCommand() *Command {
+	c := newCommand("changes", "", "find the downloaded files that changed on GRC's server", `
+Changes checks whether the selected episodes' files in the save directory
+changed on GRC's server since they were downloaded, e.g. because an episode's
+audio was re-uploaded or its transcript was corrected. When a file is
+downloaded, the ETag, Last-Modified, and size that the server reported are
+kept in the download history; a file changed if any of them differ from what
+the server reports now. For files downloaded before this was kept, only the
+sizes of the local file and the server's file are compared; if they match, what
+the server reports is kept for the next check. Audio files may have been
+tagged, which changes their size, so for them what the server reports is kept
+on the first check without comparing anything. By default, all episodes are
+checked.
+
+With -update, the changed files are downloaded again. The previous version is
+kept, with the date it was downloaded added to its name, e.g.
+sn-500.2015-03-24.txt. With -tag, or a profile's tag setting, the updated
+audio files are tagged again.`, runChanges)
+	rangeFlags(c.Flags, 0)
+	libraryFlags(c.Flags)
+	configFlags(c.Flags, true)
+	mirrorFlag(c.Flags)
+	c.Flags.BoolVar(&updateChanged, "update", false, "download the changed files again, keeping the previous versions")
+	c.Flags.StringVar(&sidecarList, "sidecars", "", "comma separated list of the sidecar formats to write for the updated files: "+strings.Join(sidecarFormats, ", "))
+	c.Flags.BoolVar(&tag, "tag", false, "write ID3 tags to the updated audio files")
+	c.Flags.StringVar(&cover, "cover", "", "the path or url of the cover art to embed in the ID3 tags")
+	return c
+}
+
+// runChanges reports, and optionally updates, the files that changed
+// upstream.
+func runChanges(cmd *Command, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("changes: unexpected args: %s", strings.Join(args, " "))
+	}
+	cs, err := confs(cmd.Flags)
+	if err != nil {
+		return err
+	}
+	c := cs[0]
+	last, err := lastEpisode()
+	if err != nil {
+		return err
+	}
+	err = resolveEpisodes(&c, last)
+	if err != nil {
+		return err
+	}
+	lock, err := lockSaveDir(&c)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	h, err := loadHistory(c.Storage())
+	if err != nil {
+		return fmt.Errorf("error loading the download history: %s", err)
+	}
+	err = c.layout.Prepare(c.episodes)
+	if err != nil {
+		return err
+	}
+
+	changes, checked, errs := findChanges(c, h, c.episodes)
+	for _, ch := range changes {
+		fmt.Printf("%s: changed upstream: %s\n", ch.Path, strings.Join(ch.Changes, ", "))
+	}
+	fmt.Printf("\n%d files checked; %d changed upstream\n", checked, len(changes))
+	if updateChanged && len(changes) > 0 {
+		fmt.Println()
+		downloads := updateChanges(c, h, changes)
+		errs += downloadErrors(downloads)
+		if c.tag {
+			tagDownloads(c, downloads)
+		}
+		_, err = updateSidecars(c, h, changedEpisodes(changes))
+		if err != nil {
+			fmt.Printf("error writing the sidecars: %s\n", err)
+		}
+		err = indexDownloads(c, downloads)
+		if err != nil {
+			fmt.Printf("error updating the transcript index: %s\n", err)
+		}
+	}
+	err = h.Save()
+	if err != nil {
+		return fmt.Errorf("error saving the download history: %s", err)
+	}
+	if errs > 0 {
+		return fmt.Errorf("%d files could not be checked or updated", errs)
+	}
+	return nil
+}
+
+// RemoteInfo is what the server reported about an asset's file.
+type RemoteInfo struct {
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Size         int64     `json:"size"` // -1 if the size wasn't reported
+	Checked      time.Time `json:"checked"`
+}
+
+// remoteInfo returns what the response reports about its file.
+func remoteInfo(resp *http.Response) RemoteInfo {
+	return RemoteInfo{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Size:         resp.ContentLength,
+		Checked:      time.Now().UTC(),
+	}
+}
+
+// Changes returns how r differs from prev. What either one doesn't have
+// isn't compared.
+func (r RemoteInfo) Changes(prev RemoteInfo) []string {
+	var changes []string
+	if r.ETag != "" && prev.ETag != "" && r.ETag != prev.ETag {
+		changes = append(changes, fmt.Sprintf("etag %s, was %s", r.ETag, prev.ETag))
+	}
+	if r.LastModified != "" && prev.LastModified != "" && r.LastModified != prev.LastModified {
+		changes = append(changes, fmt.Sprintf("modified %s, was %s", r.LastModified, prev.LastModified))
+	}
+	if r.Size >= 0 && prev.Size >= 0 && r.Size != prev.Size {
+		changes = append(changes, fmt.Sprintf("%d bytes, was %d", r.Size, prev.Size))
+	}
+	return changes
+}
+
+// Change is a file that changed upstream.
+type Change struct {
+	Episode int
+	Asset   Asset
+	Path    string
+	Changes []string // how it changed
+}
+
+// findChanges checks the files of c's assets of the episodes that are in the
+// save dir for upstream changes; what the server reports is recorded in h for
+// the files that didn't change. The changed files, the number of files that
+// were checked, and the number of files that couldn't be checked are returned.
+func findChanges(c Conf, h *History, episodes []int) (changes []Change, checked, errs int) {
+	s := c.Storage()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	type file struct {
+		a    Asset
+		i    int
+		name string
+		size int64
+	}
+	work := make(chan file)
+	for j := 0; j < headConcurrency; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range work {
+				ch, err := checkChange(f.a, f.i, f.size, h)
+				mu.Lock()
+				checked++
+				if err != nil {
+					fmt.Printf("%s: %s\n", s.Path(f.name), err)
+					errs++
+				} else if len(ch) > 0 {
+					changes = append(changes, Change{Episode: f.i, Asset: f.a, Path: s.Path(f.name), Changes: ch})
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, i := range episodes {
+		for _, a := range c.assets {
+			name, err := c.layout.Name(a, i)
+			if err != nil {
+				fmt.Printf("%s: %s\n", a.FileName(i), err)
+				errs++
+				continue
+			}
+			fi, err := s.Stat(name)
+			if err != nil {
+				if !os.IsNotExist(err) {
+					fmt.Printf("%s: %s\n", s.Path(name), err)
+					errs++
+				}
+				continue
+			}
+			work <- file{a: a, i: i, name: name, size: fi.Size}
+		}
+	}
+	close(work)
+	wg.Wait()
+	sort.Sort(byEpisodeAsset(changes))
+	return changes, checked, errs
+}
+
+// checkChange returns how asset a of episode i, whose local file has the
+// size, changed upstream. If it didn't change, what the server reports is
+// recorded in h. Audio files may have been tagged, so their size isn't
+// compared: without a record of what the server reported, what it reports now
+// is recorded as the baseline for the next check.
+func checkChange(a Asset, i int, size int64, h *History) ([]string, error) {
+	resp, err := http.Head(a.URL(i))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HEAD of %q resulted in an unexpected status: %q", a.URL(i), resp.Status)
+	}
+	r := remoteInfo(resp)
+	prev, ok := h.Remote(a, i)
+	if !ok && a.audio {
+		h.SetBaseline(a, i, size, r)
+		return nil, nil
+	}
+	if !ok {
+		// without a record of what the server reported, the local file
+		// is what's compared
+		prev = RemoteInfo{Size: size}
+	}
+	changes := r.Changes(prev)
+	if len(changes) == 0 {
+		h.SetRemote(a, i, r)
+	}
+	return changes, nil
+}
+
+// byEpisodeAsset sorts changes by episode and then by asset.
+type byEpisodeAsset []Change
+
+func (c byEpisodeAsset) Len() int      { return len(c) }
+func (c byEpisodeAsset) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c byEpisodeAsset) Less(i, j int) bool {
+	if c[i].Episode != c[j].Episode {
+		return c[i].Episode < c[j].Episode
+	}
+	return c[i].Asset.Name < c[j].Asset.Name
+}
+
+// changedEpisodes returns the episodes of the changes, without duplicates.
+func changedEpisodes(changes []Change) []int {
+	var episodes []int
+	for j, ch := range changes {
+		if j == 0 || changes[j-1].Episode != ch.Episode {
+			episodes = append(episodes, ch.Episode)
+		}
+	}
+	return episodes
+}
+
+// updateChanges downloads the changed files again; each previous version is
+// kept with the date it was downloaded added to its name. If a download
+// fails, the previous version is restored. The downloads are recorded in h.
+func updateChanges(c Conf, h *History, changes []Change) []Download {
+	s := c.Storage()
+	m := &MP3{storage: s, layout: c.layout, overwrite: true}
+	var downloads []Download
+	for _, ch := range changes {
+		d := m.newDownload(ch.Asset, ch.Episode)
+		if d.err != nil {
+			d.PrintResultMessage()
+			downloads = append(downloads, d)
+			continue
+		}
+		prev := previousName(s, d.file, previousDate(s, h, ch.Asset, ch.Episode, d.file))
+		err := moveStorage(s, d.file, prev)
+		if err != nil {
+			d.err = fmt.Errorf("keeping the previous version: %s", err)
+			d.PrintResultMessage()
+			downloads = append(downloads, d)
+			continue
+		}
+		d = m.Download(d)
+		if d.err != nil {
+			err = moveStorage(s, prev, d.file)
+			if err != nil {
+				fmt.Printf("%s: error restoring the previous version from %s: %s\n", d.Name, s.Path(prev), err)
+			}
+		}
+		d.PrintResultMessage()
+		if d.err == nil {
+			fmt.Printf("%s: the previous version was kept as %s\n", d.Name, s.Path(prev))
+		}
+		downloads = append(downloads, d)
+	}
+	h.recordDownloads(downloads)
+	return downloads
+}
+
+// downloadErrors returns the number of downloads that failed.
+func downloadErrors(downloads []Download) int {
+	var n int
+	for _, d := range downloads {
+		if d.err != nil && !d.skipped {
+			n++
+		}
+	}
+	return n
+}
+
+// previousDate returns the date the previous version of asset a of episode i
+// was added to the save dir; if it isn't in the history, the file's
+// modification time is used.
+func previousDate(s Storage, h *History, a Asset, i int, name string) time.Time {
+	v, ok := h.Asset(a, i)
+	if ok && !v.Added.IsZero() {
+		return v.Added
+	}
+	fi, err := s.Stat(name)
+	if err != nil {
+		return time.Now()
+	}
+	return fi.ModTime
+}
+
+// previousName returns the name the previous version of the named file is
+// kept as: the date is added before the extension, e.g. sn-500.2015-03-24.txt.
+// If that name is taken, a number is added.
+func previousName(s Storage, name string, t time.Time) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext) + "." + t.Format("2006-01-02")
+	prev := base + ext
+	for n := 2; storageExists(s, prev); n++ {
+		prev = fmt.Sprintf("%s-%d%s", base, n, ext)
+	}
+	return prev
+}
+
+// moveStorage moves the file from one name to another; local files are
+// renamed and other storages' files are copied and removed.
+func moveStorage(s Storage, from, to string) error {
+	if ls, ok := s.(localStorage); ok {
+		return os.Rename(ls.path(from), ls.path(to))
+	}
+	err := copyStorage(s, from, s, to)
+	if err != nil {
+		return err
+	}
+	return s.Remove(from)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRemoteInfoChanges(t *testing.T) {
+	tests := []struct {
+		r, prev  RemoteInfo
+		expected []string
+	}{
+		{RemoteInfo{ETag: `"a"`, Size: 3}, RemoteInfo{ETag: `"a"`, Size: 3}, nil},
+		{RemoteInfo{ETag: `"b"`, Size: 3}, RemoteInfo{ETag: `"a"`, Size: 3}, []string{`etag "b", was "a"`}},
+		{RemoteInfo{ETag: `"b"`, Size: 4}, RemoteInfo{Size: 3}, []string{"4 bytes, was 3"}},
+		{RemoteInfo{LastModified: "Tue, 24 Mar 2015 00:00:00 GMT", Size: -1}, RemoteInfo{LastModified: "Mon, 23 Mar 2015 00:00:00 GMT", Size: 3}, []string{"modified Tue, 24 Mar 2015 00:00:00 GMT, was Mon, 23 Mar 2015 00:00:00 GMT"}},
+	}
+	for i, test := range tests {
+		got := test.r.Changes(test.prev)
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%d: got %q; want %q", i, got, test.expected)
+		}
+	}
+}
+
+func TestChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	upstream := map[string][2]string{
+		"/sn-500.txt": {`"b"`, "new!"},
+		"/sn-501.txt": {`"c"`, "abcd"},
+		"/sn-502.txt": {"", "hello"},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v, ok := upstream[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if v[0] != "" {
+			w.Header().Set("ETag", v[0])
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, strings.NewReader(v[1]))
+	}))
+	defer srv.Close()
+	defer func() { TXTURL = grcTXTURL }()
+	TXTURL = srv.URL + "/"
+
+	// 500 changed, 501 doesn't have a record of the server's file, 502
+	// isn't in the history, and 503 isn't on the server
+	for name, content := range map[string]string{"sn-500.txt": "old", "sn-501.txt": "abcd", "sn-502.txt": "xy", "sn-503.txt": "gone"} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	h, err := loadHistory(localStorage{dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	txt := assets["txt"]
+	h.Record(txt, 500, 3, "download", "")
+	h.Episodes[500].Assets["txt"].Added = time.Date(2015, time.March, 24, 12, 0, 0, 0, time.UTC)
+	h.SetRemote(txt, 500, RemoteInfo{ETag: `"a"`, Size: 3})
+	h.Record(txt, 501, 4, "download", "")
+	layout, _ := ParseLayout(defaultLayout)
+	c := Conf{SaveDir: dir, assets: []Asset{txt}, layout: layout}
+
+	changes, checked, errs := findChanges(c, h, []int{499, 500, 501, 502, 503})
+	if checked != 4 || errs != 1 {
+		t.Errorf("got %d checked, %d errors; want 4 checked, 1 error", checked, errs)
+	}
+	var got []int
+	for _, ch := range changes {
+		got = append(got, ch.Episode)
+	}
+	if !reflect.DeepEqual(got, []int{500, 502}) {
+		t.Fatalf("changes: got %v; want [500 502]", got)
+	}
+	if r, ok := h.Remote(txt, 501); !ok || r.ETag != `"c"` || r.Size != 4 {
+		t.Errorf("501: got %+v, %t; want what the server reported to be recorded", r, ok)
+	}
+
+	downloads := updateChanges(c, h, changes)
+	if n := downloadErrors(downloads); n != 0 {
+		t.Errorf("update: got %d errors; want 0", n)
+	}
+	for name, content := range map[string]string{"sn-500.txt": "new!", "sn-500.2015-03-24.txt": "old", "sn-502.txt": "hello"} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(b) != content {
+			t.Errorf("%s: got %q, %v; want %q", name, b, err, content)
+		}
+	}
+	if r, ok := h.Remote(txt, 500); !ok || r.ETag != `"b"` || r.Size != 4 {
+		t.Errorf("500: got %+v, %t; want the new file's etag and size", r, ok)
+	}
+
+	// the updated files are up to date
+	upstream["/sn-503.txt"] = [2]string{"", "gone"}
+	changes, checked, errs = findChanges(c, h, []int{500, 501, 502, 503})
+	if len(changes) != 0 || checked != 4 || errs != 0 {
+		t.Errorf("after the update: got %v, %d checked, %d errors; want no changes, 4 checked, 0 errors", changes, checked, errs)
+	}
+
+	// the previous versions are kept under unique names
+	if name := previousName(localStorage{dir: dir}, "sn-500.txt", time.Date(2015, time.March, 24, 0, 0, 0, 0, time.UTC)); name != "sn-500.2015-03-24-2.txt" {
+		t.Errorf("previous name: got %q; want sn-500.2015-03-24-2.txt", name)
+	}
+}
+
+func TestChangesTaggedAudio(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"a"`)
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, strings.NewReader("audio"))
+	}))
+	defer srv.Close()
+	defer func() { SNURL = grcSNURL }()
+	SNURL = srv.URL + "/"
+
+	// the local files are larger than the server's because they were
+	// tagged; 500 is in the history and 501 isn't
+	for _, name := range []string{"sn-500.mp3", "sn-501.mp3"} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte("ID3 tag + audio"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	h, err := loadHistory(localStorage{dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hq := assets["hq"]
+	h.Record(hq, 500, 5, "download", "")
+	layout, _ := ParseLayout(defaultLayout)
+	c := Conf{SaveDir: dir, assets: []Asset{hq}, layout: layout}
+
+	changes, checked, errs := findChanges(c, h, []int{500, 501})
+	if len(changes) != 0 || checked != 2 || errs != 0 {
+		t.Errorf("got %v, %d checked, %d errors; want no changes, 2 checked, 0 errors", changes, checked, errs)
+	}
+	for _, i := range []int{500, 501} {
+		if r, ok := h.Remote(hq, i); !ok || r.ETag != `"a"` || r.Size != 5 {
+			t.Errorf("%d: got %+v, %t; want the baseline to be recorded", i, r, ok)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+// Apache License Version 2.0
+// http://www.apache.org/licenses/
+// Copyright (c) 2016 Joel Scoble
+// See LICENSE file for license text.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Command is a snow command.
+type Command struct {
+	Name  string        // the name of the command
+	Args  string        // the command's args, if any, for its usage
+	Short string        // a one line description of the command
+	Long  string        // the description of the command for its help
+	Flags *flag.FlagSet // the command's flags
+	Run   func(cmd *Command, args []string) error
+}
+
+// Usage prints the command's help.
+func (c *Command) Usage() {
+	fmt.Fprintf(os.Stderr, "usage: snow %s [flags] %s\n\n%s\n", c.Name, c.Args, strings.TrimSpace(c.Long))
+	var flags bool
+	c.Flags.VisitAll(func(*flag.Flag) { flags = true })
+	if flags {
+		fmt.Fprintf(os.Stderr, "\nflags:\n")
+		c.Flags.PrintDefaults()
+	}
+}
+
+// newCommand returns a Command with its flagset.
+func newCommand(name, args, short, long string, run func(*Command, []string) error) *Command {
+	c := &Command{Name: name, Args: args, Short: short, Long: long, Run: run}
+	c.Flags = flag.NewFlagSet(name, flag.ExitOnError)
+	c.Flags.Usage = c.Usage
+	return c
+}
+
+// commands are snow's commands, in the order they are listed in the usage.
+var commands []*Command
+
+func init() {
+	commands = []*Command{
+		getCommand(),
+		listCommand(),
+		searchCommand(),
+		grepCommand(),
+		indexCommand(),
+		refsCommand(),
+		relatedCommand(),
+		catalogCommand(),
+		verifyCommand(),
+		changesCommand(),
+		pruneCommand(),
+		markCommand(),
+		listenedCommand(),
+		nextCommand(),
+		deviceCommand(),
+		importCommand(),
+		relayoutCommand(),
+		retagCommand(),
+		sidecarsCommand(),
+		feedCommand(),
+		playlistCommand(),
+		catCommand(),
+		serveCommand(),
+		syncCommand(),
+		mirrorCommand(),
+		configCommand(),
+		versionCommand(),
+		helpCommand(),
+	}
+}
+
+// findCommand returns the named command; nil is returned if it doesn't
+// exist.
+func findCommand(name string) *Command {
+	for _, c := range commands {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// parseCommand returns the command that args run, with its flags parsed, and
+// the command's args. The first arg is the command; if there isn't one, or
+// it's a flag, the command is get, which is what snow did before it had
+// commands.
+func parseCommand(args []string) (*Command, []string, error) {
+	name := "get"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name = args[0]
+		args = args[1:]
+	}
+	cmd := findCommand(name)
+	if cmd == nil {
+		return nil, nil, fmt.Errorf("unknown command %q", name)
+	}
+	// the commands share the flag variables, so the variables are set to this
+	// command's defaults before its flags are parsed.
+	cmd.Flags.VisitAll(func(f *flag.Flag) {
+		f.Value.Set(f.DefValue)
+	})
+	cmd.Flags.Parse(args)
+	return cmd, cmd.Flags.Args(), nil
+}
+
+// usage prints snow's usage.
+func usage() {
+	fmt.Fprintf(os.Stderr, "snow is a Security Now! podcast downloader.\n\nusage: snow [command] [flags] [args]\n\ncommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "    %-10s %s\n", c.Name, c.Short)
+	}
+	fmt.Fprintf(os.Stderr, "\nIf no command is specified, get is used.\nUse \"snow help <command>\" for more information about a command.\n")
+}
+
+// rangeFlags adds the flags that select episodes to fs; n is the default
+// number of most recent episodes.
+func rangeFlags(fs *flag.FlagSet, n int) {
+	fs.IntVar(&lastN, "lastn", n, "the last n episodes; 0 means all")
+	fs.IntVar(&startEpisode, "start", 0, "episode number from which to start")
+	fs.IntVar(&stopEpisode, "stop", 0, "episode number at which to stop")
+	fs.StringVar(&episodes, "episodes", "", "episode selection, e.g. 1-10,42,500-,last:20,!403")
+	fs.StringVar(&since, "since", "", "episodes aired on or after this date: YYYY-MM-DD, YYYY-MM, YYYY, or relative, e.g. 90d, 12w, 6m, 1y")
+	fs.StringVar(&until, "until", "", "episodes aired on or before this date: YYYY-MM-DD, YYYY-MM, YYYY, or relative, e.g. 90d, 12w, 6m, 1y")
+	fs.IntVar(&year, "year", 0, "episodes aired in this year")
+}
+
+// downloadFlags adds the flags that control downloading to fs.
+func downloadFlags(fs *flag.FlagSet) {
+	fs.IntVar(&concurrency, "concurrency", concurrentDL, "number of episodes to concurrently download")
+	fs.BoolVar(&lowQuality, "lq", false, "download the low quality version: 16Kbps mp3")
+	fs.BoolVar(&overwrite, "overwrite", false, "overwrite existing file, if one exists")
+	fs.BoolVar(&tag, "tag", false, "write ID3 tags, using the episode archive's information, to the downloaded audio files")
+	fs.StringVar(&cover, "cover", "", "the path or url of the cover art to embed in the ID3 tags")
+	fs.StringVar(&onLock, "onlock", onLockExit, "what to do if another snow is using the save directory: exit, wait, or skip the episodes it's processing")
+	fs.StringVar(&sidecarList, "sidecars", "", "comma separated list of the sidecar formats to write next to the episodes' files: "+strings.Join(sidecarFormats, ", "))
+	fs.StringVar(&confirmSize, "confirm", defaultConfirmSize, "when run interactively, ask for confirmation before downloading more than this, e.g. 5GB; 0 never asks")
+}
+
+// pruneFlags adds the prune policy flags to fs.
+func pruneFlags(fs *flag.FlagSet) {
+	fs.IntVar(&retain, "retain", 0, "the number of most recent episodes to keep; older ones are removed. 0 keeps everything")
+	fs.StringVar(&keepSince, "keepsince", "", "remove episodes aired before this date: YYYY-MM-DD, YYYY-MM, YYYY, or relative, e.g. 6m")
+	fs.BoolVar(&pruneLQ, "prunelq", false, "remove the lq files of episodes whose hq file exists")
+	fs.BoolVar(&pruneListened, "prunelistened", false, "remove the episodes that are marked as played; see snow help mark")
+}
+
+// libraryFlags adds the flags that specify the library: where it is and
+// what's in it.
+func libraryFlags(fs *flag.FlagSet) {
+	fs.StringVar(&saveDir, "savedir", defaultSaveDir, "save directory")
+	fs.StringVar(&assetList, "assets", "hq", "comma separated list of the assets: "+strings.Join(assetNames(), ", "))
+	fs.StringVar(&layoutTmpl, "layout", defaultLayout, "the layout of the save directory, e.g. {year}/{number:04}-{title-slug}{suffix}.{ext}")
+}
+
+// configFlags adds the config related flags to fs; if profiles is false, the
+// profile flag isn't added.
+func configFlags(fs *flag.FlagSet, profiles bool) {
+	fs.StringVar(&configFile, "config", defaultConfig, "config file")
+	fs.StringVar(&stateFile, "statefile", defaultState, "the file that has the episodes' played states")
+	if profiles {
+		fs.StringVar(&profile, "profile", "", "the config profile to use")
+	}
+	fs.BoolVar(&verbose, "verbose", false, "verbose output")
+}
+
+// mirrorFlag adds the mirror flag to fs; it's added to the commands that get
+// things from GRC.
+func mirrorFlag(fs *flag.FlagSet) {
+	fs.StringVar(&mirrorURL, "mirror", "", "the base url of a snow mirror to use instead of GRC, e.g. http://nas:8081")
+}
+
+func getCommand() *Command {
+	c := newCommand("get", "", "download episodes", `
+Get downloads episodes and their assets. By default, the latest episode is
+downloaded, unless it already exists in the save directory.
+
+This is the default command: "snow -lastn 10" is the same as "snow get -lastn 10".`, runGet)
+	rangeFlags(c.Flags, 1)
+	downloadFlags(c.Flags)
+	pruneFlags(c.Flags)
+	libraryFlags(c.Flags)
+	configFlags(c.Flags, true)
+	mirrorFlag(c.Flags)
+	c.Flags.BoolVar(&allProfiles, "allprofiles", false, "run all of the config's profiles, in order of name")
+	return c
+}
+
+func syncCommand() *Command {
+	c := newCommand("sync", "", "run all of the config's profiles", `
+Sync runs all of the config's profiles, in order of name, using a single check
+for the latest episode. Any flag that is explicitly set takes precedence over
+each profile's setting.
+
+With -watch, sync stays resident and checks for new episodes every -interval,
+plus a random delay of up to -jitter. New episodes are downloaded as they are
+published and assets that were missing, e.g. transcripts that are published
+after the episode, are retried on each check until they are downloaded.`, runSync)
+	rangeFlags(c.Flags, 1)
+	downloadFlags(c.Flags)
+	pruneFlags(c.Flags)
+	libraryFlags(c.Flags)
+	configFlags(c.Flags, false)
+	mirrorFlag(c.Flags)
+	c.Flags.BoolVar(&watch, "watch", false, "keep running, checking for new episodes every -interval")
+	c.Flags.DurationVar(&watchInterval, "interval", time.Hour, "how often to check for new episodes with -watch")
+	c.Flags.DurationVar(&watchJitter, "jitter", 5*time.Minute, "the maximum random delay added to each -interval")
+	return c
+}
+
+// runGet downloads the episodes specified by the flags or profiles.
+func runGet(cmd *Command, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("get: unexpected args: %s", strings.Join(args, " "))
+	}
+	cs, err := confs(cmd.Flags)
+	if err != nil {
+		return err
+	}
+
+	// check the latest episode number; this will be the limit. This is shared
+	// by all of the confs so it's only retrieved once.
+	i, err := lastEpisode()
+	if err != nil {
+		return err
+	}
+
+	var errs int
+	for _, c := range cs {
+		if c.profile != "" {
+			fmt.Printf("profile %s: %s\n", c.profile, c.SaveDir)
+		}
+		_, err = process(c, i)
+		if err == nil {
+			continue
+		}
+		if len(cs) == 1 {
+			return err
+		}
+		fmt.Println(err)
+		errs++
+	}
+	if errs > 0 {
+		return fmt.Errorf("%d of %d profiles resulted in an error", errs, len(cs))
+	}
+	return nil
+}
+
+// runSync runs get with all profiles.
+func runSync(cmd *Command, args []string) error {
+	allProfiles = true
+	if watch {
+		return runWatch(cmd, args)
+	}
+	return runGet(cmd, args)
+}
+
+func versionCommand() *Command {
+	return newCommand("version", "", "print snow's version", `
+Version prints snow's version.`, func(*Command, []string) error {
+		fmt.Printf("snow %s\n", Version)
+		return nil
+	})
+}
+
+func helpCommand() *Command {
+	return newCommand("help", "[command]", "print help for a command", `
+Help prints the help for the command. If no command is specified, snow's usage
+is printed.`, func(cmd *Command, args []string) error {
+		if len(args) == 0 {
+			usage()
+			return nil
+		}
+		c := findCommand(args[0])
+		if c == nil {
+			return fmt.Errorf("help: unknown command %q", args[0])
+		}
+		c.Usage()
+		return nil
+	})
+}
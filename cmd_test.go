@@ -0,0 +1,86 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	defer func() { year, lastN, assetList, stateFilter, unmark = 0, 1, "hq", "", false }()
+	tests := []struct {
+		args     []string
+		name     string
+		cmdArgs  []string
+		lastN    int
+		year     int
+		assets   string
+		states   string
+		undo     bool
+		notFound bool
+	}{
+		// without a command, or with a flag first, the command is get
+		{args: nil, name: "get", lastN: 1, assets: "hq"},
+		{args: []string{"-lastn", "3"}, name: "get", lastN: 3, assets: "hq"},
+		{args: []string{"-assets", "hq,txt", "-lastn", "0"}, name: "get", lastN: 0, assets: "hq,txt"},
+		// the flags are reset to each command's defaults: list's lastn is 10
+		// and get's is 1, and what the previous command set is forgotten
+		{args: []string{"list", "-year", "2016", "-state", "played", "uefi"}, name: "list", cmdArgs: []string{"uefi"}, lastN: 10, year: 2016, assets: "hq", states: "played"},
+		{args: []string{"get"}, name: "get", lastN: 1, assets: "hq"},
+		{args: []string{"list", "-lastn", "5"}, name: "list", lastN: 5, assets: "hq"},
+		{args: []string{"list"}, name: "list", lastN: 10, assets: "hq"},
+		{args: []string{"mark", "played", "500-502"}, name: "mark", cmdArgs: []string{"played", "500-502"}, assets: "hq"},
+		{args: []string{"listened", "-undo", "500"}, name: "listened", cmdArgs: []string{"500"}, assets: "hq", undo: true},
+		{args: []string{"snow"}, notFound: true},
+	}
+	for i, test := range tests {
+		cmd, args, err := parseCommand(test.args)
+		if test.notFound {
+			if err == nil {
+				t.Errorf("%d: got %s; want an unknown command error", i, cmd.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: unexpected error: %s", i, err)
+			continue
+		}
+		if len(args) == 0 {
+			args = nil
+		}
+		if cmd.Name != test.name || !reflect.DeepEqual(args, test.cmdArgs) {
+			t.Errorf("%d: got %s %v; want %s %v", i, cmd.Name, args, test.name, test.cmdArgs)
+		}
+		// only the command's own flags are reset
+		flags := []struct {
+			name      string
+			got, want interface{}
+		}{
+			{"lastn", lastN, test.lastN},
+			{"year", year, test.year},
+			{"assets", assetList, test.assets},
+			{"state", stateFilter, test.states},
+			{"undo", unmark, test.undo},
+		}
+		for _, f := range flags {
+			if cmd.Flags.Lookup(f.name) != nil && f.got != f.want {
+				t.Errorf("%d: %s: got %v; want %v", i, f.name, f.got, f.want)
+			}
+		}
+	}
+}
+
+func TestCommands(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, c := range commands {
+		if seen[c.Name] {
+			t.Errorf("%s: the command is listed twice", c.Name)
+		}
+		seen[c.Name] = true
+		if c.Run == nil || c.Short == "" || c.Long == "" {
+			t.Errorf("%s: the command's run func, short, or long description is missing", c.Name)
+		}
+		if findCommand(c.Name) != c {
+			t.Errorf("%s: the command isn't found", c.Name)
+		}
+	}
+}
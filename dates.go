@@ -0,0 +1,158 @@
+// Apache License Version 2.0
+// http://www.apache.org/licenses/
+// Copyright (c) 2016 Joel Scoble
+// See LICENSE file for license text.
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// DateFilter selects episodes by their air date.
+type DateFilter struct {
+	since time.Time // episodes aired on or after this; zero means no lower bound
+	until time.Time // episodes aired before this; zero means no upper bound
+	year  int       // episodes aired in this year; 0 means any year
+}
+
+// relativeDate matches a relative date, e.g. 90d, 12w, 6m, 1y.
+var relativeDate = regexp.MustCompile(`^(\d+)([dwmy])$`)
+
+// NewDateFilter returns a DateFilter for the since, until, and year values;
+// now is the time that relative dates are relative to. Since and until can be
+// either a date, YYYY-MM-DD, a month, YYYY-MM, a year, YYYY, or a relative
+// date: the number of days, weeks, months, or years ago, e.g. 90d. Until is
+// inclusive: 2015 includes all of 2015.
+func NewDateFilter(since, until string, year int, now time.Time) (DateFilter, error) {
+	var f DateFilter
+	var err error
+	if since != "" {
+		f.since, err = parseDate(since, now, false)
+		if err != nil {
+			return f, fmt.Errorf("since: %s", err)
+		}
+	}
+	if until != "" {
+		f.until, err = parseDate(until, now, true)
+		if err != nil {
+			return f, fmt.Errorf("until: %s", err)
+		}
+	}
+	if year != 0 && (year < FirstYear || year > now.Year()) {
+		return f, fmt.Errorf("year: %d is not between %d and %d", year, FirstYear, now.Year())
+	}
+	f.year = year
+	if !f.since.IsZero() && !f.until.IsZero() && !f.since.Before(f.until) {
+		return f, fmt.Errorf("since, %s, must be before until, %s", since, until)
+	}
+	return f, nil
+}
+
+// parseDate parses s as either an absolute or relative date. If end is true,
+// the returned time is the end of the period that s represents, e.g. for 2015
+// it's the start of 2016 and for 7d it's the start of the day after the day
+// 7 days ago.
+func parseDate(s string, now time.Time, end bool) (time.Time, error) {
+	m := relativeDate.FindStringSubmatch(s)
+	if m != nil {
+		n, err := strconv.Atoi(m[1])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%q is not a valid relative date: %s", s, err)
+		}
+		y, mo, d := now.Date()
+		switch m[2] {
+		case "d":
+			d -= n
+		case "w":
+			d -= n * 7
+		case "m":
+			mo -= time.Month(n)
+		case "y":
+			y -= n
+		}
+		if end {
+			d++
+		}
+		return time.Date(y, mo, d, 0, 0, 0, 0, time.UTC), nil
+	}
+	layouts := []struct {
+		layout string
+		y      int
+		m      int
+		d      int
+	}{
+		{layout: "2006-01-02", d: 1},
+		{layout: "2006-01", m: 1},
+		{layout: "2006", y: 1},
+	}
+	for _, l := range layouts {
+		t, err := time.Parse(l.layout, s)
+		if err != nil {
+			continue
+		}
+		if end {
+			t = t.AddDate(l.y, l.m, l.d)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("%q is not a valid date: use YYYY-MM-DD, YYYY-MM, YYYY, or a relative date, e.g. 90d, 12w, 6m, 1y", s)
+}
+
+// IsZero returns whether the filter has no criteria.
+func (f DateFilter) IsZero() bool {
+	return f.since.IsZero() && f.until.IsZero() && f.year == 0
+}
+
+// Match returns whether the episode's air date matches the filter. An episode
+// without an air date never matches.
+func (f DateFilter) Match(e Episode) bool {
+	if e.Date.IsZero() {
+		return false
+	}
+	if !f.since.IsZero() && e.Date.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && !e.Date.Before(f.until) {
+		return false
+	}
+	if f.year != 0 && e.Date.Year() != f.year {
+		return false
+	}
+	return true
+}
+
+// Years returns the years whose archive pages need to be checked for the
+// filter; now is the current time.
+func (f DateFilter) Years(now time.Time) []int {
+	if f.year != 0 {
+		return []int{f.year}
+	}
+	from, to := FirstYear, now.Year()
+	if !f.since.IsZero() && f.since.Year() > from {
+		from = f.since.Year()
+	}
+	if !f.until.IsZero() && f.until.Year() < to {
+		to = f.until.Year()
+	}
+	var years []int
+	for y := from; y <= to; y++ {
+		years = append(years, y)
+	}
+	return years
+}
+
+// Filter returns the episodes in episodes that match the filter according to
+// the catalog. Episodes that aren't in the catalog don't match.
+func (f DateFilter) Filter(c Catalog, episodes []int) []int {
+	var matched []int
+	for _, v := range episodes {
+		e, ok := c[v]
+		if ok && f.Match(e) {
+			matched = append(matched, v)
+		}
+	}
+	return matched
+}
@@ -0,0 +1,415 @@
+// Apache License Version 2.0
+// http://www.apache.org/licenses/
+// Copyright (c) 2016 Joel Scoble
+// See LICENSE file for license text.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+)
+
+const (
+	deviceManifestName = ".snow-device.json" // the name of the device dir's manifest
+	deviceVersion      = 1                   // the version of the manifest's format
+)
+
+// the device flags
+var (
+	deviceN        int
+	deviceCapacity string
+)
+
+func deviceCommand() *Command {
+	c := newCommand("device", "sync dir", "copy the next episodes to a portable player", `
+Device sync copies the next episodes to listen to, see "snow help next", from
+the save directory to dir, e.g. a portable player's music directory or a
+removable drive, and removes the episodes that were played. By default, the
+next 10 episodes are copied; -n changes the number, and the range flags, e.g.
+-episodes 500-510, select the episodes to choose from.
+
+The episodes must fit in -capacity, e.g. 2GB; by default, the capacity is the
+free space of dir, less 100 MB that is kept free, plus the space used by the
+episodes snow copied to it. An
+episode's hq file is copied unless space is tight: then the lq files of the
+last episodes are copied instead, if the save directory has them, and the
+episodes that don't fit even then are left out. Only audio files are copied,
+using GRC's names, e.g. sn-500.mp3; -assets isn't used.
+
+The files snow copied are listed in dir's .snow-device.json. Only those files
+are ever removed: the ones that were played, or that are no longer selected,
+e.g. because an lq file replaced an hq file. The files snow copied that are
+still on the device aren't copied again, so running device sync again without
+any changes does nothing. Files that snow didn't copy are never replaced: an
+episode whose file name is already used by one of them isn't copied.
+
+Use -dryrun to list what would be copied and removed.`, runDevice)
+	rangeFlags(c.Flags, 0)
+	libraryFlags(c.Flags)
+	configFlags(c.Flags, true)
+	mirrorFlag(c.Flags)
+	c.Flags.IntVar(&deviceN, "n", 10, "the number of episodes to copy; 0 copies all of the selected episodes that aren't played")
+	c.Flags.StringVar(&deviceCapacity, "capacity", "", "the space the episodes may use on the device, e.g. 2GB; if empty, dir's free space plus the space of the episodes on it is used")
+	c.Flags.BoolVar(&nextNewest, "newest", false, "copy the newest unplayed episodes instead of the oldest")
+	c.Flags.BoolVar(&dryRun, "dryrun", false, "list what would be copied and removed without doing it")
+	return c
+}
+
+// runDevice runs the device command's subcommand.
+func runDevice(cmd *Command, args []string) error {
+	if len(args) == 0 || args[0] != "sync" {
+		return errors.New("device: the subcommand must be sync")
+	}
+	if len(args) != 2 {
+		return errors.New("device sync: the device dir must be specified")
+	}
+	dir := args[1]
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("device sync: %s", err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("device sync: %s isn't a dir", dir)
+	}
+	if deviceN < 0 {
+		return fmt.Errorf("device sync: -n must be 0 or greater: %d", deviceN)
+	}
+	cs, err := confs(cmd.Flags)
+	if err != nil {
+		return err
+	}
+	c := cs[0]
+	last, err := lastEpisode()
+	if err != nil {
+		return err
+	}
+	err = resolveEpisodes(&c, last)
+	if err != nil {
+		return err
+	}
+	st, err := loadUserState(c)
+	if err != nil {
+		return err
+	}
+	dev := localStorage{dir: dir}
+	m, err := loadDeviceManifest(dev)
+	if err != nil {
+		return err
+	}
+	capacity, err := deviceSpace(dir, deviceCapacity, m)
+	if err != nil {
+		return fmt.Errorf("device sync: %s", err)
+	}
+	candidates, err := deviceCandidates(c, st, deviceN, nextNewest)
+	if err != nil {
+		return err
+	}
+	if len(candidates) == 0 && len(m.Files) == 0 {
+		return errors.New("Nothing to do: none of the selected episodes that are in the save directory are unplayed.")
+	}
+	plan, left := planDevice(candidates, capacity)
+	res, err := syncDevice(c.Storage(), dev, m, plan, st, dryRun)
+	for _, v := range res.removed {
+		if dryRun {
+			fmt.Printf("%s: would be removed, %s\n", dev.Path(v.file.Name), v.reason)
+			continue
+		}
+		fmt.Printf("%s: removed, %s\n", dev.Path(v.file.Name), v.reason)
+	}
+	for _, f := range res.conflicts {
+		fmt.Printf("%s: not copied, the file exists and snow didn't copy it\n", dev.Path(f.Name))
+	}
+	for _, f := range res.copied {
+		if dryRun {
+			fmt.Printf("%s: would be copied, %s\n", dev.Path(f.Name), humanize.Bytes(uint64(f.Size)))
+			continue
+		}
+		fmt.Printf("%s: copied, %s\n", dev.Path(f.Name), humanize.Bytes(uint64(f.Size)))
+	}
+	if err != nil {
+		return err
+	}
+	var used int64
+	for _, f := range plan {
+		used += f.Size
+	}
+	for _, f := range res.conflicts {
+		used -= f.Size
+	}
+	fmt.Printf("\n%d episodes on the device, using %s of %s: %d copied, %d removed, %d up to date\n", len(plan)-len(res.conflicts), humanize.Bytes(uint64(used)), humanize.Bytes(uint64(capacity)), len(res.copied), len(res.removed), res.current)
+	if left > 0 {
+		fmt.Printf("%d episodes didn't fit\n", left)
+	}
+	return nil
+}
+
+// DeviceManifest lists the files that snow copied to a device dir.
+type DeviceManifest struct {
+	Version int          `json:"version"`
+	Synced  time.Time    `json:"synced"`
+	Files   []DeviceFile `json:"files"`
+}
+
+// DeviceFile is an episode's file on a device, or one to copy to it.
+type DeviceFile struct {
+	Episode int    `json:"episode"`
+	Asset   string `json:"asset"`
+	Name    string `json:"name"` // the name of the file in the device dir
+	Size    int64  `json:"size"`
+
+	source string // the name of the file in the save dir
+}
+
+// loadDeviceManifest loads the manifest of the device dir in s. If the dir
+// doesn't have one, an empty manifest is returned.
+func loadDeviceManifest(s Storage) (*DeviceManifest, error) {
+	m := &DeviceManifest{Version: deviceVersion}
+	b, err := readStorage(s, deviceManifestName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return m, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(b, m)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", s.Path(deviceManifestName), err)
+	}
+	if m.Version > deviceVersion {
+		return nil, fmt.Errorf("%s: unsupported version %d; this snow supports version %d", s.Path(deviceManifestName), m.Version, deviceVersion)
+	}
+	return m, nil
+}
+
+// save writes the manifest to the device dir in s.
+func (m *DeviceManifest) save(s Storage) error {
+	m.Version = deviceVersion
+	m.Synced = time.Now().UTC()
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeStorage(s, deviceManifestName, b)
+}
+
+// deviceSpace returns the space, in bytes, that the episodes may use in dir:
+// the capacity, if it's set, otherwise dir's free space, less the minimum
+// space margin, plus the space used by the files in the manifest.
+func deviceSpace(dir, capacity string, m *DeviceManifest) (int64, error) {
+	if capacity != "" {
+		n, err := humanize.ParseBytes(capacity)
+		if err != nil {
+			return 0, fmt.Errorf("capacity: %s", err)
+		}
+		return int64(n), nil
+	}
+	free, err := freeSpace(dir)
+	if err != nil {
+		return 0, fmt.Errorf("%s; use -capacity", err)
+	}
+	n := int64(free) - minSpaceMargin
+	if n < 0 {
+		n = 0
+	}
+	for _, f := range m.Files {
+		fi, err := os.Stat(localStorage{dir: dir}.path(f.Name))
+		if err == nil {
+			n += fi.Size()
+		}
+	}
+	return n, nil
+}
+
+// deviceCandidates returns up to n of the episodes to copy to a device, in
+// the order of nextOrder; n of 0 returns all of them. Each episode's files
+// are the ones it has in the save dir, in order of preference: hq and then
+// lq. Episodes without either aren't returned.
+func deviceCandidates(c Conf, st *State, n int, newest bool) ([][]DeviceFile, error) {
+	s := c.Storage()
+	var candidates [][]DeviceFile
+	for _, i := range nextOrder(c.episodes, st, newest) {
+		if n > 0 && len(candidates) == n {
+			break
+		}
+		var files []DeviceFile
+		for _, a := range []Asset{assets["hq"], assets["lq"]} {
+			name, err := c.layout.Name(a, i)
+			if err != nil {
+				return nil, err
+			}
+			fi, err := s.Stat(name)
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return nil, err
+			}
+			files = append(files, DeviceFile{Episode: i, Asset: a.Name, Name: a.FileName(i), Size: fi.Size, source: name})
+		}
+		if len(files) > 0 {
+			candidates = append(candidates, files)
+		}
+	}
+	return candidates, nil
+}
+
+// planDevice returns the files to have on the device: one file for each of
+// as many of the candidates, in order, as fit in capacity. Each candidate's
+// first file is used unless they don't all fit; then the last candidates use
+// their next file instead, one at a time, until they fit. If they don't fit
+// even then, the last candidate is left out and the first files are tried
+// again. The number of candidates that were left out is also returned.
+func planDevice(candidates [][]DeviceFile, capacity int64) ([]DeviceFile, int) {
+	for n := len(candidates); n > 0; n-- {
+		choice := make([]int, n)
+		var size int64
+		for j := range choice {
+			size += candidates[j][0].Size
+		}
+		for j := n - 1; j >= 0 && size > capacity; {
+			if choice[j] == len(candidates[j])-1 {
+				j--
+				continue
+			}
+			size += candidates[j][choice[j]+1].Size - candidates[j][choice[j]].Size
+			choice[j]++
+		}
+		if size > capacity {
+			continue
+		}
+		var plan []DeviceFile
+		for j, v := range choice {
+			plan = append(plan, candidates[j][v])
+		}
+		return plan, len(candidates) - n
+	}
+	return nil, len(candidates)
+}
+
+// removedFile is a file that was removed from a device.
+type removedFile struct {
+	file   DeviceFile
+	reason string
+}
+
+// deviceResult is what syncDevice did.
+type deviceResult struct {
+	copied    []DeviceFile
+	removed   []removedFile
+	conflicts []DeviceFile // the files that weren't copied because a file that snow didn't copy has their name
+	current   int          // the number of files that were already on the device
+}
+
+// syncDevice makes the device dir in dev have the files in the plan: the
+// files in the manifest that aren't in the plan are removed and the files in
+// the plan that aren't in the manifest and on the device, with the same size,
+// are copied from the save dir, s. Files that aren't in the manifest are
+// never replaced, or added to it; the planned files with their names are
+// conflicts. The manifest is updated and saved. If dryRun is true, what would
+// be done is returned without doing it.
+func syncDevice(s, dev Storage, m *DeviceManifest, plan []DeviceFile, st *State, dryRun bool) (deviceResult, error) {
+	var res deviceResult
+	planned := make(map[string]bool)
+	for _, f := range plan {
+		planned[f.Name] = true
+	}
+
+	// the removals are first to make room for the copies
+	var files []DeviceFile
+	for _, f := range m.Files {
+		if planned[f.Name] {
+			files = append(files, f)
+			continue
+		}
+		reason := "not selected"
+		if st.State(f.Episode) == Played {
+			reason = "played"
+		}
+		if !dryRun {
+			err := dev.Remove(f.Name)
+			if err != nil && !os.IsNotExist(err) {
+				return res, err
+			}
+		}
+		res.removed = append(res.removed, removedFile{file: f, reason: reason})
+	}
+	m.Files = files
+
+	var err error
+	for _, f := range plan {
+		fi, serr := dev.Stat(f.Name)
+		if serr == nil && !m.has(f.Name) {
+			res.conflicts = append(res.conflicts, f)
+			continue
+		}
+		if serr == nil && fi.Size == f.Size {
+			m.add(f)
+			res.current++
+			continue
+		}
+		if !dryRun {
+			err = copyStorage(s, f.source, dev, f.Name)
+			if err != nil {
+				err = fmt.Errorf("%s: %s", dev.Path(f.Name), err)
+				break
+			}
+			m.add(f)
+		}
+		res.copied = append(res.copied, f)
+	}
+	if dryRun {
+		return res, err
+	}
+	merr := m.save(dev)
+	if err == nil && merr != nil {
+		err = fmt.Errorf("error saving the device manifest: %s", merr)
+	}
+	return res, err
+}
+
+// has returns whether the manifest has the named file.
+func (m *DeviceManifest) has(name string) bool {
+	for _, v := range m.Files {
+		if v.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// add adds the file to the manifest, replacing the file with the same name,
+// if there is one.
+func (m *DeviceManifest) add(f DeviceFile) {
+	for j, v := range m.Files {
+		if v.Name == f.Name {
+			m.Files[j] = f
+			return
+		}
+	}
+	m.Files = append(m.Files, f)
+}
+
+// copyStorage copies the named file from one storage to another.
+func copyStorage(from Storage, name string, to Storage, toName string) error {
+	r, err := from.Open(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := to.Create(toName)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Commit()
+}
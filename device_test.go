@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestPlanDevice(t *testing.T) {
+	hq := func(i int, size int64) DeviceFile { return DeviceFile{Episode: i, Asset: "hq", Size: size} }
+	lq := func(i int, size int64) DeviceFile { return DeviceFile{Episode: i, Asset: "lq", Size: size} }
+	candidates := [][]DeviceFile{
+		{hq(1, 40), lq(1, 10)},
+		{hq(2, 40), lq(2, 10)},
+		{hq(3, 40)},
+	}
+	tests := []struct {
+		capacity int64
+		expected []DeviceFile
+		left     int
+	}{
+		{200, []DeviceFile{hq(1, 40), hq(2, 40), hq(3, 40)}, 0},
+		{120, []DeviceFile{hq(1, 40), hq(2, 40), hq(3, 40)}, 0},
+		{100, []DeviceFile{hq(1, 40), lq(2, 10), hq(3, 40)}, 0},
+		{60, []DeviceFile{lq(1, 10), lq(2, 10), hq(3, 40)}, 0},
+		{50, []DeviceFile{hq(1, 40), lq(2, 10)}, 1},
+		{20, []DeviceFile{lq(1, 10), lq(2, 10)}, 1},
+		{5, nil, 3},
+	}
+	for i, test := range tests {
+		plan, left := planDevice(candidates, test.capacity)
+		if !reflect.DeepEqual(plan, test.expected) || left != test.left {
+			t.Errorf("%d: got %v, %d left; want %v, %d left", i, plan, left, test.expected, test.left)
+		}
+	}
+}
+
+func TestSyncDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lib := filepath.Join(dir, "lib")
+	dev := filepath.Join(dir, "dev")
+	for _, d := range []string{lib, dev} {
+		err = os.Mkdir(d, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]int{"sn-001.mp3": 40, "sn-002.mp3": 40, "sn-002-lq.mp3": 10, "sn-003.mp3": 40, "sn-004.mp3": 40}
+	for name, n := range files {
+		err = ioutil.WriteFile(filepath.Join(lib, name), make([]byte, n), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a file that snow didn't copy is never removed
+	err = ioutil.WriteFile(filepath.Join(dev, "music.mp3"), []byte("music"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout, _ := ParseLayout(defaultLayout)
+	c := Conf{SaveDir: lib, layout: layout, episodes: []int{1, 2, 3, 4}}
+	st := &State{Episodes: map[int]*EpisodeState{1: {State: Played, Updated: time.Now()}}}
+
+	sync := func(capacity int64) deviceResult {
+		m, err := loadDeviceManifest(localStorage{dir: dev})
+		if err != nil {
+			t.Fatal(err)
+		}
+		candidates, err := deviceCandidates(c, st, 2, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plan, _ := planDevice(candidates, capacity)
+		res, err := syncDevice(c.Storage(), localStorage{dir: dev}, m, plan, st, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	devFiles := func() []string {
+		fis, _ := ioutil.ReadDir(dev)
+		var names []string
+		for _, fi := range fis {
+			names = append(names, fi.Name())
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	// episode 1 is played, so 2 and 3 are copied; 2 is lq to fit
+	res := sync(60)
+	if len(res.copied) != 2 || len(res.removed) != 0 {
+		t.Errorf("first sync: got %d copied and %d removed; want 2 and 0", len(res.copied), len(res.removed))
+	}
+	expected := []string{deviceManifestName, "music.mp3", "sn-002-lq.mp3", "sn-003.mp3"}
+	if got := devFiles(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("first sync: got %v; want %v", got, expected)
+	}
+
+	// nothing changed, so nothing is done
+	res = sync(60)
+	if len(res.copied) != 0 || len(res.removed) != 0 || res.current != 2 {
+		t.Errorf("second sync: got %d copied, %d removed, and %d current; want 0, 0, and 2", len(res.copied), len(res.removed), res.current)
+	}
+
+	// once 2 is played, it's removed and 4 would be copied, but files that
+	// snow didn't copy are never replaced or adopted
+	err = ioutil.WriteFile(filepath.Join(dev, "sn-004.mp3"), []byte("mine"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Set(2, Played, 0)
+	res = sync(100)
+	if len(res.conflicts) != 1 || res.conflicts[0].Name != "sn-004.mp3" || len(res.copied) != 0 {
+		t.Errorf("conflict: got %v conflicts and %v copied; want sn-004.mp3 and none", res.conflicts, res.copied)
+	}
+	if len(res.removed) != 1 || res.removed[0].reason != "played" {
+		t.Errorf("conflict: got %v removed; want 1, played", res.removed)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dev, "sn-004.mp3")); string(b) != "mine" {
+		t.Errorf("conflict: sn-004.mp3 was replaced: %q", b)
+	}
+	err = os.Remove(filepath.Join(dev, "sn-004.mp3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// once the file is gone, 4 is copied; there's room for hq
+	res = sync(100)
+	if len(res.copied) != 1 || len(res.removed) != 0 {
+		t.Errorf("third sync: got %v copied and %v removed; want 1 and 0", res.copied, res.removed)
+	}
+	expected = []string{deviceManifestName, "music.mp3", "sn-003.mp3", "sn-004.mp3"}
+	if got := devFiles(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("third sync: got %v; want %v", got, expected)
+	}
+}
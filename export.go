@@ -0,0 +1,304 @@
+// Apache License Version 2.0
+// http://www.apache.org/licenses/
+// Copyright (c) 2016 Joel Scoble
+// See LICENSE file for license text.
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// exportVersion is the version of the export's schema. Columns may be added
+// to the end of a table, and tables may be added, without changing the
+// version; anything else changes it.
+const exportVersion = 1
+
+// the catalog export flags
+var (
+	exportFormat string
+	exportTable  string
+	exportOut    string
+)
+
+func catalogCommand() *Command {
+	c := newCommand("catalog", "export", "export the episode archive and the library", `
+Catalog export exports the episode archive, with the save directory's files
+and download history, for use with other tools. The formats are:
+
+    json    a JSON object with the schema's version and each table, as an
+            array of objects
+    csv     one table, set by -table, with a header row
+    sqlite  an SQLite database with a table for each table; the schema's
+            version is the database's user_version
+
+The tables, and their columns, are:
+
+    meta      key, value: schema_version, snow_version, and exported
+    episodes  number, title, date, minutes, description, listened, state,
+              position: listened is when the episode was marked as played,
+              state is its played state, and position is, for episodes in
+              progress, where listening stopped, in seconds; see "snow help
+              mark"
+    assets    episode, asset, url, size: the assets GRC publishes, with
+              their advertised sizes
+    files     episode, asset, name, size, modified: the files in the save
+              directory
+    history   episode, asset, size, added, source, pruned, original, sha256:
+              the download history
+
+Dates are YYYY-MM-DD and times are RFC 3339, in UTC. The schema is versioned:
+columns may be added to the end of a table, and tables may be added, but
+anything else is a new version.
+
+The export is written to stdout unless -o is used.`, runCatalogCommand)
+	libraryFlags(c.Flags)
+	configFlags(c.Flags, true)
+	mirrorFlag(c.Flags)
+	c.Flags.StringVar(&exportFormat, "format", "json", "the export format: json, csv, or sqlite")
+	c.Flags.StringVar(&exportTable, "table", "episodes", "the table to export as csv: episodes, assets, files, history, or meta")
+	c.Flags.StringVar(&exportOut, "o", "", "the file to write the export to; if empty, it's written to stdout")
+	return c
+}
+
+// runCatalogCommand runs the catalog command's subcommand.
+func runCatalogCommand(cmd *Command, args []string) error {
+	if len(args) == 0 || args[0] != "export" {
+		return errors.New("catalog: the subcommand must be export")
+	}
+	if len(args) > 1 {
+		return fmt.Errorf("catalog export: unexpected args: %s", strings.Join(args[1:], " "))
+	}
+	switch exportFormat {
+	case "json", "csv", "sqlite":
+	default:
+		return fmt.Errorf("catalog export: unknown format %q: must be json, csv, or sqlite", exportFormat)
+	}
+	cs, err := confs(cmd.Flags)
+	if err != nil {
+		return err
+	}
+	c := cs[0]
+	cat, err := runCatalog.Get(allYears(time.Now())...)
+	if err != nil {
+		return fmt.Errorf("error getting the episode catalog: %s", err)
+	}
+	h, err := loadHistory(c.Storage())
+	if err != nil {
+		return fmt.Errorf("error loading the download history: %s", err)
+	}
+	st, err := loadUserState(c)
+	if err != nil {
+		return err
+	}
+	tables, err := exportTables(c, cat, h, st, time.Now())
+	if err != nil {
+		return err
+	}
+	w := io.Writer(os.Stdout)
+	if exportOut != "" {
+		f, err := os.Create(exportOut)
+		if err != nil {
+			return fmt.Errorf("catalog export: %s", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	switch exportFormat {
+	case "json":
+		err = writeExportJSON(w, tables)
+	case "csv":
+		err = writeExportCSV(w, tables, exportTable)
+	case "sqlite":
+		err = writeSQLite(w, tables, exportVersion)
+	}
+	if err != nil {
+		return fmt.Errorf("catalog export: %s", err)
+	}
+	if f, ok := w.(*os.File); ok && f != os.Stdout {
+		return f.Close()
+	}
+	return nil
+}
+
+// exportTables returns the tables of the export of the catalog, c's library,
+// and the user's played states; now is the time of the export.
+func exportTables(c Conf, cat Catalog, h *History, st *State, now time.Time) ([]sqliteTable, error) {
+	meta := sqliteTable{
+		Name:    "meta",
+		Columns: []sqliteColumn{{"key", "TEXT"}, {"value", "TEXT"}},
+		Rows: [][]interface{}{
+			{"schema_version", fmt.Sprint(exportVersion)},
+			{"snow_version", Version},
+			{"exported", now.UTC().Format(time.RFC3339)},
+		},
+	}
+	episodes := sqliteTable{
+		Name:    "episodes",
+		Columns: []sqliteColumn{{"number", "INTEGER"}, {"title", "TEXT"}, {"date", "TEXT"}, {"minutes", "INTEGER"}, {"description", "TEXT"}, {"listened", "TEXT"}, {"state", "TEXT"}, {"position", "INTEGER"}},
+	}
+	as := sqliteTable{
+		Name:    "assets",
+		Columns: []sqliteColumn{{"episode", "INTEGER"}, {"asset", "TEXT"}, {"url", "TEXT"}, {"size", "INTEGER"}},
+	}
+	files := sqliteTable{
+		Name:    "files",
+		Columns: []sqliteColumn{{"episode", "INTEGER"}, {"asset", "TEXT"}, {"name", "TEXT"}, {"size", "INTEGER"}, {"modified", "TEXT"}},
+	}
+	history := sqliteTable{
+		Name:    "history",
+		Columns: []sqliteColumn{{"episode", "INTEGER"}, {"asset", "TEXT"}, {"size", "INTEGER"}, {"added", "TEXT"}, {"source", "TEXT"}, {"pruned", "TEXT"}, {"original", "TEXT"}, {"sha256", "TEXT"}},
+	}
+
+	// the save dir is listed once instead of checking for each file
+	local := make(map[string]StorageInfo)
+	list, err := c.Storage().List("")
+	if err != nil {
+		return nil, fmt.Errorf("error listing the save dir: %s", err)
+	}
+	for _, fi := range list {
+		local[fi.Name] = fi
+	}
+
+	numbers := cat.Numbers()
+	for _, i := range numbers {
+		e := cat[i]
+		var listened, position interface{}
+		if v := st.Episodes[i]; v != nil && v.State == Played {
+			listened = exportTime(v.Updated)
+		}
+		if st.State(i) == InProgress {
+			position = int64(st.Position(i))
+		}
+		episodes.Rows = append(episodes.Rows, []interface{}{int64(i), e.Title, exportDate(e.Date), exportInt(int64(e.Minutes)), exportText(e.Description), listened, st.State(i), position})
+		for _, name := range assetNames() {
+			a := assets[name]
+			if n, ok := e.Sizes[name]; ok {
+				as.Rows = append(as.Rows, []interface{}{int64(i), name, a.SourceURL(i), int64(n)})
+			}
+			fname, err := c.layout.Name(a, i)
+			if err != nil {
+				return nil, err
+			}
+			if fi, ok := local[fname]; ok {
+				files.Rows = append(files.Rows, []interface{}{int64(i), name, fi.Name, fi.Size, exportTime(fi.ModTime)})
+			}
+		}
+	}
+
+	var hist []int
+	for i := range h.Episodes {
+		hist = append(hist, i)
+	}
+	sort.Ints(hist)
+	for _, i := range hist {
+		var names []string
+		for name := range h.Episodes[i].Assets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			v := h.Episodes[i].Assets[name]
+			var pruned, sum interface{}
+			if v.Pruned != nil {
+				pruned = exportTime(*v.Pruned)
+			}
+			if v.Hash != nil {
+				sum = v.Hash.SHA256
+			}
+			history.Rows = append(history.Rows, []interface{}{int64(i), name, v.Size, exportTime(v.Added), v.Source, pruned, exportText(v.Original), sum})
+		}
+	}
+	return []sqliteTable{meta, episodes, as, files, history}, nil
+}
+
+// exportDate returns the date as YYYY-MM-DD; a zero date is NULL.
+func exportDate(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.Format("2006-01-02")
+}
+
+// exportTime returns the time in RFC 3339, in UTC; a zero time is NULL.
+func exportTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// exportInt returns n; 0, which means it isn't known, is NULL.
+func exportInt(n int64) interface{} {
+	if n == 0 {
+		return nil
+	}
+	return n
+}
+
+// exportText returns s; an empty string is NULL.
+func exportText(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// writeExportJSON writes the tables as a JSON object: the schema's version
+// and each table as an array of objects keyed by column name.
+func writeExportJSON(w io.Writer, tables []sqliteTable) error {
+	export := map[string]interface{}{"schema_version": exportVersion}
+	for _, t := range tables {
+		rows := []map[string]interface{}{}
+		for _, row := range t.Rows {
+			m := make(map[string]interface{})
+			for j, c := range t.Columns {
+				m[c.Name] = row[j]
+			}
+			rows = append(rows, m)
+		}
+		export[t.Name] = rows
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(export)
+}
+
+// writeExportCSV writes the named table as CSV with a header row; NULLs are
+// empty.
+func writeExportCSV(w io.Writer, tables []sqliteTable, name string) error {
+	var names []string
+	for _, t := range tables {
+		names = append(names, t.Name)
+		if t.Name != name {
+			continue
+		}
+		cw := csv.NewWriter(w)
+		var rec []string
+		for _, c := range t.Columns {
+			rec = append(rec, c.Name)
+		}
+		cw.Write(rec)
+		for _, row := range t.Rows {
+			rec = rec[:0]
+			for _, v := range row {
+				if v == nil {
+					rec = append(rec, "")
+					continue
+				}
+				rec = append(rec, fmt.Sprint(v))
+			}
+			cw.Write(rec)
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return fmt.Errorf("unknown table %q: must be %s", name, strings.Join(names, ", "))
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testExportTables(t *testing.T) []sqliteTable {
+	dir, err := ioutil.TempDir("", "snow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"sn-500.mp3", "sn-500.txt", "sn-501.mp3", "notes.txt"} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte("abc"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	modified := time.Date(2015, time.March, 25, 12, 0, 0, 0, time.UTC)
+	os.Chtimes(filepath.Join(dir, "sn-500.mp3"), modified, modified)
+	h, err := loadHistory(localStorage{dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Record(assets["hq"], 500, 3, "download", "")
+	h.Episodes[500].Assets["hq"].Added = modified
+	h.SetHash(assets["hq"], 500, StorageInfo{Size: 3, ModTime: modified}, "ba7816bf")
+	h.MarkPruned(assets["lq"], 499)
+	h.Episodes[499].Assets["lq"].Pruned = &modified
+	cat := Catalog{
+		500: {Number: 500, Title: "Windows Secure Boot", Date: time.Date(2015, time.March, 24, 0, 0, 0, 0, time.UTC), Minutes: 98, Description: "UEFI", Sizes: map[string]uint64{"hq": 47000000, "lq": 11000000}},
+		501: {Number: 501, Title: "Security Questions"},
+	}
+	st := &State{Episodes: map[int]*EpisodeState{
+		500: {State: Played, Updated: modified},
+		501: {State: InProgress, Position: 754, Updated: modified},
+	}}
+	c := Conf{SaveDir: dir}
+	tables, err := exportTables(c, cat, h, st, time.Date(2016, time.January, 2, 3, 4, 5, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return tables
+}
+
+func TestExportTables(t *testing.T) {
+	tables := testExportTables(t)
+	expected := map[string][][]interface{}{
+		"meta": {
+			{"schema_version", "1"},
+			{"snow_version", Version},
+			{"exported", "2016-01-02T03:04:05Z"},
+		},
+		"episodes": {
+			{int64(500), "Windows Secure Boot", "2015-03-24", int64(98), "UEFI", "2015-03-25T12:00:00Z", "played", nil},
+			{int64(501), "Security Questions", nil, nil, nil, nil, "inprogress", int64(754)},
+		},
+		"assets": {
+			{int64(500), "hq", "https://media.grc.com/sn/sn-500.mp3", int64(47000000)},
+			{int64(500), "lq", "https://media.grc.com/sn/sn-500-lq.mp3", int64(11000000)},
+		},
+		"files": {
+			{int64(500), "hq", "sn-500.mp3", int64(3), "2015-03-25T12:00:00Z"},
+			{int64(500), "txt", "sn-500.txt", int64(3), nil},
+			{int64(501), "hq", "sn-501.mp3", int64(3), nil},
+		},
+		"history": {
+			{int64(499), "lq", int64(0), nil, "unknown", "2015-03-25T12:00:00Z", nil, nil},
+			{int64(500), "hq", int64(3), "2015-03-25T12:00:00Z", "download", nil, nil, "ba7816bf"},
+		},
+	}
+	if len(tables) != len(expected) {
+		t.Fatalf("got %d tables; want %d", len(tables), len(expected))
+	}
+	for _, table := range tables {
+		rows := table.Rows
+		if table.Name == "files" {
+			// the modification times of the files that weren't set are now
+			for _, row := range rows {
+				if row[2] != "sn-500.mp3" {
+					row[4] = nil
+				}
+			}
+		}
+		if !reflect.DeepEqual(rows, expected[table.Name]) {
+			t.Errorf("%s: got %v; want %v", table.Name, rows, expected[table.Name])
+		}
+	}
+}
+
+func TestWriteExportCSV(t *testing.T) {
+	tables := testExportTables(t)
+	var buf bytes.Buffer
+	err := writeExportCSV(&buf, tables, "episodes")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := "number,title,date,minutes,description,listened,state,position\n500,Windows Secure Boot,2015-03-24,98,UEFI,2015-03-25T12:00:00Z,played,\n501,Security Questions,,,,,inprogress,754\n"
+	if buf.String() != expected {
+		t.Errorf("got %q; want %q", buf.String(), expected)
+	}
+	err = writeExportCSV(&buf, tables, "downloads")
+	if err == nil {
+		t.Error("downloads: expected an error")
+	}
+}
+
+func TestWriteExportJSON(t *testing.T) {
+	var buf bytes.Buffer
+	err := writeExportJSON(&buf, testExportTables(t))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var export struct {
+		SchemaVersion int `json:"schema_version"`
+		Episodes      []struct {
+			Number  int     `json:"number"`
+			Title   string  `json:"title"`
+			Minutes *int    `json:"minutes"`
+			Date    *string `json:"date"`
+		} `json:"episodes"`
+		History []map[string]interface{} `json:"history"`
+	}
+	err = json.Unmarshal(buf.Bytes(), &export)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if export.SchemaVersion != exportVersion {
+		t.Errorf("got schema version %d; want %d", export.SchemaVersion, exportVersion)
+	}
+	if len(export.Episodes) != 2 || export.Episodes[0].Title != "Windows Secure Boot" || *export.Episodes[0].Minutes != 98 || export.Episodes[1].Date != nil {
+		t.Errorf("episodes: got %+v", export.Episodes)
+	}
+	if len(export.History) != 2 || export.History[1]["sha256"] != "ba7816bf" {
+		t.Errorf("history: got %v", export.History)
+	}
+}
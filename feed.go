@@ -0,0 +1,335 @@
+// Apache License Version 2.0
+// http://www.apache.org/licenses/
+// Copyright (c) 2016 Joel Scoble
+// See LICENSE file for license text.
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	feedName   = "feed.xml"                                   // the default name of the feed file
+	iTunesNS   = "http://www.itunes.com/dtds/podcast-1.0.dtd" // the iTunes podcast namespace
+	feedTitle  = "Security Now! (snow archive)"
+	feedLink   = "https://www.grc.com/securitynow.htm"
+	feedDesc   = "The Security Now! episodes in the local snow archive."
+	feedAuthor = Artist
+)
+
+// the feed command's flags
+var (
+	feedOut     string
+	feedBaseURL string
+	feedServe   string
+)
+
+// rss is a podcast RSS 2.0 feed.
+type rss struct {
+	XMLName xml.Name    `xml:"rss"`
+	Version string      `xml:"version,attr"`
+	ITunes  string      `xml:"xmlns:itunes,attr"`
+	Channel feedChannel `xml:"channel"`
+}
+
+type feedChannel struct {
+	Title          string       `xml:"title"`
+	Link           string       `xml:"link"`
+	Description    string       `xml:"description"`
+	Language       string       `xml:"language"`
+	LastBuildDate  string       `xml:"lastBuildDate"`
+	ITunesAuthor   string       `xml:"itunes:author"`
+	ITunesSummary  string       `xml:"itunes:summary"`
+	ITunesExplicit string       `xml:"itunes:explicit"`
+	ITunesImage    *iTunesImage `xml:"itunes:image,omitempty"`
+	ITunesCategory iTunesImage  `xml:"itunes:category"`
+	Items          []feedItem   `xml:"item"`
+}
+
+// iTunesImage is used for both itunes:image and itunes:category; each only
+// has a single attribute, which is written by the field that is set.
+type iTunesImage struct {
+	Href string `xml:"href,attr,omitempty"`
+	Text string `xml:"text,attr,omitempty"`
+}
+
+type feedItem struct {
+	Title          string        `xml:"title"`
+	Description    string        `xml:"description"`
+	PubDate        string        `xml:"pubDate"`
+	GUID           feedGUID      `xml:"guid"`
+	Enclosure      feedEnclosure `xml:"enclosure"`
+	ITunesEpisode  int           `xml:"itunes:episode"`
+	ITunesDuration string        `xml:"itunes:duration,omitempty"`
+	ITunesSummary  string        `xml:"itunes:summary,omitempty"`
+}
+
+type feedGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type feedEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+// feedFile is a local file that is in the feed.
+type feedFile struct {
+	Episode int
+	Path    string // the path of the file, relative to the save dir
+	Size    int64
+	ModTime time.Time
+}
+
+// buildFeed returns the feed for the files; baseURL is prepended to each
+// file's path to make its enclosure url. Episode information comes from the
+// catalog; if an episode isn't in it, the file's modification time is used as
+// its publication date. The items are ordered by episode, newest first.
+func buildFeed(files []feedFile, cat Catalog, baseURL, image string) rss {
+	f := rss{Version: "2.0", ITunes: iTunesNS}
+	f.Channel = feedChannel{
+		Title:          feedTitle,
+		Link:           feedLink,
+		Description:    feedDesc,
+		Language:       "en-us",
+		LastBuildDate:  time.Now().UTC().Format(time.RFC1123Z),
+		ITunesAuthor:   feedAuthor,
+		ITunesSummary:  feedDesc,
+		ITunesExplicit: "no",
+		ITunesCategory: iTunesImage{Text: "Technology"},
+	}
+	if image != "" {
+		f.Channel.ITunesImage = &iTunesImage{Href: image}
+	}
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		v := files[i]
+		e, ok := cat[v.Episode]
+		if !ok {
+			e = Episode{Number: v.Episode}
+		}
+		item := feedItem{
+			Title:         episodeTag(e, nil, "").Title,
+			Description:   e.Description,
+			ITunesEpisode: v.Episode,
+			ITunesSummary: e.Description,
+		}
+		date := e.Date
+		if date.IsZero() {
+			date = v.ModTime
+		}
+		item.PubDate = date.UTC().Format(time.RFC1123Z)
+		if e.Minutes > 0 {
+			item.ITunesDuration = fmt.Sprintf("%d:%02d:00", e.Minutes/60, e.Minutes%60)
+		}
+		u := baseURL + (&url.URL{Path: v.Path}).EscapedPath()
+		item.GUID = feedGUID{IsPermaLink: false, Value: v.Path}
+		item.Enclosure = feedEnclosure{URL: u, Length: v.Size, Type: "audio/mpeg"}
+		f.Channel.Items = append(f.Channel.Items, item)
+	}
+	return f
+}
+
+// writeFeed writes the feed, as XML, to w.
+func writeFeed(w io.Writer, f rss) error {
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	err = enc.Encode(f)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+// feedFiles returns the conf's episodes' local audio files. Only the first of
+// the conf's audio assets is used so that each episode is in the feed once.
+func feedFiles(c Conf) ([]feedFile, error) {
+	var a *Asset
+	for i := range c.assets {
+		if c.assets[i].audio {
+			a = &c.assets[i]
+			break
+		}
+	}
+	if a == nil {
+		return nil, errors.New("feed: the assets must include an audio asset: hq or lq")
+	}
+	var files []feedFile
+	for _, i := range c.episodes {
+		p, err := c.Path(*a, i)
+		if err != nil {
+			return nil, err
+		}
+		fi, err := os.Stat(p)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(c.SaveDir, p)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, feedFile{Episode: i, Path: filepath.ToSlash(rel), Size: fi.Size(), ModTime: fi.ModTime()})
+	}
+	return files, nil
+}
+
+func feedCommand() *Command {
+	c := newCommand("feed", "", "generate a podcast feed of the downloaded episodes", `
+Feed generates a podcast RSS 2.0 feed, with iTunes tags, of the episodes in the
+save directory. Each episode's publication date and description come from the
+episode archive and its enclosure is the local file. By default, the feed is
+written to feed.xml in the save directory and includes all episodes.
+
+The enclosure urls are the files' paths appended to -baseurl; if -baseurl isn't
+specified, file urls are used. With -serve, the feed and the files that it
+lists are also served over HTTP at the specified address, e.g. :8080, so that
+podcatchers on the network can subscribe to http://host:8080/feed.xml; the
+served feed's urls use the host that the feed was requested from. Nothing else
+in the save directory is served.`, runFeed)
+	rangeFlags(c.Flags, 0)
+	libraryFlags(c.Flags)
+	configFlags(c.Flags, true)
+	mirrorFlag(c.Flags)
+	c.Flags.StringVar(&feedOut, "out", "", "the path of the feed; - writes it to stdout. If empty, feed.xml in the save directory is used")
+	c.Flags.StringVar(&feedBaseURL, "baseurl", "", "the base url of the enclosures")
+	c.Flags.StringVar(&feedServe, "serve", "", "serve the feed and its episodes' files over HTTP at this address, e.g. :8080")
+	c.Flags.StringVar(&cover, "cover", "", "the url of the feed's image")
+	return c
+}
+
+// runFeed writes the feed and, optionally, serves it.
+func runFeed(cmd *Command, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("feed: unexpected args: %s", strings.Join(args, " "))
+	}
+	c, cat, err := selected(cmd)
+	if err != nil {
+		return err
+	}
+	err = requireLocal(c, "feed")
+	if err != nil {
+		return err
+	}
+	// only a url can be used as the feed's image
+	image := c.cover
+	if !strings.HasPrefix(image, "http://") && !strings.HasPrefix(image, "https://") {
+		image = ""
+	}
+
+	files, err := feedFiles(c)
+	if err != nil {
+		return err
+	}
+	base := feedBaseURL
+	if base == "" {
+		dir, err := filepath.Abs(c.SaveDir)
+		if err != nil {
+			return err
+		}
+		base = (&url.URL{Scheme: "file", Path: filepath.ToSlash(dir)}).String()
+	}
+	f := buildFeed(files, cat, base, image)
+	switch feedOut {
+	case "-":
+		err = writeFeed(os.Stdout, f)
+	default:
+		out := feedOut
+		if out == "" {
+			out = filepath.Join(c.SaveDir, feedName)
+		}
+		err = writeFeedFile(out, f)
+		if err == nil {
+			fmt.Printf("%d episodes written to %s\n", len(f.Channel.Items), out)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("feed: %s", err)
+	}
+	if feedServe == "" {
+		return nil
+	}
+
+	fmt.Printf("serving %s on %s\n", c.SaveDir, feedServe)
+	return http.ListenAndServe(feedServe, feedHandler(c, cat, image))
+}
+
+// feedHandler returns the handler that serves the feed, as feed.xml, and the
+// files that it lists. Nothing else in the save dir is served, e.g. the
+// download history, and directories aren't listed. The files are checked on
+// each request so that new downloads show up.
+func feedHandler(c Conf, cat Catalog, image string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/"+feedName, func(w http.ResponseWriter, r *http.Request) {
+		files, err := feedFiles(c)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		base := feedBaseURL
+		if base == "" {
+			base = "http://" + r.Host + "/"
+		}
+		w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+		writeFeed(w, buildFeed(files, cat, base, image))
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		files, err := feedFiles(c)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		for _, f := range files {
+			if f.Path == name {
+				serveFile(w, r, filepath.Join(c.SaveDir, filepath.FromSlash(f.Path)))
+				return
+			}
+		}
+		http.NotFound(w, r)
+	})
+	return mux
+}
+
+// writeFeedFile writes the feed to path; the feed is written to a temporary
+// file that replaces path once it's complete.
+func writeFeedFile(path string, f rss) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	err = writeFeed(tmp, f)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Chmod(0644)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
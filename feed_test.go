@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildFeed(t *testing.T) {
+	cat := Catalog{
+		500: {Number: 500, Title: "Windows Secure Boot", Date: time.Date(2015, time.March, 24, 0, 0, 0, 0, time.UTC), Minutes: 94, Description: "Leo and I discuss"},
+	}
+	files := []feedFile{
+		{Episode: 500, Path: "sn-500.mp3", Size: 45000000},
+		{Episode: 501, Path: "sn-501.mp3", Size: 46000000, ModTime: time.Date(2015, time.March, 31, 12, 0, 0, 0, time.UTC)},
+	}
+	f := buildFeed(files, cat, "http://nas:8080", "")
+	if len(f.Channel.Items) != 2 {
+		t.Fatalf("got %d items; want 2", len(f.Channel.Items))
+	}
+	// newest first
+	expected := []feedItem{
+		{
+			Title:         "SN 501",
+			PubDate:       "Tue, 31 Mar 2015 12:00:00 +0000",
+			GUID:          feedGUID{Value: "sn-501.mp3"},
+			Enclosure:     feedEnclosure{URL: "http://nas:8080/sn-501.mp3", Length: 46000000, Type: "audio/mpeg"},
+			ITunesEpisode: 501,
+		},
+		{
+			Title:          "SN 500: Windows Secure Boot",
+			Description:    "Leo and I discuss",
+			PubDate:        "Tue, 24 Mar 2015 00:00:00 +0000",
+			GUID:           feedGUID{Value: "sn-500.mp3"},
+			Enclosure:      feedEnclosure{URL: "http://nas:8080/sn-500.mp3", Length: 45000000, Type: "audio/mpeg"},
+			ITunesEpisode:  500,
+			ITunesDuration: "1:34:00",
+			ITunesSummary:  "Leo and I discuss",
+		},
+	}
+	for i, item := range f.Channel.Items {
+		if item != expected[i] {
+			t.Errorf("%d: got %+v; want %+v", i, item, expected[i])
+		}
+	}
+
+	var buf bytes.Buffer
+	err := writeFeed(&buf, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := buf.String()
+	for _, v := range []string{
+		`<rss version="2.0" xmlns:itunes="http://www.itunes.com/dtds/podcast-1.0.dtd">`,
+		`<itunes:author>Steve Gibson &amp; Leo Laporte</itunes:author>`,
+		`<itunes:category text="Technology"></itunes:category>`,
+		`<enclosure url="http://nas:8080/sn-500.mp3" length="45000000" type="audio/mpeg"></enclosure>`,
+		`<guid isPermaLink="false">sn-500.mp3</guid>`,
+		`<itunes:episode>500</itunes:episode>`,
+	} {
+		if !strings.Contains(s, v) {
+			t.Errorf("expected the feed to contain %s:\n%s", v, s)
+		}
+	}
+	// it must be well-formed
+	var v rss
+	err = xml.Unmarshal(buf.Bytes(), &v)
+	if err != nil {
+		t.Errorf("unmarshal: %s", err)
+	}
+}
+
+func TestFeedHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"sn-500.mp3", "sn-500.txt", historyName, lockName} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := Conf{SaveDir: dir, assets: []Asset{assets["hq"]}, episodes: []int{500, 501}}
+	srv := httptest.NewServer(feedHandler(c, Catalog{}, ""))
+	defer srv.Close()
+
+	tests := []struct {
+		path string
+		code int
+	}{
+		{"/" + feedName, http.StatusOK},
+		{"/sn-500.mp3", http.StatusOK},
+		// only the files that the feed lists are served
+		{"/sn-500.txt", http.StatusNotFound},
+		{"/" + historyName, http.StatusNotFound},
+		{"/" + lockName, http.StatusNotFound},
+		{"/sn-501.mp3", http.StatusNotFound},
+		// directories aren't listed
+		{"/", http.StatusNotFound},
+	}
+	for i, test := range tests {
+		resp, err := http.Get(srv.URL + test.path)
+		if err != nil {
+			t.Errorf("%d: %s", i, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.code {
+			t.Errorf("%d: %s: got %d; want %d", i, test.path, resp.StatusCode, test.code)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+// Apache License Version 2.0
+// http://www.apache.org/licenses/
+// Copyright (c) 2016 Joel Scoble
+// See LICENSE file for license text.
+
+//go:build !linux && !darwin && !freebsd && !windows
+// +build !linux,!darwin,!freebsd,!windows
+
+package main
+
+import "errors"
+
+// freeSpace isn't supported on this platform, so the free space check is
+// skipped.
+func freeSpace(dir string) (uint64, error) {
+	return 0, errors.New("checking the free space isn't supported on this platform")
+}
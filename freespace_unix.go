@@ -0,0 +1,22 @@
+// Apache License Version 2.0
+// http://www.apache.org/licenses/
+// Copyright (c) 2016 Joel Scoble
+// See LICENSE file for license text.
+
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package main
+
+import "syscall"
+
+// freeSpace returns the number of bytes available to unprivileged users on
+// the filesystem of dir.
+func freeSpace(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(dir, &st)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
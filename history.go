@@ -0,0 +1,280 @@
+// Apache License Version 2.0
+// http://www.apache.org/licenses/
+// Copyright (c) 2016 Joel Scoble
+// See LICENSE file for license text.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	historyName    = ".snow-history.json" // the name of the save dir's download history
+	historyVersion = 1                    // the version of the history's format
+)
+
+// History is a save dir's download history: what was downloaded, or
+// imported, and what was pruned. Pruned assets aren't downloaded again
+// unless overwrite is used.
+type History struct {
+	Version  int                     `json:"version"`
+	Layout   string                  `json:"layout,omitempty"` // the layout of the save dir
+	Episodes map[int]*EpisodeHistory `json:"episodes"`
+
+	storage Storage
+	changed map[assetKey]bool // what this snow changed since the history was loaded
+	mu      sync.Mutex
+}
+
+// assetKey identifies an asset of an episode.
+type assetKey struct {
+	episode int
+	asset   string
+}
+
+// EpisodeHistory is an episode's history.
+type EpisodeHistory struct {
+	Assets map[string]*AssetHistory `json:"assets,omitempty"` // keyed by asset name
+}
+
+// AssetHistory is the history of an episode's asset.
+type AssetHistory struct {
+	Size     int64       `json:"size"`
+	Added    time.Time   `json:"added"`
+	Source   string      `json:"source"` // how it was added: download or import
+	Pruned   *time.Time  `json:"pruned,omitempty"`
+	Original string      `json:"original,omitempty"` // for imports, the path of the file that was imported
+	Hash     *FileHash   `json:"hash,omitempty"`
+	Remote   *RemoteInfo `json:"remote,omitempty"` // what the server reported when it was downloaded or last checked
+}
+
+// FileHash is the SHA-256 hash of a file, with the size and modification time
+// the file had when it was hashed.
+type FileHash struct {
+	SHA256  string    `json:"sha256"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// loadHistory loads the download history of the save dir in s. If the save
+// dir doesn't have a history, an empty one is returned.
+func loadHistory(s Storage) (*History, error) {
+	h := &History{Version: historyVersion, Episodes: make(map[int]*EpisodeHistory), storage: s}
+	b, err := readStorage(s, historyName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return h, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(b, h)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", s.Path(historyName), err)
+	}
+	if h.Version > historyVersion {
+		return nil, fmt.Errorf("%s: unsupported version %d; this snow supports version %d", s.Path(historyName), h.Version, historyVersion)
+	}
+	if h.Episodes == nil {
+		h.Episodes = make(map[int]*EpisodeHistory)
+	}
+	return h, nil
+}
+
+// Save writes the history to the save dir. Other snows may have saved the
+// history since it was loaded, so it's loaded again and what this snow changed
+// is merged into it; the merged history replaces h's.
+func (h *History) Save() error {
+	m, err := lockMutex(h.storage)
+	if err != nil {
+		return fmt.Errorf("error locking %s: %s", h.storage.Path(historyName), err)
+	}
+	defer m.Unlock()
+	cur, err := loadHistory(h.storage)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for k := range h.changed {
+		e := cur.episode(k.episode)
+		if v := h.episode(k.episode).Assets[k.asset]; v != nil {
+			e.Assets[k.asset] = v
+		} else {
+			delete(e.Assets, k.asset)
+		}
+	}
+	if h.Layout != "" {
+		cur.Layout = h.Layout
+	}
+	h.Layout, h.Episodes, h.changed = cur.Layout, cur.Episodes, nil
+	h.Version = historyVersion
+	b, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeStorage(h.storage, historyName, b)
+}
+
+// checkLayout returns an error if the save dir's files use a different layout
+// than l; if they don't, l is recorded as the save dir's layout. A history
+// without a layout is for the default layout.
+func (h *History) checkLayout(l *Layout) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	current := h.Layout
+	if current == "" && len(h.Episodes) > 0 {
+		current = defaultLayout
+	}
+	if current != "" && current != l.String() {
+		return fmt.Errorf("the save dir uses the layout %q, not %q; use snow relayout to change its layout", current, l.String())
+	}
+	h.Layout = l.String()
+	return nil
+}
+
+// touch records that asset a of episode i was changed; the caller must hold
+// the lock.
+func (h *History) touch(i int, a string) {
+	if h.changed == nil {
+		h.changed = make(map[assetKey]bool)
+	}
+	h.changed[assetKey{episode: i, asset: a}] = true
+}
+
+// episode returns episode i's history, adding it if it doesn't exist; the
+// caller must hold the lock.
+func (h *History) episode(i int) *EpisodeHistory {
+	e, ok := h.Episodes[i]
+	if !ok {
+		e = &EpisodeHistory{}
+		h.Episodes[i] = e
+	}
+	if e.Assets == nil {
+		e.Assets = make(map[string]*AssetHistory)
+	}
+	return e
+}
+
+// Asset returns the history of asset a of episode i, if it has one.
+func (h *History) Asset(a Asset, i int) (AssetHistory, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e, ok := h.Episodes[i]
+	if !ok || e.Assets[a.Name] == nil {
+		return AssetHistory{}, false
+	}
+	return *e.Assets[a.Name], true
+}
+
+// Record records that asset a of episode i was added to the save dir; any
+// previous pruning is forgotten.
+func (h *History) Record(a Asset, i int, size int64, source, original string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.episode(i).Assets[a.Name] = &AssetHistory{Size: size, Added: time.Now().UTC(), Source: source, Original: original}
+	h.touch(i, a.Name)
+}
+
+// Hash returns the hash of the file of asset a of episode i, if it was hashed
+// and the file, fi, hasn't changed since.
+func (h *History) Hash(a Asset, i int, fi StorageInfo) (string, bool) {
+	v, ok := h.Asset(a, i)
+	if !ok || v.Hash == nil || v.Hash.Size != fi.Size || !v.Hash.ModTime.Equal(fi.ModTime) {
+		return "", false
+	}
+	return v.Hash.SHA256, true
+}
+
+// SetHash records the hash of the file, fi, of asset a of episode i. If the
+// asset isn't in the history, e.g. its file was added before the history was
+// kept, it's added with an unknown source.
+func (h *History) SetHash(a Asset, i int, fi StorageInfo, sum string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e := h.episode(i)
+	v, ok := e.Assets[a.Name]
+	if !ok {
+		v = &AssetHistory{Size: fi.Size, Source: "unknown"}
+		e.Assets[a.Name] = v
+	}
+	v.Hash = &FileHash{SHA256: sum, Size: fi.Size, ModTime: fi.ModTime}
+	h.touch(i, a.Name)
+}
+
+// Remote returns what the server reported about the file of asset a of
+// episode i when it was downloaded, or last checked, if that's known.
+func (h *History) Remote(a Asset, i int) (RemoteInfo, bool) {
+	v, ok := h.Asset(a, i)
+	if !ok || v.Remote == nil {
+		return RemoteInfo{}, false
+	}
+	return *v.Remote, true
+}
+
+// SetRemote records what the server reported about the file of asset a of
+// episode i. It's only recorded for assets that are in the history.
+func (h *History) SetRemote(a Asset, i int, r RemoteInfo) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e, ok := h.Episodes[i]
+	if !ok || e.Assets[a.Name] == nil {
+		return
+	}
+	e.Assets[a.Name].Remote = &r
+	h.touch(i, a.Name)
+}
+
+// SetBaseline records what the server reported about the file of asset a of
+// episode i, whose local file has the size, as the baseline for detecting
+// upstream changes. If the asset isn't in the history, it's added with an
+// unknown source.
+func (h *History) SetBaseline(a Asset, i int, size int64, r RemoteInfo) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e := h.episode(i)
+	v, ok := e.Assets[a.Name]
+	if !ok {
+		v = &AssetHistory{Size: size, Source: "unknown"}
+		e.Assets[a.Name] = v
+	}
+	v.Remote = &r
+	h.touch(i, a.Name)
+}
+
+// Pruned returns whether asset a of episode i was pruned.
+func (h *History) Pruned(a Asset, i int) bool {
+	v, ok := h.Asset(a, i)
+	return ok && v.Pruned != nil
+}
+
+// MarkPruned records that asset a of episode i was pruned.
+func (h *History) MarkPruned(a Asset, i int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e := h.episode(i)
+	v, ok := e.Assets[a.Name]
+	if !ok {
+		v = &AssetHistory{Source: "unknown"}
+		e.Assets[a.Name] = v
+	}
+	t := time.Now().UTC()
+	v.Pruned = &t
+	h.touch(i, a.Name)
+}
+
+// recordDownloads records the successful downloads in the history.
+func (h *History) recordDownloads(downloads []Download) {
+	for _, d := range downloads {
+		if d.skipped || d.err != nil {
+			continue
+		}
+		h.Record(d.Asset, d.Episode, int64(d.n), "download", "")
+		if !d.remote.Checked.IsZero() {
+			h.SetRemote(d.Asset, d.Episode, d.remote)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+// Apache License Version 2.0
+// http://www.apache.org/licenses/
+// Copyright (c) 2016 Joel Scoble
+// See LICENSE file for license text.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+)
+
+// Tag is the information that is written to an episode's ID3v2.4 tag.
+type Tag struct {
+	Title     string // TIT2
+	Album     string // TALB
+	Artist    string // TPE1
+	Track     string // TRCK
+	Date      string // TDRC: YYYY-MM-DD
+	Comment   string // COMM
+	Cover     []byte // APIC: the front cover
+	CoverMIME string // the MIME type of the cover
+}
+
+// text encodings
+const encUTF8 = 3
+
+// Bytes returns the ID3v2.4 encoding of the tag. Empty fields are omitted.
+func (t Tag) Bytes() []byte {
+	var frames bytes.Buffer
+	textFrame(&frames, "TIT2", t.Title)
+	textFrame(&frames, "TALB", t.Album)
+	textFrame(&frames, "TPE1", t.Artist)
+	textFrame(&frames, "TRCK", t.Track)
+	textFrame(&frames, "TDRC", t.Date)
+	if t.Comment != "" {
+		// encoding, language, empty short description, the comment
+		var b bytes.Buffer
+		b.WriteByte(encUTF8)
+		b.WriteString("eng")
+		b.WriteByte(0)
+		b.WriteString(t.Comment)
+		frame(&frames, "COMM", b.Bytes())
+	}
+	if len(t.Cover) > 0 {
+		// encoding, MIME type, picture type, empty description, the picture
+		var b bytes.Buffer
+		b.WriteByte(encUTF8)
+		b.WriteString(t.CoverMIME)
+		b.WriteByte(0)
+		b.WriteByte(3) // front cover
+		b.WriteByte(0)
+		b.Write(t.Cover)
+		frame(&frames, "APIC", b.Bytes())
+	}
+
+	var tag bytes.Buffer
+	tag.WriteString("ID3")
+	tag.Write([]byte{4, 0, 0}) // version 2.4.0, no flags
+	tag.Write(syncsafe(uint32(frames.Len())))
+	tag.Write(frames.Bytes())
+	return tag.Bytes()
+}
+
+// textFrame writes a text frame to w; if s is empty, nothing is written.
+func textFrame(w *bytes.Buffer, id, s string) {
+	if s == "" {
+		return
+	}
+	frame(w, id, append([]byte{encUTF8}, s...))
+}
+
+// frame writes a frame to w.
+func frame(w *bytes.Buffer, id string, data []byte) {
+	w.WriteString(id)
+	w.Write(syncsafe(uint32(len(data))))
+	w.Write([]byte{0, 0}) // no flags
+	w.Write(data)
+}
+
+// syncsafe returns the 4 byte syncsafe encoding of n: 7 bits per byte.
+func syncsafe(n uint32) []byte {
+	return []byte{byte(n>>21) & 0x7f, byte(n>>14) & 0x7f, byte(n>>7) & 0x7f, byte(n) & 0x7f}
+}
+
+// unsyncsafe decodes a 4 byte syncsafe integer.
+func unsyncsafe(b []byte) uint32 {
+	return uint32(b[0])<<21 | uint32(b[1])<<14 | uint32(b[2])<<7 | uint32(b[3])
+}
+
+// tagSize returns the size of the ID3v2 tag at the start of r, including its
+// header and footer. If there isn't an ID3v2 tag, 0 is returned.
+func tagSize(r io.Reader) (int64, error) {
+	var h [10]byte
+	_, err := io.ReadFull(r, h[:])
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, nil
+		}
+		return 0, err
+	}
+	if string(h[:3]) != "ID3" {
+		return 0, nil
+	}
+	n := int64(unsyncsafe(h[6:])) + 10
+	if h[5]&0x10 != 0 { // footer present
+		n += 10
+	}
+	return n, nil
+}
+
+// WriteTag replaces the ID3v2 tag of the file at path with t; if the file
+// doesn't have an ID3v2 tag, t is prepended to it. The file is rewritten to
+// a temporary file that replaces the original once it's complete.
+func WriteTag(path string, t Tag) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	n, err := tagSize(f)
+	if err != nil {
+		return err
+	}
+	if n > fi.Size() {
+		return fmt.Errorf("%s: ID3 tag size, %d, exceeds the file's size, %d", path, n, fi.Size())
+	}
+	_, err = f.Seek(n, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	// if anything goes wrong, remove the temp file
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(t.Bytes())
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	_, err = io.Copy(tmp, f)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Chmod(fi.Mode())
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Rename(tmp.Name(), path)
+}
+
+// ReadTag reads the text frames of the ID3v2.3 or ID3v2.4 tag at the start of
+// r. If r doesn't start with a tag, an empty Tag is returned. Only the text
+// frames that are in Tag are read; TYER is used for the date of v2.3 tags.
+func ReadTag(r io.Reader) (Tag, error) {
+	var t Tag
+	var h [10]byte
+	_, err := io.ReadFull(r, h[:])
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return t, nil
+		}
+		return t, err
+	}
+	if string(h[:3]) != "ID3" {
+		return t, nil
+	}
+	version := h[3]
+	if version != 3 && version != 4 {
+		return t, fmt.Errorf("unsupported ID3 version 2.%d", version)
+	}
+	b := make([]byte, unsyncsafe(h[6:]))
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return t, fmt.Errorf("read ID3 tag: %s", err)
+	}
+	// skip the extended header
+	if h[5]&0x40 != 0 && len(b) >= 4 {
+		n := int(binary.BigEndian.Uint32(b)) + 4
+		if version == 4 {
+			n = int(unsyncsafe(b))
+		}
+		if n > len(b) {
+			return t, fmt.Errorf("ID3 extended header size, %d, exceeds the tag's size", n)
+		}
+		b = b[n:]
+	}
+	for len(b) >= 10 && b[0] != 0 {
+		id := string(b[:4])
+		n := int(binary.BigEndian.Uint32(b[4:8]))
+		if version == 4 {
+			n = int(unsyncsafe(b[4:8]))
+		}
+		b = b[10:]
+		if n > len(b) {
+			return t, fmt.Errorf("ID3 frame %s: size, %d, exceeds the tag's size", id, n)
+		}
+		v := decodeText(b[:n])
+		b = b[n:]
+		switch id {
+		case "TIT2":
+			t.Title = v
+		case "TALB":
+			t.Album = v
+		case "TPE1":
+			t.Artist = v
+		case "TRCK":
+			t.Track = v
+		case "TDRC", "TYER":
+			t.Date = v
+		}
+	}
+	return t, nil
+}
+
+// decodeText decodes the data of a text frame; the first byte is the text
+// encoding. Only the first string of the frame is returned.
+func decodeText(b []byte) string {
+	if len(b) < 2 {
+		return ""
+	}
+	enc, b := b[0], b[1:]
+	var s string
+	switch enc {
+	case 0: // ISO-8859-1
+		r := make([]rune, len(b))
+		for i, c := range b {
+			r[i] = rune(c)
+		}
+		s = string(r)
+	case 1, 2: // UTF-16 with a BOM, UTF-16BE
+		var order binary.ByteOrder = binary.BigEndian
+		if enc == 1 && len(b) >= 2 {
+			if b[0] == 0xff && b[1] == 0xfe {
+				order = binary.LittleEndian
+			}
+			b = b[2:]
+		}
+		u := make([]uint16, len(b)/2)
+		for i := range u {
+			u[i] = order.Uint16(b[i*2:])
+		}
+		s = string(utf16.Decode(u))
+	default:
+		s = string(b)
+	}
+	if i := strings.IndexRune(s, 0); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+// mp3 bitrates, in kbps, by bitrate index for layer III: MPEG-1 and MPEG-2
+// and 2.5.
+var (
+	mpeg1Bitrates = [16]int{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0}
+	mpeg2Bitrates = [16]int{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0}
+)
+
+// mp3Bitrate returns the bitrate, in kbps, of the first MPEG audio layer III
+// frame in the file at path. The file's ID3v2 tag, if any, is skipped. If a
+// frame isn't found near the start of the file, 0 is returned.
+func mp3Bitrate(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	n, err := tagSize(f)
+	if err != nil {
+		return 0, err
+	}
+	_, err = f.Seek(n, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	r := bufio.NewReader(io.LimitReader(f, 64<<10))
+	var prev byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				return 0, nil
+			}
+			return 0, err
+		}
+		// the frame sync is 11 set bits; the layer must be III
+		if prev != 0xff || c&0xe0 != 0xe0 || (c>>1)&3 != 1 {
+			prev = c
+			continue
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil
+		}
+		rate := mpeg2Bitrates[b>>4]
+		if (c>>3)&3 == 3 { // MPEG-1
+			rate = mpeg1Bitrates[b>>4]
+		}
+		// a free or invalid bitrate isn't a frame
+		if rate > 0 {
+			return rate, nil
+		}
+		prev = b
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSyncsafe(t *testing.T) {
+	tests := []struct {
+		n        uint32
+		expected []byte
+	}{
+		{0, []byte{0, 0, 0, 0}},
+		{127, []byte{0, 0, 0, 0x7f}},
+		{128, []byte{0, 0, 1, 0}},
+		{0x0fffffff, []byte{0x7f, 0x7f, 0x7f, 0x7f}},
+	}
+	for i, test := range tests {
+		b := syncsafe(test.n)
+		if !bytes.Equal(b, test.expected) {
+			t.Errorf("%d: got %v; want %v", i, b, test.expected)
+		}
+		n := unsyncsafe(b)
+		if n != test.n {
+			t.Errorf("%d: got %d; want %d", i, n, test.n)
+		}
+	}
+}
+
+func TestTagBytes(t *testing.T) {
+	tag := Tag{Title: "SN 500: Windows Secure Boot", Track: "500"}
+	expected := []byte("ID3\x04\x00\x00\x00\x00\x00\x34" +
+		"TIT2\x00\x00\x00\x1c\x00\x00\x03SN 500: Windows Secure Boot" +
+		"TRCK\x00\x00\x00\x04\x00\x00\x03500")
+	b := tag.Bytes()
+	if !bytes.Equal(b, expected) {
+		t.Errorf("got %q; want %q", b, expected)
+	}
+}
+
+func TestEpisodeTag(t *testing.T) {
+	e := Episode{Number: 500, Title: "Windows Secure Boot", Date: time.Date(2015, time.March, 24, 0, 0, 0, 0, time.UTC), Description: "Leo and I discuss"}
+	tag := episodeTag(e, nil, "")
+	expected := Tag{Title: "SN 500: Windows Secure Boot", Album: Album, Artist: Artist, Track: "500", Date: "2015-03-24", Comment: "Leo and I discuss"}
+	if tag.Title != expected.Title || tag.Album != expected.Album || tag.Artist != expected.Artist || tag.Track != expected.Track || tag.Date != expected.Date || tag.Comment != expected.Comment {
+		t.Errorf("got %+v; want %+v", tag, expected)
+	}
+}
+
+func TestWriteTag(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	audio := []byte("\xff\xfbaudio frames")
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"untagged.mp3", audio},
+		{"tagged.mp3", append(Tag{Title: "an old title that is replaced", Comment: "old"}.Bytes(), audio...)},
+	}
+	tag := Tag{Title: "SN 500: Windows Secure Boot", Track: "500"}
+	for _, test := range tests {
+		p := filepath.Join(dir, test.name)
+		err := ioutil.WriteFile(p, test.data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = WriteTag(p, tag)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := append(tag.Bytes(), audio...)
+		if !bytes.Equal(b, expected) {
+			t.Errorf("%s: got %q; want %q", test.name, b, expected)
+		}
+	}
+}
+
+func TestReadTag(t *testing.T) {
+	tag := Tag{Title: "SN 500: Windows Secure Boot", Album: Album, Artist: Artist, Track: "500", Date: "2015-03-24", Comment: "ignored"}
+	got, err := ReadTag(bytes.NewReader(append(tag.Bytes(), 0xff, 0xfb)))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	tag.Comment = ""
+	if !reflect.DeepEqual(got, tag) {
+		t.Errorf("got %+v; want %+v", got, tag)
+	}
+
+	// an ID3v2.3 tag with a UTF-16 title
+	frame := []byte{1, 0xff, 0xfe, 'S', 0, 'N', 0, 0, 0}
+	v23 := []byte{'I', 'D', '3', 3, 0, 0, 0, 0, 0, byte(10 + len(frame))}
+	v23 = append(v23, 'T', 'I', 'T', '2', 0, 0, 0, byte(len(frame)), 0, 0)
+	v23 = append(v23, frame...)
+	got, err = ReadTag(bytes.NewReader(v23))
+	if err != nil {
+		t.Fatalf("v2.3: unexpected error: %s", err)
+	}
+	if got.Title != "SN" {
+		t.Errorf("v2.3: got %q; want %q", got.Title, "SN")
+	}
+
+	// no tag
+	got, err = ReadTag(bytes.NewReader([]byte{0xff, 0xfb, 0x90, 0x64}))
+	if err != nil || !reflect.DeepEqual(got, Tag{}) {
+		t.Errorf("no tag: got %+v, %v; want an empty tag", got, err)
+	}
+}
+
+func TestMP3Bitrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		data     []byte
+		expected int
+	}{
+		{[]byte{0xff, 0xfb, 0x50, 0x64}, 64},                             // MPEG-1
+		{append(Tag{Title: "x"}.Bytes(), 0, 0xff, 0xf3, 0x20, 0xc4), 16}, // MPEG-2 after a tag
+		{[]byte{0xff, 0xf3, 0xf0, 0xff, 0xe3, 0x10}, 8},                  // a bad bitrate then MPEG-2.5
+		{[]byte("not an mp3"), 0},
+	}
+	for i, test := range tests {
+		p := filepath.Join(dir, "test.mp3")
+		err = ioutil.WriteFile(p, test.data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := mp3Bitrate(p)
+		if err != nil {
+			t.Errorf("%d: unexpected error: %s", i, err)
+			continue
+		}
+		if n != test.expected {
+			t.Errorf("%d: got %d; want %d", i, n, test.expected)
+		}
+	}
+}
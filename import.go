@@ -0,0 +1,368 @@
+// Apache License Version 2.0
+// http://www.apache.org/licenses/
+// Copyright (c) 2016 Joel Scoble
+// See LICENSE file for license text.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// importMove moves the imported files instead of copying them.
+var importMove bool
+
+func importCommand() *Command {
+	c := newCommand("import", "dir", "import an existing collection of episodes", `
+Import copies the Security Now! files in dir, and its subdirectories, into the
+save directory using snow's names, e.g. sn-500.mp3 and sn-500-lq.mp3, and
+records them in the save directory's download history.
+
+Each file's episode is identified by, in order:
+
+    its name, e.g. SN-042.mp3, sn042.mp3, or Security Now 500.mp3
+    its ID3 tag's track number or title, for mp3s
+    its name matching an episode's title
+    its size matching the size of an episode's file in the episode archive
+
+Mp3s with a bitrate of 32Kbps or less, or with lq in their name, are imported
+as lq; the rest are imported as hq. Files that can't be identified, or whose
+episode already has the file in the save directory, are skipped unless
+-overwrite is used.
+
+Use -dryrun to list what would be imported.`, runImport)
+	c.Flags.BoolVar(&importMove, "move", false, "move the files instead of copying them")
+	c.Flags.BoolVar(&dryRun, "dryrun", false, "list what would be imported without importing anything")
+	c.Flags.BoolVar(&overwrite, "overwrite", false, "replace files that are already in the save directory")
+	libraryFlags(c.Flags)
+	configFlags(c.Flags, true)
+	mirrorFlag(c.Flags)
+	return c
+}
+
+// runImport imports the files in the dir.
+func runImport(cmd *Command, args []string) error {
+	if len(args) != 1 {
+		return errors.New("import: a single dir to import must be specified")
+	}
+	cs, err := confs(cmd.Flags)
+	if err != nil {
+		return err
+	}
+	c := cs[0]
+	err = requireLocal(c, "import")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(c.SaveDir, 0755)
+	if err != nil {
+		return fmt.Errorf("error making save dir: %s", err)
+	}
+	cat, err := runCatalog.Get(allYears(time.Now())...)
+	if err != nil {
+		if c.layout.UsesCatalog() {
+			return fmt.Errorf("error getting the episode catalog, which the layout uses: %s", err)
+		}
+		fmt.Printf("error getting the episode catalog; files will only be identified by their names and tags: %s\n", err)
+		cat = Catalog{}
+	}
+	lock, err := lockSaveDir(&c)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	h, err := loadHistory(c.Storage())
+	if err != nil {
+		return fmt.Errorf("error loading the download history: %s", err)
+	}
+	err = h.checkLayout(c.layout)
+	if err != nil {
+		return err
+	}
+
+	id := newIdentifier(cat)
+	var imported, skipped int
+	err = filepath.Walk(args[0], func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		f, ok := id.Identify(path, fi.Size())
+		if !ok {
+			Verbose(fmt.Sprintf("%s: skipped, not identified", path))
+			return nil
+		}
+		dst, err := c.Path(f.asset, f.episode)
+		if err != nil {
+			fmt.Printf("%s: skipped, %s\n", path, err)
+			skipped++
+			return nil
+		}
+		// the save dir may be within dir
+		if mustAbs(path) == mustAbs(dst) {
+			return nil
+		}
+		if !overwrite && exists(dst) {
+			fmt.Printf("%s: skipped, episode %d's %s file exists as %s\n", path, f.episode, f.asset.Name, dst)
+			skipped++
+			return nil
+		}
+		if dryRun {
+			fmt.Printf("%s: would be imported as %s; identified by %s\n", path, dst, f.how)
+			imported++
+			return nil
+		}
+		err = importFile(path, dst, importMove)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		h.Record(f.asset, f.episode, fi.Size(), "import", path)
+		fmt.Printf("%s: imported as %s; identified by %s\n", path, dst, f.how)
+		imported++
+		return nil
+	})
+	if !dryRun && imported > 0 {
+		herr := h.Save()
+		if herr != nil && err == nil {
+			err = fmt.Errorf("error saving the download history: %s", herr)
+		}
+	}
+	if dryRun {
+		fmt.Printf("\n%d files would be imported; %d files would be skipped\n", imported, skipped)
+	} else {
+		fmt.Printf("\n%d files imported; %d files skipped\n", imported, skipped)
+	}
+	return err
+}
+
+// mustAbs returns the absolute path of p; if it can't be determined, p is
+// returned.
+func mustAbs(p string) string {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return p
+	}
+	return abs
+}
+
+// identifiedFile is a file whose episode and asset were identified.
+type identifiedFile struct {
+	episode int
+	asset   Asset
+	how     string // how the episode was identified
+}
+
+// The patterns that file names and titles are matched against; the first
+// submatch is the episode number.
+var episodePatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)(?:^|[^a-z0-9])sn[-_ .#]?0*(\d{1,4})(?:[^0-9]|$)`),
+	regexp.MustCompile(`(?i)security[-_ .]?now!?[^0-9]{0,12}?0*(\d{1,4})(?:[^0-9]|$)`),
+	regexp.MustCompile(`(?i)(?:^|[^a-z])(?:episode|ep)[-_ .#]?0*(\d{1,4})(?:[^0-9]|$)`),
+}
+
+// lqPattern matches names of low quality files.
+var lqPattern = regexp.MustCompile(`(?i)(?:^|[^a-z])lq(?:[^a-z]|$)`)
+
+// episodeFromName returns the episode number in s, e.g. a file name or an
+// ID3 title.
+func episodeFromName(s string) (int, bool) {
+	for _, re := range episodePatterns {
+		m := re.FindStringSubmatch(s)
+		if m == nil {
+			continue
+		}
+		i, err := strconv.Atoi(m[1])
+		if err == nil && i > 0 {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// identifier identifies the episodes of files using the catalog.
+type identifier struct {
+	catalog Catalog
+	titles  map[string]int   // episode numbers keyed by normalized title
+	sizes   map[uint64][]int // episode numbers keyed by the sizes of their files
+}
+
+// newIdentifier returns an identifier for the catalog's episodes.
+func newIdentifier(cat Catalog) *identifier {
+	id := &identifier{catalog: cat, titles: make(map[string]int), sizes: make(map[uint64][]int)}
+	for i, e := range cat {
+		if t := normalizeTitle(e.Title); t != "" {
+			id.titles[t] = i
+		}
+		for _, n := range e.Sizes {
+			id.sizes[n] = append(id.sizes[n], i)
+		}
+	}
+	return id
+}
+
+// Identify identifies the episode and asset of the file at path, whose size
+// is size. If the file isn't a Security Now! file, false is returned.
+func (id *identifier) Identify(path string, size int64) (identifiedFile, bool) {
+	var f identifiedFile
+	name := filepath.Base(path)
+	ext := strings.ToLower(filepath.Ext(name))
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	switch ext {
+	case ".mp3":
+		f.asset = assets["hq"]
+	case ".txt":
+		f.asset = assets["txt"]
+	case ".pdf":
+		f.asset = assets["pdf"]
+		if strings.Contains(strings.ToLower(base), "notes") {
+			f.asset = assets["notes"]
+		}
+	default:
+		return f, false
+	}
+
+	var ok bool
+	f.episode, ok = episodeFromName(base)
+	ok = ok && id.known(f.episode)
+	f.how = "name"
+	if !ok && f.asset.audio {
+		f.episode, ok = id.fromTag(path)
+		ok = ok && id.known(f.episode)
+		f.how = "ID3 tag"
+	}
+	if !ok {
+		f.episode, ok = id.titles[normalizeTitle(base)]
+		f.how = "title"
+	}
+	if !ok {
+		// the size must only match one episode
+		if v := id.sizes[uint64(size)]; len(v) == 1 {
+			f.episode, ok = v[0], true
+			f.how = "size"
+		}
+	}
+	if !ok {
+		return f, false
+	}
+	if f.asset.audio && id.isLQ(path, base, f.episode, size) {
+		f.asset = assets["lq"]
+	}
+	return f, true
+}
+
+// known returns whether episode i is in the catalog; if the catalog is empty,
+// e.g. it couldn't be retrieved, every episode is known. This keeps numbers
+// that aren't episode numbers, e.g. a year in a name, from being used.
+func (id *identifier) known(i int) bool {
+	if len(id.catalog) == 0 {
+		return true
+	}
+	_, ok := id.catalog[i]
+	return ok
+}
+
+// fromTag returns the episode of the mp3 at path using its ID3 tag.
+func (id *identifier) fromTag(path string) (int, bool) {
+	r, err := os.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer r.Close()
+	t, err := ReadTag(r)
+	if err != nil {
+		Verbose(fmt.Sprintf("%s: %s", path, err))
+		return 0, false
+	}
+	if i, ok := episodeFromName(t.Title); ok {
+		return i, true
+	}
+	// the track number is only trusted if it's a Security Now! tag
+	album := strings.ToLower(t.Album + " " + t.Artist)
+	if strings.Contains(album, "security now") || strings.Contains(album, "gibson") {
+		n, err := strconv.Atoi(strings.SplitN(t.Track, "/", 2)[0])
+		if err == nil && n > 0 {
+			return n, true
+		}
+	}
+	i, ok := id.titles[normalizeTitle(t.Title)]
+	return i, ok
+}
+
+// isLQ returns whether the mp3 at path is the low quality version of episode
+// i.
+func (id *identifier) isLQ(path, base string, i int, size int64) bool {
+	if lqPattern.MatchString(base) {
+		return true
+	}
+	e := id.catalog[i]
+	if n, ok := e.Sizes["lq"]; ok && n == uint64(size) {
+		return true
+	}
+	if n, ok := e.Sizes["hq"]; ok && n == uint64(size) {
+		return false
+	}
+	rate, err := mp3Bitrate(path)
+	return err == nil && rate > 0 && rate <= 32
+}
+
+// normalizeTitle returns the title in lower case with only its letters and
+// numbers, separated by a space.
+func normalizeTitle(s string) string {
+	return strings.Join(titleWords(s), " ")
+}
+
+// importFile copies, or moves, src to dst. The file is copied to a temporary
+// file that replaces dst once it's complete.
+func importFile(src, dst string, move bool) error {
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+	if move {
+		// renaming only works within a filesystem; otherwise it's copied
+		err = os.Rename(src, dst)
+		if err == nil {
+			return nil
+		}
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), "."+filepath.Base(dst))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, in)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Chmod(0664)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), dst)
+	if err != nil || !move {
+		return err
+	}
+	in.Close()
+	return os.Remove(src)
+}
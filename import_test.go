@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEpisodeFromName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected int
+		ok       bool
+	}{
+		{"SN-042", 42, true},
+		{"sn042", 42, true},
+		{"sn-500-lq", 500, true},
+		{"SN_0500_hq", 500, true},
+		{"Security Now 500 - Windows Secure Boot", 500, true},
+		{"Security Now! #423", 423, true},
+		{"security_now_ep12", 12, true},
+		{"Episode 7", 7, true},
+		{"TWiT 500", 0, false},
+		{"snapshot-2", 0, false},
+		{"Windows Secure Boot", 0, false},
+	}
+	for i, test := range tests {
+		n, ok := episodeFromName(test.name)
+		if n != test.expected || ok != test.ok {
+			t.Errorf("%d: %s: got %d %t; want %d %t", i, test.name, n, ok, test.expected, test.ok)
+		}
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cat := Catalog{
+		42:  Episode{Number: 42, Title: "NAT Traversal", Sizes: map[string]uint64{"hq": 100, "lq": 7}},
+		500: Episode{Number: 500, Title: "Windows Secure Boot", Sizes: map[string]uint64{"hq": 1000, "lq": 9}},
+		501: Episode{Number: 501, Title: "Listener Feedback #170"},
+	}
+	// an MPEG-2 layer III frame header at 16Kbps
+	lqFrame := []byte{0xff, 0xf3, 0x20, 0xc4}
+	tag := Tag{Title: "Security Now 501: Listener Feedback", Album: "Security Now!", Track: "501"}.Bytes()
+	untitled := Tag{Title: "Feedback", Album: "Security Now!", Artist: "Steve Gibson", Track: "501/600"}.Bytes()
+	tests := []struct {
+		name     string
+		data     []byte
+		episode  int
+		asset    string
+		how      string
+		expected bool
+	}{
+		{"SN-042.mp3", make([]byte, 100), 42, "hq", "name", true},
+		{"sn042lq.mp3", make([]byte, 7), 42, "lq", "name", true},
+		{"sn-500 lq.mp3", []byte("x"), 500, "lq", "name", true},
+		{"sn500.mp3", lqFrame, 500, "lq", "name", true},
+		{"sn-500.TXT", []byte("x"), 500, "txt", "name", true},
+		{"sn-500-notes.pdf", []byte("x"), 500, "notes", "name", true},
+		{"podcast.mp3", tag, 501, "hq", "ID3 tag", true},
+		{"feedback.mp3", untitled, 501, "hq", "ID3 tag", true},
+		{"Windows Secure Boot.mp3", []byte("x"), 500, "hq", "title", true},
+		{"download (1).mp3", make([]byte, 1000), 500, "hq", "size", true},
+		{"Security Now 2016-05-03.mp3", []byte("x"), 0, "", "", false},
+		{"sn-500.ogg", []byte("x"), 0, "", "", false},
+		{"unknown.mp3", []byte("x"), 0, "", "", false},
+	}
+	id := newIdentifier(cat)
+	for i, test := range tests {
+		p := filepath.Join(dir, test.name)
+		err = ioutil.WriteFile(p, test.data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, ok := id.Identify(p, int64(len(test.data)))
+		if ok != test.expected {
+			t.Errorf("%d: %s: got %t; want %t", i, test.name, ok, test.expected)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if f.episode != test.episode || f.asset.Name != test.asset || f.how != test.how {
+			t.Errorf("%d: %s: got %d %s %s; want %d %s %s", i, test.name, f.episode, f.asset.Name, f.how, test.episode, test.asset, test.how)
+		}
+	}
+}
+
+func TestImportFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "SN-042.mp3")
+	dst := filepath.Join(dir, "lib", "sn-042.mp3")
+	err = ioutil.WriteFile(src, []byte("episode 42"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = importFile(src, dst, false)
+	if err != nil {
+		t.Fatalf("copy: unexpected error: %s", err)
+	}
+	if !exists(src) || !exists(dst) {
+		t.Errorf("copy: expected both %s and %s to exist", src, dst)
+	}
+	os.Remove(dst)
+	err = importFile(src, dst, true)
+	if err != nil {
+		t.Fatalf("move: unexpected error: %s", err)
+	}
+	b, _ := ioutil.ReadFile(dst)
+	if exists(src) || string(b) != "episode 42" {
+		t.Errorf("move: got %q, source exists %t; want %q, false", b, exists(src), "episode 42")
+	}
+}
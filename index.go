@@ -0,0 +1,729 @@
+// Apache License Version 2.0
+// http://www.apache.org/licenses/
+// Copyright (c) 2016 Joel Scoble
+// See LICENSE file for license text.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	indexDir     = ".snow-index"          // the dir, in the save dir, of the transcript index
+	indexName    = indexDir + "/index.gz" // the transcript index
+	indexMagic   = "snowidx"              // the start of the index file
+	indexVersion = 1                      // the version of the index's format
+)
+
+// The BM25 parameters.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// the grep flags
+var (
+	grepResults  int
+	grepContext  int
+	grepNoUpdate bool
+	transcripts  bool // search the transcripts instead of the titles and descriptions
+)
+
+func indexCommand() *Command {
+	c := newCommand("index", "", "update the transcript search index", `
+Index adds the selected episodes' transcripts to the save directory's
+transcript search index, which grep uses. Transcripts that are in the save
+directory are read from it; the rest are downloaded and kept with the index.
+Only transcripts that aren't already indexed, or that changed, are indexed.
+By default, all episodes are indexed.
+
+The index is also updated when transcripts are downloaded to a save directory
+that has one.`, runIndex)
+	rangeFlags(c.Flags, 0)
+	libraryFlags(c.Flags)
+	configFlags(c.Flags, true)
+	mirrorFlag(c.Flags)
+	return c
+}
+
+func grepCommand() *Command {
+	c := newCommand("grep", "terms...", "search the episode transcripts", `
+Grep lists the episodes whose transcripts contain all of the terms, best match
+first, with the part of the transcript where they matched. An arg with more
+than one word, e.g. "secure boot", is a phrase: its words must be next to each
+other. The search is case-insensitive. By default, all episodes are searched.
+
+Unless -noupdate is used, the transcript index is updated first; see
+"snow help index".`, runGrep)
+	rangeFlags(c.Flags, 0)
+	libraryFlags(c.Flags)
+	configFlags(c.Flags, true)
+	mirrorFlag(c.Flags)
+	grepFlags(c.Flags)
+	return c
+}
+
+// grepFlags adds the flags that control transcript searches to fs.
+func grepFlags(fs *flag.FlagSet) {
+	fs.IntVar(&grepResults, "n", 20, "the maximum number of episodes to list; 0 lists all of them")
+	fs.IntVar(&grepContext, "context", 12, "the number of words before and after the match to show")
+	fs.BoolVar(&grepNoUpdate, "noupdate", false, "don't update the transcript index before searching")
+}
+
+// runIndex updates the transcript index.
+func runIndex(cmd *Command, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("index: unexpected args: %s", strings.Join(args, " "))
+	}
+	c, _, err := selected(cmd)
+	if err != nil {
+		return err
+	}
+	idx, err := loadIndex(c.Storage())
+	if err != nil {
+		return err
+	}
+	n, err := updateIndex(c, idx, c.episodes)
+	fmt.Printf("%d transcripts indexed; the index has %d transcripts\n", n, idx.Len())
+	return err
+}
+
+// runGrep searches the transcripts.
+func runGrep(cmd *Command, args []string) error {
+	if len(args) == 0 {
+		return errors.New("grep: nothing to search for")
+	}
+	c, cat, err := selected(cmd)
+	if err != nil {
+		return err
+	}
+	return grepTranscripts(c, cat, args)
+}
+
+// grepTranscripts prints the conf's episodes whose transcripts match the
+// query.
+func grepTranscripts(c Conf, cat Catalog, query []string) error {
+	hits, err := searchTranscripts(c, query)
+	if err != nil {
+		return err
+	}
+	if grepResults > 0 && len(hits) > grepResults {
+		hits = hits[:grepResults]
+	}
+	for _, h := range hits {
+		e, ok := cat[h.Episode]
+		if !ok {
+			e = Episode{Number: h.Episode}
+		}
+		fmt.Printf("%s  (%.2f)\n", episodeLine(e, nil), h.Score)
+		text, err := transcriptText(c, h.Episode)
+		if err != nil {
+			Verbose(fmt.Sprintf("episode %d: %s", h.Episode, err))
+			continue
+		}
+		fmt.Printf("      %s\n", snippet(text, h.Position, h.Length, grepContext))
+	}
+	Verbose(fmt.Sprintf("%d episodes matched", len(hits)))
+	return nil
+}
+
+// searchTranscripts returns the hits of the query in the transcripts of c's
+// episodes, best first; unless -noupdate was used, the index is updated
+// first.
+func searchTranscripts(c Conf, query []string) ([]Hit, error) {
+	q := parseQuery(query)
+	if len(q) == 0 {
+		return nil, errors.New("grep: nothing to search for")
+	}
+	idx, err := loadIndex(c.Storage())
+	if err != nil {
+		return nil, err
+	}
+	if !grepNoUpdate {
+		n, err := updateIndex(c, idx, c.episodes)
+		if err != nil {
+			fmt.Printf("error updating the transcript index: %s\n", err)
+		}
+		Verbose(fmt.Sprintf("%d transcripts indexed", n))
+	}
+	if idx.Len() == 0 {
+		return nil, errors.New("grep: the transcript index is empty; use snow index to build it")
+	}
+	return idx.Search(q, c.episodes), nil
+}
+
+// token is a word in a text.
+type token struct {
+	word       string // the word in lower case
+	start, end int    // the byte offsets of the word in the text
+}
+
+// tokenize returns the words in s; a word is a run of letters and digits.
+func tokenize(s string) []token {
+	var tokens []token
+	start := -1
+	for i, r := range s {
+		word := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if word && start < 0 {
+			start = i
+		}
+		if !word && start >= 0 {
+			tokens = append(tokens, token{word: strings.ToLower(s[start:i]), start: start, end: i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, token{word: strings.ToLower(s[start:]), start: start, end: len(s)})
+	}
+	return tokens
+}
+
+// words returns the words in s in lower case.
+func words(s string) []string {
+	var w []string
+	for _, t := range tokenize(s) {
+		w = append(w, t.word)
+	}
+	return w
+}
+
+// parseQuery returns the phrases of a query; each arg is a phrase of one or
+// more words.
+func parseQuery(args []string) [][]string {
+	var q [][]string
+	for _, v := range args {
+		w := words(v)
+		if len(w) > 0 {
+			q = append(q, w)
+		}
+	}
+	return q
+}
+
+// indexDoc is an indexed transcript.
+type indexDoc struct {
+	length int   // the number of words in the transcript
+	size   int64 // the size of the transcript when it was indexed
+}
+
+// posting is the positions of a word in a transcript.
+type posting struct {
+	episode   int
+	positions []int // the positions, in words, of the word in the transcript; sorted
+}
+
+// TranscriptIndex is an inverted index of the episodes' transcripts: for each
+// word, the transcripts that have it and where.
+type TranscriptIndex struct {
+	docs    map[int]indexDoc
+	terms   map[string][]posting // sorted by episode
+	added   map[int]string       // the transcripts added since the index was loaded
+	storage Storage
+}
+
+// newIndex returns an empty index that is saved to s.
+func newIndex(s Storage) *TranscriptIndex {
+	return &TranscriptIndex{docs: make(map[int]indexDoc), terms: make(map[string][]posting), added: make(map[int]string), storage: s}
+}
+
+// loadIndex loads the transcript index in s; if there isn't one, an empty
+// index is returned.
+func loadIndex(s Storage) (*TranscriptIndex, error) {
+	idx := newIndex(s)
+	r, err := s.Open(indexName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return idx, nil
+		}
+		return nil, err
+	}
+	defer r.Close()
+	err = idx.read(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", s.Path(indexName), err)
+	}
+	return idx, nil
+}
+
+// Len returns the number of indexed transcripts.
+func (idx *TranscriptIndex) Len() int {
+	return len(idx.docs)
+}
+
+// Indexed returns whether the transcript of episode i, whose size is size, is
+// indexed.
+func (idx *TranscriptIndex) Indexed(i int, size int64) bool {
+	d, ok := idx.docs[i]
+	return ok && d.size == size
+}
+
+// Add indexes the transcript of episode i, replacing it if it was already
+// indexed.
+func (idx *TranscriptIndex) Add(i int, text string) {
+	if _, ok := idx.docs[i]; ok {
+		idx.remove(i)
+	}
+	positions := make(map[string][]int)
+	w := words(text)
+	for pos, v := range w {
+		positions[v] = append(positions[v], pos)
+	}
+	for v, p := range positions {
+		postings := idx.terms[v]
+		n := sort.Search(len(postings), func(j int) bool { return postings[j].episode >= i })
+		postings = append(postings, posting{})
+		copy(postings[n+1:], postings[n:])
+		postings[n] = posting{episode: i, positions: p}
+		idx.terms[v] = postings
+	}
+	idx.docs[i] = indexDoc{length: len(w), size: int64(len(text))}
+	idx.added[i] = text
+}
+
+// remove removes episode i's transcript from the index.
+func (idx *TranscriptIndex) remove(i int) {
+	for v, postings := range idx.terms {
+		for j, p := range postings {
+			if p.episode == i {
+				postings = append(postings[:j], postings[j+1:]...)
+				break
+			}
+		}
+		if len(postings) == 0 {
+			delete(idx.terms, v)
+			continue
+		}
+		idx.terms[v] = postings
+	}
+	delete(idx.docs, i)
+}
+
+// Hit is a transcript that matched a search.
+type Hit struct {
+	Episode  int
+	Score    float64 // the BM25 score of the transcript; higher is better
+	Position int     // the position, in words, of the best match
+	Length   int     // the length, in words, of the match at Position
+}
+
+// Search returns the transcripts, of the episodes, that have every phrase of
+// the query, best match first. If episodes is nil, every transcript is
+// searched.
+func (idx *TranscriptIndex) Search(q [][]string, episodes []int) []Hit {
+	var allowed map[int]bool
+	if episodes != nil {
+		allowed = make(map[int]bool)
+		for _, i := range episodes {
+			allowed[i] = true
+		}
+	}
+	if len(idx.docs) == 0 || len(q) == 0 {
+		return nil
+	}
+	var avg float64
+	for _, d := range idx.docs {
+		avg += float64(d.length)
+	}
+	avg /= float64(len(idx.docs))
+
+	// the matches of each phrase, keyed by episode; the rarest phrase's first
+	// match is the hit's position.
+	var hits []Hit
+	var matches []map[int][]int
+	for _, phrase := range q {
+		matches = append(matches, idx.phrase(phrase))
+	}
+	rarest := 0
+	for j := range matches {
+		if len(matches[j]) < len(matches[rarest]) {
+			rarest = j
+		}
+	}
+Episodes:
+	for i, positions := range matches[rarest] {
+		if allowed != nil && !allowed[i] {
+			continue
+		}
+		for _, m := range matches {
+			if len(m[i]) == 0 {
+				continue Episodes
+			}
+		}
+		h := Hit{Episode: i, Position: positions[0], Length: len(q[rarest])}
+		for j, phrase := range q {
+			h.Score += idx.bm25(i, len(matches[j]), len(matches[j][i]), avg) * float64(len(phrase))
+		}
+		hits = append(hits, h)
+	}
+	sort.Sort(byScore(hits))
+	return hits
+}
+
+// phrase returns the positions of the phrase's first word, keyed by
+// episode, where the phrase is in the transcripts.
+func (idx *TranscriptIndex) phrase(phrase []string) map[int][]int {
+	m := make(map[int][]int)
+	for _, p := range idx.terms[phrase[0]] {
+		m[p.episode] = p.positions
+	}
+	for j, v := range phrase[1:] {
+		next := make(map[int][]int)
+		for _, p := range idx.terms[v] {
+			starts, ok := m[p.episode]
+			if !ok {
+				continue
+			}
+			var matched []int
+			for _, start := range starts {
+				if hasPosition(p.positions, start+j+1) {
+					matched = append(matched, start)
+				}
+			}
+			if len(matched) > 0 {
+				next[p.episode] = matched
+			}
+		}
+		m = next
+	}
+	return m
+}
+
+// hasPosition returns whether the sorted positions have pos.
+func hasPosition(positions []int, pos int) bool {
+	n := sort.SearchInts(positions, pos)
+	return n < len(positions) && positions[n] == pos
+}
+
+// bm25 returns the BM25 score of a term that is in df transcripts and is in
+// episode i's transcript tf times; avg is the average transcript length.
+func (idx *TranscriptIndex) bm25(i, df, tf int, avg float64) float64 {
+	n := float64(len(idx.docs))
+	idf := math.Log(1 + (n-float64(df)+0.5)/(float64(df)+0.5))
+	l := float64(idx.docs[i].length)
+	f := float64(tf)
+	return idf * f * (bm25K1 + 1) / (f + bm25K1*(1-bm25B+bm25B*l/avg))
+}
+
+// byScore sorts hits by score, highest first, and then by episode, newest
+// first.
+type byScore []Hit
+
+func (h byScore) Len() int      { return len(h) }
+func (h byScore) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h byScore) Less(i, j int) bool {
+	if h[i].Score != h[j].Score {
+		return h[i].Score > h[j].Score
+	}
+	return h[i].Episode > h[j].Episode
+}
+
+// Save writes the index to its storage. So that concurrent updates aren't
+// lost, the saved index is reloaded, while the save dir's mutex is held, and
+// the transcripts that were added since the index was loaded are added to it.
+func (idx *TranscriptIndex) Save() error {
+	m, err := lockMutex(idx.storage)
+	if err != nil {
+		return fmt.Errorf("error locking %s: %s", idx.storage.Path(indexName), err)
+	}
+	defer m.Unlock()
+	cur, err := loadIndex(idx.storage)
+	if err != nil {
+		return err
+	}
+	for i, text := range idx.added {
+		cur.Add(i, text)
+	}
+	idx.docs, idx.terms, idx.added = cur.docs, cur.terms, make(map[int]string)
+	var b bytes.Buffer
+	err = idx.write(&b)
+	if err != nil {
+		return err
+	}
+	return writeStorage(idx.storage, indexName, b.Bytes())
+}
+
+// write writes the index to w, gzipped. Everything is written as uvarints;
+// episodes and positions are written as the difference from the previous
+// one.
+func (idx *TranscriptIndex) write(w io.Writer) error {
+	zw := gzip.NewWriter(w)
+	bw := bufio.NewWriter(zw)
+	buf := make([]byte, binary.MaxVarintLen64)
+	put := func(v uint64) {
+		n := binary.PutUvarint(buf, v)
+		bw.Write(buf[:n])
+	}
+	bw.WriteString(indexMagic)
+	put(indexVersion)
+	var episodes []int
+	for i := range idx.docs {
+		episodes = append(episodes, i)
+	}
+	sort.Ints(episodes)
+	put(uint64(len(episodes)))
+	for _, i := range episodes {
+		put(uint64(i))
+		put(uint64(idx.docs[i].length))
+		put(uint64(idx.docs[i].size))
+	}
+	var terms []string
+	for v := range idx.terms {
+		terms = append(terms, v)
+	}
+	sort.Strings(terms)
+	put(uint64(len(terms)))
+	for _, v := range terms {
+		put(uint64(len(v)))
+		bw.WriteString(v)
+		postings := idx.terms[v]
+		put(uint64(len(postings)))
+		var prev int
+		for _, p := range postings {
+			put(uint64(p.episode - prev))
+			prev = p.episode
+			put(uint64(len(p.positions)))
+			var last int
+			for _, pos := range p.positions {
+				put(uint64(pos - last))
+				last = pos
+			}
+		}
+	}
+	err := bw.Flush()
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// read reads an index written by write. The lengths that are read are
+// checked against what was read before them, e.g. a word can't be longer
+// than the largest transcript, so that a corrupt index can't make read
+// allocate more than the index could hold.
+func (idx *TranscriptIndex) read(r io.Reader) error {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	br := bufio.NewReader(zr)
+	magic := make([]byte, len(indexMagic))
+	_, err = io.ReadFull(br, magic)
+	if err != nil || string(magic) != indexMagic {
+		return errors.New("not a transcript index")
+	}
+	// the first error is kept; get returns 0 once there's an error
+	get := func() int {
+		if err != nil {
+			return 0
+		}
+		var v uint64
+		v, err = binary.ReadUvarint(br)
+		return int(v)
+	}
+	// getMax is get for a length that can't be more than max
+	getMax := func(max int) int {
+		v := get()
+		if err == nil && (v < 0 || v > max) {
+			err = fmt.Errorf("corrupt index: a length of %d; the most is %d", v, max)
+			return 0
+		}
+		return v
+	}
+	if v := get(); err == nil && v > indexVersion {
+		return fmt.Errorf("unsupported version %d; this snow supports version %d", v, indexVersion)
+	}
+	var maxSize int
+	for n := get(); n > 0 && err == nil; n-- {
+		i := get()
+		d := indexDoc{length: get(), size: int64(get())}
+		if d.size < 0 || d.length < 0 || int64(d.length) > d.size {
+			err = fmt.Errorf("corrupt index: episode %d has %d words in %d bytes", i, d.length, d.size)
+			break
+		}
+		if int(d.size) > maxSize {
+			maxSize = int(d.size)
+		}
+		idx.docs[i] = d
+	}
+	for n := get(); n > 0 && err == nil; n-- {
+		b := make([]byte, getMax(maxSize))
+		if err == nil {
+			_, err = io.ReadFull(br, b)
+		}
+		postings := make([]posting, getMax(len(idx.docs)))
+		var prev int
+		for j := range postings {
+			prev += get()
+			d, ok := idx.docs[prev]
+			if err == nil && !ok {
+				err = fmt.Errorf("corrupt index: episode %d isn't indexed", prev)
+			}
+			postings[j] = posting{episode: prev, positions: make([]int, getMax(d.length))}
+			var last int
+			for k := range postings[j].positions {
+				last += get()
+				postings[j].positions[k] = last
+			}
+		}
+		idx.terms[string(b)] = postings
+	}
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// transcriptName returns the name of the copy of episode i's transcript that
+// is kept with the index.
+func transcriptName(i int) string {
+	return indexDir + "/" + assets["txt"].FileName(i)
+}
+
+// transcriptText returns episode i's transcript from the save dir or, if it
+// isn't there, the copy that is kept with the index.
+func transcriptText(c Conf, i int) (string, error) {
+	s := c.Storage()
+	name, err := c.layout.Name(assets["txt"], i)
+	if err != nil {
+		return "", err
+	}
+	b, err := readStorage(s, name)
+	if err != nil && os.IsNotExist(err) {
+		b, err = readStorage(s, transcriptName(i))
+	}
+	return string(b), err
+}
+
+// updateIndex indexes the transcripts of the episodes that aren't indexed or
+// that changed since they were indexed, and saves the index. Transcripts
+// that aren't in the save dir are downloaded and kept with the index; ones
+// that haven't been published aren't indexed. The number of transcripts that
+// were indexed is returned.
+func updateIndex(c Conf, idx *TranscriptIndex, episodes []int) (int, error) {
+	s := c.Storage()
+	txt := assets["txt"]
+	var get []int
+	var n int
+	for _, i := range episodes {
+		// the save dir's copy is used if there is one
+		name, err := c.layout.Name(txt, i)
+		if err != nil {
+			return n, fmt.Errorf("episode %d: %s", i, err)
+		}
+		fi, err := s.Stat(name)
+		if err != nil {
+			fi, err = s.Stat(transcriptName(i))
+		}
+		if err == nil {
+			if idx.Indexed(i, fi.Size) {
+				continue
+			}
+			text, err := transcriptText(c, i)
+			if err != nil {
+				return n, fmt.Errorf("episode %d: %s", i, err)
+			}
+			idx.Add(i, text)
+			n++
+			continue
+		}
+		get = append(get, i)
+	}
+	if len(get) > 0 {
+		fmt.Printf("downloading %d transcripts for the index...\n", len(get))
+	}
+
+	// download the missing transcripts to the index dir
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	work := make(chan int)
+	m := &MP3{storage: s}
+	for j := 0; j < c.ConcurrentDL || j == 0; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				d := m.Download(Download{Name: txt.FileName(i), file: transcriptName(i), URL: txt.URL(i), Episode: i, Asset: txt})
+				if d.err != nil {
+					Verbose(fmt.Sprintf("%s: not indexed: %s", d.Name, d.err))
+					continue
+				}
+				b, err := readStorage(s, d.file)
+				if err != nil {
+					Verbose(fmt.Sprintf("%s: not indexed: %s", d.Name, err))
+					continue
+				}
+				mu.Lock()
+				idx.Add(i, string(b))
+				n++
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, i := range get {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+	if n == 0 {
+		return 0, nil
+	}
+	return n, idx.Save()
+}
+
+// indexDownloads adds the downloaded transcripts to the save dir's transcript
+// index, if it has one.
+func indexDownloads(c Conf, downloads []Download) error {
+	var episodes []int
+	for _, d := range downloads {
+		if d.Asset.Name == "txt" && !d.skipped && d.err == nil {
+			episodes = append(episodes, d.Episode)
+		}
+	}
+	if len(episodes) == 0 || !storageExists(c.Storage(), indexName) {
+		return nil
+	}
+	idx, err := loadIndex(c.Storage())
+	if err != nil {
+		return err
+	}
+	_, err = updateIndex(c, idx, episodes)
+	return err
+}
+
+// snippet returns the words of text around the match that is n words long
+// at pos, with context words before and after it, on one line.
+func snippet(text string, pos, n, context int) string {
+	tokens := tokenize(text)
+	if pos >= len(tokens) {
+		return ""
+	}
+	first := pos - context
+	if first < 0 {
+		first = 0
+	}
+	last := pos + n - 1 + context
+	if last >= len(tokens) {
+		last = len(tokens) - 1
+	}
+	s := strings.Join(strings.Fields(text[tokens[first].start:tokens[last].end]), " ")
+	if first > 0 {
+		s = "..." + s
+	}
+	if last < len(tokens)-1 {
+		s += "..."
+	}
+	return s
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var testTranscripts = map[int]string{
+	498: "Steve: Today we talk about certificates. Certificate authorities sign certificates.",
+	499: "Leo: Secure boot is on every new PC. Steve: And secure boot can be turned off.",
+	500: "Steve: Windows Secure Boot. The boot loader is signed, so boot is secure.",
+	501: "Leo: Passwords again. Steve: Yes, passwords; use a password manager.",
+}
+
+func testIndex() *TranscriptIndex {
+	idx := newIndex(nil)
+	for i, v := range testTranscripts {
+		idx.Add(i, v)
+	}
+	return idx
+}
+
+func TestTokenize(t *testing.T) {
+	tokens := tokenize("Leo: It's SN-500!")
+	expected := []token{{"leo", 0, 3}, {"it", 5, 7}, {"s", 8, 9}, {"sn", 10, 12}, {"500", 13, 16}}
+	if !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("got %v; want %v", tokens, expected)
+	}
+}
+
+func TestIndexSearch(t *testing.T) {
+	idx := testIndex()
+	tests := []struct {
+		query    []string
+		episodes []int
+		expected []int
+	}{
+		{[]string{"secure"}, nil, []int{499, 500}},
+		{[]string{"secure boot"}, nil, []int{499, 500}},
+		{[]string{"boot secure"}, nil, nil},
+		{[]string{"boot loader"}, nil, []int{500}},
+		{[]string{"steve", "passwords"}, nil, []int{501}},
+		{[]string{"Certificates"}, nil, []int{498}},
+		{[]string{"certificate"}, nil, []int{498}},
+		{[]string{"secure"}, []int{500, 501}, []int{500}},
+		{[]string{"quantum"}, nil, nil},
+		{[]string{"secure", "quantum"}, nil, nil},
+	}
+	for i, test := range tests {
+		var got []int
+		for _, h := range idx.Search(parseQuery(test.query), test.episodes) {
+			got = append(got, h.Episode)
+		}
+		// the order is checked separately
+		if len(got) == 2 && got[0] > got[1] {
+			got[0], got[1] = got[1], got[0]
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%d: got %v; want %v", i, got, test.expected)
+		}
+	}
+
+	// the transcript with more matches, relative to its length, ranks first
+	hits := idx.Search(parseQuery([]string{"boot"}), nil)
+	if len(hits) != 2 || hits[0].Episode != 500 || hits[0].Score <= hits[1].Score {
+		t.Errorf("ranking: got %+v; want 500 first", hits)
+	}
+	// the position is the phrase's first match
+	hits = idx.Search(parseQuery([]string{"secure boot"}), []int{499})
+	if len(hits) != 1 || hits[0].Position != 1 || hits[0].Length != 2 {
+		t.Errorf("position: got %+v; want position 1, length 2", hits)
+	}
+}
+
+func TestIndexReplace(t *testing.T) {
+	idx := testIndex()
+	idx.Add(501, "Leo: This week, secure boot.")
+	if hits := idx.Search(parseQuery([]string{"passwords"}), nil); len(hits) != 0 {
+		t.Errorf("the replaced transcript's words are still indexed: %+v", hits)
+	}
+	if hits := idx.Search(parseQuery([]string{"secure boot"}), nil); len(hits) != 3 {
+		t.Errorf("the replacement wasn't indexed: got %d hits; want 3", len(hits))
+	}
+	if idx.Len() != 4 {
+		t.Errorf("len: got %d; want 4", idx.Len())
+	}
+}
+
+func TestIndexSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := localStorage{dir: dir}
+	idx := testIndex()
+	idx.storage = s
+	err = idx.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadIndex(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.docs, idx.docs) {
+		t.Errorf("docs: got %v; want %v", loaded.docs, idx.docs)
+	}
+	if !reflect.DeepEqual(loaded.terms, idx.terms) {
+		t.Errorf("terms: got %v; want %v", loaded.terms, idx.terms)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, filepath.FromSlash(indexName)), []byte("not an index"), 0644)
+	_, err = loadIndex(s)
+	if err == nil {
+		t.Error("loading a bad index: got no error")
+	}
+
+	// an index that was saved since idx was loaded isn't lost
+	os.Remove(filepath.Join(dir, filepath.FromSlash(indexName)))
+	other, err := loadIndex(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Add(502, "Steve: Another transcript.")
+	err = other.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.Add(503, "Leo: And one more.")
+	err = idx.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err = loadIndex(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Indexed(502, 26) || !loaded.Indexed(503, 18) {
+		t.Errorf("concurrent saves: got %v; want 502 and 503 indexed", loaded.docs)
+	}
+}
+
+func TestIndexReadCorrupt(t *testing.T) {
+	tests := []struct {
+		docs  map[int]indexDoc
+		terms map[string][]posting
+	}{
+		// a word that's longer than any transcript
+		{map[int]indexDoc{500: {1, 5}}, map[string][]posting{"certificates": {{500, []int{0}}}}},
+		// more positions than the transcript has words
+		{map[int]indexDoc{500: {1, 5}}, map[string][]posting{"boot": {{500, []int{0, 1, 2}}}}},
+		// a transcript that isn't indexed
+		{map[int]indexDoc{500: {1, 5}}, map[string][]posting{"boot": {{501, []int{0}}}}},
+		// more postings than transcripts
+		{map[int]indexDoc{500: {1, 5}}, map[string][]posting{"boot": {{500, []int{0}}, {500, []int{0}}}}},
+		// more words than bytes
+		{map[int]indexDoc{500: {10, 5}}, nil},
+	}
+	for i, test := range tests {
+		idx := newIndex(nil)
+		idx.docs, idx.terms = test.docs, test.terms
+		var b bytes.Buffer
+		err := idx.write(&b)
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		err = newIndex(nil).read(&b)
+		if err == nil {
+			t.Errorf("%d: got no error", i)
+		}
+	}
+}
+
+func TestUpdateIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/sn-499.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(testTranscripts[499]))
+	}))
+	defer srv.Close()
+	defer func() { TXTURL = grcTXTURL }()
+	TXTURL = srv.URL + "/"
+
+	// 500 is in the save dir, 499 is downloaded, and 501 hasn't been published
+	ioutil.WriteFile(filepath.Join(dir, "sn-500.txt"), []byte(testTranscripts[500]), 0644)
+	c := Conf{SaveDir: dir, ConcurrentDL: 2}
+	idx, _ := loadIndex(c.Storage())
+	n, err := updateIndex(c, idx, []int{499, 500, 501})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("indexed: got %d; want 2", n)
+	}
+	text, err := transcriptText(c, 499)
+	if err != nil || text != testTranscripts[499] {
+		t.Errorf("the downloaded transcript wasn't kept: %q, %v", text, err)
+	}
+
+	// only new or changed transcripts are indexed
+	idx, _ = loadIndex(c.Storage())
+	ioutil.WriteFile(filepath.Join(dir, "sn-500.txt"), []byte("Steve: A corrected transcript."), 0644)
+	requests = 0
+	n, err = updateIndex(c, idx, []int{499, 500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || requests != 0 {
+		t.Errorf("update: got %d indexed, %d requests; want 1, 0", n, requests)
+	}
+	if hits := idx.Search(parseQuery([]string{"corrected"}), nil); len(hits) != 1 {
+		t.Errorf("the changed transcript wasn't indexed")
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	text := "Leo: Hi.\nSteve: Today, we're going to talk about  secure\nboot, which is new."
+	tests := []struct {
+		pos, n, context int
+		expected        string
+	}{
+		{10, 2, 2, "...talk about secure boot, which is..."},
+		{0, 1, 1, "Leo: Hi..."},
+		{12, 1, 3, "...about secure boot, which is new"},
+		{100, 1, 3, ""},
+	}
+	for i, test := range tests {
+		got := snippet(text, test.pos, test.n, test.context)
+		if got != test.expected {
+			t.Errorf("%d: got %q; want %q", i, got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,568 @@
+// Apache License Version 2.0
+// http://www.apache.org/licenses/
+// Copyright (c) 2016 Joel Scoble
+// See LICENSE file for license text.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// relayoutFrom is the layout that relayout moves the files from.
+var relayoutFrom string
+
+func relayoutCommand() *Command {
+	c := newCommand("relayout", "", "move the save directory's files to a new layout", `
+Relayout moves the files in the save directory from their current layout to
+the layout specified by -layout, or the profile's layout. The current layout is
+the one recorded in the save directory's download history; if there isn't one,
+the default layout, {name}, is used. Use -from to specify it.
+
+The layout is a template of each file's path, relative to the save directory,
+with fields in braces; a / separates directories. The fields are:
+
+    {name}        GRC's name for the file, e.g. sn-500-lq.mp3
+    {number}      the episode number; {number:04} pads it with zeros to 4 digits
+    {asset}       the asset: hq, lq, txt, pdf, or notes
+    {ext}         the file's extension: mp3, txt, or pdf
+    {suffix}      the asset's suffix in GRC's names: -lq, -notes, or nothing
+    {year}        the year the episode aired
+    {month}       the month the episode aired: 01-12
+    {day}         the day of the month the episode aired: 01-31
+    {date}        the date the episode aired: YYYY-MM-DD
+    {title}       the episode's title
+    {title-slug}  the episode's title in lower case with words separated by -
+
+e.g. {year}/{number:04}-{title-slug}{suffix}.{ext}. The fields' values are
+sanitized so that they are valid file names on any filesystem. Files that
+would replace an existing file are skipped; if any file would be skipped,
+nothing is moved.
+
+Use -dryrun to list what would be moved.`, runRelayout)
+	c.Flags.StringVar(&relayoutFrom, "from", "", "the save directory's current layout; if empty, the layout in the download history is used")
+	c.Flags.BoolVar(&dryRun, "dryrun", false, "list what would be moved without moving anything")
+	libraryFlags(c.Flags)
+	configFlags(c.Flags, true)
+	mirrorFlag(c.Flags)
+	return c
+}
+
+// runRelayout moves the save dir's files to the conf's layout.
+func runRelayout(cmd *Command, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("relayout: unexpected args: %s", strings.Join(args, " "))
+	}
+	cs, err := confs(cmd.Flags)
+	if err != nil {
+		return err
+	}
+	c := cs[0]
+	err = requireLocal(c, "relayout")
+	if err != nil {
+		return err
+	}
+	lock, err := lockSaveDir(&c)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	h, err := loadHistory(c.Storage())
+	if err != nil {
+		return fmt.Errorf("error loading the download history: %s", err)
+	}
+	tmpl := relayoutFrom
+	if tmpl == "" {
+		tmpl = h.Layout
+	}
+	from, err := ParseLayout(tmpl)
+	if err != nil {
+		return fmt.Errorf("from: %s", err)
+	}
+	if from.String() == c.layout.String() {
+		return fmt.Errorf("relayout: the save dir already uses the layout %q; use -layout to specify the new layout", from)
+	}
+	last, err := lastEpisode()
+	if err != nil {
+		return err
+	}
+	episodes := episodeRange(1, last)
+	for _, l := range []*Layout{from, c.layout} {
+		err = l.Prepare(episodes)
+		if err != nil {
+			return err
+		}
+	}
+
+	moved, skipped, err := relayout(c.SaveDir, from, c.layout, episodes, dryRun)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		fmt.Printf("\n%d files would be moved; %d files would be skipped\n", moved, skipped)
+		return nil
+	}
+	if skipped > 0 {
+		return fmt.Errorf("relayout: %d files would be skipped, so nothing was moved and the save dir's layout wasn't changed", skipped)
+	}
+	fmt.Printf("\n%d files moved\n", moved)
+	h.Layout = c.layout.String()
+	err = h.Save()
+	if err != nil {
+		return fmt.Errorf("error saving the download history: %s", err)
+	}
+	return nil
+}
+
+// relayoutMove is the move of an asset's file, and its sidecars, from one
+// layout to another.
+type relayoutMove struct {
+	a        Asset
+	src, dst string
+	sidecars [][2]string // the sidecars that were moved: src, dst
+}
+
+// relayout moves the files of the episodes' assets in dir from one layout to
+// another. Files that would replace an existing file are skipped; if any file
+// is skipped, nothing is moved, so that the save dir is never left in a mix of
+// the layouts. If a move fails, the files that were moved are moved back. The
+// number of files that were, or would be, moved and skipped are returned. If
+// dryRun is true, what would be moved is printed without moving anything.
+func relayout(dir string, from, to *Layout, episodes []int, dryRun bool) (moved, skipped int, err error) {
+	var moves []relayoutMove
+	for _, i := range episodes {
+		for _, name := range assetNames() {
+			a := assets[name]
+			src, err := from.Path(dir, a, i)
+			if err != nil {
+				fmt.Printf("%s: skipped, %s\n", a.FileName(i), err)
+				skipped++
+				continue
+			}
+			dst, err := to.Path(dir, a, i)
+			if err != nil {
+				if exists(src) {
+					fmt.Printf("%s: skipped, %s\n", src, err)
+					skipped++
+				}
+				continue
+			}
+			if src == dst || !exists(src) {
+				continue
+			}
+			if exists(dst) {
+				fmt.Printf("%s: skipped, %s exists\n", src, dst)
+				skipped++
+				continue
+			}
+			moves = append(moves, relayoutMove{a: a, src: src, dst: dst})
+		}
+	}
+	if dryRun {
+		for _, m := range moves {
+			fmt.Printf("%s: would be moved to %s\n", m.src, m.dst)
+		}
+		return len(moves), skipped, nil
+	}
+	if skipped > 0 {
+		return 0, skipped, nil
+	}
+	for j := range moves {
+		err = moves[j].move(dir)
+		if err != nil {
+			for k := j; k >= 0; k-- {
+				rerr := moves[k].undo(dir)
+				if rerr != nil {
+					fmt.Printf("%s: error moving it back from %s: %s\n", moves[k].src, moves[k].dst, rerr)
+				}
+			}
+			return 0, skipped, err
+		}
+		fmt.Printf("%s: moved to %s\n", moves[j].src, moves[j].dst)
+	}
+	return len(moves), skipped, nil
+}
+
+// move moves the file, and its sidecars, to its new place in dir.
+func (m *relayoutMove) move(dir string) error {
+	err := os.MkdirAll(filepath.Dir(m.dst), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(m.src, m.dst)
+	if err != nil {
+		return err
+	}
+	for _, f := range sidecarFormats {
+		ssrc, sdst := sidecarName(m.src, m.a, f), sidecarName(m.dst, m.a, f)
+		if ssrc == "" || !exists(ssrc) || exists(sdst) {
+			continue
+		}
+		err = os.Rename(ssrc, sdst)
+		if err != nil {
+			return err
+		}
+		m.sidecars = append(m.sidecars, [2]string{ssrc, sdst})
+	}
+	removeEmptyDirs(filepath.Dir(m.src), dir)
+	return nil
+}
+
+// undo moves the file, and the sidecars that were moved, back to their
+// places in dir; what wasn't moved is left as is.
+func (m *relayoutMove) undo(dir string) error {
+	for _, v := range m.sidecars {
+		err := os.Rename(v[1], v[0])
+		if err != nil {
+			return err
+		}
+	}
+	m.sidecars = nil
+	if !exists(m.dst) {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(m.src), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(m.dst, m.src)
+	if err != nil {
+		return err
+	}
+	removeEmptyDirs(filepath.Dir(m.dst), dir)
+	return nil
+}
+
+// removeEmptyDirs removes dir, and its parents, up to, but not including,
+// root, as long as they are empty.
+func removeEmptyDirs(dir, root string) {
+	root = filepath.Clean(root)
+	for dir = filepath.Clean(dir); dir != root && strings.HasPrefix(dir, root+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+// defaultLayout is the default layout: every file in the save dir using GRC's
+// names, e.g. sn-500.mp3.
+const defaultLayout = "{name}"
+
+// layoutFields are the fields that can be used in a layout's template. The
+// fields that need the episode archive are true.
+var layoutFields = map[string]bool{
+	"name":       false, // GRC's name for the file, e.g. sn-500-lq.mp3
+	"number":     false, // the episode number; {number:04} pads it with zeros to 4 digits
+	"asset":      false, // the asset: hq, lq, txt, pdf, or notes
+	"ext":        false, // the file's extension, without the dot: mp3, txt, or pdf
+	"suffix":     false, // the asset's suffix in GRC's names: -lq, -notes, or nothing
+	"year":       true,  // the year the episode aired
+	"month":      true,  // the month the episode aired: 01-12
+	"day":        true,  // the day of the month the episode aired: 01-31
+	"date":       true,  // the date the episode aired: YYYY-MM-DD
+	"title":      true,  // the episode's title
+	"title-slug": true,  // the episode's title in lower case with words separated by -
+}
+
+// Layout is where an episode's files are in the save dir. It's a template of
+// the path, relative to the save dir, with fields in braces, e.g.
+// {year}/{number:04}-{title-slug}{suffix}.{ext}; a / separates directories.
+// The field values are sanitized so that they are valid file names on any
+// filesystem.
+//
+// If a field that needs the episode archive is used, an episode's files can
+// only be named once the episode is in the archive.
+type Layout struct {
+	template string
+	parts    []layoutPart
+	catalog  bool // whether the episode archive is used
+
+	lookup func(i int) (Episode, error) // looks up an episode in the archive; if nil, the run's catalog is used
+}
+
+// layoutPart is either a literal or a field of a layout's template.
+type layoutPart struct {
+	literal string
+	field   string
+	width   int // for number, the width to pad it to with zeros
+}
+
+// ParseLayout parses a layout template. An empty template is the default
+// layout.
+func ParseLayout(s string) (*Layout, error) {
+	if s == "" {
+		s = defaultLayout
+	}
+	l := &Layout{template: s}
+	if strings.HasPrefix(s, "/") || strings.Contains(s, "\\") {
+		return nil, fmt.Errorf("layout %q: must be a relative path using / to separate directories", s)
+	}
+	for _, v := range strings.Split(s, "/") {
+		if v == "" || v == "." || v == ".." {
+			return nil, fmt.Errorf("layout %q: %q is not a valid directory name", s, v)
+		}
+	}
+	rest := s
+	for rest != "" {
+		i := strings.IndexByte(rest, '{')
+		if i < 0 {
+			l.parts = append(l.parts, layoutPart{literal: rest})
+			break
+		}
+		if i > 0 {
+			l.parts = append(l.parts, layoutPart{literal: rest[:i]})
+		}
+		j := strings.IndexByte(rest[i:], '}')
+		if j < 0 {
+			return nil, fmt.Errorf("layout %q: unclosed {", s)
+		}
+		p, err := parseLayoutField(rest[i+1 : i+j])
+		if err != nil {
+			return nil, fmt.Errorf("layout %q: %s", s, err)
+		}
+		l.catalog = l.catalog || layoutFields[p.field]
+		l.parts = append(l.parts, p)
+		rest = rest[i+j+1:]
+	}
+	for _, p := range l.parts {
+		if strings.ContainsAny(p.literal, "}") {
+			return nil, fmt.Errorf("layout %q: } without a {", s)
+		}
+	}
+	// every asset of an episode must have its own file
+	e := Episode{Number: 1, Title: "Title", Date: time.Date(2005, 8, 19, 0, 0, 0, 0, time.UTC)}
+	seen := make(map[string]string)
+	for _, name := range assetNames() {
+		p := l.render(assets[name], e)
+		if other, ok := seen[p]; ok {
+			return nil, fmt.Errorf("layout %q: the %s and %s files have the same name; use {suffix} or {asset}", s, other, name)
+		}
+		seen[p] = name
+	}
+	// the episodes must have their own files
+	for _, p := range l.parts {
+		if p.field == "number" || p.field == "name" {
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("layout %q: the episodes don't have their own names; use {number} or {name}", s)
+}
+
+// parseLayoutField parses a field, without its braces, e.g. number:04.
+func parseLayoutField(s string) (layoutPart, error) {
+	p := layoutPart{field: s}
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		p.field = s[:i]
+		if p.field != "number" {
+			return p, fmt.Errorf("{%s}: only number has a width", s)
+		}
+		n, err := strconv.Atoi(s[i+1:])
+		if err != nil || n < 1 || n > 9 {
+			return p, fmt.Errorf("{%s}: the width must be between 1 and 9", s)
+		}
+		p.width = n
+	}
+	if _, ok := layoutFields[p.field]; !ok {
+		return p, fmt.Errorf("unknown field {%s}", p.field)
+	}
+	return p, nil
+}
+
+// String returns the layout's template.
+func (l *Layout) String() string {
+	if l == nil {
+		return defaultLayout
+	}
+	return l.template
+}
+
+// UsesCatalog returns whether the layout uses the episode archive.
+func (l *Layout) UsesCatalog() bool {
+	return l != nil && l.catalog
+}
+
+// IsDefault returns whether the layout is the default layout.
+func (l *Layout) IsDefault() bool {
+	return l.String() == defaultLayout
+}
+
+// Path returns the path of asset a of episode i within dir. A nil Layout is
+// the default layout.
+func (l *Layout) Path(dir string, a Asset, i int) (string, error) {
+	name, err := l.Name(a, i)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.FromSlash(name)), nil
+}
+
+// Name returns the slash separated name, relative to the save dir, of asset
+// a of episode i. If the layout uses the episode archive, an error is
+// returned when the episode can't be looked up in it, as where the file
+// belongs isn't known; falling back to another name would put the file where
+// it won't be found once the episode is in the archive.
+func (l *Layout) Name(a Asset, i int) (string, error) {
+	if l == nil {
+		return a.FileName(i), nil
+	}
+	if !l.catalog {
+		return l.render(a, Episode{Number: i}), nil
+	}
+	e, err := l.episode(i)
+	if err == errNotFound {
+		return "", fmt.Errorf("episode %d isn't in the episode archive yet; the layout %q needs it", i, l.template)
+	}
+	if err != nil {
+		return "", fmt.Errorf("the layout uses the episode archive: %s", err)
+	}
+	return l.render(a, e), nil
+}
+
+// Prepare makes sure that the episode archive has been retrieved for the
+// episodes, if the layout uses it, so that a run fails before anything is
+// done when it can't be. Episodes that aren't in the archive yet are left to
+// Name, which fails for them.
+func (l *Layout) Prepare(episodes []int) error {
+	if l == nil || !l.catalog {
+		return nil
+	}
+	for _, i := range episodes {
+		_, err := l.episode(i)
+		if err != nil && err != errNotFound {
+			return fmt.Errorf("the layout uses the episode archive: %s", err)
+		}
+	}
+	return nil
+}
+
+// episode returns episode i from the episode archive. If the episode isn't
+// in it, errNotFound is returned.
+func (l *Layout) episode(i int) (Episode, error) {
+	lookup := l.lookup
+	if lookup == nil {
+		lookup = catalogEpisode
+	}
+	return lookup(i)
+}
+
+// catalogEpisode returns episode i from the run's catalog. The main archive
+// page is checked first; if the episode isn't on it, every year's archive page
+// is checked.
+func catalogEpisode(i int) (Episode, error) {
+	e, ok, err := runCatalog.Episode(i)
+	if err != nil {
+		return Episode{}, err
+	}
+	if ok && !e.Date.IsZero() {
+		return e, nil
+	}
+	e, ok, err = runCatalog.Episode(i, allYears(time.Now())...)
+	if err != nil {
+		return Episode{}, err
+	}
+	if !ok || e.Date.IsZero() {
+		return Episode{}, errNotFound
+	}
+	return e, nil
+}
+
+// render returns the path, using /, of asset a of episode e.
+func (l *Layout) render(a Asset, e Episode) string {
+	var b bytes.Buffer
+	for _, p := range l.parts {
+		if p.field == "" {
+			b.WriteString(p.literal)
+			continue
+		}
+		b.WriteString(sanitizeName(l.field(p, a, e)))
+	}
+	// a field's value may have been the whole name of a directory or file
+	names := strings.Split(b.String(), "/")
+	for i, v := range names {
+		if strings.Trim(v, " .") == "" {
+			names[i] = "_"
+		}
+	}
+	return path.Join(names...)
+}
+
+// field returns the value of the field for asset a of episode e.
+func (l *Layout) field(p layoutPart, a Asset, e Episode) string {
+	switch p.field {
+	case "name":
+		return a.FileName(e.Number)
+	case "number":
+		return fmt.Sprintf("%0*d", p.width, e.Number)
+	case "asset":
+		return a.Name
+	case "ext":
+		return strings.TrimPrefix(path.Ext(a.format), ".")
+	case "suffix":
+		return assetSuffix(a)
+	case "year":
+		return strconv.Itoa(e.Date.Year())
+	case "month":
+		return fmt.Sprintf("%02d", e.Date.Month())
+	case "day":
+		return fmt.Sprintf("%02d", e.Date.Day())
+	case "date":
+		return e.Date.Format("2006-01-02")
+	case "title":
+		return e.Title
+	case "title-slug":
+		return slug(e.Title)
+	}
+	return ""
+}
+
+// assetSuffix returns the part of the asset's GRC name that distinguishes it
+// from the other assets with the same extension, e.g. -lq.
+func assetSuffix(a Asset) string {
+	ext := path.Ext(a.format)
+	return strings.TrimSuffix(strings.TrimPrefix(a.format, "sn-%03d"), ext)
+}
+
+// maxNameLen is the maximum length of a sanitized field value.
+const maxNameLen = 120
+
+// sanitizeName returns s with the characters that aren't valid in file
+// names, on any filesystem, replaced with _; leading and trailing spaces and
+// dots are removed.
+func sanitizeName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return '_'
+		}
+		return r
+	}, s)
+	if r := []rune(s); len(r) > maxNameLen {
+		s = string(r[:maxNameLen])
+	}
+	return strings.Trim(s, " .")
+}
+
+// slug returns s in lower case with only its letters and numbers; words are
+// separated by -.
+func slug(s string) string {
+	return strings.Join(titleWords(s), "-")
+}
+
+// titleWords returns the words of s, in lower case, with only their letters
+// and numbers.
+func titleWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9')
+	})
+}
+
+// Path returns the path of asset a of episode i using the conf's save dir and
+// layout. Everything that needs to locate an episode's file should use this.
+func (c Conf) Path(a Asset, i int) (string, error) {
+	return c.layout.Path(c.SaveDir, a, i)
+}
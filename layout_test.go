@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseLayout(t *testing.T) {
+	tests := []struct {
+		template    string
+		expectedErr string
+	}{
+		{"", ""},
+		{"{name}", ""},
+		{"{year}/{number:04}-{title-slug}{suffix}.{ext}", ""},
+		{"{asset}/{number}.{ext}", ""},
+		{"/{name}", `layout "/{name}": must be a relative path using / to separate directories`},
+		{"../{name}", `layout "../{name}": ".." is not a valid directory name`},
+		{"{year}//{name}", `layout "{year}//{name}": "" is not a valid directory name`},
+		{"{name", `layout "{name": unclosed {`},
+		{"name}", `layout "name}": } without a {`},
+		{"{episode}", `layout "{episode}": unknown field {episode}`},
+		{"{year:4}/{name}", `layout "{year:4}/{name}": {year:4}: only number has a width`},
+		{"{number:x}{suffix}.{ext}", `layout "{number:x}{suffix}.{ext}": {number:x}: the width must be between 1 and 9`},
+		{"{number}.{ext}", `layout "{number}.{ext}": the hq and lq files have the same name; use {suffix} or {asset}`},
+		{"{title}{suffix}.{ext}", `layout "{title}{suffix}.{ext}": the episodes don't have their own names; use {number} or {name}`},
+	}
+	for i, test := range tests {
+		_, err := ParseLayout(test.template)
+		if err != nil {
+			if err.Error() != test.expectedErr {
+				t.Errorf("%d: got %q; want %q", i, err, test.expectedErr)
+			}
+			continue
+		}
+		if test.expectedErr != "" {
+			t.Errorf("%d: got no error; want %q", i, test.expectedErr)
+		}
+	}
+}
+
+func TestLayoutPath(t *testing.T) {
+	cat := Catalog{
+		500:  Episode{Number: 500, Title: "Windows Secure Boot", Date: time.Date(2015, 3, 24, 0, 0, 0, 0, time.UTC)},
+		1000: Episode{Number: 1000, Title: `What's "Next"? A/B: <Testing>...`, Date: time.Date(2024, 11, 26, 0, 0, 0, 0, time.UTC)},
+	}
+	lookup := func(i int) (Episode, error) {
+		if i == 502 {
+			return Episode{}, errors.New("the archive can't be retrieved")
+		}
+		e, ok := cat[i]
+		if !ok {
+			return e, errNotFound
+		}
+		return e, nil
+	}
+	tests := []struct {
+		template string
+		asset    string
+		episode  int
+		expected string
+		err      bool
+	}{
+		{"{name}", "hq", 500, "sn-500.mp3", false},
+		{"{name}", "lq", 1000, "sn-1000-lq.mp3", false},
+		{"{asset}/{name}", "txt", 42, "txt/sn-042.txt", false},
+		{"{year}/{number:04}-{title-slug}{suffix}.{ext}", "hq", 500, "2015/0500-windows-secure-boot.mp3", false},
+		{"{year}/{number:04}-{title-slug}{suffix}.{ext}", "notes", 500, "2015/0500-windows-secure-boot-notes.pdf", false},
+		{"{year}/{month}/{number} {date} {title}{suffix}.{ext}", "lq", 1000, "2024/11/1000 2024-11-26 What's _Next__ A_B_ _Testing_-lq.mp3", false},
+		// without the archive, where the files belong isn't known
+		{"{year}/{number:04}-{title-slug}{suffix}.{ext}", "hq", 501, "", true},
+		{"{year}/{number:04}-{title-slug}{suffix}.{ext}", "hq", 502, "", true},
+		{"{number:04}{suffix}.{ext}", "hq", 502, "0502.mp3", false},
+	}
+	for i, test := range tests {
+		l, err := ParseLayout(test.template)
+		if err != nil {
+			t.Errorf("%d: unexpected error: %s", i, err)
+			continue
+		}
+		l.lookup = lookup
+		p, err := l.Path("lib", assets[test.asset], test.episode)
+		if err != nil {
+			if !test.err {
+				t.Errorf("%d: unexpected error: %s", i, err)
+			}
+			continue
+		}
+		if test.err {
+			t.Errorf("%d: got %q; want an error", i, p)
+			continue
+		}
+		expected := filepath.Join("lib", filepath.FromSlash(test.expected))
+		if p != expected {
+			t.Errorf("%d: got %q; want %q", i, p, expected)
+		}
+	}
+}
+
+func TestRelayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	from, _ := ParseLayout("{name}")
+	to, _ := ParseLayout("{asset}/{number:04}{suffix}.{ext}")
+	for _, name := range []string{"sn-001.mp3", "sn-001.nfo", "sn-001.txt", "sn-001.txt.json", "sn-002-lq.mp3", "hq/0002.mp3", "sn-002.mp3"} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(p), 0755)
+		err = ioutil.WriteFile(p, []byte(name), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// sn-002.mp3 would replace hq/0002.mp3, so nothing is moved
+	moved, skipped, err := relayout(dir, from, to, []int{1, 2}, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if moved != 0 || skipped != 1 {
+		t.Errorf("got %d moved, %d skipped; want 0 moved, 1 skipped", moved, skipped)
+	}
+	for _, name := range []string{"sn-001.mp3", "sn-001.nfo", "sn-001.txt", "sn-001.txt.json", "sn-002-lq.mp3", "sn-002.mp3"} {
+		if !exists(filepath.Join(dir, filepath.FromSlash(name))) {
+			t.Errorf("%s: was moved", name)
+		}
+	}
+	b, _ := ioutil.ReadFile(filepath.Join(dir, "hq", "0002.mp3"))
+	if string(b) != "hq/0002.mp3" {
+		t.Errorf("hq/0002.mp3 was replaced")
+	}
+
+	err = os.Remove(filepath.Join(dir, "hq", "0002.mp3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved, skipped, err = relayout(dir, from, to, []int{1, 2}, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if moved != 4 || skipped != 0 {
+		t.Errorf("got %d moved, %d skipped; want 4 moved, 0 skipped", moved, skipped)
+	}
+	for _, name := range []string{"hq/0001.mp3", "hq/0001.nfo", "txt/0001.txt", "txt/0001.txt.json", "lq/0002-lq.mp3", "hq/0002.mp3"} {
+		if !exists(filepath.Join(dir, filepath.FromSlash(name))) {
+			t.Errorf("%s: doesn't exist", name)
+		}
+	}
+}
+
+func TestRelayoutUndo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"sn-001.mp3", "sn-001.nfo", "sn-002-lq.mp3"} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	from, _ := ParseLayout("{name}")
+	to, _ := ParseLayout("{asset}/{number:04}{suffix}.{ext}")
+	// a file where the dir for episode 2's file would be makes its move fail
+	err = ioutil.WriteFile(filepath.Join(dir, "lq"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = relayout(dir, from, to, []int{1, 2}, false)
+	if err == nil {
+		t.Fatal("got no error; want one")
+	}
+	if exists(filepath.Join(dir, "hq")) {
+		t.Error("hq: the moved file's dir wasn't removed")
+	}
+	for _, name := range []string{"sn-001.mp3", "sn-001.nfo", "sn-002-lq.mp3"} {
+		if !exists(filepath.Join(dir, name)) {
+			t.Errorf("%s: wasn't moved back", name)
+		}
+	}
+}
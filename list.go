@@ -0,0 +1,210 @@
+// Apache License Version 2.0
+// http://www.apache.org/licenses/
+// Copyright (c) 2016 Joel Scoble
+// See LICENSE file for license text.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// localOnly restricts listings to the episodes that are in the save dir.
+var localOnly bool
+
+func listCommand() *Command {
+	c := newCommand("list", "", "list episodes", `
+List lists the episodes' numbers, air dates, and titles along with which of the
+assets are in the save directory. By default, the last 10 episodes are listed.
+
+With -state, only the episodes in those played states are listed, e.g.
+-state unplayed,inprogress; see "snow help mark".`, runList)
+	rangeFlags(c.Flags, 10)
+	libraryFlags(c.Flags)
+	configFlags(c.Flags, true)
+	mirrorFlag(c.Flags)
+	c.Flags.BoolVar(&localOnly, "local", false, "only list episodes that have at least one of the assets in the save directory")
+	stateFilterFlag(c.Flags)
+	return c
+}
+
+func searchCommand() *Command {
+	c := newCommand("search", "terms...", "search episode titles and descriptions", `
+Search lists the episodes whose title or description contains all of the
+terms; the search is case-insensitive. By default, all episodes are searched.
+
+With -transcripts, the episodes' transcripts are searched instead; this is the
+same as grep.`, runSearch)
+	rangeFlags(c.Flags, 0)
+	libraryFlags(c.Flags)
+	configFlags(c.Flags, true)
+	mirrorFlag(c.Flags)
+	c.Flags.BoolVar(&localOnly, "local", false, "only list episodes that have at least one of the assets in the save directory")
+	c.Flags.BoolVar(&transcripts, "transcripts", false, "search the transcripts; see snow help grep")
+	stateFilterFlag(c.Flags)
+	grepFlags(c.Flags)
+	return c
+}
+
+// runList lists the selected episodes.
+func runList(cmd *Command, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("list: unexpected args: %s", strings.Join(args, " "))
+	}
+	return listEpisodes(cmd, nil)
+}
+
+// runSearch lists the selected episodes that match the search terms.
+func runSearch(cmd *Command, args []string) error {
+	if len(args) == 0 {
+		return errors.New("search: nothing to search for")
+	}
+	if transcripts {
+		c, cat, err := selected(cmd)
+		if err != nil {
+			return err
+		}
+		c.episodes, err = filterStates(c, c.episodes)
+		if err != nil {
+			return err
+		}
+		return grepTranscripts(c, cat, args)
+	}
+	var terms []string
+	for _, v := range args {
+		terms = append(terms, strings.Fields(strings.ToLower(v))...)
+	}
+	return listEpisodes(cmd, func(e Episode) bool {
+		return matchTerms(e, terms)
+	})
+}
+
+// matchTerms returns whether the episode's title or description contains all
+// of the terms; the terms must be lower case.
+func matchTerms(e Episode, terms []string) bool {
+	s := strings.ToLower(e.Title + " " + e.Description)
+	for _, t := range terms {
+		if !strings.Contains(s, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// listEpisodes prints the episodes selected by the command's flags. If match
+// isn't nil, only the episodes that it matches are printed.
+func listEpisodes(cmd *Command, match func(Episode) bool) error {
+	c, cat, err := selected(cmd)
+	if err != nil {
+		return err
+	}
+	episodes, err := filterStates(c, c.episodes)
+	if err != nil {
+		return err
+	}
+	var n int
+	for _, i := range episodes {
+		e, ok := cat[i]
+		if !ok {
+			e = Episode{Number: i}
+		}
+		if match != nil && !match(e) {
+			continue
+		}
+		local, err := localAssets(c, i)
+		if err != nil {
+			return err
+		}
+		if localOnly && len(local) == 0 {
+			continue
+		}
+		fmt.Println(episodeLine(e, local))
+		n++
+	}
+	Verbose(fmt.Sprintf("%d episodes listed", n))
+	return nil
+}
+
+// selected returns the conf, with its episodes resolved, for the command's
+// flags along with the catalog for those episodes.
+func selected(cmd *Command) (Conf, Catalog, error) {
+	cs, err := confs(cmd.Flags)
+	if err != nil {
+		return Conf{}, nil, err
+	}
+	c := cs[0]
+	last, err := lastEpisode()
+	if err != nil {
+		return c, nil, err
+	}
+	err = resolveEpisodes(&c, last)
+	if err != nil {
+		return c, nil, err
+	}
+	cat, err := catalogFor(c.episodes)
+	if err != nil {
+		return c, nil, fmt.Errorf("error getting the episode catalog: %s", err)
+	}
+	return c, cat, nil
+}
+
+// catalogFor returns a catalog that has the passed episodes. The main archive
+// page is checked first; if any of the episodes aren't on it, the archive
+// pages for every year are checked.
+func catalogFor(episodes []int) (Catalog, error) {
+	cat, err := runCatalog.Get()
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range episodes {
+		if _, ok := cat[i]; !ok {
+			return runCatalog.Get(allYears(time.Now())...)
+		}
+	}
+	return cat, nil
+}
+
+// allYears returns every year that has episodes; now is the current time.
+func allYears(now time.Time) []int {
+	var years []int
+	for y := FirstYear; y <= now.Year(); y++ {
+		years = append(years, y)
+	}
+	return years
+}
+
+// localAssets returns the names of the conf's assets that are in the save
+// dir for episode i.
+func localAssets(c Conf, i int) ([]string, error) {
+	var names []string
+	for _, a := range c.assets {
+		name, err := c.layout.Name(a, i)
+		if err != nil {
+			return nil, err
+		}
+		_, err = c.Storage().Stat(name)
+		if err == nil {
+			names = append(names, a.Name)
+		}
+	}
+	return names, nil
+}
+
+// episodeLine returns the listing line for an episode.
+func episodeLine(e Episode, local []string) string {
+	date := "          "
+	if !e.Date.IsZero() {
+		date = e.Date.Format("2006-01-02")
+	}
+	title := e.Title
+	if title == "" {
+		title = "(not in the episode archive)"
+	}
+	s := fmt.Sprintf("%4d  %s  %s", e.Number, date, title)
+	if len(local) > 0 {
+		s += fmt.Sprintf("  [%s]", strings.Join(local, " "))
+	}
+	return s
+}
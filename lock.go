@@ -0,0 +1,336 @@
+// Apache License Version 2.0
+// http://www.apache.org/licenses/
+// Copyright (c) 2016 Joel Scoble
+// See LICENSE file for license text.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	lockName    = ".snow.lock"          // the name of the save dir's lock file
+	mutexName   = ".snow.mutex"         // the name of the save dir's mutex file
+	exitLocked  = 3                     // the exit code used when the save dir is locked by another snow
+	lockPoll    = 2 * time.Second       // how often a locked save dir is checked when waiting for it
+	mutexPoll   = 50 * time.Millisecond // how often a held mutex is checked
+	mutexMaxAge = time.Minute           // how long a mutex can be held; older ones were left by snows that died
+)
+
+// What to do when the save dir is locked by another snow.
+const (
+	onLockExit = "exit" // exit with exitLocked
+	onLockWait = "wait" // wait for the other snow to finish
+	onLockSkip = "skip" // only process the episodes that the other snow isn't processing
+)
+
+// ownClaims are the names of the claims that this snow holds. A snow's own
+// claims don't conflict with each other, so that it can process an episode's
+// assets concurrently, e.g. the mirror's fetches.
+var ownClaims = struct {
+	sync.Mutex
+	names map[string]bool
+}{names: make(map[string]bool)}
+
+// claimSeq numbers this snow's claims so that each has a unique name.
+var claimSeq int64
+
+// lockedError is returned when the save dir is locked by another snow.
+type lockedError struct {
+	dir string
+	pid int
+}
+
+func (e *lockedError) Error() string {
+	return fmt.Sprintf("%s is in use by another snow, pid %d; use -onlock wait or -onlock skip to run anyway", e.dir, e.pid)
+}
+
+// dirLock is a held lock, or claim, on a save dir.
+type dirLock struct {
+	storage Storage
+	name    string // the name of the lock file
+}
+
+// Unlock releases the lock.
+func (l *dirLock) Unlock() error {
+	if l.name == "" {
+		return nil
+	}
+	ownClaims.Lock()
+	delete(ownClaims.names, l.name)
+	ownClaims.Unlock()
+	return l.storage.Remove(l.name)
+}
+
+// lockOwner is the contents of a lock file: the snow that holds it, when it
+// was created, and the episodes that it's processing.
+type lockOwner struct {
+	name     string
+	pid      int
+	host     string
+	created  time.Time
+	episodes []int
+}
+
+// claims returns whether the owner is processing any of the episodes.
+func (o lockOwner) claims(episodes []int) bool {
+	for _, i := range o.episodes {
+		for _, j := range episodes {
+			if i == j {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// lockSaveDir locks c's save dir for processing c's episodes. The lock is
+// advisory: it only keeps snows from processing the same episodes at the
+// same time. A lock whose snow is no longer running is stale and is removed.
+// If the save dir is locked, or other snows have claimed some of c's
+// episodes, c.onLock determines what happens: by default a lockedError is
+// returned; with wait, this waits for the lock; with skip, the episodes that
+// are being processed by other snows are removed from c.episodes and the rest
+// are claimed. The lock files are in the save dir, whether it's a local dir
+// or in an object store.
+func lockSaveDir(c *Conf) (*dirLock, error) {
+	var waiting bool
+	for {
+		l, owner, err := tryLock(c)
+		if err != nil {
+			return nil, err
+		}
+		if l != nil {
+			return l, nil
+		}
+		switch c.onLock {
+		case onLockWait:
+			if !waiting {
+				fmt.Fprintf(messages, "waiting for snow, pid %d, to finish with %s\n", owner.pid, c.SaveDir)
+				waiting = true
+			}
+			time.Sleep(lockPoll)
+		case onLockSkip:
+			return claimEpisodes(c)
+		default:
+			return nil, &lockedError{dir: c.SaveDir, pid: owner.pid}
+		}
+	}
+}
+
+// tryLock locks c's save dir unless another snow holds the lock or has
+// claimed some of c's episodes; then that snow is returned instead.
+func tryLock(c *Conf) (*dirLock, lockOwner, error) {
+	s := c.Storage()
+	m, err := lockMutex(s)
+	if err != nil {
+		return nil, lockOwner{}, fmt.Errorf("error locking %s: %s", c.SaveDir, err)
+	}
+	defer m.Unlock()
+	owners, err := readLocks(s)
+	if err != nil {
+		return nil, lockOwner{}, err
+	}
+	for _, owner := range owners {
+		if owner.name == lockName || owner.claims(c.episodes) {
+			return nil, owner, nil
+		}
+	}
+	l, err := createLock(s, lockName, c.episodes)
+	if err != nil {
+		return nil, lockOwner{}, fmt.Errorf("error locking %s: %s", c.SaveDir, err)
+	}
+	return l, lockOwner{}, nil
+}
+
+// claimEpisodes removes the episodes that are claimed by other snows from
+// c.episodes and claims the rest. This snow's own claims are ignored; each
+// claim has its own lock file.
+func claimEpisodes(c *Conf) (*dirLock, error) {
+	s := c.Storage()
+	m, err := lockMutex(s)
+	if err != nil {
+		return nil, fmt.Errorf("error locking %s: %s", c.SaveDir, err)
+	}
+	defer m.Unlock()
+	owners, err := readLocks(s)
+	if err != nil {
+		return nil, err
+	}
+	claimed := make(map[int]bool)
+	ownClaims.Lock()
+	defer ownClaims.Unlock()
+	for _, owner := range owners {
+		if ownClaims.names[owner.name] {
+			continue
+		}
+		for _, i := range owner.episodes {
+			claimed[i] = true
+		}
+	}
+	var episodes []int
+	for _, i := range c.episodes {
+		if claimed[i] {
+			Verbose(fmt.Sprintf("episode %d is being processed by another snow", i))
+			continue
+		}
+		episodes = append(episodes, i)
+	}
+	if len(episodes) == 0 {
+		return nil, fmt.Errorf("Nothing to do: all of the episodes are being processed by another snow.")
+	}
+	c.episodes = episodes
+	l, err := createLock(s, fmt.Sprintf("%s.%d.%d", lockName, os.Getpid(), atomic.AddInt64(&claimSeq, 1)), episodes)
+	if err != nil {
+		return nil, err
+	}
+	ownClaims.names[l.name] = true
+	return l, nil
+}
+
+// readLocks returns the owners of the save dir's lock and claims, in s; the
+// stale ones are removed. The caller must hold the save dir's mutex.
+func readLocks(s Storage) ([]lockOwner, error) {
+	var names []string
+	if s.Local() {
+		// listing a local dir walks the whole library
+		paths, err := filepath.Glob(s.Path(lockName + "*"))
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range paths {
+			names = append(names, filepath.Base(p))
+		}
+	} else {
+		files, err := s.List(lockName)
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range files {
+			names = append(names, fi.Name)
+		}
+	}
+	var owners []lockOwner
+	for _, name := range names {
+		owner, err := readLock(s, name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("error reading the lock: %s", err)
+		}
+		if owner.stale() {
+			Verbose(fmt.Sprintf("removing the stale lock of pid %d", owner.pid))
+			err = s.Remove(name)
+			if err != nil && !os.IsNotExist(err) {
+				return nil, fmt.Errorf("error removing the stale lock: %s", err)
+			}
+			continue
+		}
+		owners = append(owners, owner)
+	}
+	return owners, nil
+}
+
+// lockMutex takes the save dir's mutex, in s, which makes checking and
+// creating locks, and reloading and saving the history, atomic; it's only
+// held briefly. A mutex whose snow is no longer running, or that is older
+// than mutexMaxAge, is removed.
+func lockMutex(s Storage) (*dirLock, error) {
+	for {
+		l, err := createLock(s, mutexName, nil)
+		if err == nil {
+			return l, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		owner, err := readLock(s, mutexName)
+		if err == nil && (owner.stale() || (!owner.created.IsZero() && time.Since(owner.created) > mutexMaxAge)) {
+			s.Remove(mutexName)
+			continue
+		}
+		time.Sleep(mutexPoll)
+	}
+}
+
+// createLock creates the named lock file in s; the lock file must not exist.
+func createLock(s Storage, name string, episodes []int) (*dirLock, error) {
+	var b bytes.Buffer
+	host, _ := os.Hostname()
+	fmt.Fprintf(&b, "%d %s %s\n", os.Getpid(), host, time.Now().UTC().Format(time.RFC3339))
+	for _, i := range episodes {
+		fmt.Fprintf(&b, "%d\n", i)
+	}
+	err := s.CreateExclusive(name, b.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return &dirLock{storage: s, name: name}, nil
+}
+
+// readLock reads the named lock file in s. A lock file that was just created
+// may not have been written yet; its owner's pid is 0.
+func readLock(s Storage, name string) (lockOwner, error) {
+	owner := lockOwner{name: name}
+	b, err := readStorage(s, name)
+	if err != nil {
+		return owner, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	fields := strings.Fields(lines[0])
+	if len(fields) > 0 {
+		owner.pid, _ = strconv.Atoi(fields[0])
+	}
+	if len(fields) > 1 {
+		owner.host = fields[1]
+	}
+	if len(fields) > 2 {
+		owner.created, _ = time.Parse(time.RFC3339, fields[2])
+	}
+	for _, v := range lines[1:] {
+		i, err := strconv.Atoi(strings.TrimSpace(v))
+		if err == nil {
+			owner.episodes = append(owner.episodes, i)
+		}
+	}
+	return owner, nil
+}
+
+// stale returns whether the lock's snow is no longer running. Locks held by
+// snows on other hosts, e.g. when the save dir is on a NAS, can't be checked
+// so they are never stale.
+func (o lockOwner) stale() bool {
+	if o.pid <= 0 {
+		return false
+	}
+	host, _ := os.Hostname()
+	if o.host != host {
+		return false
+	}
+	return !processExists(o.pid)
+}
+
+// processExists returns whether the process with the pid is running.
+func processExists(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// on Windows, finding the process is the check
+	if runtime.GOOS == "windows" {
+		return true
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLockSaveDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, lockName)
+
+	c := Conf{SaveDir: dir, episodes: []int{498, 499, 500}, onLock: onLockExit}
+	l, err := lockSaveDir(&c)
+	if err != nil {
+		t.Fatalf("lock: unexpected error: %s", err)
+	}
+	owner, err := readLock(localStorage{dir: dir}, lockName)
+	if err != nil {
+		t.Fatalf("read lock: unexpected error: %s", err)
+	}
+	if owner.pid != os.Getpid() || !reflect.DeepEqual(owner.episodes, c.episodes) {
+		t.Errorf("lock: got %d %v; want %d %v", owner.pid, owner.episodes, os.Getpid(), c.episodes)
+	}
+
+	// the lock is held
+	c2 := Conf{SaveDir: dir, episodes: []int{499, 500, 501}, onLock: onLockExit}
+	_, err = lockSaveDir(&c2)
+	if _, ok := err.(*lockedError); !ok {
+		t.Errorf("locked: got %v; want a lockedError", err)
+	}
+
+	// the unclaimed episodes are claimed
+	c2.onLock = onLockSkip
+	claim, err := lockSaveDir(&c2)
+	if err != nil {
+		t.Fatalf("skip: unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(c2.episodes, []int{501}) {
+		t.Errorf("skip: got %v; want [501]", c2.episodes)
+	}
+	// this snow's own claims don't conflict with each other
+	c3 := Conf{SaveDir: dir, episodes: []int{500, 501}, onLock: onLockSkip}
+	claim3, err := lockSaveDir(&c3)
+	if err != nil {
+		t.Fatalf("own claims: unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(c3.episodes, []int{501}) {
+		t.Errorf("own claims: got %v; want [501]", c3.episodes)
+	}
+	claim3.Unlock()
+
+	// another snow's claims do
+	other := filepath.Join(dir, lockName+".other")
+	err = ioutil.WriteFile(other, []byte("1 elsewhere\n502\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c5 := Conf{SaveDir: dir, episodes: []int{502}, onLock: onLockSkip}
+	_, err = lockSaveDir(&c5)
+	if err == nil {
+		t.Errorf("skip: expected an error when every episode is claimed")
+	}
+	os.Remove(other)
+
+	// the claims are honoured once the lock is released
+	l.Unlock()
+	c4 := Conf{SaveDir: dir, episodes: []int{501, 502}, onLock: onLockExit}
+	_, err = lockSaveDir(&c4)
+	if _, ok := err.(*lockedError); !ok {
+		t.Errorf("claimed: got %v; want a lockedError", err)
+	}
+	claim.Unlock()
+
+	// stale locks are removed
+	host, _ := os.Hostname()
+	err = ioutil.WriteFile(path, []byte(fmt.Sprintf("%d %s\n500\n", 1<<30, host)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err = lockSaveDir(&c)
+	if err != nil {
+		t.Fatalf("stale: unexpected error: %s", err)
+	}
+	l.Unlock()
+	_, err = os.Stat(path)
+	if !os.IsNotExist(err) {
+		t.Errorf("unlock: expected the lock file to be removed: %v", err)
+	}
+}
+
+func TestHistorySaveMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := localStorage{dir: dir}
+	hq, txt := assets["hq"], assets["txt"]
+
+	// two snows load the history, then each records its downloads
+	h1, err := loadHistory(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := loadHistory(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h1.Record(hq, 500, 10, "download", "")
+	h2.Record(hq, 501, 10, "download", "")
+	h2.Record(txt, 500, 5, "download", "")
+	for i, h := range []*History{h1, h2} {
+		err = h.Save()
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %s", i, err)
+		}
+	}
+	h, err := loadHistory(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []struct {
+		a Asset
+		i int
+	}{{hq, 500}, {hq, 501}, {txt, 500}} {
+		if _, ok := h.Asset(v.a, v.i); !ok {
+			t.Errorf("%d %s: not in the saved history", v.i, v.a.Name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, mutexName)); !os.IsNotExist(err) {
+		t.Errorf("expected the mutex to be removed: %v", err)
+	}
+}
@@ -5,128 +5,301 @@
 package main
 
 import (
-	"flag"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"sort"
+	"strings"
+	"time"
 )
 
 const (
-	UA           = "snow"                                // UserAgent for snow
-	URL          = "https://www.grc.com/securitynow.htm" // url of main security now page.
-	SNURL        = "https://media.grc.com/sn/"
-	concurrentDL = 1 // default number of episodes to download concurrently
+	UA           = "snow" // UserAgent for snow
+	concurrentDL = 1      // default number of episodes to download concurrently
 	// if a value > maxConcurrency is specified, maxConcurrency will
 	// be used and a message notifying the user will be emitted.
 	maxConcurrentDL = 4 // maximum number of episodes to download concurrently
 )
 
+// GRC's urls.
+const (
+	grcURL     = "https://www.grc.com/securitynow.htm" // url of main security now page.
+	grcSNURL   = "https://media.grc.com/sn/"
+	grcTXTURL  = "https://www.grc.com/sn/"            // base url of the transcripts and show notes
+	grcPastURL = "https://www.grc.com/sn/past/%d.htm" // format of the url of a year's archive page
+)
+
+// The urls that snow gets everything from. These are GRC's urls unless a
+// mirror is used; see setMirror.
+var (
+	URL     = grcURL
+	SNURL   = grcSNURL
+	TXTURL  = grcTXTURL
+	PastURL = grcPastURL // the only arg is the year
+)
+
+// setMirror points snow's urls at the snow mirror at base, e.g.
+// http://nas:8081.
+func setMirror(base string) {
+	base = strings.TrimSuffix(base, "/")
+	URL = base + mirrorPagePath
+	SNURL = base + mirrorFilePath
+	TXTURL = base + mirrorFilePath
+	PastURL = base + mirrorPastPath + "%d.htm"
+}
+
 type Conf struct {
-	lastN        int    // download the last n episodes. If 0, all are downloaded unless start is specified
-	startEpisode int    // episode number to start downloading from; this takes precedence over lastN
-	stopEpisode  int    // episode number to stop downloading at; if 0 everything up to current will be downloaded
-	lowQuality   bool   // download the low quality version
-	overwrite    bool   // overwrite existing file, if one exists
-	ConcurrentDL int    `json:"concurrent_downloads"` // the number of episodes to download concurrently
-	SaveDir      string `json:"save_dir"`             // directory to save the downloads to; if empty, $HOME/Downloads/security-now/ will be used
+	lastN         int        // download the last n episodes. If 0, all are downloaded unless start is specified
+	startEpisode  int        // episode number to start downloading from; this takes precedence over lastN
+	stopEpisode   int        // episode number to stop downloading at; if 0 everything up to current will be downloaded
+	lowQuality    bool       // download the low quality version
+	overwrite     bool       // overwrite existing file, if one exists
+	assets        []Asset    // the assets to download for each episode
+	selection     Selection  // the episode selection; this is applied to the episode range
+	episodes      []int      // the episodes to process; this is set by setEpisodes
+	retry         []int      // episodes to process in addition to the selected ones, e.g. ones with missing assets
+	dates         DateFilter // the air dates of the episodes to process
+	retain        int        // the number of most recent episodes to keep; 0 keeps everything
+	keepSince     time.Time  // episodes aired before this are removed; zero keeps everything
+	pruneLQ       bool       // remove the lq files of episodes whose hq file exists
+	pruneListened bool       // remove the episodes that are marked as played
+	tag           bool       // write ID3 tags to the downloaded audio files
+	cover         string     // the path or url of the cover art to embed in the tags
+	profile       string     // the name of the profile this conf is for, if any
+	layout        *Layout    // where the episodes' files are in the save dir
+	storage       Storage    // the save dir's storage; if nil, the save dir is a local dir
+	onLock        string     // what to do if the save dir is locked by another snow: exit, wait, or skip
+	confirmSize   uint64     // ask for confirmation before downloading more than this many bytes; 0 never asks
+	sidecars      []string   // the formats of the sidecars to write next to the episodes' files
+	stateFile     string     // the user's state file, which has the episodes' played states
+	states        []string   // only the episodes in these played states are processed; empty means all
+	ConcurrentDL  int        `json:"concurrent_downloads"` // the number of episodes to download concurrently
+	SaveDir       string     `json:"save_dir"`             // directory to save the downloads to; if empty, $HOME/Downloads/security-now/ will be used
 }
 
+const (
+	Version        = "0.2.0"                        // the version of snow
+	defaultSaveDir = "$HOME/Downloads/security-now" // the default save directory
+	defaultConfig  = "$HOME/.snow.json"             // the default config file
+)
+
+// the flag values; these are initialized with their defaults because not
+// every command has every flag.
 var (
-	conf         Conf
-	lastN        int
-	startEpisode int
-	stopEpisode  int
-	concurrency  int
-	lowQuality   bool
-	overwrite    bool
-	saveDir      string
+	lastN         = 1
+	startEpisode  int
+	stopEpisode   int
+	concurrency   = concurrentDL
+	lowQuality    bool
+	overwrite     bool
+	saveDir       = defaultSaveDir
+	assetList     = "hq"
+	episodes      string
+	since         string
+	until         string
+	year          int
+	retain        int
+	tag           bool
+	cover         string
+	configFile    = defaultConfig
+	profile       string
+	allProfiles   bool
+	mirrorURL     string
+	onLock        = onLockExit
+	keepSince     string
+	pruneLQ       bool
+	pruneListened bool
+	layoutTmpl    string
+	confirmSize   = defaultConfirmSize
 
 	//verbose provides more detailed output
 	verbose bool
 )
 
+// messages is where the verbose, info, and lock messages are written; cat
+// writes them to stderr so that they aren't mixed into the audio on stdout.
+var messages io.Writer = os.Stdout
+
 func (c *Conf) Concurrency(i int) {
 	if i == 0 {
 		c.ConcurrentDL = concurrentDL
-		fmt.Printf("info: invalid download concurrency, %d was specified, snow will use it's default value: %d\n", i, concurrentDL)
+		fmt.Fprintf(messages, "info: invalid download concurrency, %d was specified, snow will use it's default value: %d\n", i, concurrentDL)
 		return
 	}
 	if i > maxConcurrentDL {
 		c.ConcurrentDL = maxConcurrentDL
-		fmt.Printf("info: invalid download concurrency, %d was specified, snow will use it's maximum value: %d\n", i, maxConcurrentDL)
+		fmt.Fprintf(messages, "info: invalid download concurrency, %d was specified, snow will use it's maximum value: %d\n", i, maxConcurrentDL)
 		return
 	}
 	c.ConcurrentDL = i
 }
 
-func init() {
-	// -1 means last episode; the default
-	flag.IntVar(&lastN, "lastn", 1, "download the last n episodes; 0 means all")
-	flag.IntVar(&startEpisode, "start", 0, "episode number from which to start downloading")
-	flag.IntVar(&stopEpisode, "stop", 0, "episode number at which to stop downloading")
-	flag.IntVar(&concurrency, "concurrency", concurrentDL, "number of episodes to concurrently download")
-	flag.BoolVar(&lowQuality, "lq", false, "download the low quality version: 16Kbps mp3")
-	flag.BoolVar(&verbose, "verbose", false, "verbose output")
-	flag.BoolVar(&overwrite, "overwrite", false, "overwrite existing file, if one exists")
-	flag.StringVar(&saveDir, "savedir", "$HOME/Downloads/security-now", "save directory")
-}
-
 func main() {
-	flag.Parse()
-
-	conf.lastN = lastN
-	conf.startEpisode = startEpisode
-	conf.stopEpisode = stopEpisode
-	conf.lowQuality = lowQuality
-	conf.SaveDir = saveDir
-	conf.Concurrency(concurrency) // set via method because the checking logic is part of conf
-
-	// check flags for validity
-	if conf.SaveDir == "" {
-		fmt.Println("must specify a save directory; to use the default do not use the -savedir flag")
-		return
+	cmd, args, err := parseCommand(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "snow: %s\n\n", err)
+		usage()
+		os.Exit(2)
 	}
-
-	if conf.startEpisode > 0 && conf.stopEpisode < conf.startEpisode {
-		fmt.Printf("episode at which to stop downloading, %d, must be either greater than the start episode, %d, or 0\n", conf.stopEpisode, conf.startEpisode)
-		return
+	// errors go to stderr so that they don't end up in what's piped, e.g.
+	// snow cat 500 | mpv -
+	err = applyMirror(cmd.Flags)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
+	err = cmd.Run(cmd, args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if _, ok := err.(*lockedError); ok {
+			os.Exit(exitLocked)
+		}
+		os.Exit(1)
+	}
+}
 
-	// resolve home dir
-	conf.SaveDir = os.ExpandEnv(conf.SaveDir)
-
+// process downloads the episodes specified by the conf; last is the most
+// recent episode number. The results of the downloads are returned.
+func process(c Conf, last int) ([]Download, error) {
 	// make the dir (if necessary)
-	err := os.MkdirAll(conf.SaveDir, 764)
-	if err != nil {
-		fmt.Printf("error making save dir: %s\n", err)
-		return
+	if c.Storage().Local() {
+		err := os.MkdirAll(c.SaveDir, 764)
+		if err != nil {
+			return nil, fmt.Errorf("error making save dir: %s", err)
+		}
 	}
 
-	// check the latest episode number; this will be the limit
-	i, err := GetLastEpisodeNumber()
+	// set the episodes to process
+	err := resolveEpisodes(&c, last)
 	if err != nil {
-		fmt.Println("error:", err)
-		return
+		return nil, err
 	}
 
-	// if the last episode is 0, something went wrong.
-	if i == 0 {
-		fmt.Println("error: snow encountered an unknown problem while processing episode information, the last episode was 0")
-		return
+	// keep other snows from writing the same files
+	lock, err := lockSaveDir(&c)
+	if err != nil {
+		return nil, err
 	}
+	defer lock.Unlock()
 
-	// set the Start Stop info
-	err = setEpisodeRange(i, &conf)
+	h, err := loadHistory(c.Storage())
 	if err != nil {
-		fmt.Println(err)
-		return
+		return nil, fmt.Errorf("error loading the download history: %s", err)
+	}
+	err = h.checkLayout(c.layout)
+	if err != nil {
+		return nil, err
+	}
+	err = c.layout.Prepare(c.episodes)
+	if err != nil {
+		return nil, err
 	}
 
 	// download
-	mp3 := NewMP3(conf)
+	mp3 := NewMP3(c)
+	mp3.history = h
+	err = preflight(c, mp3)
+	if err != nil {
+		return nil, err
+	}
 	mp3.Process()
+	h.recordDownloads(mp3.downloads)
+	err = h.Save()
+	if err != nil {
+		return mp3.downloads, fmt.Errorf("error saving the download history: %s", err)
+	}
+
+	if c.tag {
+		tagDownloads(c, mp3.downloads)
+	}
+	err = indexDownloads(c, mp3.downloads)
+	if err != nil {
+		fmt.Printf("error updating the transcript index: %s\n", err)
+	}
+	_, err = updateSidecars(c, h, c.episodes)
+	if err != nil {
+		fmt.Printf("error writing the sidecars: %s\n", err)
+	}
 
 	// summary message
 	fmt.Println(mp3.Message())
+
+	// remove what the prune policies don't keep
+	removed, err := pruneLibrary(c, last, h, false)
+	for _, v := range removed {
+		fmt.Printf("%s: removed, %s\n", v.path, v.reason)
+	}
+	if err != nil {
+		return mp3.downloads, fmt.Errorf("error removing old episodes: %s", err)
+	}
+	return mp3.downloads, nil
+}
+
+// resolveEpisodes sets the episodes that the conf selects, by range, by
+// selection, and by air date; last is the most recent episode number.
+func resolveEpisodes(c *Conf, last int) error {
+	err := setEpisodes(last, c)
+	if err != nil {
+		return err
+	}
+
+	// filter by air date
+	if !c.dates.IsZero() {
+		cat, err := runCatalog.Get(c.dates.Years(time.Now())...)
+		if err != nil {
+			return fmt.Errorf("error getting the episode catalog: %s", err)
+		}
+		c.episodes = c.dates.Filter(cat, c.episodes)
+		if len(c.episodes) == 0 {
+			return errors.New("Nothing to do: no episodes aired within the specified dates.")
+		}
+	}
+
+	// add the retries; the ones that wouldn't be retained are skipped
+	var min int
+	if c.retain > 0 {
+		min = last - c.retain
+	}
+	c.episodes = mergeEpisodes(c.episodes, c.retry, min)
+	return nil
+}
+
+// mergeEpisodes returns the episodes with the other episodes that are newer
+// than min added; the result is sorted and has no duplicates.
+func mergeEpisodes(episodes, other []int, min int) []int {
+	if len(other) == 0 {
+		return episodes
+	}
+	seen := make(map[int]bool)
+	var merged []int
+	for _, v := range episodes {
+		if !seen[v] {
+			seen[v] = true
+			merged = append(merged, v)
+		}
+	}
+	for _, v := range other {
+		if v > min && !seen[v] {
+			seen[v] = true
+			merged = append(merged, v)
+		}
+	}
+	sort.Ints(merged)
+	return merged
+}
+
+// lastEpisode returns the number of the most recent episode.
+func lastEpisode() (int, error) {
+	i, err := GetLastEpisodeNumber()
+	if err != nil {
+		return 0, fmt.Errorf("error: %s", err)
+	}
+	// if the last episode is 0, something went wrong.
+	if i == 0 {
+		return 0, errors.New("error: snow encountered an unknown problem while processing episode information, the last episode was 0")
+	}
+	return i, nil
 }
 
 // Verbose prints out messages if verbose.
@@ -134,5 +307,5 @@ func Verbose(s string) {
 	if !verbose {
 		return
 	}
-	fmt.Println(s)
+	fmt.Fprintln(messages, s)
 }
@@ -0,0 +1,334 @@
+// Apache License Version 2.0
+// http://www.apache.org/licenses/
+// Copyright (c) 2016 Joel Scoble
+// See LICENSE file for license text.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The paths that a mirror serves; they are the same as GRC's so that a mirror
+// is used by replacing the host.
+const (
+	mirrorPagePath = "/securitynow.htm" // the main Security Now! page
+	mirrorFilePath = "/sn/"             // the episodes' assets
+	mirrorPastPath = "/sn/past/"        // the archive pages, e.g. /sn/past/2016.htm
+	mirrorPageDir  = ".mirror"          // the dir, in the save dir, that the pages are cached in
+)
+
+// the mirror command's flags
+var (
+	mirrorAddr string
+	mirrorTTL  time.Duration
+)
+
+func mirrorCommand() *Command {
+	c := newCommand("mirror", "", "serve a caching mirror of GRC for other snow instances", `
+Mirror serves the save directory as a caching mirror of GRC's Security Now!
+pages and episode assets. Other snow instances on the network use it by
+setting -mirror, or the config's mirror, to the mirror's url, e.g.
+http://nas:8081.
+
+Assets that are in the save directory are served from it. Assets that aren't
+are retrieved from GRC, saved, and then served; if several requests for the
+same asset arrive while it's being retrieved, it's only retrieved once. The
+asset's episode is claimed while the asset is retrieved; if another snow is
+processing the episode, the request fails with 503 Service Unavailable, and
+the client's download of the asset fails, so that it's downloaded on its next
+run. The episode pages are cached in the save directory for -ttl. The archive
+pages of past years don't change, so they are kept indefinitely. If GRC can't
+be reached, the cached pages are served regardless of their age.`, runMirror)
+	libraryFlags(c.Flags)
+	configFlags(c.Flags, true)
+	c.Flags.StringVar(&mirrorAddr, "addr", ":8081", "the address to serve the mirror on")
+	c.Flags.DurationVar(&mirrorTTL, "ttl", time.Hour, "how long the main and current year's archive pages are cached")
+	return c
+}
+
+// runMirror serves the mirror.
+func runMirror(cmd *Command, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("mirror: unexpected args: %s", strings.Join(args, " "))
+	}
+	cs, err := confs(cmd.Flags)
+	if err != nil {
+		return err
+	}
+	c := cs[0]
+	err = requireLocal(c, "mirror")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Join(c.SaveDir, mirrorPageDir), 0755)
+	if err != nil {
+		return fmt.Errorf("error making save dir: %s", err)
+	}
+	m := newMirror(c, mirrorTTL)
+	fmt.Printf("mirroring GRC to %s on %s\n", c.SaveDir, mirrorAddr)
+	return http.ListenAndServe(mirrorAddr, m.Handler())
+}
+
+// mirror is a caching mirror of GRC.
+type mirror struct {
+	dir    string        // the save dir
+	layout *Layout       // the save dir's layout
+	ttl    time.Duration // how long pages that change are cached
+	flight flight
+}
+
+// newMirror returns a mirror that caches to c's save dir using c's layout.
+func newMirror(c Conf, ttl time.Duration) *mirror {
+	return &mirror{dir: c.SaveDir, layout: c.layout, ttl: ttl}
+}
+
+// Handler returns the mirror's handler.
+func (m *mirror) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(mirrorPagePath, m.handlePage)
+	mux.HandleFunc(mirrorPastPath, m.handlePast)
+	mux.HandleFunc(mirrorFilePath, m.handleFile)
+	return mux
+}
+
+// handleFile serves an episode's asset, retrieving it first if it isn't in
+// the save dir.
+func (m *mirror) handleFile(w http.ResponseWriter, r *http.Request) {
+	a, i, ok := parseAssetFile(strings.TrimPrefix(r.URL.Path, mirrorFilePath))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	err := m.layout.Prepare([]int{i})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	p, err := m.layout.Path(m.dir, a, i)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	err = m.flight.Do(p, func() error {
+		return m.fetchAsset(a, i)
+	})
+	if err != nil {
+		Verbose(fmt.Sprintf("mirror: %s", err))
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	serveFile(w, r, p)
+}
+
+// statusError is an error that is reported to the mirror's clients with the
+// status.
+type statusError struct {
+	status int
+	err    error
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+// errorStatus returns the status that err is reported to the mirror's clients
+// with; errors that aren't statusErrors are upstream failures.
+func errorStatus(err error) int {
+	if e, ok := err.(*statusError); ok {
+		return e.status
+	}
+	return http.StatusBadGateway
+}
+
+// getPage returns the page at u; if GRC doesn't have it, the error is a 404
+// statusError, so that the mirror's clients see the same thing GRC's would.
+func getPage(u string) ([]byte, error) {
+	resp, err := http.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("GET of %q resulted in an unexpected status: %q", u, resp.Status)
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, &statusError{status: http.StatusNotFound, err: err}
+		}
+		return nil, err
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// fetchAsset retrieves asset a of episode i to the save dir if it isn't
+// already there. The episode is claimed while it's retrieved, so that the
+// mirror's concurrent fetches don't lock each other out; if another snow is
+// processing the episode, it isn't retrieved. A failed download never
+// leaves a partial file to be served. If GRC doesn't have the asset, e.g. a
+// transcript that hasn't been published yet, the error is a 404 statusError.
+func (m *mirror) fetchAsset(a Asset, i int) error {
+	p, err := m.layout.Path(m.dir, a, i)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(p); err == nil {
+		return nil
+	}
+	c := Conf{SaveDir: m.dir, episodes: []int{i}}
+	lock, err := claimEpisodes(&c)
+	if err != nil {
+		return &statusError{status: http.StatusServiceUnavailable, err: err}
+	}
+	defer lock.Unlock()
+	dl := &MP3{storage: localStorage{dir: m.dir}, layout: m.layout}
+	d := dl.Get(a, i)
+	if d.missing {
+		return &statusError{status: http.StatusNotFound, err: d.err}
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if !d.skipped {
+		fmt.Printf("%s: %d bytes retrieved\n", d.Name, d.n)
+	}
+	return nil
+}
+
+// handlePage serves the main Security Now! page.
+func (m *mirror) handlePage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != mirrorPagePath {
+		http.NotFound(w, r)
+		return
+	}
+	m.servePage(w, r, "securitynow.htm", URL, m.ttl)
+}
+
+// handlePast serves a year's archive page. The pages of past years are
+// cached indefinitely.
+func (m *mirror) handlePast(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, mirrorPastPath)
+	y, err := strconv.Atoi(strings.TrimSuffix(name, ".htm"))
+	if err != nil || !strings.HasSuffix(name, ".htm") || y < FirstYear || y > time.Now().Year() {
+		http.NotFound(w, r)
+		return
+	}
+	ttl := m.ttl
+	if y < time.Now().Year() {
+		ttl = -1
+	}
+	m.servePage(w, r, fmt.Sprintf("past-%d.htm", y), fmt.Sprintf(PastURL, y), ttl)
+}
+
+// servePage serves the page cached as name, retrieving it from u first if
+// the cached copy is older than ttl; a negative ttl never expires. If the page
+// can't be retrieved, the cached copy is served, if there is one.
+func (m *mirror) servePage(w http.ResponseWriter, r *http.Request, name, u string, ttl time.Duration) {
+	p := filepath.Join(m.dir, mirrorPageDir, name)
+	err := m.flight.Do(p, func() error {
+		fi, err := os.Stat(p)
+		if err == nil && (ttl < 0 || time.Since(fi.ModTime()) < ttl) {
+			return nil
+		}
+		b, gerr := getPage(u)
+		if gerr != nil {
+			if err == nil {
+				Verbose(fmt.Sprintf("mirror: serving the cached %s: %s", name, gerr))
+				return nil
+			}
+			return gerr
+		}
+		return writeFileAtomic(p, b)
+	})
+	if err != nil {
+		Verbose(fmt.Sprintf("mirror: %s", err))
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	serveFile(w, r, p)
+}
+
+// serveFile serves the file at p; range requests are supported.
+func serveFile(w http.ResponseWriter, r *http.Request, p string) {
+	f, err := os.Open(p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+}
+
+// writeFileAtomic writes b to path; it's written to a temporary file that
+// replaces path once it's complete.
+func writeFileAtomic(path string, b []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(b)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Chmod(0644)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// flight coalesces concurrent calls for the same key: while a call for a key
+// is in progress, other calls for that key wait for it and get its result.
+type flight struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	wg  sync.WaitGroup
+	err error
+}
+
+// Do calls fn unless a call for key is in progress, in which case it waits
+// for that call's result.
+func (f *flight) Do(key string, fn func() error) error {
+	f.mu.Lock()
+	if f.calls == nil {
+		f.calls = make(map[string]*flightCall)
+	}
+	c, ok := f.calls[key]
+	if ok {
+		f.mu.Unlock()
+		c.wg.Wait()
+		return c.err
+	}
+	c = &flightCall{}
+	c.wg.Add(1)
+	f.calls[key] = c
+	f.mu.Unlock()
+
+	c.err = fn()
+	c.wg.Done()
+
+	f.mu.Lock()
+	delete(f.calls, key)
+	f.mu.Unlock()
+	return c.err
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMirror(t *testing.T) {
+	var hits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		switch r.URL.Path {
+		case "/sn/sn-500.mp3":
+			// give the other requests time to arrive while this is in progress
+			time.Sleep(50 * time.Millisecond)
+			w.Write([]byte("episode 500"))
+		case "/securitynow.htm":
+			w.Write([]byte("<html></html>"))
+		case "/sn/sn-501.mp3":
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+	defer func() {
+		URL, SNURL, TXTURL, PastURL = grcURL, grcSNURL, grcTXTURL, grcPastURL
+	}()
+	setMirror(upstream.URL)
+
+	dir, err := ioutil.TempDir("", "snow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = os.MkdirAll(filepath.Join(dir, mirrorPageDir), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := httptest.NewServer(newMirror(Conf{SaveDir: dir}, time.Hour).Handler())
+	defer m.Close()
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(m.URL + path)
+		if err != nil {
+			t.Error(err)
+			return 0, ""
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	// concurrent requests for the same asset result in one upstream request
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			code, body := get("/sn/sn-500.mp3")
+			if code != http.StatusOK || body != "episode 500" {
+				t.Errorf("sn-500.mp3: got %d %q; want 200 %q", code, body, "episode 500")
+			}
+		}()
+	}
+	wg.Wait()
+	if hits != 1 {
+		t.Errorf("upstream requests: got %d; want 1", hits)
+	}
+	_, err = os.Stat(filepath.Join(dir, "sn-500.mp3"))
+	if err != nil {
+		t.Errorf("sn-500.mp3 wasn't saved: %s", err)
+	}
+
+	// cached assets and pages aren't retrieved again
+	get("/sn/sn-500.mp3")
+	get("/securitynow.htm")
+	get("/securitynow.htm")
+	if hits != 2 {
+		t.Errorf("upstream requests: got %d; want 2", hits)
+	}
+
+	// missing assets aren't saved; what GRC doesn't have isn't found, and
+	// other failures are upstream errors
+	code, _ := get("/sn/sn-501.txt")
+	if code != http.StatusNotFound {
+		t.Errorf("sn-501.txt: got %d; want %d", code, http.StatusNotFound)
+	}
+	code, _ = get("/sn/sn-501.mp3")
+	if code != http.StatusBadGateway {
+		t.Errorf("sn-501.mp3: got %d; want %d", code, http.StatusBadGateway)
+	}
+	code, _ = get("/sn/past/2005.htm")
+	if code != http.StatusNotFound {
+		t.Errorf("2005.htm: got %d; want %d", code, http.StatusNotFound)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	for _, fi := range files {
+		if fi.Name() != "sn-500.mp3" && fi.Name() != mirrorPageDir {
+			t.Errorf("unexpected file in the save dir: %s", fi.Name())
+		}
+	}
+
+	// what another snow is processing isn't retrieved
+	c := Conf{SaveDir: dir, episodes: []int{502}, onLock: onLockExit}
+	l, err := lockSaveDir(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ = get("/sn/sn-502.mp3")
+	l.Unlock()
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("sn-502.mp3: got %d; want %d", code, http.StatusServiceUnavailable)
+	}
+
+	// only asset names are served
+	code, _ = get("/sn/passwd")
+	if code != http.StatusNotFound {
+		t.Errorf("passwd: got %d; want %d", code, http.StatusNotFound)
+	}
+}
+
+func TestMirrorConcurrentFetches(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the fetches overlap while the upstream is slow
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer upstream.Close()
+	defer func() {
+		URL, SNURL, TXTURL, PastURL = grcURL, grcSNURL, grcTXTURL, grcPastURL
+	}()
+	setMirror(upstream.URL)
+
+	dir, err := ioutil.TempDir("", "snow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := httptest.NewServer(newMirror(Conf{SaveDir: dir}, time.Hour).Handler())
+	defer m.Close()
+
+	// two assets of one episode and several episodes at once
+	paths := []string{"/sn/sn-500.mp3", "/sn/sn-500.txt", "/sn/sn-501.mp3", "/sn/sn-502.mp3", "/sn/sn-503.mp3"}
+	var wg sync.WaitGroup
+	for _, p := range paths {
+		wg.Add(1)
+		go func(p string) {
+			defer wg.Done()
+			resp, err := http.Get(m.URL + p)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			b, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK || string(b) != p {
+				t.Errorf("%s: got %d %q; want 200 %q", p, resp.StatusCode, b, p)
+			}
+		}(p)
+	}
+	wg.Wait()
+	locks, _ := filepath.Glob(filepath.Join(dir, lockName+"*"))
+	if len(locks) != 0 {
+		t.Errorf("the claims weren't released: %v", locks)
+	}
+}
@@ -0,0 +1,349 @@
+// Apache License Version 2.0
+// http://www.apache.org/licenses/
+// Copyright (c) 2016 Joel Scoble
+// See LICENSE file for license text.
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// the playlist flags
+var (
+	playlistFormat   string
+	playlistOut      string
+	playlistAbsolute bool
+)
+
+// playlistFormats are the supported playlist formats.
+var playlistFormats = []string{"m3u8", "pls", "xspf"}
+
+func playlistCommand() *Command {
+	c := newCommand("playlist", "[terms...]", "write a playlist of the downloaded episodes", `
+Playlist writes a playlist of the selected episodes' audio files that are in
+the save directory, oldest first. If an episode has more than one of the audio
+assets, the first one in -assets is used. By default, all episodes are
+selected; e.g. -year 2016 selects the episodes aired in 2016.
+
+With terms, only the episodes whose title or description contains all of the
+terms are in the playlist. With -transcripts, the episodes' transcripts are
+searched instead, see "snow help grep", and the playlist is ordered by best
+match.
+
+The formats are m3u8, an extended M3U playlist with each episode's length and
+title; pls; and xspf. The playlist is written to stdout unless -o is used, in
+which case it's written to that file in the save directory; if -format isn't
+used, the file's extension is the format. The paths are relative to the
+playlist's directory, or to the save directory when the playlist is written to
+stdout, unless -absolute is used.
+
+With -state, only the episodes in those played states are in the playlist,
+e.g. -state unplayed; see "snow help mark".`, runPlaylist)
+	rangeFlags(c.Flags, 0)
+	libraryFlags(c.Flags)
+	configFlags(c.Flags, true)
+	mirrorFlag(c.Flags)
+	c.Flags.StringVar(&playlistFormat, "format", "m3u8", "the playlist format: "+strings.Join(playlistFormats, ", "))
+	c.Flags.StringVar(&playlistOut, "o", "", "the name of the playlist file to write in the save directory, e.g. 2016.m3u8 or playlists/2016.m3u8; if empty, it's written to stdout")
+	c.Flags.BoolVar(&playlistAbsolute, "absolute", false, "use absolute paths instead of paths relative to the playlist")
+	c.Flags.BoolVar(&transcripts, "transcripts", false, "search the transcripts for the terms")
+	c.Flags.BoolVar(&grepNoUpdate, "noupdate", false, "don't update the transcript index first")
+	stateFilterFlag(c.Flags)
+	return c
+}
+
+// runPlaylist writes a playlist of the selected episodes.
+func runPlaylist(cmd *Command, args []string) error {
+	format := playlistFormat
+	if !setFlags(cmd.Flags)["format"] && playlistOut != "" {
+		if ext := strings.TrimPrefix(path.Ext(playlistOut), "."); ext != "" {
+			format = strings.ToLower(ext)
+		}
+		if format == "m3u" {
+			format = "m3u8"
+		}
+	}
+	if !validPlaylistFormat(format) {
+		return fmt.Errorf("playlist: unknown format %q: must be %s", format, strings.Join(playlistFormats, ", "))
+	}
+	if playlistOut != "" && (filepath.IsAbs(playlistOut) || strings.HasPrefix(path.Clean(filepath.ToSlash(playlistOut)), "../")) {
+		return fmt.Errorf("playlist: %s: the playlist must be in the save directory", playlistOut)
+	}
+	c, cat, err := selected(cmd)
+	if err != nil {
+		return err
+	}
+	episodes := c.episodes
+	if len(args) > 0 {
+		episodes, err = searchEpisodes(c, cat, args)
+		if err != nil {
+			return err
+		}
+	}
+	episodes, err = filterStates(c, episodes)
+	if err != nil {
+		return err
+	}
+	// the relative paths are resolved against the playlist's dir
+	dir := "."
+	if playlistOut != "" {
+		dir = path.Dir(path.Clean(filepath.ToSlash(playlistOut)))
+	}
+	entries, err := playlistEntries(c, cat, episodes, dir, playlistAbsolute)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return errors.New("Nothing to do: none of the selected episodes have audio files in the save directory.")
+	}
+	var b bytes.Buffer
+	err = writePlaylist(&b, format, entries)
+	if err != nil {
+		return err
+	}
+	if playlistOut == "" {
+		_, err = os.Stdout.Write(b.Bytes())
+		return err
+	}
+	s := c.Storage()
+	name := path.Clean(filepath.ToSlash(playlistOut))
+	err = writeStorage(s, name, b.Bytes())
+	if err != nil {
+		return fmt.Errorf("playlist: %s", err)
+	}
+	fmt.Printf("%s: %d episodes\n", s.Path(name), len(entries))
+	return nil
+}
+
+// validPlaylistFormat returns whether the format is supported.
+func validPlaylistFormat(format string) bool {
+	for _, v := range playlistFormats {
+		if v == format {
+			return true
+		}
+	}
+	return false
+}
+
+// searchEpisodes returns c's episodes that match the search terms: either
+// the ones whose title and description contain all of the terms, in order,
+// or, with -transcripts, the ones whose transcripts match, best match first.
+func searchEpisodes(c Conf, cat Catalog, args []string) ([]int, error) {
+	var episodes []int
+	if transcripts {
+		hits, err := searchTranscripts(c, args)
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range hits {
+			episodes = append(episodes, h.Episode)
+		}
+		return episodes, nil
+	}
+	var terms []string
+	for _, v := range args {
+		terms = append(terms, strings.Fields(strings.ToLower(v))...)
+	}
+	for _, i := range c.episodes {
+		if matchTerms(cat[i], terms) {
+			episodes = append(episodes, i)
+		}
+	}
+	return episodes, nil
+}
+
+// playlistEntry is an episode in a playlist.
+type playlistEntry struct {
+	Path     string // relative paths are slash separated
+	Episode  Episode
+	Relative bool
+}
+
+// Title returns the entry's title, e.g. SN 500: Windows Secure Boot.
+func (p playlistEntry) Title() string {
+	return episodeTag(p.Episode, nil, "").Title
+}
+
+// Seconds returns the entry's length in seconds; -1 means that it isn't
+// known.
+func (p playlistEntry) Seconds() int {
+	if p.Episode.Minutes == 0 {
+		return -1
+	}
+	return p.Episode.Minutes * 60
+}
+
+// playlistEntries returns the playlist entries of the episodes that have
+// one of c's audio assets in the save dir. The relative paths are relative to
+// dir, the slash separated path of the playlist's dir in the save dir.
+func playlistEntries(c Conf, cat Catalog, episodes []int, dir string, absolute bool) ([]playlistEntry, error) {
+	s := c.Storage()
+	var entries []playlistEntry
+	for _, i := range episodes {
+		e, ok := cat[i]
+		if !ok {
+			e = Episode{Number: i}
+		}
+		name, err := audioName(c, s, i)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			continue
+		}
+		entry := playlistEntry{Path: name, Episode: e, Relative: true}
+		if dir != "." {
+			p, err := filepath.Rel(filepath.FromSlash(dir), filepath.FromSlash(name))
+			if err != nil {
+				return nil, err
+			}
+			entry.Path = filepath.ToSlash(p)
+		}
+		if absolute {
+			p := s.Path(name)
+			if s.Local() {
+				var err error
+				p, err = filepath.Abs(p)
+				if err != nil {
+					return nil, err
+				}
+			}
+			entry.Path = p
+			entry.Relative = false
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// audioName returns the name of the file of the first of c's audio assets
+// that episode i has in the save dir, s; if it doesn't have any, an empty
+// string is returned.
+func audioName(c Conf, s Storage, i int) (string, error) {
+	for _, a := range c.assets {
+		if !a.audio {
+			continue
+		}
+		name, err := c.layout.Name(a, i)
+		if err != nil {
+			return "", err
+		}
+		if storageExists(s, name) {
+			return name, nil
+		}
+	}
+	return "", nil
+}
+
+// writePlaylist writes the entries as a playlist in the format.
+func writePlaylist(w io.Writer, format string, entries []playlistEntry) error {
+	switch format {
+	case "m3u8":
+		return writeM3U8(w, entries)
+	case "pls":
+		return writePLS(w, entries)
+	case "xspf":
+		return writeXSPF(w, entries)
+	}
+	return fmt.Errorf("unknown playlist format %q", format)
+}
+
+// filePath returns the entry's path for the M3U and PLS playlists, which use
+// the OS's separator for relative paths.
+func (p playlistEntry) filePath() string {
+	if p.Relative {
+		return filepath.FromSlash(p.Path)
+	}
+	return p.Path
+}
+
+// writeM3U8 writes an extended M3U playlist, in UTF-8.
+func writeM3U8(w io.Writer, entries []playlistEntry) error {
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n")
+	for _, e := range entries {
+		fmt.Fprintf(&b, "#EXTINF:%d,%s - %s\n%s\n", e.Seconds(), Artist, e.Title(), e.filePath())
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// writePLS writes a PLS playlist.
+func writePLS(w io.Writer, entries []playlistEntry) error {
+	var b bytes.Buffer
+	b.WriteString("[playlist]\n")
+	for j, e := range entries {
+		fmt.Fprintf(&b, "File%d=%s\nTitle%d=%s\nLength%d=%d\n", j+1, e.filePath(), j+1, e.Title(), j+1, e.Seconds())
+	}
+	fmt.Fprintf(&b, "NumberOfEntries=%d\nVersion=2\n", len(entries))
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// xspfPlaylist is an XSPF playlist: http://xspf.org/spec.
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"http://xspf.org/ns/0/ playlist"`
+	Version int         `xml:"version,attr"`
+	Title   string      `xml:"title"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+type xspfTrack struct {
+	Location   string `xml:"location"`
+	Title      string `xml:"title"`
+	Creator    string `xml:"creator"`
+	Album      string `xml:"album"`
+	TrackNum   int    `xml:"trackNum"`
+	Duration   int    `xml:"duration,omitempty"` // in milliseconds
+	Annotation string `xml:"annotation,omitempty"`
+}
+
+// writeXSPF writes an XSPF playlist.
+func writeXSPF(w io.Writer, entries []playlistEntry) error {
+	pl := xspfPlaylist{Version: 1, Title: Album}
+	for _, e := range entries {
+		t := xspfTrack{
+			Location:   e.location(),
+			Title:      e.Title(),
+			Creator:    Artist,
+			Album:      Album,
+			TrackNum:   e.Episode.Number,
+			Annotation: e.Episode.Description,
+		}
+		if n := e.Seconds(); n > 0 {
+			t.Duration = n * 1000
+		}
+		pl.Tracks = append(pl.Tracks, t)
+	}
+	b, err := xml.MarshalIndent(pl, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, xml.Header+string(b)+"\n")
+	return err
+}
+
+// location returns the entry's path as an XSPF location, which is a URI:
+// relative paths are relative references and absolute paths are file URIs.
+func (p playlistEntry) location() string {
+	if p.Relative {
+		return (&url.URL{Path: p.Path}).String()
+	}
+	if strings.Contains(p.Path, "://") {
+		return p.Path
+	}
+	s := filepath.ToSlash(p.Path)
+	if !strings.HasPrefix(s, "/") {
+		s = "/" + s // e.g. C:/
+	}
+	return (&url.URL{Scheme: "file", Path: s}).String()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPlaylistEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"sn-499-lq.mp3", "sn-500.mp3", "sn-500-lq.mp3", "sn-501.txt"} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	layout, _ := ParseLayout(defaultLayout)
+	c := Conf{SaveDir: dir, assets: []Asset{assets["txt"], assets["hq"], assets["lq"]}, layout: layout}
+	cat := Catalog{500: {Number: 500, Title: "Windows Secure Boot"}}
+	tests := []struct {
+		dir      string
+		absolute bool
+		expected []string
+	}{
+		{".", false, []string{"sn-499-lq.mp3", "sn-500.mp3"}},
+		{"playlists/2016", false, []string{"../../sn-499-lq.mp3", "../../sn-500.mp3"}},
+		{"playlists", true, []string{filepath.Join(dir, "sn-499-lq.mp3"), filepath.Join(dir, "sn-500.mp3")}},
+	}
+	for i, test := range tests {
+		entries, err := playlistEntries(c, cat, []int{499, 500, 501}, test.dir, test.absolute)
+		if err != nil {
+			t.Errorf("%d: unexpected error: %s", i, err)
+			continue
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Path)
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%d: got %v; want %v", i, got, test.expected)
+		}
+	}
+}
+
+func TestWritePlaylist(t *testing.T) {
+	entries := []playlistEntry{
+		{Path: "2015/sn 500.mp3", Relative: true, Episode: Episode{Number: 500, Title: "Windows Secure Boot", Minutes: 98, Date: time.Date(2015, time.March, 24, 0, 0, 0, 0, time.UTC), Description: "UEFI & TPM"}},
+		{Path: "2015/sn-501.mp3", Relative: true, Episode: Episode{Number: 501}},
+	}
+	sep := string(filepath.Separator)
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{"m3u8", "#EXTM3U\n#EXTINF:5880,Steve Gibson & Leo Laporte - SN 500: Windows Secure Boot\n2015" + sep + "sn 500.mp3\n#EXTINF:-1,Steve Gibson & Leo Laporte - SN 501\n2015" + sep + "sn-501.mp3\n"},
+		{"pls", "[playlist]\nFile1=2015" + sep + "sn 500.mp3\nTitle1=SN 500: Windows Secure Boot\nLength1=5880\nFile2=2015" + sep + "sn-501.mp3\nTitle2=SN 501\nLength2=-1\nNumberOfEntries=2\nVersion=2\n"},
+		{"xspf", `<?xml version="1.0" encoding="UTF-8"?>
+<playlist xmlns="http://xspf.org/ns/0/" version="1">
+  <title>Security Now!</title>
+  <trackList>
+    <track>
+      <location>2015/sn%20500.mp3</location>
+      <title>SN 500: Windows Secure Boot</title>
+      <creator>Steve Gibson &amp; Leo Laporte</creator>
+      <album>Security Now!</album>
+      <trackNum>500</trackNum>
+      <duration>5880000</duration>
+      <annotation>UEFI &amp; TPM</annotation>
+    </track>
+    <track>
+      <location>2015/sn-501.mp3</location>
+      <title>SN 501</title>
+      <creator>Steve Gibson &amp; Leo Laporte</creator>
+      <album>Security Now!</album>
+      <trackNum>501</trackNum>
+    </track>
+  </trackList>
+</playlist>
+`},
+	}
+	for i, test := range tests {
+		var b bytes.Buffer
+		err := writePlaylist(&b, test.format, entries)
+		if err != nil {
+			t.Errorf("%d: unexpected error: %s", i, err)
+			continue
+		}
+		if b.String() != test.expected {
+			t.Errorf("%d: got %q; want %q", i, b.String(), test.expected)
+		}
+	}
+}
+
+func TestPlaylistLocation(t *testing.T) {
+	tests := []struct {
+		entry    playlistEntry
+		expected string
+	}{
+		{playlistEntry{Path: "sn-500.mp3", Relative: true}, "sn-500.mp3"},
+		{playlistEntry{Path: "a:b/sn-500.mp3", Relative: true}, "./a:b/sn-500.mp3"},
+		{playlistEntry{Path: "/home/leo/Security Now/sn-500.mp3"}, "file:///home/leo/Security%20Now/sn-500.mp3"},
+		{playlistEntry{Path: "s3://bucket/sn-500.mp3"}, "s3://bucket/sn-500.mp3"},
+	}
+	for i, test := range tests {
+		got := test.entry.location()
+		if got != test.expected {
+			t.Errorf("%d: got %q; want %q", i, got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,390 @@
+// Apache License Version 2.0
+// http://www.apache.org/licenses/
+// Copyright (c) 2016 Joel Scoble
+// See LICENSE file for license text.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ConfigFile is snow's config file. It holds the named profiles.
+type ConfigFile struct {
+	Mirror   string             `json:"mirror,omitempty"` // the base url of the snow mirror to use instead of GRC
+	Profiles map[string]Profile `json:"profiles"`
+}
+
+// Profile is a named set of settings for an archive target. Any setting that
+// isn't set in a profile uses the flag's value. Flags that are explicitly set
+// take precedence over the profile's settings.
+type Profile struct {
+	SaveDir       string   `json:"save_dir,omitempty"`             // directory to save the downloads to
+	Assets        []string `json:"assets,omitempty"`               // the assets to download, e.g. hq, lq, txt
+	Layout        string   `json:"layout,omitempty"`               // the layout of the save dir
+	LastN         *int     `json:"lastn,omitempty"`                // download the last n episodes; 0 means all
+	Start         int      `json:"start,omitempty"`                // episode number from which to start downloading
+	Stop          int      `json:"stop,omitempty"`                 // episode number at which to stop downloading
+	Episodes      string   `json:"episodes,omitempty"`             // episode selection expression, e.g. 1-10,42,500-
+	Since         string   `json:"since,omitempty"`                // episodes aired on or after this date
+	Until         string   `json:"until,omitempty"`                // episodes aired on or before this date
+	Year          int      `json:"year,omitempty"`                 // episodes aired in this year
+	Retain        int      `json:"retain,omitempty"`               // the number of most recent episodes to keep; 0 keeps everything
+	KeepSince     string   `json:"keep_since,omitempty"`           // remove episodes aired before this date
+	PruneLQ       bool     `json:"prune_lq,omitempty"`             // remove lq files whose episode's hq file exists
+	PruneListened bool     `json:"prune_listened,omitempty"`       // remove episodes that are marked as played
+	Tag           bool     `json:"tag,omitempty"`                  // write ID3 tags to the downloaded audio files
+	Cover         string   `json:"cover,omitempty"`                // the path or url of the cover art to embed in the tags
+	ConcurrentDL  int      `json:"concurrent_downloads,omitempty"` // the number of episodes to download concurrently
+	ConfirmSize   string   `json:"confirm_size,omitempty"`         // ask for confirmation before downloading more than this, e.g. 5GB
+	Sidecars      []string `json:"sidecars,omitempty"`             // the sidecar formats to write next to the episodes' files, e.g. json, nfo
+}
+
+// LoadConfig reads the config file at path.
+func LoadConfig(path string) (ConfigFile, error) {
+	var cfg ConfigFile
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("read config: %s", err)
+	}
+	err = json.Unmarshal(b, &cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("parse config %s: %s", path, err)
+	}
+	return cfg, nil
+}
+
+// ProfileNames returns the names of the config's profiles, sorted.
+func (c ConfigFile) ProfileNames() []string {
+	var names []string
+	for k := range c.Profiles {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Profile returns the named profile.
+func (c ConfigFile) Profile(name string) (Profile, error) {
+	p, ok := c.Profiles[name]
+	if !ok {
+		return p, fmt.Errorf("profile %q not found in config", name)
+	}
+	return p, nil
+}
+
+// setFlags returns the names of the flags in fs that were explicitly set.
+func setFlags(fs *flag.FlagSet) map[string]bool {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
+
+// applyMirror points snow at a mirror if either the -mirror flag or the
+// config's mirror is set; the flag takes precedence. Commands without the
+// -mirror flag never use a mirror.
+func applyMirror(fs *flag.FlagSet) error {
+	if fs.Lookup("mirror") == nil {
+		return nil
+	}
+	base := mirrorURL
+	if base == "" {
+		path := os.ExpandEnv(configFile)
+		_, err := os.Stat(path)
+		if err != nil {
+			return nil
+		}
+		cfg, err := LoadConfig(path)
+		if err != nil {
+			return err
+		}
+		base = cfg.Mirror
+	}
+	if base == "" {
+		return nil
+	}
+	if !strings.HasPrefix(base, "http://") && !strings.HasPrefix(base, "https://") {
+		return fmt.Errorf("mirror: %q is not an http or https url", base)
+	}
+	Verbose("using mirror " + base)
+	setMirror(base)
+	return nil
+}
+
+// confs returns the Confs to process using the flags in fs. If neither a
+// profile nor all profiles was specified, the Conf is built from the flags.
+func confs(fs *flag.FlagSet) ([]Conf, error) {
+	set := setFlags(fs)
+	if profile == "" && !allProfiles {
+		c, err := flagConf(nil, set)
+		if err != nil {
+			return nil, err
+		}
+		return []Conf{c}, nil
+	}
+
+	cfg, err := LoadConfig(os.ExpandEnv(configFile))
+	if err != nil {
+		return nil, err
+	}
+	names := []string{profile}
+	if allProfiles {
+		names = cfg.ProfileNames()
+		if len(names) == 0 {
+			return nil, fmt.Errorf("no profiles found in %s", configFile)
+		}
+	}
+	var cs []Conf
+	for _, name := range names {
+		p, err := cfg.Profile(name)
+		if err != nil {
+			return nil, err
+		}
+		c, err := flagConf(&p, set)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %s", name, err)
+		}
+		c.profile = name
+		cs = append(cs, c)
+	}
+	return cs, nil
+}
+
+// flagConf returns a Conf built from the flags. If p is not nil, the
+// profile's settings are used for any flag that wasn't explicitly set.
+func flagConf(p *Profile, set map[string]bool) (Conf, error) {
+	var c Conf
+	c.lastN = lastN
+	c.startEpisode = startEpisode
+	c.stopEpisode = stopEpisode
+	c.lowQuality = lowQuality
+	c.overwrite = overwrite
+	c.retain = retain
+	c.tag = tag
+	c.cover = cover
+	c.onLock = onLock
+	c.pruneLQ = pruneLQ
+	c.pruneListened = pruneListened
+	keep := keepSince
+	tmpl := layoutTmpl
+	confirmAt := confirmSize
+	c.SaveDir = saveDir
+	selection := episodes
+	from, to, yr := since, until, year
+	// whether a range rule was specified, either by flag or by the profile
+	rangeSet := set["lastn"] || set["start"] || set["stop"] || set["episodes"]
+	concurrent := concurrency
+	names := []string{assetList}
+	if lowQuality {
+		names = []string{"lq"}
+	}
+	sidecars := []string{sidecarList}
+
+	if p != nil {
+		if p.SaveDir != "" && !set["savedir"] {
+			c.SaveDir = p.SaveDir
+		}
+		if len(p.Assets) > 0 && !set["assets"] && !set["lq"] {
+			names = p.Assets
+		}
+		if p.Layout != "" && !set["layout"] {
+			tmpl = p.Layout
+		}
+		// the range flags go together: if any of them were set, the
+		// profile's range rule isn't used.
+		if !set["lastn"] && !set["start"] && !set["stop"] && !set["episodes"] {
+			if p.LastN != nil {
+				c.lastN = *p.LastN
+			}
+			c.startEpisode = p.Start
+			c.stopEpisode = p.Stop
+			selection = p.Episodes
+			rangeSet = p.LastN != nil || p.Start > 0 || p.Stop > 0 || p.Episodes != ""
+		}
+		if p.Since != "" && !set["since"] {
+			from = p.Since
+		}
+		if p.Until != "" && !set["until"] {
+			to = p.Until
+		}
+		if p.Year != 0 && !set["year"] {
+			yr = p.Year
+		}
+		if p.Retain > 0 && !set["retain"] {
+			c.retain = p.Retain
+		}
+		if p.KeepSince != "" && !set["keepsince"] {
+			keep = p.KeepSince
+		}
+		if p.PruneLQ && !set["prunelq"] {
+			c.pruneLQ = true
+		}
+		if p.PruneListened && !set["prunelistened"] {
+			c.pruneListened = true
+		}
+		if p.Tag && !set["tag"] {
+			c.tag = true
+		}
+		if p.Cover != "" && !set["cover"] {
+			c.cover = p.Cover
+		}
+		if p.ConcurrentDL > 0 && !set["concurrency"] {
+			concurrent = p.ConcurrentDL
+		}
+		if p.ConfirmSize != "" && !set["confirm"] {
+			confirmAt = p.ConfirmSize
+		}
+		if len(p.Sidecars) > 0 && !set["sidecars"] {
+			sidecars = p.Sidecars
+		}
+	}
+
+	var err error
+	c.assets, err = parseAssets(names...)
+	if err != nil {
+		return c, err
+	}
+	c.selection, err = ParseSelection(selection)
+	if err != nil {
+		return c, err
+	}
+	c.layout, err = ParseLayout(tmpl)
+	if err != nil {
+		return c, err
+	}
+	c.dates, err = NewDateFilter(from, to, yr, time.Now())
+	if err != nil {
+		return c, err
+	}
+	c.confirmSize, err = parseConfirmSize(confirmAt)
+	if err != nil {
+		return c, err
+	}
+	c.sidecars, err = parseSidecars(sidecars...)
+	if err != nil {
+		return c, err
+	}
+	c.states, err = parseStates(stateFilter)
+	if err != nil {
+		return c, err
+	}
+	if keep != "" {
+		c.keepSince, err = parseDate(keep, time.Now(), false)
+		if err != nil {
+			return c, fmt.Errorf("keepsince: %s", err)
+		}
+	}
+	// when selecting by date without a range rule, all episodes are
+	// candidates instead of just the latest one.
+	if !c.dates.IsZero() && !rangeSet {
+		c.lastN = 0
+	}
+	c.Concurrency(concurrent) // set via method because the checking logic is part of conf
+
+	// check for validity
+	if c.SaveDir == "" {
+		return c, errors.New("must specify a save directory; to use the default do not use the -savedir flag")
+	}
+	if c.startEpisode > 0 && c.stopEpisode > 0 && c.stopEpisode < c.startEpisode {
+		return c, fmt.Errorf("episode at which to stop downloading, %d, must be either greater than the start episode, %d, or 0", c.stopEpisode, c.startEpisode)
+	}
+	if c.retain < 0 {
+		return c, fmt.Errorf("the number of episodes to retain, %d, must be 0 or greater", c.retain)
+	}
+	switch c.onLock {
+	case onLockExit, onLockWait, onLockSkip:
+	default:
+		return c, fmt.Errorf("unknown onlock action %q: must be exit, wait, or skip", c.onLock)
+	}
+
+	// resolve home dir
+	c.SaveDir = os.ExpandEnv(c.SaveDir)
+	c.stateFile = os.ExpandEnv(stateFile)
+	s, err := openStorage(c.SaveDir)
+	if err != nil {
+		return c, err
+	}
+	if !s.Local() {
+		if c.tag {
+			return c, fmt.Errorf("%s: audio files can only be tagged in local save dirs", c.SaveDir)
+		}
+		c.storage = s
+	}
+	return c, nil
+}
+
+// initConfig writes an example config file if one doesn't exist.
+var initConfig bool
+
+// exampleConfig is the config file written by config -init.
+var exampleConfig = ConfigFile{
+	Profiles: map[string]Profile{
+		"default": {SaveDir: defaultSaveDir, Assets: []string{"hq"}},
+	},
+}
+
+func configCommand() *Command {
+	c := newCommand("config", "", "show the config's profiles", `
+Config prints the location of the config file and its profiles. If -profile is
+specified, only that profile is printed.
+
+With -init, a config file with a default profile is written, unless the config
+file already exists.`, runConfig)
+	configFlags(c.Flags, true)
+	c.Flags.BoolVar(&initConfig, "init", false, "write a config file with a default profile if it doesn't exist")
+	return c
+}
+
+// runConfig prints the config file's profiles.
+func runConfig(cmd *Command, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("config: unexpected args: %s", strings.Join(args, " "))
+	}
+	path := os.ExpandEnv(configFile)
+	if initConfig {
+		_, err := os.Stat(path)
+		if err == nil {
+			return fmt.Errorf("config: %s already exists", path)
+		}
+		b, err := json.MarshalIndent(exampleConfig, "", "  ")
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(path, append(b, '\n'), 0644)
+		if err != nil {
+			return fmt.Errorf("config: %s", err)
+		}
+		fmt.Printf("wrote %s\n", path)
+		return nil
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("config: %s\n", path)
+	names := cfg.ProfileNames()
+	if profile != "" {
+		names = []string{profile}
+	}
+	for _, name := range names {
+		p, err := cfg.Profile(name)
+		if err != nil {
+			return err
+		}
+		b, err := json.MarshalIndent(p, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("\nprofile %s:\n%s\n", name, b)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFlagConf(t *testing.T) {
+	twenty := 20
+	zero := 0
+	flat, _ := ParseLayout(defaultLayout)
+	// the flag values
+	lastN = 1
+	concurrency = 1
+	saveDir = "/tmp/sn"
+	assetList = "hq"
+	stateFile = "/tmp/state.json"
+	defer func() {
+		saveDir = ""
+		assetList = ""
+		stateFile = defaultState
+	}()
+
+	tests := []struct {
+		p           *Profile
+		set         map[string]bool
+		expected    Conf
+		expectedErr string
+	}{
+		{
+			p:        nil,
+			expected: Conf{lastN: 1, assets: []Asset{assets["hq"]}, ConcurrentDL: 1, layout: flat, onLock: onLockExit, confirmSize: 5000000000, stateFile: "/tmp/state.json", SaveDir: "/tmp/sn"},
+		},
+		{
+			p:        &Profile{SaveDir: "/laptop", Assets: []string{"lq"}, LastN: &twenty, Retain: 20},
+			expected: Conf{lastN: 20, retain: 20, assets: []Asset{assets["lq"]}, ConcurrentDL: 1, layout: flat, onLock: onLockExit, confirmSize: 5000000000, stateFile: "/tmp/state.json", SaveDir: "/laptop"},
+		},
+		{
+			p:        &Profile{SaveDir: "/nas", Assets: []string{"hq", "txt"}, LastN: &zero, ConcurrentDL: 4},
+			expected: Conf{lastN: 0, assets: []Asset{assets["hq"], assets["txt"]}, ConcurrentDL: 4, layout: flat, onLock: onLockExit, confirmSize: 5000000000, stateFile: "/tmp/state.json", SaveDir: "/nas"},
+		},
+		{
+			p:        &Profile{SaveDir: "/laptop", LastN: &twenty},
+			set:      map[string]bool{"savedir": true, "lastn": true},
+			expected: Conf{lastN: 1, assets: []Asset{assets["hq"]}, ConcurrentDL: 1, layout: flat, onLock: onLockExit, confirmSize: 5000000000, stateFile: "/tmp/state.json", SaveDir: "/tmp/sn"},
+		},
+		{
+			p:        &Profile{SaveDir: "/laptop", LastN: &twenty},
+			set:      map[string]bool{"start": true},
+			expected: Conf{lastN: 1, assets: []Asset{assets["hq"]}, ConcurrentDL: 1, layout: flat, onLock: onLockExit, confirmSize: 5000000000, stateFile: "/tmp/state.json", SaveDir: "/laptop"},
+		},
+		{
+			p:           &Profile{Assets: []string{"ogg"}},
+			expectedErr: `unknown asset "ogg": supported assets are hq, lq, notes, pdf, txt`,
+		},
+		{
+			p:           &Profile{Start: 42, Stop: 11},
+			expectedErr: "episode at which to stop downloading, 11, must be either greater than the start episode, 42, or 0",
+		},
+	}
+
+	for i, test := range tests {
+		c, err := flagConf(test.p, test.set)
+		if err != nil {
+			if err.Error() != test.expectedErr {
+				t.Errorf("%d: got %q; want %q", i, err.Error(), test.expectedErr)
+			}
+			continue
+		}
+		if test.expectedErr != "" {
+			t.Errorf("%d: got no error; want %q", i, test.expectedErr)
+			continue
+		}
+		if !reflect.DeepEqual(c, test.expected) {
+			t.Errorf("%d: got %v; want %v", i, c, test.expected)
+		}
+	}
+
+	// -since selects the episodes to download and -keepsince is only the
+	// prune policy
+	since, keepSince = "2015", "2014"
+	defer func() {
+		since, keepSince = "", ""
+	}()
+	c, err := flagConf(nil, map[string]bool{"since": true, "keepsince": true})
+	if err != nil {
+		t.Fatalf("since: unexpected error: %s", err)
+	}
+	from := time.Date(2015, time.January, 1, 0, 0, 0, 0, time.UTC)
+	keep := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	if !c.dates.since.Equal(from) || !c.dates.until.IsZero() {
+		t.Errorf("since: got dates %v; want since %s", c.dates, from)
+	}
+	if !c.keepSince.Equal(keep) {
+		t.Errorf("keepsince: got %s; want %s", c.keepSince, keep)
+	}
+	if c.lastN != 0 {
+		t.Errorf("since: got lastn %d; want 0", c.lastN)
+	}
+}
@@ -0,0 +1,451 @@
+// Apache License Version 2.0
+// http://www.apache.org/licenses/
+// Copyright (c) 2016 Joel Scoble
+// See LICENSE file for license text.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	refsName    = indexDir + "/refs.json" // the cache of the references in the transcripts
+	refsVersion = 2                       // the version of the cache's format
+)
+
+// the refs flags
+var (
+	refsType string
+	refsJSON bool
+)
+
+func refsCommand() *Command {
+	c := newCommand("refs", "[ids...]", "list the CVEs, bulletins, vulnerabilities, and urls that episodes mention", `
+Refs finds the security advisories, named vulnerabilities, and urls mentioned
+in the selected episodes' transcripts and descriptions:
+
+    cve   CVE ids, e.g. CVE-2014-0160
+    ms    Microsoft security bulletins, e.g. MS08-067
+    kb    Microsoft knowledge base articles, e.g. KB4012212
+    vuln  named vulnerabilities, e.g. Heartbleed or Shellshock
+    url   urls, e.g. https://www.grc.com/sqrl/sqrl.htm
+
+The named vulnerabilities are the well known ones in snow's list, e.g.
+Heartbleed, Shellshock, POODLE, Spectre, and Meltdown. Names that are also
+words, e.g. BEAST, DROWN, or Meltdown, are only recognized when they are
+written the way the vulnerability's name is.
+
+Without ids, every reference is listed with the episodes that mention it. With
+ids, each mention of them is listed with its context. Use -json to export the
+references, with their episodes and contexts, as JSON.
+
+The transcripts come from the transcript index, which is updated first unless
+-noupdate is used; see "snow help index". By default, all episodes are
+searched.`, runRefs)
+	rangeFlags(c.Flags, 0)
+	libraryFlags(c.Flags)
+	configFlags(c.Flags, true)
+	mirrorFlag(c.Flags)
+	c.Flags.StringVar(&refsType, "type", "", "only list this type of reference: cve, ms, kb, vuln, or url")
+	c.Flags.BoolVar(&refsJSON, "json", false, "write the references as JSON")
+	c.Flags.IntVar(&grepContext, "context", 12, "the number of words before and after a mention to show")
+	c.Flags.BoolVar(&grepNoUpdate, "noupdate", false, "don't update the transcript index first")
+	return c
+}
+
+// runRefs lists the references.
+func runRefs(cmd *Command, args []string) error {
+	if refsType != "" && refPatterns[refsType] == nil {
+		return fmt.Errorf("refs: unknown type %q: must be %s", refsType, strings.Join(refTypes, ", "))
+	}
+	c, cat, err := selected(cmd)
+	if err != nil {
+		return err
+	}
+	if !grepNoUpdate {
+		idx, err := loadIndex(c.Storage())
+		if err != nil {
+			return err
+		}
+		_, err = updateIndex(c, idx, c.episodes)
+		if err != nil {
+			fmt.Printf("error updating the transcript index: %s\n", err)
+		}
+	}
+	rc, err := loadRefsCache(c.Storage())
+	if err != nil {
+		return err
+	}
+	xref, err := rc.Update(c, cat, c.episodes)
+	if err != nil {
+		return err
+	}
+	if refsType != "" {
+		xref = xref.Filter(func(r Ref) bool { return r.Type == refsType })
+	}
+	if len(args) > 0 {
+		want := make(map[string]bool)
+		for _, v := range args {
+			want[normalizeRef(v)] = true
+		}
+		xref = xref.Filter(func(r Ref) bool { return want[r.ID] })
+	}
+	if refsJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(xref.Export(cat))
+	}
+	for _, id := range xref.IDs() {
+		mentions := xref[id]
+		if len(args) == 0 {
+			fmt.Printf("%-24s %s\n", id, strings.Join(intStrings(mentionEpisodes(mentions)), " "))
+			continue
+		}
+		fmt.Println(id)
+		for _, m := range mentions {
+			fmt.Printf("  %4d  %-11s %s\n", m.Episode, m.Source+":", m.Context)
+		}
+	}
+	return nil
+}
+
+// refTypes are the types of references, in the order they are found.
+var refTypes = []string{"cve", "ms", "kb", "vuln", "url"}
+
+// refPatterns are the patterns of the references, keyed by type.
+var refPatterns = map[string]*regexp.Regexp{
+	"cve":  regexp.MustCompile(`(?i)\bCVE[- ]?(\d{4})[- ](\d{4,7})\b`),
+	"ms":   regexp.MustCompile(`(?i)\bMS(\d{2})-(\d{3})\b`),
+	"kb":   regexp.MustCompile(`(?i)\bKB ?(\d{6,7})\b`),
+	"vuln": vulnPattern(),
+	"url":  regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"'()\[\]{}]+`),
+}
+
+// namedVuln is a named vulnerability: its name and the pattern of its
+// mentions.
+type namedVuln struct {
+	name    string
+	pattern string
+	re      *regexp.Regexp // matches a whole mention
+}
+
+// vuln returns the namedVuln with the name and pattern.
+func vuln(name, pattern string) namedVuln {
+	return namedVuln{name: name, pattern: pattern, re: regexp.MustCompile(`^(?:` + pattern + `)$`)}
+}
+
+// namedVulns are the named vulnerabilities that refs recognizes. Names that
+// are also words are case sensitive so that only the vulnerability's name
+// matches, e.g. BEAST but not beast.
+var namedVulns = []namedVuln{
+	vuln("Heartbleed", `(?i:heart ?bleed)`),
+	vuln("Shellshock", `(?i:shell ?shock)`),
+	vuln("POODLE", `POODLE`),
+	vuln("BEAST", `BEAST`),
+	vuln("CRIME", `CRIME`),
+	vuln("BREACH", `BREACH`),
+	vuln("FREAK", `FREAK`),
+	vuln("Logjam", `Logjam|LOGJAM`),
+	vuln("DROWN", `DROWN`),
+	vuln("Sweet32", `(?i:sweet32)`),
+	vuln("GHOST", `GHOST`),
+	vuln("VENOM", `VENOM`),
+	vuln("Stagefright", `(?i:stagefright)`),
+	vuln("Rowhammer", `(?i:row ?hammer)`),
+	vuln("Dirty COW", `(?i:dirty ?cow)`),
+	vuln("Badlock", `(?i:badlock)`),
+	vuln("ImageTragick", `(?i:imagetragick)`),
+	vuln("Cloudbleed", `(?i:cloudbleed)`),
+	vuln("EternalBlue", `(?i:eternal ?blue)`),
+	vuln("KRACK", `KRACK|(?i:krack attack)`),
+	vuln("ROBOT", `ROBOT`),
+	vuln("Spectre", `(?i:spectre)`),
+	vuln("Meltdown", `Meltdown|MELTDOWN`),
+	vuln("Foreshadow", `Foreshadow|FORESHADOW`),
+	vuln("ZombieLoad", `(?i:zombieload)`),
+	vuln("BlueKeep", `(?i:blue ?keep)`),
+	vuln("Log4Shell", `(?i:log4shell)`),
+}
+
+// vulnPattern returns the pattern that matches the mentions of any of the
+// named vulnerabilities.
+func vulnPattern() *regexp.Regexp {
+	var alts []string
+	for _, v := range namedVulns {
+		alts = append(alts, v.pattern)
+	}
+	return regexp.MustCompile(`\b(?:` + strings.Join(alts, "|") + `)\b`)
+}
+
+// Ref is a reference in an episode's transcript or description.
+type Ref struct {
+	ID      string `json:"id"`      // the normalized reference, e.g. CVE-2014-0160
+	Type    string `json:"type"`    // the type of reference: cve, ms, kb, vuln, or url
+	Episode int    `json:"episode"` // the episode that mentions it
+	Source  string `json:"source"`  // where it was mentioned: transcript or description
+	Context string `json:"context"` // the words around the mention
+}
+
+// findRefs returns the references in text, with context words around each
+// one. A reference is only returned once per text; its first mention is its
+// context.
+func findRefs(text string, i int, source string, context int) []Ref {
+	var refs []Ref
+	seen := make(map[string]bool)
+	tokens := tokenize(text)
+	for _, typ := range refTypes {
+		for _, loc := range refPatterns[typ].FindAllStringIndex(text, -1) {
+			s := text[loc[0]:loc[1]]
+			if typ == "url" {
+				s = strings.TrimRight(s, ".,;:!?")
+			}
+			id := refID(typ, s)
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			pos, n := tokenSpan(tokens, loc[0], loc[0]+len(s))
+			refs = append(refs, Ref{ID: id, Type: typ, Episode: i, Source: source, Context: snippet(text, pos, n, context)})
+		}
+	}
+	return refs
+}
+
+// refID returns the normalized id of the reference s of type typ.
+func refID(typ, s string) string {
+	m := refPatterns[typ].FindStringSubmatch(s)
+	switch typ {
+	case "cve":
+		return "CVE-" + m[1] + "-" + m[2]
+	case "ms":
+		return "MS" + m[1] + "-" + m[2]
+	case "kb":
+		return "KB" + m[1]
+	case "vuln":
+		for _, v := range namedVulns {
+			if v.re.MatchString(s) {
+				return v.name
+			}
+		}
+		return s
+	}
+	// the scheme and host aren't case sensitive
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	parts := strings.SplitN(s, "/", 4)
+	parts[0] = strings.ToLower(parts[0])
+	parts[2] = strings.ToLower(parts[2])
+	return strings.Join(parts, "/")
+}
+
+// normalizeRef returns the normalized id of s, e.g. cve-2014-0160 is
+// CVE-2014-0160; if s isn't a reference, it's returned as is.
+func normalizeRef(s string) string {
+	for _, typ := range refTypes {
+		if loc := refPatterns[typ].FindStringIndex(s); loc != nil && loc[0] == 0 && loc[1] == len(s) {
+			return refID(typ, strings.TrimRight(s, ".,;:!?"))
+		}
+	}
+	return s
+}
+
+// tokenSpan returns the position of the first token that ends after start
+// and the number of tokens that start before end.
+func tokenSpan(tokens []token, start, end int) (pos, n int) {
+	pos = sort.Search(len(tokens), func(j int) bool { return tokens[j].end > start })
+	for j := pos; j < len(tokens) && tokens[j].start < end; j++ {
+		n++
+	}
+	if n == 0 {
+		n = 1
+	}
+	return pos, n
+}
+
+// CrossRef is the mentions of each reference, keyed by id.
+type CrossRef map[string][]Ref
+
+// IDs returns the references' ids, sorted.
+func (x CrossRef) IDs() []string {
+	var ids []string
+	for id := range x {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Filter returns the mentions that keep returns true for.
+func (x CrossRef) Filter(keep func(Ref) bool) CrossRef {
+	f := make(CrossRef)
+	for id, mentions := range x {
+		for _, m := range mentions {
+			if keep(m) {
+				f[id] = append(f[id], m)
+			}
+		}
+	}
+	return f
+}
+
+// RefExport is a reference, as exported to JSON.
+type RefExport struct {
+	ID       string          `json:"id"`
+	Type     string          `json:"type"`
+	Mentions []MentionExport `json:"mentions"`
+}
+
+// MentionExport is a mention of a reference, as exported to JSON.
+type MentionExport struct {
+	Episode int    `json:"episode"`
+	Title   string `json:"title,omitempty"`
+	Date    string `json:"date,omitempty"`
+	Source  string `json:"source"`
+	Context string `json:"context"`
+}
+
+// Export returns the cross reference for exporting; the catalog's titles and
+// dates are included.
+func (x CrossRef) Export(cat Catalog) []RefExport {
+	refs := []RefExport{}
+	for _, id := range x.IDs() {
+		mentions := x[id]
+		r := RefExport{ID: id, Type: mentions[0].Type}
+		for _, m := range mentions {
+			e := cat[m.Episode]
+			me := MentionExport{Episode: m.Episode, Title: e.Title, Source: m.Source, Context: m.Context}
+			if !e.Date.IsZero() {
+				me.Date = e.Date.Format("2006-01-02")
+			}
+			r.Mentions = append(r.Mentions, me)
+		}
+		refs = append(refs, r)
+	}
+	return refs
+}
+
+// mentionEpisodes returns the episodes of the mentions, sorted, without
+// duplicates.
+func mentionEpisodes(mentions []Ref) []int {
+	seen := make(map[int]bool)
+	var episodes []int
+	for _, m := range mentions {
+		if !seen[m.Episode] {
+			seen[m.Episode] = true
+			episodes = append(episodes, m.Episode)
+		}
+	}
+	sort.Ints(episodes)
+	return episodes
+}
+
+// intStrings returns the ints as strings.
+func intStrings(v []int) []string {
+	s := make([]string, len(v))
+	for i, n := range v {
+		s[i] = fmt.Sprint(n)
+	}
+	return s
+}
+
+// refsCache caches the references in the transcripts so that only new, or
+// changed, transcripts are searched. The descriptions are always searched.
+type refsCache struct {
+	Version  int                     `json:"version"`
+	Episodes map[int]*transcriptRefs `json:"episodes"`
+
+	storage Storage
+}
+
+// transcriptRefs is the references in a transcript.
+type transcriptRefs struct {
+	Size    int   `json:"size"`    // the size of the transcript that was searched
+	Context int   `json:"context"` // the number of context words
+	Refs    []Ref `json:"refs,omitempty"`
+}
+
+// loadRefsCache loads the cache in s; if there isn't one, an empty one is
+// returned.
+func loadRefsCache(s Storage) (*refsCache, error) {
+	rc := &refsCache{Version: refsVersion, Episodes: make(map[int]*transcriptRefs), storage: s}
+	b, err := readStorage(s, refsName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return rc, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(b, rc)
+	if err != nil || rc.Version != refsVersion {
+		// the cache is rebuilt
+		Verbose(fmt.Sprintf("%s: ignored: %v", s.Path(refsName), err))
+		return &refsCache{Version: refsVersion, Episodes: make(map[int]*transcriptRefs), storage: s}, nil
+	}
+	if rc.Episodes == nil {
+		rc.Episodes = make(map[int]*transcriptRefs)
+	}
+	return rc, nil
+}
+
+// Update searches the episodes' transcripts that aren't in the cache, or
+// that changed, and saves the cache. The cross reference of the episodes'
+// transcripts and the catalog's descriptions is returned.
+func (rc *refsCache) Update(c Conf, cat Catalog, episodes []int) (CrossRef, error) {
+	changed := make(map[int]*transcriptRefs)
+	xref := make(CrossRef)
+	for _, i := range episodes {
+		text, err := transcriptText(c, i)
+		if err == nil {
+			tr := rc.Episodes[i]
+			if tr == nil || tr.Size != len(text) || tr.Context != grepContext {
+				tr = &transcriptRefs{Size: len(text), Context: grepContext, Refs: findRefs(text, i, "transcript", grepContext)}
+				rc.Episodes[i] = tr
+				changed[i] = tr
+			}
+			for _, r := range tr.Refs {
+				xref[r.ID] = append(xref[r.ID], r)
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("episode %d: %s", i, err)
+		}
+		if e, ok := cat[i]; ok {
+			for _, r := range findRefs(e.Description, i, "description", grepContext) {
+				xref[r.ID] = append(xref[r.ID], r)
+			}
+		}
+	}
+	if len(changed) == 0 {
+		return xref, nil
+	}
+	return xref, rc.save(changed)
+}
+
+// save writes the cache to its storage. So that concurrent updates aren't
+// lost, the saved cache is reloaded, while the save dir's mutex is held, and
+// the changed episodes are merged into it.
+func (rc *refsCache) save(changed map[int]*transcriptRefs) error {
+	m, err := lockMutex(rc.storage)
+	if err != nil {
+		return fmt.Errorf("error locking %s: %s", rc.storage.Path(refsName), err)
+	}
+	defer m.Unlock()
+	cur, err := loadRefsCache(rc.storage)
+	if err != nil {
+		return err
+	}
+	for i, tr := range changed {
+		cur.Episodes[i] = tr
+	}
+	rc.Episodes = cur.Episodes
+	b, err := json.Marshal(cur)
+	if err != nil {
+		return err
+	}
+	return writeStorage(rc.storage, refsName, b)
+}
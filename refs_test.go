@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFindRefs(t *testing.T) {
+	text := `Steve: Heartbleed, CVE-2014-0160, and then cve 2014-6271 for Shellshock.
+Leo: Was that MS08-067? Steve: Yes, patched by KB 958644, see https://technet.microsoft.com/library/security/ms08-067.aspx.
+And again, CVE-2014-0160. Go to WWW.GRC.com/sn/ for the notes. It's a beast of a bug, like BEAST.`
+	refs := findRefs(text, 500, "transcript", 2)
+	var ids []string
+	for _, r := range refs {
+		ids = append(ids, r.Type+" "+r.ID)
+	}
+	expected := []string{
+		"cve CVE-2014-0160",
+		"cve CVE-2014-6271",
+		"ms MS08-067",
+		"kb KB958644",
+		"vuln Heartbleed",
+		"vuln Shellshock",
+		"vuln BEAST",
+		"url https://technet.microsoft.com/library/security/ms08-067.aspx",
+		"url http://www.grc.com/sn/",
+	}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Errorf("got %q; want %q", ids, expected)
+	}
+	if refs[0].Context != "Steve: Heartbleed, CVE-2014-0160, and then..." {
+		t.Errorf("context: got %q", refs[0].Context)
+	}
+	if refs[2].Context != "...Was that MS08-067? Steve: Yes..." {
+		t.Errorf("context: got %q", refs[2].Context)
+	}
+	if refs[0].Episode != 500 || refs[0].Source != "transcript" {
+		t.Errorf("got episode %d, source %s; want 500, transcript", refs[0].Episode, refs[0].Source)
+	}
+}
+
+func TestNormalizeRef(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected string
+	}{
+		{"cve-2014-0160", "CVE-2014-0160"},
+		{"CVE 2014-0160", "CVE-2014-0160"},
+		{"ms17-010", "MS17-010"},
+		{"kb4012212", "KB4012212"},
+		{"HTTPS://GRC.com/SQRL", "https://grc.com/SQRL"},
+		{"heartbleed", "Heartbleed"},
+		{"dirty cow", "Dirty COW"},
+		{"BEAST", "BEAST"},
+		{"beast", "beast"},
+		{"truecrypt", "truecrypt"},
+	}
+	for i, test := range tests {
+		got := normalizeRef(test.s)
+		if got != test.expected {
+			t.Errorf("%d: got %q; want %q", i, got, test.expected)
+		}
+	}
+}
+
+func TestRefsCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "sn-451.txt"), []byte("Steve: CVE-2014-0160 is Heartbleed."), 0644)
+	c := Conf{SaveDir: dir}
+	cat := Catalog{
+		451: {Number: 451, Title: "TrueCrypt & Heartbleed", Description: "All about Heartbleed, CVE-2014-0160."},
+		452: {Number: 452, Title: "Heartbleed Aftermath", Description: "See MS14-066."},
+	}
+	rc, err := loadRefsCache(c.Storage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	xref, err := rc.Update(c, cat, []int{451, 452})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := xref.IDs(); !reflect.DeepEqual(got, []string{"CVE-2014-0160", "Heartbleed", "MS14-066"}) {
+		t.Errorf("ids: got %v", got)
+	}
+	if n := len(xref["CVE-2014-0160"]); n != 2 {
+		t.Errorf("CVE-2014-0160: got %d mentions; want 2", n)
+	}
+	if n := len(xref["Heartbleed"]); n != 2 {
+		t.Errorf("Heartbleed: got %d mentions; want 2", n)
+	}
+
+	// the cached references are used
+	rc, _ = loadRefsCache(c.Storage())
+	if rc.Episodes[451] == nil || len(rc.Episodes[451].Refs) != 2 {
+		t.Fatalf("the transcript's references weren't cached: %+v", rc.Episodes[451])
+	}
+	rc.Episodes[451].Refs[0].ID = "CVE-cached"
+	xref, _ = rc.Update(c, cat, []int{451})
+	if len(xref["CVE-cached"]) != 1 {
+		t.Error("the cache wasn't used")
+	}
+
+	x := xref.Filter(func(r Ref) bool { return r.Source == "description" })
+	exp := x.Export(cat)
+	if len(exp) != 2 || exp[0].ID != "CVE-2014-0160" || exp[1].ID != "Heartbleed" || exp[0].Mentions[0].Title != "TrueCrypt & Heartbleed" {
+		t.Errorf("export: got %+v", exp)
+	}
+
+	// concurrent updates aren't lost
+	ioutil.WriteFile(filepath.Join(dir, "sn-453.txt"), []byte("Steve: MS14-066 again."), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "sn-454.txt"), []byte("Steve: CVE-2014-6271 is Shellshock."), 0644)
+	rc1, _ := loadRefsCache(c.Storage())
+	rc2, _ := loadRefsCache(c.Storage())
+	_, err = rc1.Update(c, cat, []int{453})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rc2.Update(c, cat, []int{454})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, _ = loadRefsCache(c.Storage())
+	if rc.Episodes[451] == nil || rc.Episodes[453] == nil || rc.Episodes[454] == nil {
+		t.Errorf("concurrent updates: got %v; want 451, 453, and 454", rc.Episodes)
+	}
+}
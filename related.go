@@ -0,0 +1,221 @@
+// Apache License Version 2.0
+// http://www.apache.org/licenses/
+// Copyright (c) 2016 Joel Scoble
+// See LICENSE file for license text.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The weight of each part of an episode when comparing episodes; a word in a
+// title counts as much as it being in the transcript three times.
+const (
+	titleWeight       = 3
+	descriptionWeight = 2
+	transcriptWeight  = 1
+)
+
+// the related flags
+var (
+	relatedN             int
+	relatedJSON          bool
+	relatedNoTranscripts bool
+)
+
+func relatedCommand() *Command {
+	c := newCommand("related", "episode", "list the episodes that are most like an episode", `
+Related lists the episodes that are most like the episode, most similar first,
+with their similarity: 1 is identical and 0 has nothing in common. Episodes are
+compared by the words in their titles, descriptions, and transcripts, using
+BM25 weighted term vectors: words that are in few episodes count for more than
+words that are in many.
+
+The transcripts come from the transcript index, which is updated first unless
+-noupdate is used; see "snow help index". With -notranscripts, only the titles
+and descriptions are compared.`, runRelated)
+	libraryFlags(c.Flags)
+	configFlags(c.Flags, true)
+	mirrorFlag(c.Flags)
+	c.Flags.IntVar(&relatedN, "n", 10, "the number of related episodes to list")
+	c.Flags.BoolVar(&relatedJSON, "json", false, "write the related episodes as JSON")
+	c.Flags.BoolVar(&relatedNoTranscripts, "notranscripts", false, "only compare the titles and descriptions")
+	c.Flags.BoolVar(&grepNoUpdate, "noupdate", false, "don't update the transcript index first")
+	return c
+}
+
+// runRelated lists the episodes related to an episode.
+func runRelated(cmd *Command, args []string) error {
+	if len(args) != 1 {
+		return errors.New("related: a single episode must be specified")
+	}
+	i, err := strconv.Atoi(args[0])
+	if err != nil || i < 1 {
+		return fmt.Errorf("related: %q isn't an episode number", args[0])
+	}
+	cs, err := confs(cmd.Flags)
+	if err != nil {
+		return err
+	}
+	c := cs[0]
+	cat, err := runCatalog.Get(allYears(time.Now())...)
+	if err != nil {
+		return fmt.Errorf("error getting the episode catalog: %s", err)
+	}
+	if _, ok := cat[i]; !ok {
+		return fmt.Errorf("related: episode %d isn't in the episode archive", i)
+	}
+	var idx *TranscriptIndex
+	if !relatedNoTranscripts {
+		idx, err = loadIndex(c.Storage())
+		if err != nil {
+			return err
+		}
+		if !grepNoUpdate {
+			_, err = updateIndex(c, idx, cat.Numbers())
+			if err != nil {
+				fmt.Printf("error updating the transcript index: %s\n", err)
+			}
+		}
+	}
+	related := newRelatedModel(cat, idx).Related(i, relatedN)
+	if relatedJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(related)
+	}
+	for _, r := range related {
+		fmt.Printf("%s  (%.3f)\n", episodeLine(cat[r.Episode], nil), r.Score)
+	}
+	return nil
+}
+
+// Related is an episode that is related to another one.
+type Related struct {
+	Episode int     `json:"episode"`
+	Title   string  `json:"title"`
+	Score   float64 `json:"score"` // the cosine similarity of the episodes: 0 to 1
+}
+
+// relatedModel is the term vectors of the episodes, for finding similar
+// episodes.
+type relatedModel struct {
+	catalog Catalog
+	vectors map[int]map[string]float64 // unit length, keyed by episode
+}
+
+// newRelatedModel returns the model of the catalog's episodes; if idx isn't
+// nil, the episodes' transcripts are part of the model.
+func newRelatedModel(cat Catalog, idx *TranscriptIndex) *relatedModel {
+	// the weighted term frequencies and lengths of each episode
+	tfs := make(map[int]map[string]int)
+	lengths := make(map[int]int)
+	add := func(i int, w string, n int) {
+		if tfs[i] == nil {
+			tfs[i] = make(map[string]int)
+		}
+		tfs[i][w] += n
+		lengths[i] += n
+	}
+	for i, e := range cat {
+		for _, w := range words(e.Title) {
+			add(i, w, titleWeight)
+		}
+		for _, w := range words(e.Description) {
+			add(i, w, descriptionWeight)
+		}
+	}
+	if idx != nil {
+		for w, postings := range idx.terms {
+			for _, p := range postings {
+				if _, ok := cat[p.episode]; ok {
+					add(p.episode, w, transcriptWeight*len(p.positions))
+				}
+			}
+		}
+	}
+
+	df := make(map[string]int)
+	var avg float64
+	for i, tf := range tfs {
+		for w := range tf {
+			df[w]++
+		}
+		avg += float64(lengths[i])
+	}
+	m := &relatedModel{catalog: cat, vectors: make(map[int]map[string]float64)}
+	if len(tfs) == 0 {
+		return m
+	}
+	n := float64(len(tfs))
+	avg /= n
+	for i, tf := range tfs {
+		v := make(map[string]float64)
+		var norm float64
+		l := float64(lengths[i])
+		for w, f := range tf {
+			// one letter words and the words that are in most episodes
+			// don't say what an episode is about
+			if len(w) < 2 || float64(df[w]) > n/2 {
+				continue
+			}
+			idf := math.Log(1 + (n-float64(df[w])+0.5)/(float64(df[w])+0.5))
+			x := idf * float64(f) * (bm25K1 + 1) / (float64(f) + bm25K1*(1-bm25B+bm25B*l/avg))
+			v[w] = x
+			norm += x * x
+		}
+		norm = math.Sqrt(norm)
+		for w := range v {
+			v[w] /= norm
+		}
+		m.vectors[i] = v
+	}
+	return m
+}
+
+// Related returns the n episodes that are most similar to episode i, most
+// similar first.
+func (m *relatedModel) Related(i, n int) []Related {
+	related := []Related{}
+	v, ok := m.vectors[i]
+	if !ok || len(v) == 0 {
+		return related
+	}
+	for j, o := range m.vectors {
+		if j == i {
+			continue
+		}
+		var score float64
+		for w, x := range v {
+			score += x * o[w]
+		}
+		if score > 0 {
+			related = append(related, Related{Episode: j, Title: m.catalog[j].Title, Score: score})
+		}
+	}
+	sort.Sort(bySimilarity(related))
+	if n > 0 && len(related) > n {
+		related = related[:n]
+	}
+	return related
+}
+
+// bySimilarity sorts related episodes by score, highest first, and then by
+// episode.
+type bySimilarity []Related
+
+func (r bySimilarity) Len() int      { return len(r) }
+func (r bySimilarity) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r bySimilarity) Less(i, j int) bool {
+	if r[i].Score != r[j].Score {
+		return r[i].Score > r[j].Score
+	}
+	return r[i].Episode < r[j].Episode
+}
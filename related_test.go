@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRelated(t *testing.T) {
+	cat := Catalog{
+		498: {Number: 498, Title: "Certificate Authorities"},
+		499: {Number: 499, Title: "Secure Boot", Description: "Is secure boot secure?"},
+		500: {Number: 500, Title: "Windows Secure Boot"},
+		501: {Number: 501, Title: "Password Managers"},
+	}
+	tests := []struct {
+		idx      *TranscriptIndex
+		episode  int
+		n        int
+		expected []int
+	}{
+		{nil, 500, 10, []int{499}},
+		{nil, 501, 10, []int{}},
+		{nil, 502, 10, []int{}},
+		{testIndex(), 500, 10, []int{499}},
+		{testIndex(), 501, 10, []int{499}},
+		{testIndex(), 499, 10, []int{500, 501}},
+		{testIndex(), 499, 1, []int{500}},
+		{testIndex(), 499, 0, []int{500, 501}},
+	}
+	for i, test := range tests {
+		related := newRelatedModel(cat, test.idx).Related(test.episode, test.n)
+		got := []int{}
+		for j, r := range related {
+			got = append(got, r.Episode)
+			if r.Score <= 0 || r.Score > 1.000001 {
+				t.Errorf("%d: %d: got score %f; want (0, 1]", i, r.Episode, r.Score)
+			}
+			if j > 0 && r.Score > related[j-1].Score {
+				t.Errorf("%d: %d: got score %f after %f; want descending scores", i, r.Episode, r.Score, related[j-1].Score)
+			}
+			if r.Title != cat[r.Episode].Title {
+				t.Errorf("%d: %d: got title %q; want %q", i, r.Episode, r.Title, cat[r.Episode].Title)
+			}
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%d: got %v; want %v", i, got, test.expected)
+		}
+	}
+}
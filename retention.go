@@ -0,0 +1,201 @@
+// Apache License Version 2.0
+// http://www.apache.org/licenses/
+// Copyright (c) 2016 Joel Scoble
+// See LICENSE file for license text.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// dryRun reports what would be done without doing it.
+var dryRun bool
+
+func pruneCommand() *Command {
+	c := newCommand("prune", "", "remove episodes according to the prune policies", `
+Prune removes episodes from the save directory according to the prune
+policies:
+
+    -retain         keep the last n episodes; older ones are removed
+    -keepsince      remove episodes aired before the date
+    -prunelq        remove the lq files of episodes whose hq file exists
+    -prunelistened  remove the episodes that are marked as played, see
+                    "snow help mark"
+
+An episode is removed if any of the policies removes it. The removed files are
+recorded in the save directory's download history so that they aren't
+downloaded again, unless -overwrite is used. The policies are also applied
+after each get and sync. If a profile is used, its policies are used for any
+policy flag that isn't specified.
+
+Use -dryrun to list what would be removed.`, runPrune)
+	pruneFlags(c.Flags)
+	c.Flags.BoolVar(&dryRun, "dryrun", false, "list what would be removed without removing anything")
+	libraryFlags(c.Flags)
+	configFlags(c.Flags, true)
+	return c
+}
+
+// runPrune removes the episodes that the prune policies don't keep.
+func runPrune(cmd *Command, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("prune: unexpected args: %s", strings.Join(args, " "))
+	}
+	cs, err := confs(cmd.Flags)
+	if err != nil {
+		return err
+	}
+	c := cs[0]
+	if !c.prunes() {
+		return errors.New("prune: no prune policy was specified: use -retain, -keepsince, -prunelq, or -prunelistened")
+	}
+	last, err := lastEpisode()
+	if err != nil {
+		return err
+	}
+	lock, err := lockSaveDir(&c)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	h, err := loadHistory(c.Storage())
+	if err != nil {
+		return fmt.Errorf("error loading the download history: %s", err)
+	}
+	removed, err := pruneLibrary(c, last, h, dryRun)
+	for _, v := range removed {
+		if dryRun {
+			fmt.Printf("%s: would be removed, %s\n", v.path, v.reason)
+			continue
+		}
+		fmt.Printf("%s: removed, %s\n", v.path, v.reason)
+	}
+	return err
+}
+
+// prunes returns whether the conf has any prune policies.
+func (c Conf) prunes() bool {
+	return c.retain > 0 || !c.keepSince.IsZero() || c.pruneLQ || c.pruneListened
+}
+
+// prunedFile is a file that was removed by a prune policy.
+type prunedFile struct {
+	path    string
+	reason  string // why it was removed
+	episode int
+	asset   Asset
+}
+
+// pruneLibrary removes the files of c's assets for every episode, up to last,
+// that c's prune policies don't keep; with the prunelq policy, an episode's lq
+// file is removed if its hq file exists regardless of c's assets. The removed
+// files are recorded in the history. If dryRun is true, the files that would
+// be removed are returned without removing them.
+func pruneLibrary(c Conf, last int, h *History, dryRun bool) ([]prunedFile, error) {
+	var removed []prunedFile
+	if !c.prunes() {
+		return removed, nil
+	}
+	var cat Catalog
+	if !c.keepSince.IsZero() {
+		var years []int
+		for y := FirstYear; y <= c.keepSince.Year(); y++ {
+			years = append(years, y)
+		}
+		var err error
+		cat, err = runCatalog.Get(years...)
+		if err != nil {
+			return removed, fmt.Errorf("error getting the episode catalog: %s", err)
+		}
+	}
+	var st *State
+	if c.pruneListened {
+		var err error
+		st, err = loadUserState(c)
+		if err != nil {
+			return removed, err
+		}
+	}
+	var err error
+	s := c.Storage()
+	for i := 1; i <= last; i++ {
+		as := c.assets
+		reason := pruneReason(c, last, i, cat, st)
+		if reason == "" {
+			if !c.pruneLQ {
+				continue
+			}
+			var hq string
+			hq, err = c.layout.Name(assets["hq"], i)
+			if err != nil {
+				break
+			}
+			if !storageExists(s, hq) {
+				continue
+			}
+			as = []Asset{assets["lq"]}
+			reason = "the hq file exists"
+		}
+		for _, a := range as {
+			var name string
+			name, err = c.layout.Name(a, i)
+			if err != nil {
+				break
+			}
+			if !storageExists(s, name) {
+				continue
+			}
+			if !dryRun {
+				err = s.Remove(name)
+				if err != nil {
+					break
+				}
+				h.MarkPruned(a, i)
+				err = removeSidecars(s, name, a)
+				if err != nil {
+					break
+				}
+			}
+			removed = append(removed, prunedFile{path: s.Path(name), reason: reason, episode: i, asset: a})
+		}
+		if err != nil {
+			break
+		}
+	}
+	if dryRun || len(removed) == 0 {
+		return removed, err
+	}
+	herr := h.Save()
+	if err == nil && herr != nil {
+		err = fmt.Errorf("error saving the download history: %s", herr)
+	}
+	return removed, err
+}
+
+// pruneReason returns why the prune policies remove episode i; if the episode
+// is kept, an empty string is returned. st is only used by the prunelistened
+// policy.
+func pruneReason(c Conf, last, i int, cat Catalog, st *State) string {
+	if c.retain > 0 && i <= last-c.retain {
+		return fmt.Sprintf("older than the last %d episodes", c.retain)
+	}
+	if !c.keepSince.IsZero() {
+		e, ok := cat[i]
+		if ok && !e.Date.IsZero() && e.Date.Before(c.keepSince) {
+			return fmt.Sprintf("aired before %s", c.keepSince.Format("2006-01-02"))
+		}
+	}
+	if c.pruneListened && st.State(i) == Played {
+		return "played"
+	}
+	return ""
+}
+
+// exists returns whether there's a file at p.
+func exists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestPruneLibrary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"sn-001.mp3", "sn-001.mp3.json", "sn-001.nfo", "sn-002.mp3", "sn-003.mp3", "sn-003-lq.mp3", "sn-004-lq.mp3", "sn-005.mp3"} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stateDir, err := ioutil.TempDir("", "snow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stateDir)
+	// episode 2 is played
+	stateFile := filepath.Join(stateDir, "state.json")
+	err = ioutil.WriteFile(stateFile, []byte(`{"version": 1, "episodes": {"2": {"state": "played", "updated": "2016-05-01T00:00:00Z"}}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := loadHistory(localStorage{dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Conf{SaveDir: dir, assets: []Asset{assets["hq"]}, retain: 4, pruneLQ: true, pruneListened: true, stateFile: stateFile}
+
+	// a dry run doesn't remove anything
+	expected := []string{"sn-001.mp3", "sn-002.mp3", "sn-003-lq.mp3"}
+	removed, err := pruneLibrary(c, 5, h, true)
+	if err != nil {
+		t.Fatalf("dry run: unexpected error: %s", err)
+	}
+	if got := prunedNames(removed); !reflect.DeepEqual(got, expected) {
+		t.Errorf("dry run: got %v; want %v", got, expected)
+	}
+	if !exists(filepath.Join(dir, "sn-001.mp3")) {
+		t.Error("dry run: sn-001.mp3 was removed")
+	}
+
+	removed, err = pruneLibrary(c, 5, h, false)
+	if err != nil {
+		t.Fatalf("prune: unexpected error: %s", err)
+	}
+	if got := prunedNames(removed); !reflect.DeepEqual(got, expected) {
+		t.Errorf("prune: got %v; want %v", got, expected)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	var names []string
+	for _, fi := range files {
+		names = append(names, fi.Name())
+	}
+	want := []string{historyName, "sn-003.mp3", "sn-004-lq.mp3", "sn-005.mp3"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("files: got %v; want %v", names, want)
+	}
+
+	// the pruned files are in the saved history and aren't downloaded again
+	h, err = loadHistory(localStorage{dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.Pruned(assets["hq"], 1) || !h.Pruned(assets["lq"], 3) || h.Pruned(assets["hq"], 3) {
+		t.Error("history: the pruned files weren't recorded")
+	}
+	m := &MP3{storage: localStorage{dir: dir}, history: h}
+	d := m.Get(assets["hq"], 1)
+	if !d.skipped || !d.pruned {
+		t.Errorf("get: got skipped %t pruned %t; want true true", d.skipped, d.pruned)
+	}
+}
+
+func prunedNames(files []prunedFile) []string {
+	var names []string
+	for _, v := range files {
+		names = append(names, filepath.Base(v.path))
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,402 @@
+// Apache License Version 2.0
+// http://www.apache.org/licenses/
+// Copyright (c) 2016 Joel Scoble
+// See LICENSE file for license text.
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	s3Scheme        = "s3://"
+	s3DefaultRegion = "us-east-1"
+	// the hash of an empty payload, which is what every request but PUT has
+	s3EmptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// s3Storage is a bucket, or a prefix within one, in an S3 compatible object
+// store, e.g. AWS S3 or MinIO. The store's endpoint and credentials come from
+// the environment:
+//
+//	SNOW_S3_ENDPOINT       the url of the store; defaults to AWS S3
+//	AWS_REGION             the region of the bucket; defaults to us-east-1
+//	AWS_ACCESS_KEY_ID      the access key; if empty, requests aren't signed
+//	AWS_SECRET_ACCESS_KEY  the secret key
+//
+// Buckets are addressed by path, e.g. http://minio:9000/bucket/key, which
+// every S3 compatible store supports.
+type s3Storage struct {
+	endpoint  *url.URL
+	bucket    string
+	prefix    string // the prefix of the library's keys; empty or ending in /
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+	now       func() time.Time
+}
+
+// newS3Storage returns the s3Storage for the url, s3://bucket/prefix.
+func newS3Storage(u string) (*s3Storage, error) {
+	loc := strings.TrimPrefix(u, s3Scheme)
+	parts := strings.SplitN(loc, "/", 2)
+	if parts[0] == "" {
+		return nil, fmt.Errorf("%s: no bucket", u)
+	}
+	s := &s3Storage{
+		bucket:    parts[0],
+		region:    os.Getenv("AWS_REGION"),
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		client:    http.DefaultClient,
+		now:       time.Now,
+	}
+	if len(parts) == 2 {
+		s.prefix = strings.Trim(parts[1], "/")
+		if s.prefix != "" {
+			s.prefix += "/"
+		}
+	}
+	if s.region == "" {
+		s.region = s3DefaultRegion
+	}
+	endpoint := os.Getenv("SNOW_S3_ENDPOINT")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s.region)
+	}
+	var err error
+	s.endpoint, err = url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("SNOW_S3_ENDPOINT: %s", err)
+	}
+	if s.endpoint.Scheme != "http" && s.endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("SNOW_S3_ENDPOINT: %q must be an http or https url", endpoint)
+	}
+	return s, nil
+}
+
+// key returns the object key of the named file.
+func (s *s3Storage) key(name string) string {
+	return s.prefix + name
+}
+
+// objectURL returns the url of the object with the key. The path is escaped
+// the way that it's escaped in the signature.
+func (s *s3Storage) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	u.Path = s.endpoint.Path + "/" + s.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3Escape(u.Path, false)
+	return &u
+}
+
+func (s *s3Storage) Stat(name string) (StorageInfo, error) {
+	resp, err := s.do("HEAD", s.key(name), nil, nil, s3EmptyHash, nil)
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return StorageInfo{}, &os.PathError{Op: "stat", Path: s.Path(name), Err: os.ErrNotExist}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return StorageInfo{}, s3Error("HEAD", s.Path(name), resp)
+	}
+	fi := StorageInfo{Name: name, Size: resp.ContentLength}
+	fi.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return fi, nil
+}
+
+func (s *s3Storage) Open(name string) (io.ReadCloser, error) {
+	resp, err := s.do("GET", s.key(name), nil, nil, s3EmptyHash, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, &os.PathError{Op: "open", Path: s.Path(name), Err: os.ErrNotExist}
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, s3Error("GET", s.Path(name), resp)
+	}
+	return resp.Body, nil
+}
+
+// Create writes to a temporary local file that is uploaded on commit. A PUT
+// is atomic: the object isn't replaced unless the whole file is uploaded.
+func (s *s3Storage) Create(name string) (StorageWriter, error) {
+	f, err := ioutil.TempFile("", "snow-s3-")
+	if err != nil {
+		return nil, err
+	}
+	return &s3Writer{s: s, name: name, f: f, hash: sha256.New()}, nil
+}
+
+// s3ListResult is the response to a ListObjectsV2 request.
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *s3Storage) List(prefix string) ([]StorageInfo, error) {
+	var files []StorageInfo
+	var token string
+	for {
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("prefix", s.key(prefix))
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := s.do("GET", "", q, nil, s3EmptyHash, nil)
+		if err != nil {
+			return files, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			defer resp.Body.Close()
+			return files, s3Error("GET", s.Path(prefix), resp)
+		}
+		var res s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return files, fmt.Errorf("error listing %s: %s", s.Path(prefix), err)
+		}
+		for _, v := range res.Contents {
+			files = append(files, StorageInfo{Name: strings.TrimPrefix(v.Key, s.prefix), Size: v.Size, ModTime: v.LastModified})
+		}
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			return files, nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+func (s *s3Storage) Remove(name string) error {
+	resp, err := s.do("DELETE", s.key(name), nil, nil, s3EmptyHash, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s3Error("DELETE", s.Path(name), resp)
+	}
+	return nil
+}
+
+// CreateExclusive uses a conditional PUT, If-None-Match: *, which the store
+// rejects if the object exists.
+func (s *s3Storage) CreateExclusive(name string, b []byte) error {
+	sum := sha256.Sum256(b)
+	header := http.Header{"If-None-Match": {"*"}}
+	resp, err := s.do("PUT", s.key(name), nil, bytes.NewReader(b), hex.EncodeToString(sum[:]), header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		// a conflict is a concurrent conditional PUT of the same object
+		return &os.PathError{Op: "create", Path: s.Path(name), Err: os.ErrExist}
+	}
+	return s3Error("PUT", s.Path(name), resp)
+}
+
+func (s *s3Storage) Path(name string) string {
+	return s3Scheme + s.bucket + "/" + s.key(name)
+}
+
+func (s *s3Storage) Local() bool {
+	return false
+}
+
+// do sends a request for the object with the key; if key is empty, the
+// request is for the bucket. The body's length and the hex encoded SHA256 of
+// its contents must be known because they're part of the signature. The
+// header, if it isn't nil, is added to the request.
+func (s *s3Storage) do(method, key string, q url.Values, body io.ReadSeeker, payloadHash string, header http.Header) (*http.Response, error) {
+	u := s.objectURL(key)
+	u.RawQuery = s3Query(q)
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		n, err := body.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+		_, err = body.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(body)
+		req.ContentLength = n
+	}
+	req.Header.Set("User-Agent", UA)
+	if s.accessKey != "" {
+		signS3(req, payloadHash, s.region, s.accessKey, s.secretKey, s.now())
+	}
+	return s.client.Do(req)
+}
+
+// s3Writer is an s3Storage file that is being written.
+type s3Writer struct {
+	s    *s3Storage
+	name string
+	f    *os.File
+	hash hash.Hash
+}
+
+func (w *s3Writer) Write(b []byte) (int, error) {
+	n, err := w.f.Write(b)
+	w.hash.Write(b[:n])
+	return n, err
+}
+
+func (w *s3Writer) Commit() error {
+	defer w.Abort()
+	resp, err := w.s.do("PUT", w.s.key(w.name), nil, w.f, hex.EncodeToString(w.hash.Sum(nil)), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error("PUT", w.s.Path(w.name), resp)
+	}
+	return nil
+}
+
+func (w *s3Writer) Abort() error {
+	w.f.Close()
+	return os.Remove(w.f.Name())
+}
+
+// s3ErrorResponse is the body of an error response.
+type s3ErrorResponse struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// s3Error returns the error for the unexpected response to a request for the
+// path.
+func s3Error(method, path string, resp *http.Response) error {
+	var e s3ErrorResponse
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if xml.Unmarshal(b, &e) == nil && e.Code != "" {
+		return fmt.Errorf("%s of %s resulted in an unexpected status: %q: %s: %s", method, path, resp.Status, e.Code, e.Message)
+	}
+	return fmt.Errorf("%s of %s resulted in an unexpected status: %q", method, path, resp.Status)
+}
+
+// signS3 signs the request using AWS Signature Version 4; the request's host
+// and every header that's set are signed.
+func signS3(req *http.Request, payloadHash, region, accessKey, secretKey string, t time.Time) {
+	t = t.UTC()
+	date := t.Format("20060102")
+	stamp := t.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if k == "user-agent" || k == "authorization" {
+			continue
+		}
+		headers[k] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonical bytes.Buffer
+	canonical.WriteString(req.Method + "\n")
+	canonical.WriteString(req.URL.EscapedPath() + "\n")
+	canonical.WriteString(req.URL.RawQuery + "\n")
+	for _, k := range names {
+		canonical.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	canonical.WriteString("\n" + signed + "\n" + payloadHash)
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	sum := sha256.Sum256(canonical.Bytes())
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signed, sig))
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// s3Query returns the query string of q as S3 expects it: sorted by key, with
+// everything but the unreserved characters escaped.
+func s3Query(q url.Values) string {
+	var keys []string
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range q[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent encodes everything in s but the unreserved characters;
+// unless slash is true, slashes aren't encoded.
+func s3Escape(s string, slash bool) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !slash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
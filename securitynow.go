@@ -10,7 +10,6 @@ import (
 	"io"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strconv"
 
 	"github.com/dustin/go-humanize"
@@ -20,10 +19,17 @@ import (
 // download holds information about a given download
 type Download struct {
 	Name    string // the name of the thing downloaded
-	Path    string // the path of the save file; including name
+	Path    string // the path, or url, of the save file; including name
+	URL     string // the url of the thing downloaded
+	Episode int    // the episode the download is for
+	Asset   Asset  // the asset downloaded
 	skipped bool
-	n       uint64 // number of bytes downloaded
-	err     error  // error incountered, if any
+	pruned  bool       // whether it was skipped because it was pruned
+	file    string     // the name of the save file in the storage
+	remote  RemoteInfo // what the server reported about the file
+	missing bool       // whether the server doesn't have the file, e.g. a transcript that hasn't been published yet
+	n       uint64     // number of bytes downloaded
+	err     error      // error incountered, if any
 }
 
 // PrintResultMessage prints the result of the download.
@@ -42,35 +48,46 @@ func (d *Download) PrintResultMessage() {
 // SkipMessage creates the message string for skipped downloads. This also
 // handles errors related to skipping the download.
 func (d *Download) SkipMessage() string {
+	if d.pruned {
+		return fmt.Sprintf("%s: skipped, it was pruned; use -overwrite to download it again", d.Name)
+	}
 	if d.err == nil {
-		return fmt.Sprintf("%s: skipped, episode exists as %s", d.Name, d.Path)
+		return fmt.Sprintf("%s: skipped, file exists as %s", d.Name, d.Path)
 	}
 	return fmt.Sprintf("%s skipped: check file error: %s\n", d.Name, d.err)
 }
 
+// tagable returns whether the download is an audio file that was
+// successfully downloaded.
+func (d *Download) tagable() bool {
+	return d.Asset.audio && !d.skipped && d.err == nil && d.n > 0
+}
+
 // Error handles formatting of an error message as a string. This handles
 // non-skip errors. If skipped SkipMessage should be used.
 func (d *Download) Error() string {
 	if d.n == 0 {
 		return fmt.Sprintf("%s: download error: %s", d.Name, d.err.Error())
 	}
-	return fmt.Sprintf("%s: %s downloaded as %s with an error: %s\n", d.Name, humanize.Bytes(d.n), d.Path, d.err.Error())
+	return fmt.Sprintf("%s: %s downloaded with an error, %s wasn't saved: %s\n", d.Name, humanize.Bytes(d.n), d.Path, d.err.Error())
 }
 
-// MP3 handles the downloading of MP3 episodes
+// MP3 handles the downloading of MP3 episodes, and any other assets
+// associated with them.
 type MP3 struct {
 	// config
-	overwrite    bool
-	concurrency  int
-	startEpisode int // inclusive
-	stopEpisode  int // inclusive
-	saveDir      string
+	overwrite   bool
+	concurrency int
+	episodes    []int    // the episodes to download
+	storage     Storage  // where the save dir is
+	layout      *Layout  // the save dir's layout
+	assets      []Asset  // the assets to download for each episode
+	history     *History // the save dir's download history; if nil, the history isn't checked
 
 	// processing related stuff
 	workCh    chan int      // channel for sending work to
 	resultCh  chan Download // channel for sending result of download to
 	downloads []Download    // results of the downloads
-	Get       func(i int) Download
 }
 
 // Returns a MP3 processor.
@@ -78,16 +95,18 @@ func NewMP3(c Conf) *MP3 {
 	var mp3 MP3
 	mp3.overwrite = c.overwrite
 	mp3.concurrency = c.ConcurrentDL
-	mp3.startEpisode = c.startEpisode
-	mp3.stopEpisode = c.stopEpisode
-	mp3.saveDir = c.SaveDir
+	mp3.episodes = c.episodes
+	if len(mp3.episodes) == 0 {
+		mp3.episodes = episodeRange(c.startEpisode, c.stopEpisode)
+	}
+	mp3.storage = c.Storage()
+	mp3.layout = c.layout
+	mp3.assets = c.assets
+	if len(mp3.assets) == 0 {
+		mp3.assets = []Asset{assets["hq"]}
+	}
 	mp3.workCh = make(chan int)
 	mp3.resultCh = make(chan Download)
-	if c.lowQuality {
-		mp3.Get = mp3.LowQuality
-		return &mp3
-	}
-	mp3.Get = mp3.HighQuality
 	return &mp3
 }
 
@@ -96,20 +115,19 @@ func NewMP3(c Conf) *MP3 {
 // and the error are returned. If the process completes without an error, the
 // number of episodes downloaded along with the bytes downloaded are returned.
 func (m *MP3) Process() {
-	for i := 0; i < m.concurrency; i++ {
-		go m.GetEpisodes()
-	}
+	m.Start()
 
 	Verbose("downloading...")
 
 	go func() {
-		for i := m.startEpisode; i <= m.stopEpisode; i++ {
-			m.workCh <- i
+		for _, i := range m.episodes {
+			m.Queue(i)
 		}
 	}()
 
-	// we know how many results we're going to get so we just count the results
-	for i := 0; i < (m.stopEpisode - m.startEpisode + 1); i++ {
+	// we know how many results we're going to get so we just count the results;
+	// each episode results in one download per asset.
+	for i := 0; i < len(m.episodes)*len(m.assets); i++ {
 		Verbose(fmt.Sprintf("waiting for result %d", i+1))
 		v := <-m.resultCh
 		v.PrintResultMessage()
@@ -122,6 +140,25 @@ func (m *MP3) Process() {
 	return
 }
 
+// Start starts the download workers; the results of the downloads are sent
+// to the result channel, Results. Process starts the workers itself.
+func (m *MP3) Start() {
+	for i := 0; i < m.concurrency; i++ {
+		go m.GetEpisodes()
+	}
+}
+
+// Queue queues episode i for download; this blocks until a worker receives
+// it.
+func (m *MP3) Queue(i int) {
+	m.workCh <- i
+}
+
+// Results returns the channel that download results are sent to.
+func (m *MP3) Results() <-chan Download {
+	return m.resultCh
+}
+
 // GetEpisodes downloads episodes.
 func (m *MP3) GetEpisodes() {
 	// work until work channel is closed
@@ -131,33 +168,78 @@ func (m *MP3) GetEpisodes() {
 		if !ok {
 			return
 		}
-		m.resultCh <- m.Get(i)
-		Verbose("result sent")
+		for _, a := range m.assets {
+			m.resultCh <- m.Get(a, i)
+			Verbose("result sent")
+		}
 	}
 }
 
-// LowQuality downloads the high quality 16Kbps version of an episode.
-func (m *MP3) LowQuality(i int) Download {
-	var d Download
-	d.Name = fmt.Sprintf("sn-%03d-lq.mp3", i)
-	d.Path = filepath.Join(m.saveDir, d.Name)
+// Get downloads asset a of episode i.
+func (m *MP3) Get(a Asset, i int) Download {
+	d := m.newDownload(a, i)
+	if d.err != nil {
+		return d
+	}
+	// what was pruned isn't downloaded again
+	if m.pruned(a, i) {
+		d.skipped = true
+		d.pruned = true
+		return d
+	}
 	Verbose("download:" + d.Name)
 	return m.Download(d)
 }
 
-// HighQuality downloads the high quality 64Kbps version of an episode.
-func (m *MP3) HighQuality(i int) Download {
+// newDownload returns the Download of asset a of episode i. If the file's
+// name can't be resolved, e.g. the layout needs the episode archive and the
+// episode isn't in it yet, the Download's err is set.
+func (m *MP3) newDownload(a Asset, i int) Download {
 	var d Download
-	d.Name = fmt.Sprintf("sn-%03d.mp3", i)
-	d.Path = filepath.Join(m.saveDir, d.Name)
-	Verbose("download:" + d.Name)
-	return m.Download(d)
+	d.Name = a.FileName(i)
+	d.URL = a.URL(i)
+	d.Episode = i
+	d.Asset = a
+	d.file, d.err = m.layout.Name(a, i)
+	if d.err == nil {
+		d.Path = m.storage.Path(d.file)
+	}
+	return d
+}
+
+// pruned returns whether asset a of episode i was pruned and shouldn't be
+// downloaded again.
+func (m *MP3) pruned(a Asset, i int) bool {
+	return m.history != nil && !m.overwrite && m.history.Pruned(a, i)
+}
+
+// Planned returns the downloads that Process would do: the assets of the
+// episodes that aren't in the save dir and weren't pruned.
+func (m *MP3) Planned() []Download {
+	var planned []Download
+	for _, i := range m.episodes {
+		for _, a := range m.assets {
+			if m.pruned(a, i) {
+				continue
+			}
+			d := m.newDownload(a, i)
+			if d.err != nil {
+				planned = append(planned, d)
+				continue
+			}
+			skip, _ := m.shouldSkip(d.file)
+			if !skip {
+				planned = append(planned, d)
+			}
+		}
+	}
+	return planned
 }
 
 // Download handles the actual download.
 func (m *MP3) Download(d Download) Download {
 	// if not overwrting existing files and it already exists; don't do anything
-	t, err := m.shouldSkip(d.Path)
+	t, err := m.shouldSkip(d.file)
 	d.skipped = t
 	if err != nil {
 		d.err = err
@@ -165,42 +247,62 @@ func (m *MP3) Download(d Download) Download {
 	if t { // if should skip, return
 		return d
 	}
+	return m.Stream(d, nil, true)
+}
 
-	// open the save file
-	f, err := os.OpenFile(d.Path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0664)
+// Stream downloads d, writing the file to w, if it isn't nil, as it's
+// downloaded; if save is true, the file is also saved. Unlike Download,
+// whether the file already exists isn't checked.
+func (m *MP3) Stream(d Download, w io.Writer, save bool) Download {
+	if d.err != nil {
+		return d
+	}
+	// Get the file; this is done before the save file is opened so that a
+	// missing asset, e.g. a transcript that hasn't been published yet, doesn't
+	// leave an empty file behind.
+	resp, err := http.Get(d.URL)
 	if err != nil {
 		d.err = err
 		return d
 	}
-	defer f.Close()
-	// Get the file
-	resp, err := http.Get(SNURL + d.Name)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		d.missing = resp.StatusCode == http.StatusNotFound
+		d.err = fmt.Errorf("GET of %q resulted in an unexpected status: %q", d.URL, resp.Status)
+		return d
+	}
+	d.remote = remoteInfo(resp)
+	if !save {
+		n, err := io.Copy(w, resp.Body)
+		d.n = uint64(n)
+		d.err = err
+		return d
+	}
+
+	// the save file isn't replaced until the download is complete
+	sw, err := m.storage.Create(d.file)
 	if err != nil {
 		d.err = err
 		return d
 	}
-	defer resp.Body.Close()
-	for {
-		n, err := io.Copy(f, resp.Body)
-		d.n += uint64(n)
-		if err != nil {
-			if err == io.EOF {
-				return d
-			}
-			d.err = err
-			return d
-		}
-		// no bytes copied == done
-		if n == 0 {
-			break
-		}
+	dst := io.Writer(sw)
+	if w != nil {
+		dst = io.MultiWriter(w, sw)
 	}
+	n, err := io.Copy(dst, resp.Body)
+	d.n = uint64(n)
+	if err != nil {
+		sw.Abort()
+		d.err = err
+		return d
+	}
+	d.err = sw.Commit()
 	return d
 }
 
 // Message returns
 func (m *MP3) Message() string {
-	msg := fmt.Sprintf("\n%d episodes processed\n", len(m.downloads))
+	msg := fmt.Sprintf("\n%d files processed\n", len(m.downloads))
 	var skipped, errs, success int
 	var n uint64
 	for _, v := range m.downloads {
@@ -219,10 +321,10 @@ func (m *MP3) Message() string {
 		msg += fmt.Sprintf("%d downloads resulted in an error\n", errs)
 	}
 	if skipped > 0 {
-		msg += fmt.Sprintf("%d episodes were skipped\n", skipped)
+		msg += fmt.Sprintf("%d files were skipped\n", skipped)
 	}
 	if success > 0 {
-		msg += fmt.Sprintf("%d episodes totalling %s were downloaded\n", success, humanize.Bytes(n))
+		msg += fmt.Sprintf("%d files totalling %s were downloaded\n", success, humanize.Bytes(n))
 	}
 	return msg
 }
@@ -236,7 +338,7 @@ func (m *MP3) shouldSkip(n string) (bool, error) {
 	if m.overwrite {
 		return false, nil
 	}
-	_, err := os.Stat(n)
+	_, err := m.storage.Stat(n)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return false, nil
@@ -338,6 +440,27 @@ func setEpisodeRange(i int, cnf *Conf) error {
 	return nil
 }
 
+// setEpisodes sets the episodes to process. The episode range is set and
+// the conf's selection, if any, is then applied to it.
+func setEpisodes(i int, cnf *Conf) error {
+	// the range isn't used when the selection has its own episodes
+	if len(cnf.selection.include) == 0 {
+		err := setEpisodeRange(i, cnf)
+		if err != nil {
+			return err
+		}
+	}
+	if cnf.selection.IsEmpty() {
+		cnf.episodes = episodeRange(cnf.startEpisode, cnf.stopEpisode)
+		return nil
+	}
+	cnf.episodes = cnf.selection.Episodes(i, episodeRange(cnf.startEpisode, cnf.stopEpisode))
+	if len(cnf.episodes) == 0 {
+		return fmt.Errorf("Nothing to do: no episodes were selected. The last episode was %d.", i)
+	}
+	return nil
+}
+
 func printDownloadMessage(episode int, n int64, name string) {
 	fmt.Printf("downloaded episode %d, totalling %d bytes, as %s\n", episode, n, name)
 }
@@ -0,0 +1,188 @@
+// Apache License Version 2.0
+// http://www.apache.org/licenses/
+// Copyright (c) 2016 Joel Scoble
+// See LICENSE file for license text.
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Selection is a parsed episode selection expression. An expression is a
+// comma separated list of terms; the selected episodes are the union of the
+// terms. A term that is prefixed with a ! is an exclusion: its episodes are
+// removed from the selection. The supported terms are:
+//
+//	500      a single episode
+//	1-10     a range of episodes, inclusive
+//	500-     an open range: episode 500 through the most recent episode
+//	-10      an open range: the first episode through episode 10
+//	last:20  the 20 most recent episodes
+//	all      all episodes
+//
+// e.g. "1-10,42,500-,!403" selects episodes 1 through 10, 42, and 500 through
+// the most recent, except for 403. If a selection only has exclusions, they
+// are applied to the episodes selected by the range flags.
+type Selection struct {
+	include []term
+	exclude []term
+}
+
+// term is a single range of episodes within a Selection.
+type term struct {
+	from int // the first episode, inclusive; 0 means the first episode
+	to   int // the last episode, inclusive; 0 means the most recent episode
+	last int // if > 0, the n most recent episodes; from and to aren't used
+}
+
+// episodes returns the episodes in the term; last is the most recent episode.
+func (t term) episodes(last int) []int {
+	from, to := t.from, t.to
+	if t.last > 0 {
+		from, to = last-t.last+1, last
+	}
+	if from < 1 {
+		from = 1
+	}
+	if to == 0 || to > last {
+		to = last
+	}
+	return episodeRange(from, to)
+}
+
+// ParseSelection parses a selection expression.
+func ParseSelection(s string) (Selection, error) {
+	var sel Selection
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		exclude := strings.HasPrefix(v, "!")
+		t, err := parseTerm(strings.TrimSpace(strings.TrimPrefix(v, "!")))
+		if err != nil {
+			return sel, fmt.Errorf("episode selection %q: %s", s, err)
+		}
+		if exclude {
+			sel.exclude = append(sel.exclude, t)
+			continue
+		}
+		sel.include = append(sel.include, t)
+	}
+	return sel, nil
+}
+
+// parseTerm parses a single term of a selection expression.
+func parseTerm(s string) (term, error) {
+	var t term
+	if s == "all" {
+		return t, nil
+	}
+	if strings.HasPrefix(s, "last:") {
+		n, err := strconv.Atoi(strings.TrimPrefix(s, "last:"))
+		if err != nil || n < 1 {
+			return t, fmt.Errorf("%q: the number of episodes must be greater than 0", s)
+		}
+		t.last = n
+		return t, nil
+	}
+	i := strings.Index(s, "-")
+	if i < 0 {
+		n, err := episodeNumber(s)
+		if err != nil {
+			return t, err
+		}
+		t.from, t.to = n, n
+		return t, nil
+	}
+	var err error
+	if i > 0 {
+		t.from, err = episodeNumber(s[:i])
+		if err != nil {
+			return t, err
+		}
+	}
+	if i < len(s)-1 {
+		t.to, err = episodeNumber(s[i+1:])
+		if err != nil {
+			return t, err
+		}
+	}
+	if t.from == 0 && t.to == 0 {
+		return t, fmt.Errorf("%q: a range must have a start, a stop, or both", s)
+	}
+	if t.to > 0 && t.to < t.from {
+		return t, fmt.Errorf("%q: the end of the range must not be less than the start", s)
+	}
+	return t, nil
+}
+
+// episodeNumber parses s as an episode number.
+func episodeNumber(s string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("%q is not a valid episode number", s)
+	}
+	return n, nil
+}
+
+// IsEmpty returns whether the selection has any terms.
+func (s Selection) IsEmpty() bool {
+	return len(s.include) == 0 && len(s.exclude) == 0
+}
+
+// Max returns the highest episode that the selection includes. If any of the
+// included terms depend on the most recent episode, e.g. 500- or last:20, or
+// there are no included terms, false is returned.
+func (s Selection) Max() (int, bool) {
+	var max int
+	for _, t := range s.include {
+		if t.last > 0 || t.to == 0 {
+			return 0, false
+		}
+		if t.to > max {
+			max = t.to
+		}
+	}
+	return max, max > 0
+}
+
+// Episodes returns the selected episodes, sorted; last is the most recent
+// episode. If the selection doesn't include any episodes, the exclusions are
+// applied to base.
+func (s Selection) Episodes(last int, base []int) []int {
+	set := make(map[int]bool)
+	if len(s.include) == 0 {
+		for _, v := range base {
+			set[v] = true
+		}
+	}
+	for _, t := range s.include {
+		for _, v := range t.episodes(last) {
+			set[v] = true
+		}
+	}
+	for _, t := range s.exclude {
+		for _, v := range t.episodes(last) {
+			delete(set, v)
+		}
+	}
+	episodes := make([]int, 0, len(set))
+	for k := range set {
+		episodes = append(episodes, k)
+	}
+	sort.Ints(episodes)
+	return episodes
+}
+
+// episodeRange returns the episodes from start to stop, inclusive.
+func episodeRange(start, stop int) []int {
+	var episodes []int
+	for i := start; i <= stop; i++ {
+		episodes = append(episodes, i)
+	}
+	return episodes
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSelection(t *testing.T) {
+	tests := []struct {
+		s           string
+		expected    Selection
+		expectedErr string
+	}{
+		{s: "", expected: Selection{}},
+		{s: "42", expected: Selection{include: []term{{from: 42, to: 42}}}},
+		{s: "1-10, 500-", expected: Selection{include: []term{{from: 1, to: 10}, {from: 500}}}},
+		{s: "-10", expected: Selection{include: []term{{to: 10}}}},
+		{s: "last:20,!403", expected: Selection{include: []term{{last: 20}}, exclude: []term{{from: 403, to: 403}}}},
+		{s: "all,!1-10", expected: Selection{include: []term{{}}, exclude: []term{{from: 1, to: 10}}}},
+		{s: "10-1", expectedErr: `episode selection "10-1": "10-1": the end of the range must not be less than the start`},
+		{s: "-", expectedErr: `episode selection "-": "-": a range must have a start, a stop, or both`},
+		{s: "last:0", expectedErr: `episode selection "last:0": "last:0": the number of episodes must be greater than 0`},
+		{s: "abc", expectedErr: `episode selection "abc": "abc" is not a valid episode number`},
+	}
+
+	for i, test := range tests {
+		sel, err := ParseSelection(test.s)
+		if err != nil {
+			if err.Error() != test.expectedErr {
+				t.Errorf("%d: got %q; want %q", i, err.Error(), test.expectedErr)
+			}
+			continue
+		}
+		if test.expectedErr != "" {
+			t.Errorf("%d: got no error; want %q", i, test.expectedErr)
+			continue
+		}
+		if !reflect.DeepEqual(sel, test.expected) {
+			t.Errorf("%d: got %v; want %v", i, sel, test.expected)
+		}
+	}
+}
+
+func TestSelectionEpisodes(t *testing.T) {
+	tests := []struct {
+		s        string
+		base     []int
+		expected []int
+	}{
+		{s: "1-3,42,98-", expected: []int{1, 2, 3, 42, 98, 99, 100}},
+		{s: "last:3", expected: []int{98, 99, 100}},
+		{s: "last:3,!99", expected: []int{98, 100}},
+		{s: "95-,!97-98,2", expected: []int{2, 95, 96, 99, 100}},
+		{s: "99-110", expected: []int{99, 100}},
+		{s: "!99", base: []int{97, 98, 99, 100}, expected: []int{97, 98, 100}},
+		{s: "1,!1", expected: []int{}},
+	}
+
+	for i, test := range tests {
+		sel, err := ParseSelection(test.s)
+		if err != nil {
+			t.Errorf("%d: unexpected error: %s", i, err)
+			continue
+		}
+		episodes := sel.Episodes(100, test.base)
+		if !reflect.DeepEqual(episodes, test.expected) {
+			t.Errorf("%d: got %v; want %v", i, episodes, test.expected)
+		}
+	}
+}
+
+func TestSelectionMax(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected int
+		ok       bool
+	}{
+		{"", 0, false},
+		{"500", 500, true},
+		{"1-10,42", 42, true},
+		{"-10", 10, true},
+		{"500-", 0, false},
+		{"42,last:5", 0, false},
+		{"all", 0, false},
+		{"1-10,!5", 10, true},
+	}
+	for i, test := range tests {
+		s, err := ParseSelection(test.s)
+		if err != nil {
+			t.Errorf("%d: unexpected error: %s", i, err)
+			continue
+		}
+		max, ok := s.Max()
+		if max != test.expected || ok != test.ok {
+			t.Errorf("%d: got %d %t; want %d %t", i, max, ok, test.expected, test.ok)
+		}
+	}
+}
@@ -0,0 +1,506 @@
+// Apache License Version 2.0
+// http://www.apache.org/licenses/
+// Copyright (c) 2016 Joel Scoble
+// See LICENSE file for license text.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serveAddr is the address the web UI is served on.
+var serveAddr string
+
+// serveQueueLen is the number of episodes that can be queued for download.
+const serveQueueLen = 100
+
+func serveCommand() *Command {
+	c := newCommand("serve", "", "browse and stream the archive in a browser", `
+Serve starts an HTTP server with a web UI for the episode archive and the save
+directory. It lists the episodes, which can be searched and filtered, and each
+episode has a page with its description and transcript. The episodes in the
+save directory can be streamed and the ones that aren't can be queued for
+download, which uses the same downloader as get. The episodes that are queued
+while a download is in progress are downloaded together once it's done; the
+save directory is locked while they are downloaded and the ones that another
+snow is processing are skipped. An episode whose audio was downloaded is
+downloaded even if its other assets, e.g. a transcript, haven't been published
+yet; its page lists them. At most 100 episodes can be queued at a time.
+
+The transcript is read from the save directory if it's there; otherwise it's
+retrieved from GRC.
+
+Each episode's page lists its related episodes; see "snow help related". They
+are also served as JSON, e.g. /related/500?n=10. The transcripts in the
+transcript index are used, but the index isn't updated.`, runServe)
+	libraryFlags(c.Flags)
+	configFlags(c.Flags, true)
+	mirrorFlag(c.Flags)
+	c.Flags.IntVar(&concurrency, "concurrency", concurrentDL, "number of episodes to concurrently download")
+	c.Flags.StringVar(&serveAddr, "addr", ":8080", "the address to serve the web UI on")
+	return c
+}
+
+// runServe serves the web UI.
+func runServe(cmd *Command, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("serve: unexpected args: %s", strings.Join(args, " "))
+	}
+	cs, err := confs(cmd.Flags)
+	if err != nil {
+		return err
+	}
+	c := cs[0]
+	err = requireLocal(c, "serve")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(c.SaveDir, 0755)
+	if err != nil {
+		return fmt.Errorf("error making save dir: %s", err)
+	}
+	fmt.Println("getting the episode catalog...")
+	cat, err := runCatalog.Get(allYears(time.Now())...)
+	if err != nil {
+		return fmt.Errorf("error getting the episode catalog: %s", err)
+	}
+	s := newServer(c, cat)
+	s.StartDownloader()
+	fmt.Printf("serving %s on %s\n", c.SaveDir, serveAddr)
+	return http.ListenAndServe(serveAddr, s.Handler())
+}
+
+// server is the web UI's server.
+type server struct {
+	conf    Conf
+	catalog Catalog
+	queue   chan int // the episodes queued for download; nil until the downloader is started
+
+	relatedOnce sync.Once
+	related     *relatedModel // built on first use
+
+	mu     sync.Mutex
+	status map[int]string // the download status of the queued episodes
+}
+
+// newServer returns a server for the library described by c.
+func newServer(c Conf, cat Catalog) *server {
+	return &server{conf: c, catalog: cat, status: make(map[int]string)}
+}
+
+// StartDownloader starts downloading the queued episodes. The episodes that
+// are queued while a download is in progress are downloaded together, as a
+// batch, once it's done.
+func (s *server) StartDownloader() {
+	s.queue = make(chan int, serveQueueLen)
+	go func() {
+		for i := range s.queue {
+			batch := []int{i}
+		queued:
+			for {
+				select {
+				case i := <-s.queue:
+					batch = append(batch, i)
+				default:
+					break queued
+				}
+			}
+			s.download(batch)
+		}
+	}()
+}
+
+// download downloads the episodes and records them in the download history.
+// The save dir is locked while they are downloaded; the episodes that other
+// snows are processing are skipped.
+func (s *server) download(episodes []int) {
+	c := s.conf
+	c.episodes = episodes
+	c.onLock = onLockSkip
+	lock, err := lockSaveDir(&c)
+	if err != nil {
+		s.setStatus(episodes, "error: "+err.Error())
+		return
+	}
+	defer lock.Unlock()
+	s.setStatus(episodes, "being downloaded by another snow")
+	s.setStatus(c.episodes, "downloading")
+
+	m := NewMP3(c)
+	m.Process()
+	h, err := loadHistory(c.Storage())
+	if err == nil {
+		h.recordDownloads(m.downloads)
+		err = h.Save()
+	}
+	if err != nil {
+		fmt.Printf("error updating the download history: %s\n", err)
+	}
+	byEpisode := make(map[int][]Download)
+	for _, d := range m.downloads {
+		byEpisode[d.Episode] = append(byEpisode[d.Episode], d)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, ds := range byEpisode {
+		s.status[i] = downloadStatus(ds)
+	}
+}
+
+// downloadStatus returns the download status of an episode from the
+// downloads of its assets. Assets other than audio are often published after
+// the episode, so if they are missing, the episode is still downloaded.
+func downloadStatus(ds []Download) string {
+	var missing []string
+	for _, d := range ds {
+		if d.err == nil || d.skipped {
+			continue
+		}
+		if d.missing && !d.Asset.audio {
+			missing = append(missing, d.Asset.Name)
+			continue
+		}
+		return "error: " + d.err.Error()
+	}
+	if len(missing) > 0 {
+		return "downloaded; not published yet: " + strings.Join(missing, ", ")
+	}
+	return "downloaded"
+}
+
+// setStatus sets the download status of the episodes.
+func (s *server) setStatus(episodes []int, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, i := range episodes {
+		s.status[i] = status
+	}
+}
+
+// Handler returns the server's handler.
+func (s *server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleList)
+	mux.HandleFunc("/episode/", s.handleEpisode)
+	mux.HandleFunc("/audio/", s.handleAudio)
+	mux.HandleFunc("/download/", s.handleDownload)
+	mux.HandleFunc("/related/", s.handleRelated)
+	return mux
+}
+
+// episodeView is an episode as presented by the web UI.
+type episodeView struct {
+	Episode
+	Local      []string // the names of the assets in the save directory
+	Audio      bool     // whether there's a local audio file
+	Status     string   // the download status, if it was queued
+	Transcript string
+	Related    []Related
+}
+
+// view returns the view of episode i.
+func (s *server) view(i int) episodeView {
+	e, ok := s.catalog[i]
+	if !ok {
+		e = Episode{Number: i}
+	}
+	v := episodeView{Episode: e}
+	local, err := localAssets(s.conf, i)
+	if err != nil {
+		Verbose(fmt.Sprintf("episode %d: %s", i, err))
+	}
+	v.Local = local
+	_, v.Audio = s.audioPath(i)
+	s.mu.Lock()
+	v.Status = s.status[i]
+	s.mu.Unlock()
+	return v
+}
+
+// audioPath returns the path of episode i's local audio file, if there is one.
+func (s *server) audioPath(i int) (string, bool) {
+	for _, a := range s.conf.assets {
+		if !a.audio {
+			continue
+		}
+		p, err := s.conf.Path(a, i)
+		if err != nil {
+			Verbose(fmt.Sprintf("episode %d: %s", i, err))
+			return "", false
+		}
+		_, err = os.Stat(p)
+		if err == nil {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// listPage is the data for the list template.
+type listPage struct {
+	Query    string
+	Year     int
+	Local    bool
+	Years    []int
+	Episodes []episodeView
+}
+
+// handleList lists the episodes that match the query, newest first.
+func (s *server) handleList(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	var p listPage
+	p.Query = strings.TrimSpace(r.FormValue("q"))
+	p.Year, _ = strconv.Atoi(r.FormValue("year"))
+	p.Local = r.FormValue("local") != ""
+	for y := time.Now().Year(); y >= FirstYear; y-- {
+		p.Years = append(p.Years, y)
+	}
+	terms := strings.Fields(strings.ToLower(p.Query))
+	numbers := s.catalog.Numbers()
+	for j := len(numbers) - 1; j >= 0; j-- {
+		e := s.catalog[numbers[j]]
+		if p.Year != 0 && e.Date.Year() != p.Year {
+			continue
+		}
+		if !matchTerms(e, terms) {
+			continue
+		}
+		v := s.view(e.Number)
+		if p.Local && len(v.Local) == 0 {
+			continue
+		}
+		p.Episodes = append(p.Episodes, v)
+	}
+	render(w, listTmpl, p)
+}
+
+// episodeNumberFromPath returns the episode number at the end of the path.
+func episodeNumberFromPath(w http.ResponseWriter, r *http.Request, prefix string) (int, bool) {
+	i, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, prefix))
+	if err != nil || i < 1 {
+		http.NotFound(w, r)
+		return 0, false
+	}
+	return i, true
+}
+
+// handleEpisode shows an episode's page.
+func (s *server) handleEpisode(w http.ResponseWriter, r *http.Request) {
+	i, ok := episodeNumberFromPath(w, r, "/episode/")
+	if !ok {
+		return
+	}
+	v := s.view(i)
+	v.Transcript = s.transcript(i)
+	v.Related = s.relatedModel().Related(i, 10)
+	render(w, episodeTmpl, v)
+}
+
+// relatedModel returns the model used to find related episodes; it's built on
+// first use from the catalog and the transcript index.
+func (s *server) relatedModel() *relatedModel {
+	s.relatedOnce.Do(func() {
+		idx, err := loadIndex(s.conf.Storage())
+		if err != nil {
+			Verbose(fmt.Sprintf("related episodes won't use the transcripts: %s", err))
+			idx = nil
+		}
+		s.related = newRelatedModel(s.catalog, idx)
+	})
+	return s.related
+}
+
+// handleRelated writes an episode's related episodes as JSON; n is the number
+// of episodes, which defaults to 10.
+func (s *server) handleRelated(w http.ResponseWriter, r *http.Request) {
+	i, ok := episodeNumberFromPath(w, r, "/related/")
+	if !ok {
+		return
+	}
+	if _, ok := s.catalog[i]; !ok {
+		http.NotFound(w, r)
+		return
+	}
+	n := 10
+	if v := r.FormValue("n"); v != "" {
+		var err error
+		n, err = strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("n: %q isn't a number of episodes", v), http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(s.relatedModel().Related(i, n))
+	if err != nil {
+		Verbose(fmt.Sprintf("related %d: %s", i, err))
+	}
+}
+
+// transcript returns episode i's text transcript; the local file is used if
+// it exists.
+func (s *server) transcript(i int) string {
+	a := assets["txt"]
+	p, err := s.conf.Path(a, i)
+	if err == nil {
+		b, err := ioutil.ReadFile(p)
+		if err == nil {
+			return string(b)
+		}
+	}
+	b, err := getBytes(a.URL(i))
+	if err != nil {
+		Verbose(fmt.Sprintf("transcript %d: %s", i, err))
+		return ""
+	}
+	return string(b)
+}
+
+// handleAudio streams an episode's local audio file; range requests are
+// supported.
+func (s *server) handleAudio(w http.ResponseWriter, r *http.Request) {
+	i, ok := episodeNumberFromPath(w, r, "/audio/")
+	if !ok {
+		return
+	}
+	p, ok := s.audioPath(i)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "audio/mpeg")
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+}
+
+// handleDownload queues an episode for download.
+func (s *server) handleDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	i, ok := episodeNumberFromPath(w, r, "/download/")
+	if !ok {
+		return
+	}
+	if s.queue == nil {
+		http.Error(w, "the downloader isn't running", http.StatusServiceUnavailable)
+		return
+	}
+	s.mu.Lock()
+	queued := s.status[i] == "queued"
+	if !queued {
+		s.status[i] = "queued"
+	}
+	s.mu.Unlock()
+	if !queued {
+		select {
+		case s.queue <- i:
+		default:
+			s.mu.Lock()
+			delete(s.status, i)
+			s.mu.Unlock()
+			http.Error(w, "the download queue is full; try again later", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	back := r.Referer()
+	if back == "" {
+		back = fmt.Sprintf("/episode/%d", i)
+	}
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// render executes the template; errors are logged.
+func render(w http.ResponseWriter, t *template.Template, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := t.Execute(w, data)
+	if err != nil {
+		Verbose(fmt.Sprintf("render %s: %s", t.Name(), err))
+	}
+}
+
+var funcs = template.FuncMap{
+	"date": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format("2006-01-02")
+	},
+	"join": strings.Join,
+}
+
+const pageHead = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{template "title" .}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td { padding: 0.2em 0.6em; vertical-align: top; }
+tr:nth-child(even) { background: #f4f4f4; }
+pre { white-space: pre-wrap; }
+form.inline { display: inline; }
+</style></head><body>
+`
+
+var listTmpl = template.Must(template.New("list").Funcs(funcs).Parse(pageHead + `{{define "title"}}Security Now! archive{{end}}
+<h1>Security Now! archive</h1>
+<form method="get" action="/">
+<input type="text" name="q" value="{{.Query}}" placeholder="search titles and descriptions">
+<select name="year"><option value="0">all years</option>
+{{range .Years}}<option value="{{.}}"{{if eq . $.Year}} selected{{end}}>{{.}}</option>{{end}}
+</select>
+<label><input type="checkbox" name="local" value="1"{{if .Local}} checked{{end}}> downloaded only</label>
+<input type="submit" value="filter">
+</form>
+<p>{{len .Episodes}} episodes</p>
+<table>
+{{range .Episodes}}<tr>
+<td>{{.Number}}</td><td>{{date .Date}}</td>
+<td><a href="/episode/{{.Number}}">{{.Title}}</a></td>
+<td>{{join .Local " "}}</td>
+<td>{{if .Audio}}<a href="/audio/{{.Number}}">play</a>{{else if .Status}}{{.Status}}{{else}}<form class="inline" method="post" action="/download/{{.Number}}"><input type="submit" value="download"></form>{{end}}</td>
+</tr>
+{{end}}</table>
+</body></html>
+`))
+
+var episodeTmpl = template.Must(template.New("episode").Funcs(funcs).Parse(pageHead + `{{define "title"}}SN {{.Number}}: {{.Title}}{{end}}
+<p><a href="/">&larr; all episodes</a></p>
+<h1>Episode {{.Number}}: {{.Title}}</h1>
+<p>{{date .Date}}{{if .Minutes}} | {{.Minutes}} min.{{end}}{{if .Local}} | downloaded: {{join .Local " "}}{{end}}</p>
+<p>{{.Description}}</p>
+{{if .Audio}}<audio controls preload="none" src="/audio/{{.Number}}"></audio>
+{{else if not .Status}}<form method="post" action="/download/{{.Number}}"><input type="submit" value="download"></form>
+{{end}}{{if .Status}}<p>{{.Status}}</p>
+{{end}}
+{{if .Related}}<h2>Related episodes</h2>
+<ul>
+{{range .Related}}<li><a href="/episode/{{.Episode}}">{{.Episode}}: {{.Title}}</a> ({{printf "%.2f" .Score}})</li>
+{{end}}</ul>
+{{end}}<h2>Transcript</h2>
+{{if .Transcript}}<pre>{{.Transcript}}</pre>{{else}}<p>The transcript isn't available.</p>{{end}}
+</body></html>
+`))
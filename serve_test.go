@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "sn-500.mp3"), []byte("0123456789"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "sn-500.txt"), []byte("GIBSON: <transcript>"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cat := Catalog{
+		499: {Number: 499, Title: "Bad BIOS", Date: time.Date(2015, time.March, 17, 0, 0, 0, 0, time.UTC)},
+		500: {Number: 500, Title: "Windows Secure Boot", Date: time.Date(2015, time.March, 24, 0, 0, 0, 0, time.UTC), Description: "UEFI"},
+		540: {Number: 540, Title: "Security Predictions", Date: time.Date(2016, time.January, 5, 0, 0, 0, 0, time.UTC)},
+		541: {Number: 541, Title: "Secure Boot Bypassed", Date: time.Date(2016, time.January, 12, 0, 0, 0, 0, time.UTC)},
+	}
+	c := Conf{SaveDir: dir, assets: []Asset{assets["hq"], assets["txt"]}, ConcurrentDL: 1}
+	ts := httptest.NewServer(newServer(c, cat).Handler())
+	defer ts.Close()
+
+	tests := []struct {
+		method   string
+		path     string
+		header   map[string]string
+		status   int
+		contains []string
+		excludes []string
+	}{
+		{method: "GET", path: "/", status: 200, contains: []string{"Bad BIOS", "Windows Secure Boot", "Security Predictions", `href="/audio/500"`}},
+		{method: "GET", path: "/?q=uefi", status: 200, contains: []string{"Windows Secure Boot"}, excludes: []string{"Bad BIOS", "Security Predictions"}},
+		{method: "GET", path: "/?year=2016", status: 200, contains: []string{"Security Predictions"}, excludes: []string{"Bad BIOS"}},
+		{method: "GET", path: "/?local=1", status: 200, contains: []string{"Windows Secure Boot"}, excludes: []string{"Bad BIOS"}},
+		{method: "GET", path: "/episode/500", status: 200, contains: []string{"Windows Secure Boot", "UEFI", "GIBSON: &lt;transcript&gt;", `<audio controls`}},
+		{method: "GET", path: "/episode/500", status: 200, contains: []string{"Related episodes", `href="/episode/541"`}, excludes: []string{`href="/episode/499"`}},
+		{method: "GET", path: "/episode/abc", status: 404},
+		{method: "GET", path: "/related/500", status: 200, contains: []string{`"episode":541`, `"title":"Secure Boot Bypassed"`}, excludes: []string{`"episode":499`}},
+		{method: "GET", path: "/related/500?n=0", status: 200, contains: []string{`"episode":541`}},
+		{method: "GET", path: "/related/500?n=x", status: 400},
+		{method: "GET", path: "/related/999", status: 404},
+		{method: "GET", path: "/audio/500", header: map[string]string{"Range": "bytes=2-5"}, status: 206, contains: []string{"2345"}},
+		{method: "GET", path: "/audio/499", status: 404},
+		{method: "GET", path: "/download/499", status: 405},
+		{method: "POST", path: "/download/499", status: 503},
+	}
+	for i, test := range tests {
+		req, err := http.NewRequest(test.method, ts.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range test.header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("%d: %s", i, err)
+			continue
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%d: %s %s: got status %d; want %d", i, test.method, test.path, resp.StatusCode, test.status)
+			continue
+		}
+		for _, v := range test.contains {
+			if !strings.Contains(string(b), v) {
+				t.Errorf("%d: %s: expected the response to contain %q", i, test.path, v)
+			}
+		}
+		for _, v := range test.excludes {
+			if strings.Contains(string(b), v) {
+				t.Errorf("%d: %s: expected the response to not contain %q", i, test.path, v)
+			}
+		}
+	}
+}
+
+func TestDownloadStatus(t *testing.T) {
+	failed := errors.New("GET failed")
+	hq := Download{Asset: assets["hq"]}
+	txt := Download{Asset: assets["txt"]}
+	missing := func(d Download) Download {
+		d.err, d.missing = failed, true
+		return d
+	}
+	broken := func(d Download) Download {
+		d.err = failed
+		return d
+	}
+	tests := []struct {
+		downloads []Download
+		expected  string
+	}{
+		{[]Download{hq, txt}, "downloaded"},
+		{[]Download{hq, missing(txt)}, "downloaded; not published yet: txt"},
+		{[]Download{missing(hq), txt}, "error: GET failed"},
+		{[]Download{hq, broken(txt)}, "error: GET failed"},
+	}
+	for i, test := range tests {
+		status := downloadStatus(test.downloads)
+		if status != test.expected {
+			t.Errorf("%d: got %q; want %q", i, status, test.expected)
+		}
+	}
+}
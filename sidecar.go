@@ -0,0 +1,331 @@
+// Apache License Version 2.0
+// http://www.apache.org/licenses/
+// Copyright (c) 2016 Joel Scoble
+// See LICENSE file for license text.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const sidecarVersion = 1 // the version of the JSON sidecars' format
+
+// sidecarFormats are the supported sidecar formats.
+var sidecarFormats = []string{"json", "nfo"}
+
+// sidecarList is the sidecars flag's value.
+var sidecarList string
+
+func sidecarsCommand() *Command {
+	c := newCommand("sidecars", "", "write metadata files next to the downloaded episodes", `
+Sidecars writes a metadata file, a sidecar, next to each of the selected
+episodes' files in the save directory, so that tools other than snow, e.g.
+media servers, can use the episode archive's information. The formats are:
+
+    json  a JSON file named after the file, e.g. sn-500.mp3.json, for each
+          of the assets
+    nfo   a Kodi and Jellyfin episode file with the audio file's base name,
+          e.g. sn-500.nfo, for each of the audio files
+
+A sidecar has the episode's number, title, air date, length, and description,
+and the file's source url, size, and SHA-256 hash. Sidecars are only written if
+their content changed; the hashes are kept in the download history so that a
+file is only hashed again if it changed.
+
+Get and sync, with -sidecars, write the sidecars of the episodes they process,
+which keeps them in sync with the episode archive. Use this command to write
+the sidecars of the episodes that were already downloaded. By default, all
+episodes' sidecars are written.`, runSidecars)
+	rangeFlags(c.Flags, 0)
+	libraryFlags(c.Flags)
+	configFlags(c.Flags, true)
+	mirrorFlag(c.Flags)
+	c.Flags.StringVar(&sidecarList, "sidecars", "json", "comma separated list of the sidecar formats: "+strings.Join(sidecarFormats, ", "))
+	return c
+}
+
+// runSidecars writes the sidecars of the selected episodes.
+func runSidecars(cmd *Command, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("sidecars: unexpected args: %s", strings.Join(args, " "))
+	}
+	cs, err := confs(cmd.Flags)
+	if err != nil {
+		return err
+	}
+	c := cs[0]
+	if len(c.sidecars) == 0 {
+		return errors.New("sidecars: no sidecar format was specified: use -sidecars")
+	}
+	last, err := lastEpisode()
+	if err != nil {
+		return err
+	}
+	err = resolveEpisodes(&c, last)
+	if err != nil {
+		return err
+	}
+	lock, err := lockSaveDir(&c)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	h, err := loadHistory(c.Storage())
+	if err != nil {
+		return fmt.Errorf("error loading the download history: %s", err)
+	}
+	n, err := updateSidecars(c, h, c.episodes)
+	fmt.Printf("\n%d sidecars written\n", n)
+	return err
+}
+
+// parseSidecars returns the sidecar formats for the passed names. The names
+// may be either a slice of names, a comma separated list of names, or a mix.
+// No names means no sidecars.
+func parseSidecars(names ...string) ([]string, error) {
+	var formats []string
+	seen := make(map[string]bool)
+	for _, v := range names {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" || seen[name] {
+				continue
+			}
+			if sidecarName("x.mp3", assets["hq"], name) == "" {
+				return nil, fmt.Errorf("unknown sidecar format %q: supported formats are %s", name, strings.Join(sidecarFormats, ", "))
+			}
+			seen[name] = true
+			formats = append(formats, name)
+		}
+	}
+	return formats, nil
+}
+
+// sidecarName returns the name of the sidecar of the format for the file of
+// asset a that has the name; if the asset doesn't have that kind of sidecar,
+// an empty string is returned.
+func sidecarName(name string, a Asset, format string) string {
+	switch format {
+	case "json":
+		return name + ".json"
+	case "nfo":
+		if a.audio {
+			return strings.TrimSuffix(name, filepath.Ext(name)) + ".nfo"
+		}
+	}
+	return ""
+}
+
+// removeSidecars removes the sidecars of the file of asset a that has the
+// name; sidecars that don't exist are ignored.
+func removeSidecars(s Storage, name string, a Asset) error {
+	for _, f := range sidecarFormats {
+		sname := sidecarName(name, a, f)
+		if sname == "" {
+			continue
+		}
+		err := s.Remove(sname)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sidecar is the metadata of an episode's file.
+type Sidecar struct {
+	Version     int    `json:"version"`
+	Episode     int    `json:"episode"`
+	Title       string `json:"title"`
+	Date        string `json:"date,omitempty"`
+	Minutes     int    `json:"minutes,omitempty"`
+	Description string `json:"description,omitempty"`
+	Asset       string `json:"asset"`
+	Source      string `json:"source"` // the url of the file on GRC's server
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+}
+
+// newSidecar returns the sidecar of the file of asset a of episode e.
+func newSidecar(e Episode, a Asset, size int64, sum string) Sidecar {
+	sc := Sidecar{
+		Version:     sidecarVersion,
+		Episode:     e.Number,
+		Title:       e.Title,
+		Minutes:     e.Minutes,
+		Description: e.Description,
+		Asset:       a.Name,
+		Source:      a.SourceURL(e.Number),
+		Size:        size,
+		SHA256:      sum,
+	}
+	if !e.Date.IsZero() {
+		sc.Date = e.Date.Format("2006-01-02")
+	}
+	return sc
+}
+
+// nfoEpisode is an nfo sidecar: the episodedetails of Kodi and Jellyfin. The
+// file's information, which they don't have elements for, is in the snow
+// element, which they ignore.
+type nfoEpisode struct {
+	XMLName   xml.Name `xml:"episodedetails"`
+	Title     string   `xml:"title"`
+	ShowTitle string   `xml:"showtitle"`
+	Episode   int      `xml:"episode"`
+	Aired     string   `xml:"aired,omitempty"`
+	Runtime   int      `xml:"runtime,omitempty"`
+	Plot      string   `xml:"plot,omitempty"`
+	Studio    string   `xml:"studio"`
+	UniqueID  nfoID    `xml:"uniqueid"`
+	Snow      nfoFile  `xml:"snow"`
+}
+
+type nfoID struct {
+	Type    string `xml:"type,attr"`
+	Default bool   `xml:"default,attr"`
+	ID      int    `xml:",chardata"`
+}
+
+type nfoFile struct {
+	Asset  string `xml:"asset"`
+	Source string `xml:"source"`
+	Size   int64  `xml:"size"`
+	SHA256 string `xml:"sha256"`
+}
+
+// Marshal returns the sidecar in the format.
+func (sc Sidecar) Marshal(format string) ([]byte, error) {
+	switch format {
+	case "json":
+		b, err := json.MarshalIndent(sc, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(b, '\n'), nil
+	case "nfo":
+		nfo := nfoEpisode{
+			Title:     sc.Title,
+			ShowTitle: Album,
+			Episode:   sc.Episode,
+			Aired:     sc.Date,
+			Runtime:   sc.Minutes,
+			Plot:      sc.Description,
+			Studio:    "TWiT",
+			UniqueID:  nfoID{Type: "securitynow", Default: true, ID: sc.Episode},
+			Snow:      nfoFile{Asset: sc.Asset, Source: sc.Source, Size: sc.Size, SHA256: sc.SHA256},
+		}
+		b, err := xml.MarshalIndent(nfo, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>`+"\n"), append(b, '\n')...), nil
+	}
+	return nil, fmt.Errorf("unknown sidecar format %q", format)
+}
+
+// updateSidecars writes c's sidecars for the episodes' files that are in the
+// save dir, using the episode archive, and saves the history if any hashes
+// were added to it. The number of sidecars written is returned.
+func updateSidecars(c Conf, h *History, episodes []int) (int, error) {
+	if len(c.sidecars) == 0 || len(episodes) == 0 {
+		return 0, nil
+	}
+	cat, err := catalogFor(episodes)
+	if err != nil {
+		return 0, fmt.Errorf("error getting the episode catalog: %s", err)
+	}
+	n, hashed, err := writeSidecars(c, h, cat, episodes)
+	if hashed > 0 {
+		herr := h.Save()
+		if err == nil && herr != nil {
+			err = fmt.Errorf("error saving the download history: %s", herr)
+		}
+	}
+	return n, err
+}
+
+// writeSidecars writes c's sidecars for the episodes' files that are in the
+// save dir; a sidecar is only written if its content changed. Episodes that
+// aren't in the catalog are skipped. The files' hashes are recorded in h;
+// the number of sidecars written and the number of files that were hashed
+// are returned.
+func writeSidecars(c Conf, h *History, cat Catalog, episodes []int) (written, hashed int, err error) {
+	s := c.Storage()
+	for _, i := range episodes {
+		e, ok := cat[i]
+		if !ok {
+			Verbose(fmt.Sprintf("episode %d: sidecars skipped: %s", i, errNoTag))
+			continue
+		}
+		for _, a := range c.assets {
+			name, err := c.layout.Name(a, i)
+			if err != nil {
+				return written, hashed, err
+			}
+			fi, err := s.Stat(name)
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return written, hashed, err
+			}
+			sum, ok := h.Hash(a, i, fi)
+			if !ok {
+				sum, err = hashStorage(s, name)
+				if err != nil {
+					return written, hashed, fmt.Errorf("%s: %s", s.Path(name), err)
+				}
+				h.SetHash(a, i, fi, sum)
+				hashed++
+			}
+			sc := newSidecar(e, a, fi.Size, sum)
+			for _, f := range c.sidecars {
+				sname := sidecarName(name, a, f)
+				if sname == "" {
+					continue
+				}
+				b, err := sc.Marshal(f)
+				if err != nil {
+					return written, hashed, err
+				}
+				old, err := readStorage(s, sname)
+				if err == nil && bytes.Equal(old, b) {
+					continue
+				}
+				err = writeStorage(s, sname, b)
+				if err != nil {
+					return written, hashed, fmt.Errorf("%s: %s", s.Path(sname), err)
+				}
+				Verbose(fmt.Sprintf("%s: written", s.Path(sname)))
+				written++
+			}
+		}
+	}
+	return written, hashed, nil
+}
+
+// hashStorage returns the hex encoded SHA-256 hash of the named file.
+func hashStorage(s Storage, name string) (string, error) {
+	r, err := s.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, r)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
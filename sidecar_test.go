@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSidecarName(t *testing.T) {
+	tests := []struct {
+		name     string
+		asset    string
+		format   string
+		expected string
+	}{
+		{"sn-500.mp3", "hq", "json", "sn-500.mp3.json"},
+		{"sn-500.mp3", "hq", "nfo", "sn-500.nfo"},
+		{"sn-500-lq.mp3", "lq", "nfo", "sn-500-lq.nfo"},
+		{"2015/0500.txt", "txt", "json", "2015/0500.txt.json"},
+		{"2015/0500.txt", "txt", "nfo", ""},
+		{"sn-500.mp3", "hq", "xml", ""},
+	}
+	for i, test := range tests {
+		got := sidecarName(test.name, assets[test.asset], test.format)
+		if got != test.expected {
+			t.Errorf("%d: got %q; want %q", i, got, test.expected)
+		}
+	}
+}
+
+func TestParseSidecars(t *testing.T) {
+	tests := []struct {
+		names    []string
+		expected []string
+		err      string
+	}{
+		{[]string{""}, nil, ""},
+		{[]string{"json"}, []string{"json"}, ""},
+		{[]string{"NFO, json", "nfo"}, []string{"nfo", "json"}, ""},
+		{[]string{"xml"}, nil, `unknown sidecar format "xml"`},
+	}
+	for i, test := range tests {
+		got, err := parseSidecars(test.names...)
+		if err != nil {
+			if test.err == "" || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%d: got error %q; want %q", i, err, test.err)
+			}
+			continue
+		}
+		if test.err != "" {
+			t.Errorf("%d: got no error; want %q", i, test.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%d: got %v; want %v", i, got, test.expected)
+		}
+	}
+}
+
+func TestWriteSidecars(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"sn-500.mp3", "sn-500.txt"} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte("abc"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := localStorage{dir: dir}
+	h, err := loadHistory(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Record(assets["hq"], 500, 3, "download", "")
+	layout, _ := ParseLayout(defaultLayout)
+	c := Conf{SaveDir: dir, assets: []Asset{assets["hq"], assets["txt"], assets["lq"]}, layout: layout, sidecars: []string{"json", "nfo"}}
+	cat := Catalog{
+		500: {Number: 500, Title: "Windows Secure Boot", Date: time.Date(2015, time.March, 24, 0, 0, 0, 0, time.UTC), Minutes: 98, Description: "UEFI & TPM"},
+	}
+
+	written, hashed, err := writeSidecars(c, h, cat, []int{499, 500})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if written != 3 || hashed != 2 {
+		t.Errorf("got %d written, %d hashed; want 3 written, 2 hashed", written, hashed)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "sn-500.mp3.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sc Sidecar
+	err = json.Unmarshal(b, &sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Sidecar{
+		Version:     sidecarVersion,
+		Episode:     500,
+		Title:       "Windows Secure Boot",
+		Date:        "2015-03-24",
+		Minutes:     98,
+		Description: "UEFI & TPM",
+		Asset:       "hq",
+		Source:      "https://media.grc.com/sn/sn-500.mp3",
+		Size:        3,
+		SHA256:      "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+	}
+	if sc != expected {
+		t.Errorf("json: got %+v; want %+v", sc, expected)
+	}
+	b, err = ioutil.ReadFile(filepath.Join(dir, "sn-500.nfo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"<episodedetails>", "<title>Windows Secure Boot</title>", "<episode>500</episode>", "<aired>2015-03-24</aired>", "<runtime>98</runtime>", "<plot>UEFI &amp; TPM</plot>", "<sha256>ba7816bf"} {
+		if !strings.Contains(string(b), v) {
+			t.Errorf("nfo: expected it to contain %q", v)
+		}
+	}
+	if exists(filepath.Join(dir, "sn-500.txt.nfo")) || exists(filepath.Join(dir, "sn-500-lq.mp3.json")) {
+		t.Error("unexpected sidecars were written")
+	}
+
+	// unchanged sidecars aren't rewritten and cached hashes are used, even
+	// for the txt file, which wasn't in the history
+	written, hashed, err = writeSidecars(c, h, cat, []int{500})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if written != 0 || hashed != 0 {
+		t.Errorf("unchanged: got %d written, %d hashed; want 0 written, 0 hashed", written, hashed)
+	}
+
+	// changed metadata, or a changed file, updates the sidecars
+	e := cat[500]
+	e.Title = "Windows 10 Secure Boot"
+	cat[500] = e
+	err = ioutil.WriteFile(filepath.Join(dir, "sn-500.mp3"), []byte("abcd"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.sidecars = []string{"json"}
+	written, hashed, err = writeSidecars(c, h, cat, []int{500})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if written != 2 || hashed != 1 {
+		t.Errorf("changed: got %d written, %d hashed; want 2 written, 1 hashed", written, hashed)
+	}
+	b, _ = ioutil.ReadFile(filepath.Join(dir, "sn-500.mp3.json"))
+	if !strings.Contains(string(b), "Windows 10 Secure Boot") || !strings.Contains(string(b), `"size": 4`) {
+		t.Errorf("changed: got %s", b)
+	}
+	b, _ = ioutil.ReadFile(filepath.Join(dir, "sn-500.nfo"))
+	if strings.Contains(string(b), "Windows 10") {
+		t.Error("changed: the nfo was written without its format being specified")
+	}
+}
@@ -0,0 +1,191 @@
+// Apache License Version 2.0
+// http://www.apache.org/licenses/
+// Copyright (c) 2016 Joel Scoble
+// See LICENSE file for license text.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	spaceMargin        = 5         // the percentage of the downloads' size that is left free
+	minSpaceMargin     = 100 << 20 // the least amount of space that is left free
+	headConcurrency    = 8         // the number of concurrent HEAD requests for sizes that aren't advertised
+	defaultConfirmSize = "5 GB"    // the default size of the downloads above which confirmation is asked for
+)
+
+// preflight checks that there's enough space in the save dir for the
+// downloads that m will do; the downloads' sizes are the sizes advertised in
+// the episode archive or, if an asset's size isn't advertised, the size
+// reported by a HEAD request. If the downloads are larger than c's confirm
+// size and snow is being run interactively, confirmation is asked for.
+func preflight(c Conf, m *MP3) error {
+	planned := m.Planned()
+	if len(planned) == 0 {
+		return nil
+	}
+	total, unknown := downloadSize(planned, sizeCatalog(planned))
+	msg := fmt.Sprintf("%d files totalling about %s will be downloaded", len(planned), humanize.Bytes(total))
+	if unknown > 0 {
+		msg += fmt.Sprintf("; the sizes of %d files couldn't be determined", unknown)
+	}
+	Verbose(msg)
+	if c.Storage().Local() {
+		err := checkSpace(c.SaveDir, total)
+		if err != nil {
+			return err
+		}
+	}
+	if c.confirmSize == 0 || total <= c.confirmSize || !interactive() {
+		return nil
+	}
+	if !confirm(os.Stdin, os.Stdout, msg+". Continue? [y/N] ") {
+		return errors.New("Nothing to do: the downloads were cancelled.")
+	}
+	return nil
+}
+
+// sizeCatalog returns the catalog with the advertised sizes of the planned
+// downloads' assets. The main archive page is used unless some of the
+// episodes aren't on it. If the catalog can't be retrieved, an empty one is
+// returned and the sizes are retrieved using HEAD requests.
+func sizeCatalog(planned []Download) Catalog {
+	cat, err := runCatalog.Get()
+	if err != nil {
+		Verbose(fmt.Sprintf("error getting the episode catalog: %s", err))
+		return Catalog{}
+	}
+	for _, d := range planned {
+		if _, ok := cat[d.Episode]; ok {
+			continue
+		}
+		all, err := runCatalog.Get(allYears(time.Now())...)
+		if err != nil {
+			Verbose(fmt.Sprintf("error getting the episode catalog: %s", err))
+			return cat
+		}
+		return all
+	}
+	return cat
+}
+
+// downloadSize returns the total size of the downloads and the number of
+// downloads whose size couldn't be determined. The sizes advertised in cat
+// are used; the others are retrieved with HEAD requests.
+func downloadSize(downloads []Download, cat Catalog) (total uint64, unknown int) {
+	var head []Download
+	for _, d := range downloads {
+		n, ok := cat[d.Episode].Sizes[d.Asset.Name]
+		if !ok {
+			head = append(head, d)
+			continue
+		}
+		total += n
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	work := make(chan string)
+	for i := 0; i < headConcurrency && i < len(head); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for u := range work {
+				n, ok := headSize(u)
+				mu.Lock()
+				if ok {
+					total += n
+				} else {
+					unknown++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, d := range head {
+		work <- d.URL
+	}
+	close(work)
+	wg.Wait()
+	return total, unknown
+}
+
+// headSize returns the size of the file at url using a HEAD request.
+func headSize(url string) (uint64, bool) {
+	resp, err := http.Head(url)
+	if err != nil {
+		Verbose(fmt.Sprintf("HEAD %s: %s", url, err))
+		return 0, false
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ContentLength < 0 {
+		Verbose(fmt.Sprintf("HEAD %s: %s", url, resp.Status))
+		return 0, false
+	}
+	return uint64(resp.ContentLength), true
+}
+
+// checkSpace returns an error if the filesystem of dir doesn't have n bytes,
+// and the margin, free. If the free space can't be determined, the check is
+// skipped.
+func checkSpace(dir string, n uint64) error {
+	free, err := freeSpace(dir)
+	if err != nil {
+		Verbose(fmt.Sprintf("the free space of %s can't be determined: %s", dir, err))
+		return nil
+	}
+	margin := n * spaceMargin / 100
+	if margin < minSpaceMargin {
+		margin = minSpaceMargin
+	}
+	if n+margin > free {
+		return fmt.Errorf("not enough space in %s: the downloads need about %s, and %s is kept free, but only %s is free", dir, humanize.Bytes(n), humanize.Bytes(margin), humanize.Bytes(free))
+	}
+	return nil
+}
+
+// interactive returns whether snow's input and output are a terminal.
+func interactive() bool {
+	for _, f := range []*os.File{os.Stdin, os.Stdout} {
+		fi, err := f.Stat()
+		if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// confirm writes the prompt to w and returns whether the answer read from r
+// is yes.
+func confirm(r io.Reader, w io.Writer, prompt string) bool {
+	fmt.Fprint(w, prompt)
+	answer, _ := bufio.NewReader(r).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
+
+// parseConfirmSize parses a confirm size, e.g. 5GB or 500 MB; 0 means that
+// confirmation is never asked for.
+func parseConfirmSize(s string) (uint64, error) {
+	if strings.TrimSpace(s) == "0" {
+		return 0, nil
+	}
+	n, err := humanize.ParseBytes(s)
+	if err != nil {
+		return 0, fmt.Errorf("confirm: %s", err)
+	}
+	return n, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDownloadSize(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "HEAD" {
+			t.Errorf("got a %s request; want HEAD", r.Method)
+		}
+		switch r.URL.Path {
+		case "/sn-500.txt":
+			w.Header().Set("Content-Length", "1000")
+		case "/sn-501.txt":
+			w.Header().Set("Content-Length", "2000")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	cat := Catalog{
+		500: {Number: 500, Sizes: map[string]uint64{"hq": 45000000, "lq": 11000000}},
+		501: {Number: 501, Sizes: map[string]uint64{"hq": 44000000}},
+	}
+	var downloads []Download
+	for _, i := range []int{500, 501, 502} {
+		for _, a := range []Asset{assets["hq"], assets["txt"]} {
+			downloads = append(downloads, Download{Episode: i, Asset: a, URL: srv.URL + "/" + a.FileName(i)})
+		}
+	}
+	total, unknown := downloadSize(downloads, cat)
+	if total != 89003000 {
+		t.Errorf("total: got %d; want 89003000", total)
+	}
+	// episode 502 isn't in the catalog and the server doesn't have it
+	if unknown != 2 {
+		t.Errorf("unknown: got %d; want 2", unknown)
+	}
+}
+
+func TestPlanned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "sn-500.mp3"), []byte("500"), 0644)
+	h, _ := loadHistory(localStorage{dir: dir})
+	h.MarkPruned(assets["hq"], 499)
+	m := NewMP3(Conf{SaveDir: dir, episodes: []int{498, 499, 500}, assets: []Asset{assets["hq"], assets["txt"]}})
+	m.history = h
+	var names []string
+	for _, d := range m.Planned() {
+		names = append(names, d.Name)
+	}
+	expected := "sn-498.mp3 sn-498.txt sn-499.txt sn-500.txt"
+	if strings.Join(names, " ") != expected {
+		t.Errorf("got %s; want %s", strings.Join(names, " "), expected)
+	}
+}
+
+func TestCheckSpace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err := freeSpace(dir); err != nil {
+		t.Skipf("free space isn't supported: %s", err)
+	}
+	err = checkSpace(dir, 1)
+	if err != nil {
+		t.Errorf("1 byte: got %s; want no error", err)
+	}
+	err = checkSpace(dir, 1<<60)
+	if err == nil || !strings.HasPrefix(err.Error(), "not enough space") {
+		t.Errorf("1 EiB: got %v; want a not enough space error", err)
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	tests := []struct {
+		answer   string
+		expected bool
+	}{
+		{"y\n", true},
+		{"Yes\n", true},
+		{" y ", true},
+		{"n\n", false},
+		{"\n", false},
+		{"", false},
+		{"yep\n", false},
+	}
+	for i, test := range tests {
+		var w bytes.Buffer
+		got := confirm(strings.NewReader(test.answer), &w, "continue? ")
+		if got != test.expected {
+			t.Errorf("%d: got %t; want %t", i, got, test.expected)
+		}
+		if w.String() != "continue? " {
+			t.Errorf("%d: prompt: got %q; want %q", i, w.String(), "continue? ")
+		}
+	}
+}
@@ -0,0 +1,308 @@
+// Apache License Version 2.0
+// http://www.apache.org/licenses/
+// Copyright (c) 2016 Joel Scoble
+// See LICENSE file for license text.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// snow doesn't use cgo, so SQLite databases are written directly in SQLite's
+// file format: https://www.sqlite.org/fileformat.html. Only what's needed to
+// write a new database of tables, without indexes, is implemented.
+const (
+	sqlitePageSize = 4096
+	sqliteVersion  = 3008000 // the SQLite version written to the header; 3.8.0 can read the file
+)
+
+// sqliteTable is a table to write to an SQLite database; the values of its
+// rows are int64, string, or nil, which is NULL.
+type sqliteTable struct {
+	Name    string
+	Columns []sqliteColumn
+	Rows    [][]interface{}
+}
+
+type sqliteColumn struct {
+	Name string
+	Type string // INTEGER or TEXT
+}
+
+// SQL returns the table's CREATE TABLE statement.
+func (t sqliteTable) SQL() string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "CREATE TABLE %s (", t.Name)
+	for i, c := range t.Columns {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%s %s", c.Name, c.Type)
+	}
+	b.WriteString(")")
+	return b.String()
+}
+
+// sqliteDB builds the pages of a database.
+type sqliteDB struct {
+	pages [][]byte // pages[0] is page 1
+}
+
+// writeSQLite writes a database with the tables to w; version is the
+// database's user_version.
+func writeSQLite(w io.Writer, tables []sqliteTable, version int) error {
+	db := &sqliteDB{pages: [][]byte{nil}} // page 1 is built last
+	var master [][]byte
+	for i, t := range tables {
+		var cells [][]byte
+		for j, row := range t.Rows {
+			if len(row) != len(t.Columns) {
+				return fmt.Errorf("sqlite: %s: row %d has %d values; want %d", t.Name, j+1, len(row), len(t.Columns))
+			}
+			cell, err := db.leafCell(int64(j+1), row)
+			if err != nil {
+				return fmt.Errorf("sqlite: %s: %s", t.Name, err)
+			}
+			cells = append(cells, cell)
+		}
+		root := db.tree(cells)
+		cell, err := db.leafCell(int64(i+1), []interface{}{"table", t.Name, t.Name, int64(root), t.SQL()})
+		if err != nil {
+			return fmt.Errorf("sqlite: %s: %s", t.Name, err)
+		}
+		master = append(master, cell)
+	}
+	leaves := db.leaves(master, 100)
+	if len(leaves) != 1 {
+		return fmt.Errorf("sqlite: too many tables: the schema doesn't fit on the first page")
+	}
+	db.pages[0] = leaves[0]
+	db.header(version)
+	for _, p := range db.pages {
+		_, err := w.Write(p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// header writes the database header to page 1.
+func (db *sqliteDB) header(version int) {
+	h := db.pages[0][:100]
+	copy(h, "SQLite format 3\x00")
+	binary.BigEndian.PutUint16(h[16:], sqlitePageSize)
+	h[18], h[19] = 1, 1              // the legacy, rollback journal, file format
+	h[21], h[22], h[23] = 64, 32, 32 // the payload fractions, which must be these
+	binary.BigEndian.PutUint32(h[24:], 1)
+	binary.BigEndian.PutUint32(h[28:], uint32(len(db.pages)))
+	binary.BigEndian.PutUint32(h[40:], 1) // the schema cookie
+	binary.BigEndian.PutUint32(h[44:], 4) // the schema format
+	binary.BigEndian.PutUint32(h[56:], 1) // UTF-8
+	binary.BigEndian.PutUint32(h[60:], uint32(version))
+	binary.BigEndian.PutUint32(h[92:], 1) // the change counter the version is valid for
+	binary.BigEndian.PutUint32(h[96:], sqliteVersion)
+}
+
+// add adds a page and returns its page number.
+func (db *sqliteDB) add(p []byte) int {
+	db.pages = append(db.pages, p)
+	return len(db.pages)
+}
+
+// tree adds the table b-tree of the cells, whose rowids are 1 to the number
+// of cells, and returns its root page.
+func (db *sqliteDB) tree(cells [][]byte) int {
+	type child struct {
+		page  int
+		rowid int64 // the largest rowid in the child
+	}
+	var children []child
+	var rowid int64
+	for _, p := range db.leaves(cells, 0) {
+		page := db.add(p)
+		rowid += int64(binary.BigEndian.Uint16(p[3:]))
+		children = append(children, child{page: page, rowid: rowid})
+	}
+	for len(children) > 1 {
+		var parents []child
+		for len(children) > 0 {
+			// an interior cell is a 4 byte page number and a rowid varint
+			// of at most 9 bytes, plus its 2 byte pointer
+			p := make([]byte, sqlitePageSize)
+			p[0] = 0x05
+			end := sqlitePageSize
+			var nc int
+			for len(children) > 1 && 12+2*(nc+1) <= end-13 {
+				cell := append(make([]byte, 4), putVarint(children[0].rowid)...)
+				binary.BigEndian.PutUint32(cell, uint32(children[0].page))
+				end -= len(cell)
+				copy(p[end:], cell)
+				binary.BigEndian.PutUint16(p[12+2*nc:], uint16(end))
+				nc++
+				children = children[1:]
+			}
+			// the last child is the right-most pointer
+			last := children[0]
+			children = children[1:]
+			binary.BigEndian.PutUint16(p[3:], uint16(nc))
+			binary.BigEndian.PutUint16(p[5:], uint16(end))
+			binary.BigEndian.PutUint32(p[8:], uint32(last.page))
+			parents = append(parents, child{page: db.add(p), rowid: last.rowid})
+		}
+		children = parents
+	}
+	return children[0].page
+}
+
+// leaves returns the table b-tree leaf pages of the cells; off is the offset
+// of the page header, which is 100 on page 1. There is always at least one
+// page.
+func (db *sqliteDB) leaves(cells [][]byte, off int) [][]byte {
+	var pages [][]byte
+	for {
+		p := make([]byte, sqlitePageSize)
+		p[off] = 0x0D
+		end := sqlitePageSize
+		var nc int
+		for len(cells) > 0 && off+8+2*(nc+1)+len(cells[0]) <= end {
+			end -= len(cells[0])
+			copy(p[end:], cells[0])
+			binary.BigEndian.PutUint16(p[off+8+2*nc:], uint16(end))
+			nc++
+			cells = cells[1:]
+		}
+		binary.BigEndian.PutUint16(p[off+3:], uint16(nc))
+		binary.BigEndian.PutUint16(p[off+5:], uint16(end))
+		pages = append(pages, p)
+		if len(cells) == 0 {
+			return pages
+		}
+	}
+}
+
+// leafCell returns the table b-tree leaf cell of the row; if the record is
+// too large for a page, the rest of it is written to overflow pages.
+func (db *sqliteDB) leafCell(rowid int64, row []interface{}) ([]byte, error) {
+	record, err := sqliteRecord(row)
+	if err != nil {
+		return nil, err
+	}
+	cell := append(putVarint(int64(len(record))), putVarint(rowid)...)
+	// the amount of the record that's in the cell is from the file format's
+	// spec; U is the usable size of a page
+	const (
+		u = sqlitePageSize
+		x = u - 35
+		m = (u-12)*32/255 - 23
+	)
+	if len(record) <= x {
+		return append(cell, record...), nil
+	}
+	local := m + (len(record)-m)%(u-4)
+	if local > x {
+		local = m
+	}
+	cell = append(cell, record[:local]...)
+	first := db.overflow(record[local:])
+	return append(cell, byte(first>>24), byte(first>>16), byte(first>>8), byte(first)), nil
+}
+
+// overflow adds the overflow pages of b and returns the first one.
+func (db *sqliteDB) overflow(b []byte) int {
+	first := len(db.pages) + 1
+	for len(b) > 0 {
+		p := make([]byte, sqlitePageSize)
+		n := copy(p[4:], b)
+		b = b[n:]
+		if len(b) > 0 {
+			binary.BigEndian.PutUint32(p, uint32(len(db.pages)+2))
+		}
+		db.add(p)
+	}
+	return first
+}
+
+// sqliteRecord returns the values in SQLite's record format.
+func sqliteRecord(values []interface{}) ([]byte, error) {
+	var types, body []byte
+	for _, v := range values {
+		switch v := v.(type) {
+		case nil:
+			types = append(types, 0)
+		case int64:
+			t, b := sqliteInt(v)
+			types = append(types, putVarint(t)...)
+			body = append(body, b...)
+		case string:
+			types = append(types, putVarint(int64(len(v))*2+13)...)
+			body = append(body, v...)
+		default:
+			return nil, fmt.Errorf("unsupported value type %T", v)
+		}
+	}
+	// the header's size includes the size varint itself
+	n := len(types) + 1
+	if len(putVarint(int64(n))) > 1 {
+		n++
+	}
+	return append(append(putVarint(int64(n)), types...), body...), nil
+}
+
+// sqliteInt returns the serial type and big-endian bytes of the integer.
+func sqliteInt(v int64) (int64, []byte) {
+	switch {
+	case v == 0:
+		return 8, nil
+	case v == 1:
+		return 9, nil
+	case v >= -1<<7 && v < 1<<7:
+		return 1, []byte{byte(v)}
+	case v >= -1<<15 && v < 1<<15:
+		return 2, []byte{byte(v >> 8), byte(v)}
+	case v >= -1<<23 && v < 1<<23:
+		return 3, []byte{byte(v >> 16), byte(v >> 8), byte(v)}
+	case v >= -1<<31 && v < 1<<31:
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(v))
+		return 4, b
+	case v >= -1<<47 && v < 1<<47:
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, uint64(v))
+		return 5, b[2:]
+	}
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(v))
+	return 6, b
+}
+
+// putVarint returns v as an SQLite varint: big-endian, 7 bits per byte, with
+// the 9th byte, if any, having 8 bits.
+func putVarint(v int64) []byte {
+	u := uint64(v)
+	if u > 1<<56-1 {
+		b := make([]byte, 9)
+		b[8] = byte(u)
+		u >>= 8
+		for i := 7; i >= 0; i-- {
+			b[i] = byte(u&0x7f) | 0x80
+			u >>= 7
+		}
+		return b
+	}
+	var b []byte
+	for {
+		b = append([]byte{byte(u & 0x7f)}, b...)
+		u >>= 7
+		if u == 0 {
+			break
+		}
+	}
+	for i := 0; i < len(b)-1; i++ {
+		b[i] |= 0x80
+	}
+	return b
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPutVarint(t *testing.T) {
+	tests := []struct {
+		v        int64
+		expected []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x81, 0x00}},
+		{16383, []byte{0xff, 0x7f}},
+		{16384, []byte{0x81, 0x80, 0x00}},
+		{-1, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+	}
+	for i, test := range tests {
+		got := putVarint(test.v)
+		if !bytes.Equal(got, test.expected) {
+			t.Errorf("%d: got %x; want %x", i, got, test.expected)
+		}
+		v, n := getVarint(got)
+		if v != test.v || n != len(got) {
+			t.Errorf("%d: got %d, %d bytes, back; want %d, %d bytes", i, v, n, test.v, len(got))
+		}
+	}
+}
+
+func TestWriteSQLite(t *testing.T) {
+	var rows [][]interface{}
+	for i := 0; i < 3000; i++ {
+		var desc interface{} = strings.Repeat(fmt.Sprintf("episode %d ", i), i%500)
+		if i%7 == 0 {
+			desc = nil
+		}
+		rows = append(rows, []interface{}{int64(i * 100003), fmt.Sprintf("title %d", i), desc, int64(-i)})
+	}
+	tables := []sqliteTable{
+		{Name: "empty", Columns: []sqliteColumn{{"a", "TEXT"}}},
+		{Name: "episodes", Columns: []sqliteColumn{{"number", "INTEGER"}, {"title", "TEXT"}, {"description", "TEXT"}, {"n", "INTEGER"}}, Rows: rows},
+		{Name: "meta", Columns: []sqliteColumn{{"key", "TEXT"}, {"value", "INTEGER"}}, Rows: [][]interface{}{{"a", int64(1)}, {"b", int64(1 << 40)}, {"c", int64(-1 << 62)}, {"d", int64(0)}}},
+	}
+	var buf bytes.Buffer
+	err := writeSQLite(&buf, tables, 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	db := buf.Bytes()
+	if !bytes.HasPrefix(db, []byte("SQLite format 3\x00")) {
+		t.Fatalf("header: got %q", db[:16])
+	}
+	if n := int(binary.BigEndian.Uint32(db[28:])); n*sqlitePageSize != len(db) {
+		t.Errorf("header: got %d pages; the file has %d", n, len(db)/sqlitePageSize)
+	}
+	if v := binary.BigEndian.Uint32(db[60:]); v != 3 {
+		t.Errorf("header: got user_version %d; want 3", v)
+	}
+
+	master := readSQLiteTable(t, db, 1)
+	if len(master) != len(tables) {
+		t.Fatalf("schema: got %d tables; want %d", len(master), len(tables))
+	}
+	for i, table := range tables {
+		m := master[i]
+		if m[0] != "table" || m[1] != table.Name || m[4] != table.SQL() {
+			t.Errorf("%s: schema: got %v", table.Name, m)
+			continue
+		}
+		got := readSQLiteTable(t, db, int(m[3].(int64)))
+		if len(got) != len(table.Rows) {
+			t.Errorf("%s: got %d rows; want %d", table.Name, len(got), len(table.Rows))
+			continue
+		}
+		for j := range got {
+			if !reflect.DeepEqual(got[j], table.Rows[j]) {
+				t.Errorf("%s: row %d: got %.60v; want %.60v", table.Name, j+1, got[j], table.Rows[j])
+				break
+			}
+		}
+	}
+
+	err = writeSQLite(&buf, []sqliteTable{{Name: "t", Columns: []sqliteColumn{{"a", "TEXT"}}, Rows: [][]interface{}{{1.5}}}}, 1)
+	if err == nil {
+		t.Error("float: expected an error")
+	}
+}
+
+// readSQLiteTable returns the rows of the table b-tree at the root page, in
+// rowid order; the rowids must be sequential from 1.
+func readSQLiteTable(t *testing.T, db []byte, root int) [][]interface{} {
+	var rows [][]interface{}
+	var walk func(page int)
+	walk = func(page int) {
+		p := db[(page-1)*sqlitePageSize : page*sqlitePageSize]
+		off := 0
+		if page == 1 {
+			off = 100
+		}
+		n := int(binary.BigEndian.Uint16(p[off+3:]))
+		switch p[off] {
+		case 0x05:
+			for j := 0; j < n; j++ {
+				c := int(binary.BigEndian.Uint16(p[off+12+2*j:]))
+				walk(int(binary.BigEndian.Uint32(p[c:])))
+			}
+			walk(int(binary.BigEndian.Uint32(p[off+8:])))
+		case 0x0D:
+			for j := 0; j < n; j++ {
+				c := int(binary.BigEndian.Uint16(p[off+8+2*j:]))
+				size, k := getVarint(p[c:])
+				c += k
+				rowid, k := getVarint(p[c:])
+				c += k
+				if rowid != int64(len(rows)+1) {
+					t.Fatalf("page %d: got rowid %d; want %d", page, rowid, len(rows)+1)
+				}
+				rows = append(rows, readSQLiteRecord(db, p[c:], int(size)))
+			}
+		default:
+			t.Fatalf("page %d: unexpected page type %x", page, p[off])
+		}
+	}
+	walk(root)
+	return rows
+}
+
+// readSQLiteRecord returns the values of the record of the size at b,
+// following its overflow pages.
+func readSQLiteRecord(db, b []byte, size int) []interface{} {
+	const x = sqlitePageSize - 35
+	const m = (sqlitePageSize-12)*32/255 - 23
+	record := b[:size:size]
+	if size > x {
+		local := m + (size-m)%(sqlitePageSize-4)
+		if local > x {
+			local = m
+		}
+		record = append([]byte{}, b[:local]...)
+		next := int(binary.BigEndian.Uint32(b[local:]))
+		for next != 0 {
+			p := db[(next-1)*sqlitePageSize : next*sqlitePageSize]
+			n := size - len(record)
+			if n > sqlitePageSize-4 {
+				n = sqlitePageSize - 4
+			}
+			record = append(record, p[4:4+n]...)
+			next = int(binary.BigEndian.Uint32(p))
+		}
+	}
+	hsize, k := getVarint(record)
+	var types []int64
+	for k < int(hsize) {
+		typ, n := getVarint(record[k:])
+		types = append(types, typ)
+		k += n
+	}
+	body := record[hsize:]
+	var values []interface{}
+	for _, typ := range types {
+		switch {
+		case typ == 0:
+			values = append(values, nil)
+		case typ == 8, typ == 9:
+			values = append(values, typ-8)
+		case typ >= 1 && typ <= 6:
+			n := []int{0, 1, 2, 3, 4, 6, 8}[typ]
+			var v int64
+			if body[0]&0x80 != 0 {
+				v = -1
+			}
+			for _, c := range body[:n] {
+				v = v<<8 | int64(c)
+			}
+			values = append(values, v)
+			body = body[n:]
+		default:
+			n := int(typ-13) / 2
+			values = append(values, string(body[:n]))
+			body = body[n:]
+		}
+	}
+	return values
+}
+
+// getVarint returns the SQLite varint at the start of b and its length.
+func getVarint(b []byte) (int64, int) {
+	var v uint64
+	for i := 0; i < 8; i++ {
+		v = v<<7 | uint64(b[i]&0x7f)
+		if b[i]&0x80 == 0 {
+			return int64(v), i + 1
+		}
+	}
+	return int64(v<<8 | uint64(b[8])), 9
+}
@@ -0,0 +1,472 @@
+// Apache License Version 2.0
+// http://www.apache.org/licenses/
+// Copyright (c) 2016 Joel Scoble
+// See LICENSE file for license text.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultState = "$HOME/.snow-state.json" // the default state file
+	stateVersion = 1                        // the version of the state file's format
+)
+
+// The played states of an episode.
+const (
+	Unplayed   = "unplayed"
+	InProgress = "inprogress"
+	Played     = "played"
+)
+
+// playedStates are the played states, for messages.
+var playedStates = []string{Unplayed, InProgress, Played}
+
+// the state flags
+var (
+	stateFile   = defaultState
+	stateFilter string
+	position    string
+	unmark      bool
+	nextN       int
+	nextNewest  bool
+	nextPrintAt bool
+)
+
+// stateFilterFlag adds the flag that filters episodes by their played state
+// to fs.
+func stateFilterFlag(fs *flag.FlagSet) {
+	fs.StringVar(&stateFilter, "state", "", "only the episodes in these played states, a comma separated list: "+strings.Join(playedStates, ", "))
+}
+
+func markCommand() *Command {
+	c := newCommand("mark", "state episodes", "mark episodes as played, unplayed, or in progress", `
+Mark sets the played state of the episodes, an episode selection, e.g.
+1-10,42. The states are:
+
+    played      the episode was listened to
+    unplayed    the episode wasn't listened to; this is every episode's state
+                until it's marked
+    inprogress  the episode is being listened to; -position is where
+                listening stopped, e.g. 42:10 or 1h2m3s
+
+The played states are the user's, not the save directory's: they are kept in
+the state file, $HOME/.snow-state.json by default, and apply to every save
+directory. List, playlist, and next use them to select episodes, and the
+-prunelistened prune policy removes the played episodes.`, runMark)
+	c.Flags.StringVar(&position, "position", "", "where listening stopped, for inprogress: [[hh:]mm:]ss or a duration, e.g. 1h2m3s")
+	libraryFlags(c.Flags)
+	configFlags(c.Flags, true)
+	return c
+}
+
+// runMark sets the played state of the selected episodes.
+func runMark(cmd *Command, args []string) error {
+	if len(args) < 2 {
+		return errors.New("mark: a state and the episodes must be specified")
+	}
+	state := strings.ToLower(args[0])
+	if !validState(state) {
+		return fmt.Errorf("mark: unknown state %q: must be %s", args[0], strings.Join(playedStates, ", "))
+	}
+	var pos int
+	if position != "" {
+		if state != InProgress {
+			return fmt.Errorf("mark: -position can only be used with %s", InProgress)
+		}
+		var err error
+		pos, err = parsePosition(position)
+		if err != nil {
+			return fmt.Errorf("mark: %s", err)
+		}
+	}
+	sel, err := ParseSelection(strings.Join(args[1:], ","))
+	if err != nil {
+		return err
+	}
+	cs, err := confs(cmd.Flags)
+	if err != nil {
+		return err
+	}
+	c := cs[0]
+	// the most recent episode is only needed for open ranges
+	last, ok := sel.Max()
+	if !ok {
+		last, err = lastEpisode()
+		if err != nil {
+			return err
+		}
+	}
+	st, err := loadUserState(c)
+	if err != nil {
+		return err
+	}
+	episodes := sel.Episodes(last, nil)
+	for _, i := range episodes {
+		st.Set(i, state, pos)
+	}
+	err = st.Save()
+	if err != nil {
+		return fmt.Errorf("error saving the state file: %s", err)
+	}
+	if state == InProgress && pos > 0 {
+		fmt.Printf("%d episodes marked as %s at %s\n", len(episodes), state, formatPosition(pos))
+		return nil
+	}
+	fmt.Printf("%d episodes marked as %s\n", len(episodes), state)
+	return nil
+}
+
+func listenedCommand() *Command {
+	c := newCommand("listened", "episodes", "mark episodes as played", `
+Listened marks the episodes, an episode selection, e.g. 1-10,42, as played; with
+-undo, they are marked as unplayed instead. It's the same as "snow mark played"
+and "snow mark unplayed"; see "snow help mark".`, runListened)
+	c.Flags.BoolVar(&unmark, "undo", false, "mark the episodes as unplayed")
+	libraryFlags(c.Flags)
+	configFlags(c.Flags, true)
+	return c
+}
+
+// runListened marks the selected episodes as played, or with -undo, as
+// unplayed.
+func runListened(cmd *Command, args []string) error {
+	if len(args) == 0 {
+		return errors.New("listened: no episodes specified")
+	}
+	state := Played
+	if unmark {
+		state = Unplayed
+	}
+	return runMark(cmd, append([]string{state}, args...))
+}
+
+func nextCommand() *Command {
+	c := newCommand("next", "", "print the path of the next episode to listen to", `
+Next prints the path of the next episode to listen to: the episode that is in
+progress, if any, otherwise the oldest unplayed episode; with -newest, it's the
+newest unplayed episode instead. Only episodes that have one of the audio
+assets in the save directory are considered; if an episode has more than one,
+the first one in -assets is used. By default, all episodes are considered.
+
+The path is absolute, so it can be passed to a player:
+
+    $ mpv "$(snow next)"
+
+With -position, the position that listening stopped at is printed instead, in
+seconds, which is 0 for unplayed episodes:
+
+    $ mpv --start=$(snow next -position) "$(snow next)"
+
+Use "snow mark" to mark the episode as played, or in progress, afterwards.`, runNext)
+	rangeFlags(c.Flags, 0)
+	libraryFlags(c.Flags)
+	configFlags(c.Flags, true)
+	mirrorFlag(c.Flags)
+	c.Flags.IntVar(&nextN, "n", 1, "the number of episodes to print")
+	c.Flags.BoolVar(&nextNewest, "newest", false, "the newest unplayed episode is next instead of the oldest")
+	c.Flags.BoolVar(&nextPrintAt, "position", false, "print the position, in seconds, that listening stopped at instead of the path")
+	return c
+}
+
+// runNext prints the next episodes to listen to.
+func runNext(cmd *Command, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("next: unexpected args: %s", strings.Join(args, " "))
+	}
+	if nextN < 1 {
+		return fmt.Errorf("next: -n must be at least 1: %d", nextN)
+	}
+	cs, err := confs(cmd.Flags)
+	if err != nil {
+		return err
+	}
+	c := cs[0]
+	err = requireLocal(c, "next")
+	if err != nil {
+		return err
+	}
+	last, err := lastEpisode()
+	if err != nil {
+		return err
+	}
+	err = resolveEpisodes(&c, last)
+	if err != nil {
+		return err
+	}
+	st, err := loadUserState(c)
+	if err != nil {
+		return err
+	}
+	next, err := nextEpisodes(c, st, nextN, nextNewest)
+	if err != nil {
+		return err
+	}
+	if len(next) == 0 {
+		return errors.New("Nothing to do: none of the selected episodes that are in the save directory are unplayed.")
+	}
+	s := c.Storage()
+	for _, v := range next {
+		if nextPrintAt {
+			fmt.Println(v.Position)
+			continue
+		}
+		p, err := filepath.Abs(s.Path(v.Name))
+		if err != nil {
+			return err
+		}
+		fmt.Println(p)
+	}
+	return nil
+}
+
+// nextEpisode is an episode to listen to.
+type nextEpisode struct {
+	Episode  int
+	Name     string // the name of its audio file in the save dir
+	Position int    // where listening stopped, in seconds
+}
+
+// nextEpisodes returns up to n of c's episodes to listen to, in the order of
+// nextOrder. Only the episodes that have one of c's audio assets in the save
+// dir are returned.
+func nextEpisodes(c Conf, st *State, n int, newest bool) ([]nextEpisode, error) {
+	s := c.Storage()
+	var next []nextEpisode
+	for _, i := range nextOrder(c.episodes, st, newest) {
+		if len(next) == n {
+			break
+		}
+		name, err := audioName(c, s, i)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			continue
+		}
+		next = append(next, nextEpisode{Episode: i, Name: name, Position: st.Position(i)})
+	}
+	return next, nil
+}
+
+// nextOrder returns the episodes that aren't played in the order they are
+// listened to: the episodes that are in progress, most recently played first,
+// and then the unplayed episodes, oldest first unless newest is true.
+func nextOrder(episodes []int, st *State, newest bool) []int {
+	var inProgress, unplayed []int
+	for _, i := range episodes {
+		switch st.State(i) {
+		case InProgress:
+			inProgress = append(inProgress, i)
+		case Unplayed:
+			unplayed = append(unplayed, i)
+		}
+	}
+	sort.Sort(byUpdated{inProgress, st})
+	if newest {
+		sort.Sort(sort.Reverse(sort.IntSlice(unplayed)))
+	}
+	return append(inProgress, unplayed...)
+}
+
+// byUpdated sorts episodes by when their state was updated, most recent
+// first.
+type byUpdated struct {
+	episodes []int
+	st       *State
+}
+
+func (b byUpdated) Len() int      { return len(b.episodes) }
+func (b byUpdated) Swap(i, j int) { b.episodes[i], b.episodes[j] = b.episodes[j], b.episodes[i] }
+func (b byUpdated) Less(i, j int) bool {
+	return b.st.Episodes[b.episodes[i]].Updated.After(b.st.Episodes[b.episodes[j]].Updated)
+}
+
+// State is a user's played states of the episodes; it's kept in the state
+// file. Episodes that aren't in it are unplayed.
+type State struct {
+	Version  int                   `json:"version"`
+	Episodes map[int]*EpisodeState `json:"episodes"`
+
+	path string
+}
+
+// EpisodeState is the played state of an episode.
+type EpisodeState struct {
+	State    string    `json:"state"`              // played or inprogress
+	Position int       `json:"position,omitempty"` // for inprogress, where listening stopped, in seconds
+	Updated  time.Time `json:"updated"`
+}
+
+// loadState loads the state file at path. If it doesn't exist, an empty
+// state is returned.
+func loadState(path string) (*State, error) {
+	st := &State{Version: stateVersion, Episodes: make(map[int]*EpisodeState), path: path}
+	b, err := readStorage(localStorage{dir: filepath.Dir(path)}, filepath.Base(path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return st, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(b, st)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if st.Version > stateVersion {
+		return nil, fmt.Errorf("%s: unsupported version %d; this snow supports version %d", path, st.Version, stateVersion)
+	}
+	if st.Episodes == nil {
+		st.Episodes = make(map[int]*EpisodeState)
+	}
+	return st, nil
+}
+
+// loadUserState loads the state file of c's user.
+func loadUserState(c Conf) (*State, error) {
+	st, err := loadState(c.stateFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading the state file: %s", err)
+	}
+	return st, nil
+}
+
+// Save writes the state file.
+func (st *State) Save() error {
+	st.Version = stateVersion
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeStorage(localStorage{dir: filepath.Dir(st.path)}, filepath.Base(st.path), b)
+}
+
+// State returns the played state of episode i.
+func (st *State) State(i int) string {
+	e, ok := st.Episodes[i]
+	if !ok {
+		return Unplayed
+	}
+	return e.State
+}
+
+// Position returns where listening to episode i stopped, in seconds; it's 0
+// unless the episode is in progress.
+func (st *State) Position(i int) int {
+	e, ok := st.Episodes[i]
+	if !ok || e.State != InProgress {
+		return 0
+	}
+	return e.Position
+}
+
+// Set sets the played state of episode i; the position is only kept for
+// inprogress.
+func (st *State) Set(i int, state string, pos int) {
+	if state == Unplayed {
+		delete(st.Episodes, i)
+		return
+	}
+	if state != InProgress {
+		pos = 0
+	}
+	st.Episodes[i] = &EpisodeState{State: state, Position: pos, Updated: time.Now().UTC()}
+}
+
+// Filter returns the episodes that are in one of the states; if there aren't
+// any states, all of the episodes are returned.
+func (st *State) Filter(episodes []int, states []string) []int {
+	if len(states) == 0 {
+		return episodes
+	}
+	var filtered []int
+	for _, i := range episodes {
+		state := st.State(i)
+		for _, v := range states {
+			if v == state {
+				filtered = append(filtered, i)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+// filterStates returns the episodes that are in one of c's played states; if
+// c doesn't have any, all of the episodes are returned.
+func filterStates(c Conf, episodes []int) ([]int, error) {
+	if len(c.states) == 0 {
+		return episodes, nil
+	}
+	st, err := loadUserState(c)
+	if err != nil {
+		return nil, err
+	}
+	return st.Filter(episodes, c.states), nil
+}
+
+// validState returns whether state is a played state.
+func validState(state string) bool {
+	for _, v := range playedStates {
+		if v == state {
+			return true
+		}
+	}
+	return false
+}
+
+// parseStates returns the played states in the comma separated list; an
+// empty list has no states.
+func parseStates(s string) ([]string, error) {
+	var states []string
+	for _, v := range strings.Split(s, ",") {
+		v = strings.ToLower(strings.TrimSpace(v))
+		if v == "" {
+			continue
+		}
+		if !validState(v) {
+			return nil, fmt.Errorf("unknown played state %q: must be %s", v, strings.Join(playedStates, ", "))
+		}
+		states = append(states, v)
+	}
+	return states, nil
+}
+
+// parsePosition returns the position, in seconds, in s, which is either
+// [[hh:]mm:]ss, e.g. 1:02:03, or a duration, e.g. 1h2m3s.
+func parsePosition(s string) (int, error) {
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return int(d / time.Second), nil
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid position %q: must be [[hh:]mm:]ss or a duration, e.g. 1h2m3s", s)
+	}
+	var pos int
+	for j, v := range parts {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || (j > 0 && n > 59) {
+			return 0, fmt.Errorf("invalid position %q: must be [[hh:]mm:]ss or a duration, e.g. 1h2m3s", s)
+		}
+		pos = pos*60 + n
+	}
+	return pos, nil
+}
+
+// formatPosition returns the position, in seconds, as [h:]mm:ss.
+func formatPosition(pos int) string {
+	if pos >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", pos/3600, pos/60%60, pos%60)
+	}
+	return fmt.Sprintf("%d:%02d", pos/60, pos%60)
+}
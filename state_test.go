@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParsePosition(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected int
+		err      bool
+	}{
+		{"0", 0, false},
+		{"90", 90, false},
+		{"42:10", 2530, false},
+		{"1:02:03", 3723, false},
+		{"1h2m3s", 3723, false},
+		{"45m", 2700, false},
+		{"1:60", 0, true},
+		{"1:2:3:4", 0, true},
+		{"-5s", 0, true},
+		{"abc", 0, true},
+	}
+	for i, test := range tests {
+		pos, err := parsePosition(test.s)
+		if err != nil {
+			if !test.err {
+				t.Errorf("%d: unexpected error: %s", i, err)
+			}
+			continue
+		}
+		if test.err {
+			t.Errorf("%d: got no error; want one", i)
+			continue
+		}
+		if pos != test.expected {
+			t.Errorf("%d: got %d; want %d", i, pos, test.expected)
+		}
+	}
+}
+
+func TestFormatPosition(t *testing.T) {
+	tests := []struct {
+		pos      int
+		expected string
+	}{
+		{0, "0:00"},
+		{2530, "42:10"},
+		{3723, "1:02:03"},
+	}
+	for i, test := range tests {
+		if s := formatPosition(test.pos); s != test.expected {
+			t.Errorf("%d: got %q; want %q", i, s, test.expected)
+		}
+	}
+}
+
+func TestState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+	st, err := loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Set(1, Played, 0)
+	st.Set(2, InProgress, 600)
+	st.Set(3, Played, 600)
+	st.Set(3, Unplayed, 0)
+	err = st.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err = loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	episodes := []int{1, 2, 3, 4}
+	tests := []struct {
+		states   []string
+		expected []int
+	}{
+		{nil, []int{1, 2, 3, 4}},
+		{[]string{Played}, []int{1}},
+		{[]string{Unplayed}, []int{3, 4}},
+		{[]string{Unplayed, InProgress}, []int{2, 3, 4}},
+	}
+	for i, test := range tests {
+		if got := st.Filter(episodes, test.states); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%d: got %v; want %v", i, got, test.expected)
+		}
+	}
+	if st.Position(2) != 600 || st.Position(1) != 0 {
+		t.Errorf("position: got %d and %d; want 600 and 0", st.Position(2), st.Position(1))
+	}
+
+	_, err = parseStates("played,finished")
+	if err == nil {
+		t.Error("parse: expected an error for an unknown state")
+	}
+}
+
+func TestNextEpisodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"sn-001.mp3", "sn-002-lq.mp3", "sn-003.mp3", "sn-004.mp3", "sn-005.txt", "sn-006.mp3"} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	layout, _ := ParseLayout(defaultLayout)
+	c := Conf{SaveDir: dir, assets: []Asset{assets["hq"], assets["lq"], assets["txt"]}, layout: layout, episodes: []int{1, 2, 3, 4, 5, 6}}
+	now := time.Now()
+	st := &State{Episodes: map[int]*EpisodeState{
+		1: {State: Played, Updated: now},
+		3: {State: InProgress, Position: 60, Updated: now.Add(-time.Hour)},
+		6: {State: InProgress, Position: 120, Updated: now},
+	}}
+	tests := []struct {
+		n        int
+		newest   bool
+		expected []nextEpisode
+	}{
+		{1, false, []nextEpisode{{6, "sn-006.mp3", 120}}},
+		{4, false, []nextEpisode{{6, "sn-006.mp3", 120}, {3, "sn-003.mp3", 60}, {2, "sn-002-lq.mp3", 0}, {4, "sn-004.mp3", 0}}},
+		{3, true, []nextEpisode{{6, "sn-006.mp3", 120}, {3, "sn-003.mp3", 60}, {4, "sn-004.mp3", 0}}},
+	}
+	for i, test := range tests {
+		got, err := nextEpisodes(c, st, test.n, test.newest)
+		if err != nil {
+			t.Errorf("%d: unexpected error: %s", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%d: got %v; want %v", i, got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+// Apache License Version 2.0
+// http://www.apache.org/licenses/
+// Copyright (c) 2016 Joel Scoble
+// See LICENSE file for license text.
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Storage is where a library's files are saved: a local dir or a bucket in
+// an S3 compatible object store. Names are slash separated paths relative to
+// the root of the storage, e.g. 2016/sn-500.mp3.
+type Storage interface {
+	// Stat returns the info of the named file; if it doesn't exist, the
+	// error satisfies os.IsNotExist.
+	Stat(name string) (StorageInfo, error)
+	// Open opens the named file for reading.
+	Open(name string) (io.ReadCloser, error)
+	// Create returns a writer for the named file; the file isn't replaced
+	// until the writer is committed.
+	Create(name string) (StorageWriter, error)
+	// CreateExclusive creates the named file with the contents b unless it
+	// exists, in which case the error satisfies os.IsExist.
+	CreateExclusive(name string, b []byte) error
+	// List returns the info of the files whose names start with prefix.
+	List(prefix string) ([]StorageInfo, error)
+	// Remove removes the named file.
+	Remove(name string) error
+	// Path returns the path, or url, of the named file, for messages.
+	Path(name string) string
+	// Local returns whether the storage is a local dir.
+	Local() bool
+}
+
+// StorageWriter writes a file to a storage. Nothing is written to the
+// storage until Commit is called; either Commit or Abort must be called.
+type StorageWriter interface {
+	io.Writer
+	// Commit replaces the file with what was written.
+	Commit() error
+	// Abort discards what was written.
+	Abort() error
+}
+
+// StorageInfo describes a file in a storage.
+type StorageInfo struct {
+	Name    string // the slash separated name of the file
+	Size    int64
+	ModTime time.Time
+}
+
+// openStorage returns the storage for the save dir: save dirs of the form
+// s3://bucket/prefix are in an S3 compatible object store; everything else is
+// a local dir.
+func openStorage(dir string) (Storage, error) {
+	if strings.HasPrefix(dir, s3Scheme) {
+		return newS3Storage(dir)
+	}
+	return localStorage{dir: dir}, nil
+}
+
+// Storage returns the storage of the conf's save dir.
+func (c Conf) Storage() Storage {
+	if c.storage != nil {
+		return c.storage
+	}
+	return localStorage{dir: c.SaveDir}
+}
+
+// requireLocal returns an error if the conf's save dir isn't a local dir;
+// cmd is the name of the command that needs one.
+func requireLocal(c Conf, cmd string) error {
+	if c.Storage().Local() {
+		return nil
+	}
+	return fmt.Errorf("%s: %s isn't a local dir; %s only works with local save dirs", cmd, c.SaveDir, cmd)
+}
+
+// readStorage returns the contents of the named file.
+func readStorage(s Storage, name string) ([]byte, error) {
+	r, err := s.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// writeStorage replaces the named file with b.
+func writeStorage(s Storage, name string, b []byte) error {
+	w, err := s.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Commit()
+}
+
+// storageExists returns whether the named file exists.
+func storageExists(s Storage, name string) bool {
+	_, err := s.Stat(name)
+	return err == nil
+}
+
+// localStorage is a local dir.
+type localStorage struct {
+	dir string
+}
+
+// path returns the local path of the named file.
+func (s localStorage) path(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(name))
+}
+
+func (s localStorage) Stat(name string) (StorageInfo, error) {
+	fi, err := os.Stat(s.path(name))
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	return StorageInfo{Name: name, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (s localStorage) Open(name string) (io.ReadCloser, error) {
+	return os.Open(s.path(name))
+}
+
+// Create writes to a temporary file in the file's dir that is renamed to the
+// file on commit; a partial download never replaces the file.
+func (s localStorage) Create(name string) (StorageWriter, error) {
+	p := s.path(name)
+	err := os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), "."+filepath.Base(p))
+	if err != nil {
+		return nil, err
+	}
+	return &localWriter{File: f, path: p}, nil
+}
+
+func (s localStorage) CreateExclusive(name string, b []byte) error {
+	p := s.path(name)
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err != nil {
+		f.Close()
+		os.Remove(p)
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		os.Remove(p)
+	}
+	return err
+}
+
+func (s localStorage) List(prefix string) ([]StorageInfo, error) {
+	var files []StorageInfo
+	err := filepath.Walk(s.dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if strings.HasPrefix(name, prefix) {
+			files = append(files, StorageInfo{Name: name, Size: fi.Size(), ModTime: fi.ModTime()})
+		}
+		return nil
+	})
+	return files, err
+}
+
+func (s localStorage) Remove(name string) error {
+	return os.Remove(s.path(name))
+}
+
+func (s localStorage) Path(name string) string {
+	return s.path(name)
+}
+
+func (s localStorage) Local() bool {
+	return true
+}
+
+// localWriter is a localStorage file that is being written.
+type localWriter struct {
+	*os.File
+	path string // the path of the file that's being written
+}
+
+func (w *localWriter) Commit() error {
+	err := w.File.Chmod(0664)
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	err = w.File.Close()
+	if err != nil {
+		os.Remove(w.File.Name())
+		return err
+	}
+	err = os.Rename(w.File.Name(), w.path)
+	if err != nil {
+		os.Remove(w.File.Name())
+	}
+	return err
+}
+
+func (w *localWriter) Abort() error {
+	w.File.Close()
+	return os.Remove(w.File.Name())
+}
@@ -0,0 +1,236 @@
+// Apache License Version 2.0
+// http://www.apache.org/licenses/
+// Copyright (c) 2016 Joel Scoble
+// See LICENSE file for license text.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	Album  = "Security Now!"              // the album of every episode
+	Artist = "Steve Gibson & Leo Laporte" // the artist of every episode
+)
+
+// episodeTag returns the tag for an episode; cover and its MIME type are
+// optional.
+func episodeTag(e Episode, cover []byte, mime string) Tag {
+	t := Tag{
+		Album:     Album,
+		Artist:    Artist,
+		Track:     strconv.Itoa(e.Number),
+		Comment:   e.Description,
+		Cover:     cover,
+		CoverMIME: mime,
+	}
+	t.Title = fmt.Sprintf("SN %d", e.Number)
+	if e.Title != "" {
+		t.Title += ": " + e.Title
+	}
+	if !e.Date.IsZero() {
+		t.Date = e.Date.Format("2006-01-02")
+	}
+	return t
+}
+
+// loadCover returns the cover art and its MIME type; src is either the path
+// of an image file or its url.
+func loadCover(src string) ([]byte, string, error) {
+	if src == "" {
+		return nil, "", nil
+	}
+	var b []byte
+	var err error
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		b, err = getBytes(src)
+	} else {
+		b, err = ioutil.ReadFile(os.ExpandEnv(src))
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("cover art: %s", err)
+	}
+	mime := http.DetectContentType(b)
+	if !strings.HasPrefix(mime, "image/") {
+		return nil, "", fmt.Errorf("cover art: %s is not an image: %s", src, mime)
+	}
+	return b, mime, nil
+}
+
+// getBytes returns the body of url.
+func getBytes(url string) ([]byte, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET of %q resulted in an unexpected status: %q", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// errNoTag is returned when a tag is written without catalog information.
+var errNoTag = errors.New("episode is not in the episode archive")
+
+// tagger writes tags to episodes.
+type tagger struct {
+	catalog Catalog
+	cover   []byte
+	mime    string
+}
+
+// newTagger returns a tagger for the episodes; the catalog for the episodes
+// is retrieved and the cover art, if any, is loaded.
+func newTagger(episodes []int, cover string) (*tagger, error) {
+	var t tagger
+	var err error
+	t.cover, t.mime, err = loadCover(cover)
+	if err != nil {
+		return nil, err
+	}
+	t.catalog, err = catalogFor(episodes)
+	if err != nil {
+		return nil, fmt.Errorf("error getting the episode catalog: %s", err)
+	}
+	return &t, nil
+}
+
+// Tag writes the tag for episode i to the file at path.
+func (t *tagger) Tag(path string, i int) error {
+	e, ok := t.catalog[i]
+	if !ok {
+		return errNoTag
+	}
+	return WriteTag(path, episodeTag(e, t.cover, t.mime))
+}
+
+// tagDownloads tags the audio files that were downloaded.
+func tagDownloads(c Conf, downloads []Download) {
+	var episodes []int
+	for _, d := range downloads {
+		if d.tagable() {
+			episodes = append(episodes, d.Episode)
+		}
+	}
+	if len(episodes) == 0 {
+		return
+	}
+	t, err := newTagger(episodes, c.cover)
+	if err != nil {
+		fmt.Printf("tag: %s\n", err)
+		return
+	}
+	for _, d := range downloads {
+		if !d.tagable() {
+			continue
+		}
+		err = t.Tag(d.Path, d.Episode)
+		if err != nil {
+			fmt.Printf("%s: tag: %s\n", d.Name, err)
+			continue
+		}
+		Verbose(fmt.Sprintf("%s: tagged", d.Name))
+	}
+}
+
+func retagCommand() *Command {
+	c := newCommand("retag", "", "write ID3 tags to the downloaded episodes", `
+Retag writes ID3v2.4 tags to the selected episodes' audio files in the save
+directory, replacing their existing ID3v2 tags. The tags are built from the
+episode archive: title, album, artist, track number, release date, and a
+comment with the episode's description. If cover art is specified, it's
+embedded as the front cover. By default, all episodes are retagged.`, runRetag)
+	rangeFlags(c.Flags, 0)
+	libraryFlags(c.Flags)
+	configFlags(c.Flags, true)
+	mirrorFlag(c.Flags)
+	c.Flags.StringVar(&cover, "cover", "", "the path or url of the cover art to embed")
+	return c
+}
+
+// runRetag tags the selected episodes' local audio files.
+func runRetag(cmd *Command, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("retag: unexpected args: %s", strings.Join(args, " "))
+	}
+	cs, err := confs(cmd.Flags)
+	if err != nil {
+		return err
+	}
+	c := cs[0]
+	err = requireLocal(c, "retag")
+	if err != nil {
+		return err
+	}
+	last, err := lastEpisode()
+	if err != nil {
+		return err
+	}
+	err = resolveEpisodes(&c, last)
+	if err != nil {
+		return err
+	}
+
+	// only the episodes that have audio files are tagged
+	var episodes []int
+	for _, i := range c.episodes {
+		for _, a := range c.assets {
+			if !a.audio {
+				continue
+			}
+			p, err := c.Path(a, i)
+			if err != nil {
+				return err
+			}
+			_, err = os.Stat(p)
+			if err == nil {
+				episodes = append(episodes, i)
+				break
+			}
+		}
+	}
+	if len(episodes) == 0 {
+		return errors.New("Nothing to do: none of the selected episodes have audio files in the save directory.")
+	}
+
+	t, err := newTagger(episodes, c.cover)
+	if err != nil {
+		return err
+	}
+	var n, errs int
+	for _, i := range episodes {
+		for _, a := range c.assets {
+			if !a.audio {
+				continue
+			}
+			p, err := c.Path(a, i)
+			if err != nil {
+				return err
+			}
+			_, err = os.Stat(p)
+			if err != nil {
+				continue
+			}
+			err = t.Tag(p, i)
+			if err != nil {
+				fmt.Printf("%s: tag: %s\n", p, err)
+				errs++
+				continue
+			}
+			fmt.Printf("%s: tagged\n", p)
+			n++
+		}
+	}
+	fmt.Printf("\n%d files tagged\n", n)
+	if errs > 0 {
+		return fmt.Errorf("%d files could not be tagged", errs)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+// Apache License Version 2.0
+// http://www.apache.org/licenses/
+// Copyright (c) 2016 Joel Scoble
+// See LICENSE file for license text.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// removeBad removes the files that fail verification.
+var removeBad bool
+
+func verifyCommand() *Command {
+	c := newCommand("verify", "", "verify the downloaded files", `
+Verify checks that the selected episodes' assets in the save directory are
+complete by comparing each file's size with the size of the file on GRC's
+server. Audio files' ID3v2 tags aren't compared, as -tag and retag replace
+them: only the audio after the tag is. Only files that are in the save
+directory are checked. By default, all episodes are checked.
+
+Files that fail verification can be removed with -remove so that the next get
+downloads them again.`, runVerify)
+	rangeFlags(c.Flags, 0)
+	libraryFlags(c.Flags)
+	configFlags(c.Flags, true)
+	mirrorFlag(c.Flags)
+	c.Flags.BoolVar(&removeBad, "remove", false, "remove the files that fail verification")
+	return c
+}
+
+// runVerify verifies the selected episodes' local files.
+func runVerify(cmd *Command, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("verify: unexpected args: %s", strings.Join(args, " "))
+	}
+	cs, err := confs(cmd.Flags)
+	if err != nil {
+		return err
+	}
+	c := cs[0]
+	err = requireLocal(c, "verify")
+	if err != nil {
+		return err
+	}
+	last, err := lastEpisode()
+	if err != nil {
+		return err
+	}
+	err = resolveEpisodes(&c, last)
+	if err != nil {
+		return err
+	}
+	var checked, bad int
+	for _, i := range c.episodes {
+		for _, a := range c.assets {
+			p, err := c.Path(a, i)
+			if err != nil {
+				return err
+			}
+			fi, err := os.Stat(p)
+			if err != nil {
+				continue
+			}
+			checked++
+			err = verifyFile(a, i, p, fi.Size())
+			if err == nil {
+				Verbose(fmt.Sprintf("%s: ok", p))
+				continue
+			}
+			bad++
+			fmt.Printf("%s: %s\n", p, err)
+			if !removeBad {
+				continue
+			}
+			err = os.Remove(p)
+			if err != nil {
+				fmt.Printf("%s: remove: %s\n", p, err)
+				continue
+			}
+			fmt.Printf("%s: removed\n", p)
+		}
+	}
+	fmt.Printf("\n%d files verified\n", checked)
+	if bad > 0 {
+		return fmt.Errorf("%d files failed verification", bad)
+	}
+	return nil
+}
+
+// verifyFile checks that the file at p, whose size is n, of asset a of
+// episode i is complete. The ID3v2 tags of audio files aren't compared.
+func verifyFile(a Asset, i int, p string, n int64) error {
+	if !a.audio {
+		return verifySize(a.URL(i), n)
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	tag, err := tagSize(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	size, remoteTag, err := remoteAudioSize(a.URL(i))
+	if err != nil {
+		return err
+	}
+	if n-tag != size-remoteTag {
+		return fmt.Errorf("size mismatch: got %d bytes of audio; want %d", n-tag, size-remoteTag)
+	}
+	return nil
+}
+
+// remoteAudioSize returns the size of the audio file at url and the size of
+// its ID3v2 tag; only the start of the file is retrieved.
+func remoteAudioSize(url string) (size, tag int64, err error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("Range", "bytes=0-9")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// the range wasn't honoured; only the start of the body is read
+		size = resp.ContentLength
+	case http.StatusPartialContent:
+		// Content-Range: bytes 0-9/size
+		cr := resp.Header.Get("Content-Range")
+		size, err = strconv.ParseInt(cr[strings.LastIndex(cr, "/")+1:], 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("GET of %q resulted in an unexpected Content-Range: %q", url, cr)
+		}
+	default:
+		return 0, 0, fmt.Errorf("GET of %q resulted in an unexpected status: %q", url, resp.Status)
+	}
+	if size < 0 {
+		return 0, 0, fmt.Errorf("GET of %q did not include the file's size", url)
+	}
+	tag, err = tagSize(resp.Body)
+	return size, tag, err
+}
+
+// verifySize checks that the size of the file at url is n.
+func verifySize(url string, n int64) error {
+	resp, err := http.Head(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HEAD of %q resulted in an unexpected status: %q", url, resp.Status)
+	}
+	if resp.ContentLength < 0 {
+		return fmt.Errorf("HEAD of %q did not include the file's size", url)
+	}
+	if resp.ContentLength != n {
+		return fmt.Errorf("size mismatch: got %d bytes; want %d", n, resp.ContentLength)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVerifyFile(t *testing.T) {
+	audio := bytes.Repeat([]byte{0xff, 0xfb, 0x90, 0x00}, 100)
+	grc := append(Tag{Title: "SN 500"}.Bytes(), audio...)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sn-500.mp3":
+			http.ServeContent(w, r, "sn-500.mp3", time.Time{}, bytes.NewReader(grc))
+		case "/sn-500.txt":
+			http.ServeContent(w, r, "sn-500.txt", time.Time{}, bytes.NewReader([]byte("transcript")))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	defer func() { SNURL, TXTURL = grcSNURL, grcTXTURL }()
+	SNURL, TXTURL = srv.URL+"/", srv.URL+"/"
+
+	dir, err := ioutil.TempDir("", "snow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tagged := Tag{Title: "Windows Secure Boot", Album: "Security Now!", Artist: "Steve Gibson", Comment: "a longer tag"}.Bytes()
+	tests := []struct {
+		asset string
+		file  []byte
+		ok    bool
+	}{
+		{"hq", grc, true},
+		{"hq", append(tagged, audio...), true},
+		{"hq", audio, true},
+		{"hq", append(tagged, audio[:200]...), false},
+		{"hq", grc[:len(grc)-1], false},
+		{"txt", []byte("transcript"), true},
+		{"txt", []byte("transcr"), false},
+	}
+	for i, test := range tests {
+		p := filepath.Join(dir, "file")
+		err = ioutil.WriteFile(p, test.file, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = verifyFile(assets[test.asset], 500, p, int64(len(test.file)))
+		if test.ok && err != nil {
+			t.Errorf("%d: unexpected error: %s", i, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%d: got no error; want a size mismatch", i)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+// Apache License Version 2.0
+// http://www.apache.org/licenses/
+// Copyright (c) 2016 Joel Scoble
+// See LICENSE file for license text.
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+)
+
+// the watch related flags
+var (
+	watch         bool
+	watchInterval time.Duration
+	watchJitter   time.Duration
+)
+
+// runWatch runs sync every interval until snow is stopped. Errors are
+// printed and the next check is waited for; snow doesn't exit because GRC
+// couldn't be reached.
+func runWatch(cmd *Command, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("sync: unexpected args: %s", strings.Join(args, " "))
+	}
+	if watchInterval <= 0 {
+		return fmt.Errorf("sync: the interval must be greater than 0: %s", watchInterval)
+	}
+	cs, err := confs(cmd.Flags)
+	if err != nil {
+		return err
+	}
+	w := newWatcher(cs)
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		w.Check()
+		next := time.Now().Add(watchDelay(watchInterval, watchJitter, r))
+		fmt.Printf("next check at %s\n", next.Format("2006-01-02 15:04:05"))
+		time.Sleep(next.Sub(time.Now()))
+	}
+}
+
+// watchDelay returns the time until the next check: the interval plus a
+// random jitter of up to jitter.
+func watchDelay(interval, jitter time.Duration, r *rand.Rand) time.Duration {
+	if jitter <= 0 {
+		return interval
+	}
+	return interval + time.Duration(r.Int63n(int64(jitter)))
+}
+
+// watcher keeps track of what has been seen between checks.
+type watcher struct {
+	confs   []Conf
+	last    int     // the most recent episode as of the last check
+	missing [][]int // the episodes, per conf, that had assets that weren't downloaded
+}
+
+// newWatcher returns a watcher for the confs.
+func newWatcher(cs []Conf) *watcher {
+	return &watcher{confs: cs, missing: make([][]int, len(cs))}
+}
+
+// Check checks for new episodes and downloads them along with any assets that
+// were missing from previous checks.
+func (w *watcher) Check() {
+	fmt.Printf("%s: checking for new episodes\n", time.Now().Format("2006-01-02 15:04:05"))
+	// the archive pages are retrieved again so that new episodes show up
+	runCatalog = catalogCache{}
+	last, err := lastEpisode()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for k, c := range w.confs {
+		if c.profile != "" {
+			fmt.Printf("profile %s: %s\n", c.profile, c.SaveDir)
+		}
+		// every episode published since the last check is processed, even if
+		// the range rule is for fewer episodes
+		if w.last > 0 && c.lastN > 0 && c.startEpisode == 0 && last-w.last > c.lastN {
+			c.lastN = last - w.last
+		}
+		c.retry = w.missing[k]
+		downloads, err := process(c, last)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		w.missing[k] = incompleteEpisodes(downloads)
+		if len(w.missing[k]) > 0 {
+			Verbose(fmt.Sprintf("episodes to retry: %v", w.missing[k]))
+		}
+	}
+	w.last = last
+}
+
+// incompleteEpisodes returns the episodes, sorted, that have a download that
+// resulted in an error.
+func incompleteEpisodes(downloads []Download) []int {
+	seen := make(map[int]bool)
+	var episodes []int
+	for _, d := range downloads {
+		if d.skipped || d.err == nil || seen[d.Episode] {
+			continue
+		}
+		seen[d.Episode] = true
+		episodes = append(episodes, d.Episode)
+	}
+	sort.Ints(episodes)
+	return episodes
+}
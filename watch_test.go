@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMergeEpisodes(t *testing.T) {
+	tests := []struct {
+		episodes []int
+		other    []int
+		min      int
+		expected []int
+	}{
+		{[]int{500}, nil, 0, []int{500}},
+		{[]int{500}, []int{498, 499}, 0, []int{498, 499, 500}},
+		{[]int{499, 500}, []int{500, 497}, 0, []int{497, 499, 500}},
+		{[]int{500}, []int{490, 498}, 490, []int{498, 500}},
+		{nil, []int{12}, 0, []int{12}},
+	}
+	for i, test := range tests {
+		got := mergeEpisodes(test.episodes, test.other, test.min)
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%d: got %v; want %v", i, got, test.expected)
+		}
+	}
+}
+
+func TestIncompleteEpisodes(t *testing.T) {
+	err := errors.New("404")
+	downloads := []Download{
+		{Episode: 500},
+		{Episode: 500, err: err},
+		{Episode: 499, skipped: true},
+		{Episode: 501, err: err},
+		{Episode: 498, err: err},
+		{Episode: 501, err: err},
+		{Episode: 497, skipped: true, err: err},
+	}
+	got := incompleteEpisodes(downloads)
+	expected := []int{498, 500, 501}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %v; want %v", got, expected)
+	}
+}
+
+func TestWatchDelay(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	if d := watchDelay(time.Hour, 0, r); d != time.Hour {
+		t.Errorf("no jitter: got %s; want %s", d, time.Hour)
+	}
+	for i := 0; i < 100; i++ {
+		d := watchDelay(time.Hour, time.Minute, r)
+		if d < time.Hour || d >= time.Hour+time.Minute {
+			t.Errorf("%d: got %s; want [1h, 1h1m)", i, d)
+		}
+	}
+}